@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AccessLogger writes a line for every request to the HTTP server, in the Common Log Format or as JSON
+type AccessLogger struct {
+	format string
+
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// AccessLog logs the requests as set by --access-log and --access-log-output
+var AccessLog = &AccessLogger{format: "clf", out: os.Stderr}
+
+// accessLogEntry is a request logged as JSON
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteAddr string    `json:"remote_addr"`
+	// Peer is the proxy the request came through, when it's trusted with the client address
+	Peer       string  `json:"peer,omitempty"`
+	Method     string  `json:"method"`
+	URI        string  `json:"uri"`
+	Proto      string  `json:"proto"`
+	Status     int     `json:"status"`
+	Bytes      int64   `json:"bytes"`
+	DurationMs float64 `json:"duration_ms"`
+	// Route is the pattern of the handler that served the request
+	Route     string `json:"route,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+}
+
+// NewAccessLogger logs in format, clf, json or off, to output, stdout, stderr or a file appended to
+func NewAccessLogger(format, output string) (*AccessLogger, error) {
+	logger := &AccessLogger{format: format}
+	switch output {
+	case "", "stderr":
+		logger.out = os.Stderr
+	case "stdout":
+		logger.out = os.Stdout
+	default:
+		file, err := os.OpenFile(output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open access log %s: %w", output, err)
+		}
+		logger.out = file
+	}
+	return logger, nil
+}
+
+// Handler logs the requests served by handler, with the route of the mux that matched them
+func (l *AccessLogger) Handler(mux *http.ServeMux, handler http.Handler) http.Handler {
+	if l.format == "off" {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		_, route := mux.Handler(r)
+		defer func() {
+			l.write(r, sw.status, sw.bytes, time.Since(started), route)
+		}()
+		handler.ServeHTTP(sw, r)
+	})
+}
+
+func (l *AccessLogger) write(r *http.Request, status int, bytes int64, duration time.Duration, route string) {
+	var line []byte
+	client := Proxies.ClientAddr(r)
+	if l.format == "json" {
+		entry := accessLogEntry{
+			Time:       time.Now(),
+			RemoteAddr: client,
+			Method:     r.Method,
+			URI:        loggedURI(r),
+			Proto:      r.Proto,
+			Status:     status,
+			Bytes:      bytes,
+			DurationMs: float64(duration.Microseconds()) / 1000,
+			Route:      route,
+			UserAgent:  r.UserAgent(),
+		}
+		if client != r.RemoteAddr {
+			entry.Peer = r.RemoteAddr
+		}
+		var err error
+		if line, err = json.Marshal(entry); err != nil {
+			return
+		}
+	} else {
+		size := "-"
+		if bytes > 0 {
+			size = fmt.Sprint(bytes)
+		}
+		line = []byte(fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s",
+			orDash(client),
+			time.Now().Format("02/Jan/2006:15:04:05 -0700"),
+			orDash(r.Method),
+			orDash(loggedURI(r)),
+			orDash(r.Proto),
+			status,
+			size,
+		))
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+// statusWriter remembers the status code written, and the size of the body, for the access log
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Hijack hands the connection over to the WebSocket handler
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	w.status = http.StatusSwitchingProtocols
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// redactedQueryParams are the query parameters carrying credentials, whose values aren't logged
+var redactedQueryParams = []string{"token"}
+
+// loggedURI is the request URI with the values of redactedQueryParams replaced
+func loggedURI(r *http.Request) string {
+	uri, query, ok := strings.Cut(r.RequestURI, "?")
+	if !ok {
+		return r.RequestURI
+	}
+	params := strings.Split(query, "&")
+	for i, param := range params {
+		name, _, _ := strings.Cut(param, "=")
+		if unescaped, err := url.QueryUnescape(name); err == nil && slices.Contains(redactedQueryParams, unescaped) {
+			params[i] = name + "=REDACTED"
+		}
+	}
+	return uri + "?" + strings.Join(params, "&")
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
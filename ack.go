@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ackPollInterval is how often --ack-file is checked
+const ackPollInterval = 200 * time.Millisecond
+
+// Acknowledger implements two-phase applies: once the files are written, the application is notified
+// and the apply only counts once it acknowledges it loaded them, with POST /ack or by touching a file.
+// Otherwise the previous commit is applied again
+type Acknowledger struct {
+	// Notify tells the application about the new files instead of restarting it: signal:NAME sends it
+	// a signal like HUP, a URL gets a POST with the sync placeholders as JSON
+	Notify string
+	// File, if set, acknowledges the apply when it's modified after the notification
+	File    string
+	Timeout time.Duration
+
+	mu      sync.Mutex
+	waiting string
+	acks    chan ackResult
+}
+
+type ackResult struct {
+	commit string
+	err    error
+}
+
+// Acks waits for the acknowledgments of the applies, if --ack-timeout is set
+var Acks *Acknowledger
+
+// NewAcknowledger returns nil without a timeout, which disables two-phase applies
+func NewAcknowledger(notify, file string, timeout time.Duration) (*Acknowledger, error) {
+	if timeout <= 0 {
+		return nil, nil
+	}
+	if name, ok := strings.CutPrefix(notify, "signal:"); ok {
+		if _, ok := notifySignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]; !ok {
+			return nil, fmt.Errorf("invalid --ack-notify %q: unknown signal %s", notify, name)
+		}
+	} else if notify != "" && !strings.HasPrefix(notify, "http://") && !strings.HasPrefix(notify, "https://") {
+		return nil, fmt.Errorf("invalid --ack-notify %q, expected signal:NAME or a URL", notify)
+	}
+	return &Acknowledger{Notify: notify, File: file, Timeout: timeout, acks: make(chan ackResult, 1)}, nil
+}
+
+// Begin starts waiting for the acknowledgment of the commit, dropping any earlier one
+func (a *Acknowledger) Begin(commit string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.waiting = commit
+	select {
+	case <-a.acks:
+	default:
+	}
+}
+
+// Ack acknowledges the apply the application was notified about, or rejects it with an error. A
+// commit, if given, must be the one waited for
+func (a *Acknowledger) Ack(commit string, err error) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.waiting == "" {
+		return errors.New("no apply is waiting for an acknowledgment")
+	}
+	if commit != "" && !strings.HasPrefix(a.waiting, commit) {
+		return fmt.Errorf("the apply waiting for an acknowledgment is of commit %s", a.waiting)
+	}
+	select {
+	case <-a.acks:
+	default:
+	}
+	a.acks <- ackResult{commit: a.waiting, err: err}
+	return nil
+}
+
+// NotifyApplication tells the application to load the new files, with a signal or an HTTP request
+func (a *Acknowledger) NotifyApplication(ctx context.Context, command *Command, vars SyncVars) error {
+	if name, ok := strings.CutPrefix(a.Notify, "signal:"); ok {
+		process, err := os.FindProcess(command.Pid)
+		if err != nil {
+			return fmt.Errorf("failed to notify the application: %w", err)
+		}
+		if err := process.Signal(notifySignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]); err != nil {
+			return fmt.Errorf("failed to notify the application: %w", err)
+		}
+		return nil
+	}
+
+	body, err := json.Marshal(vars)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, a.Timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Notify, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to notify the application: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to notify the application: %s returned %s", a.Notify, resp.Status)
+	}
+	return nil
+}
+
+// Wait waits for the acknowledgment of the apply started with Begin, until the timeout
+func (a *Acknowledger) Wait(ctx context.Context, since time.Time) error {
+	defer func() {
+		a.mu.Lock()
+		a.waiting = ""
+		a.mu.Unlock()
+	}()
+	timeout := time.NewTimer(a.Timeout)
+	defer timeout.Stop()
+	poll := time.NewTicker(ackPollInterval)
+	defer poll.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timeout.C:
+			return fmt.Errorf("the application didn't acknowledge the apply within %v", a.Timeout)
+		case ack := <-a.acks:
+			if ack.err != nil {
+				return fmt.Errorf("the application rejected the apply: %w", ack.err)
+			}
+			return nil
+		case <-poll.C:
+			if a.File == "" {
+				continue
+			}
+			if info, err := os.Stat(a.File); err == nil && info.ModTime().After(since) {
+				return nil
+			}
+		}
+	}
+}
+
+// applyWithAck notifies or restarts the application for the applied commit, then waits for its
+// acknowledgment. Without one, the previous commit is applied again and the application notified of
+// it, and the rejected commit is skipped until a newer one comes
+func applyWithAck(ctx context.Context, gitRepo *GitRepo, command *Command, trigger string) error {
+	rejected := gitRepo.State().Commit
+	Acks.Begin(rejected)
+	started := time.Now()
+	var err error
+	if Acks.Notify != "" {
+		err = Acks.NotifyApplication(ctx, command, gitRepo.SyncVars(trigger))
+	} else {
+		err = restartApplication(command, gitRepo.SyncVars(trigger), "sync")
+	}
+	if err == nil {
+		log.Printf("waiting up to %v for the application to acknowledge commit %s\n", Acks.Timeout, shortCommit(rejected))
+		err = Acks.Wait(ctx, started)
+	} else {
+		Acks.Begin("")
+	}
+	if err == nil {
+		Events.Publish(Event{Type: EventApplyAcknowledged, Source: trigger, Commit: rejected})
+		return nil
+	}
+
+	log.Printf("rolling back commit %s: %v\n", shortCommit(rejected), err)
+	if rollbackErr := gitRepo.Rollback(ctx, Options.LocalFolder); rollbackErr != nil {
+		log.Printf("failed to roll back: %v\n", rollbackErr)
+		Events.Publish(Event{Type: EventSyncFailed, Source: "ack", Error: rollbackErr.Error()})
+		return err
+	}
+	gitRepo.Skip(rejected)
+	fields := appliedFields(gitRepo)
+	fields["from"] = rejected
+	state := gitRepo.State()
+	Events.Publish(Event{Type: EventRolledBack, Source: "ack", Commit: state.Commit, Error: err.Error(), Fields: fields})
+	Metrics.Add("git_config_server_rollbacks_total", 1)
+	CurrentStatus.RecordSync(state.Commit, true, nil)
+	CurrentStatus.RecordChanges(state.Previous, state.Info, state.Changes)
+
+	var notifyErr error
+	if Acks.Notify != "" {
+		notifyErr = Acks.NotifyApplication(ctx, command, gitRepo.SyncVars("rollback"))
+	} else {
+		notifyErr = restartApplication(command, gitRepo.SyncVars("rollback"), "rollback")
+	}
+	if notifyErr != nil {
+		log.Printf("failed to notify the application of the rollback: %v\n", notifyErr)
+	}
+	return err
+}
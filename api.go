@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultWatchTimeout = 30 * time.Second
+	maxWatchTimeout     = 10 * time.Minute
+	// maxCipherBody limits what /encrypt and /decrypt read, as they're meant for single values
+	maxCipherBody = 64 * 1024
+)
+
+// APIActions are the operations the API can ask the main loop to perform
+type APIActions struct {
+	// Sync enqueues a sync, with the metadata of what triggered it
+	Sync func(source string, metadata map[string]string) error
+	// Rollback enqueues a rollback to the previously applied commit
+	Rollback func() error
+	// State returns what's applied, with the diff of the last change
+	State func() GitRepoState
+}
+
+// apiHandler wraps an API endpoint with the method check and the check of the token, which must have
+// the scope
+func apiHandler(method string, scope Scope, authorized func(r *http.Request, scope Scope) bool, handle http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, scope) {
+			http.Error(w, "Not authorized", http.StatusForbidden)
+			return
+		}
+		handle(w, r)
+	}
+}
+
+// logLevelResponse is returned by /admin/loglevel
+type logLevelResponse struct {
+	Level string `json:"level"`
+}
+
+// writesResponse is returned by /admin/writes and /admin/writes/confirm
+type writesResponse struct {
+	Paths []string `json:"paths"`
+}
+
+// healthResponse is returned by /healthz
+type healthResponse struct {
+	Status  string    `json:"status"`
+	Version string    `json:"version"`
+	Build   BuildInfo `json:"build"`
+	// Commit is the applied one, empty until the first sync succeeds
+	Commit    string    `json:"commit,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// watchResponse is returned by /watch once the applied commit changes
+type watchResponse struct {
+	Commit   string       `json:"commit"`
+	Previous string       `json:"previous_commit,omitempty"`
+	Changes  *SyncChanges `json:"changes,omitempty"`
+}
+
+// maxDiffPatch is how many bytes of unified diff /diff returns, the rest is cut
+const maxDiffPatch = 1 << 20
+
+// diffResponse is returned by /diff, how the files changed in the last applied change
+type diffResponse struct {
+	Commit   string     `json:"commit"`
+	Previous string     `json:"previous_commit,omitempty"`
+	Files    []FileDiff `json:"files"`
+	Patch    string     `json:"patch,omitempty"`
+}
+
+// parseWatchTimeout reads the timeout query parameter, either a duration like 90s or a number of seconds
+func parseWatchTimeout(value string) (time.Duration, error) {
+	if value == "" {
+		return defaultWatchTimeout, nil
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil {
+		var seconds int
+		if _, scanErr := fmt.Sscanf(value, "%d", &seconds); scanErr != nil {
+			return 0, fmt.Errorf("invalid timeout %q", value)
+		}
+		timeout = time.Duration(seconds) * time.Second
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", value)
+	}
+	if timeout > maxWatchTimeout {
+		timeout = maxWatchTimeout
+	}
+	return timeout, nil
+}
+
+// writeJSON serializes the value as the response body
+func writeJSON(w http.ResponseWriter, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("failed to write response: %v\n", err)
+	}
+}
+
+// registerAPIHandlers adds the endpoints used to inspect and control the running instance
+func registerAPIHandlers(mux *http.ServeMux, authorized func(r *http.Request, scope Scope) bool, actions APIActions) {
+	mux.HandleFunc("/status", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, CurrentStatus)
+	}))
+
+	// /healthz answers as long as the server runs, unauthenticated like /ready. /health is the path
+	// it used to be on
+	health := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodHead:
+			w.WriteHeader(http.StatusOK)
+		case http.MethodGet:
+			snapshot := CurrentStatus.Snapshot()
+			writeJSON(w, healthResponse{
+				Status:    "ok",
+				Version:   version,
+				Build:     GetBuildInfo(),
+				Commit:    snapshot.Commit,
+				StartedAt: snapshot.StartedAt,
+			})
+		default:
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+		}
+	}
+	mux.HandleFunc("/healthz", health)
+	mux.HandleFunc("/health", health)
+
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		ready, reason := CurrentStatus.Ready(Options.MaxStaleness)
+		if !ready {
+			http.Error(w, reason, http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("OK"))
+	})
+
+	mux.HandleFunc("/metrics", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := Metrics.Write(w); err != nil {
+			log.Printf("failed to write metrics: %v\n", err)
+		}
+	}))
+
+	// /history?type=hooks and /history?type=applied list the hook results and the commits gone live,
+	// which are only kept with --data-dir
+	mux.HandleFunc("/history", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		var bucket []byte
+		switch r.URL.Query().Get("type") {
+		case "", "syncs":
+			writeJSON(w, CurrentStatus.History())
+			return
+		case "hooks":
+			bucket = hooksBucket
+		case "applied":
+			bucket = appliedBucket
+		default:
+			http.Error(w, "Invalid type, expected syncs, hooks or applied", http.StatusBadRequest)
+			return
+		}
+		if Store == nil {
+			http.Error(w, "The history is only kept with --data-dir", http.StatusNotFound)
+			return
+		}
+		entries := Store.Entries(bucket, storeRetention)
+		if entries == nil {
+			entries = []json.RawMessage{}
+		}
+		writeJSON(w, entries)
+	}))
+
+	mux.HandleFunc("/diff", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		state := actions.State()
+		response := diffResponse{Commit: state.Commit, Previous: state.Previous, Files: []FileDiff{}}
+		if state.Diff != nil {
+			response.Files = append(response.Files, state.Diff.Files...)
+			response.Patch = state.Diff.Patch(maxDiffPatch)
+		}
+		writeJSON(w, response)
+	}))
+
+	// /watch?commit=<current> holds the request until the applied commit differs from the given one,
+	// answering 304 Not Modified if the timeout elapses first
+	mux.HandleFunc("/watch", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		timeout, err := parseWatchTimeout(r.URL.Query().Get("timeout"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		known := r.URL.Query().Get("commit")
+		if Options.WriteTimeout > 0 {
+			// the answer is only written once the wait is over
+			deadline := time.Now().Add(timeout + Options.WriteTimeout)
+			if err := http.NewResponseController(w).SetWriteDeadline(deadline); err != nil {
+				log.Printf("failed to extend the write deadline of /watch: %v\n", err)
+			}
+		}
+
+		// subscribe before looking at the status, so a change in between isn't missed
+		events, cancel := Events.Subscribe(EventSyncApplied, EventRolledBack)
+		defer cancel()
+
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		for {
+			snapshot := CurrentStatus.Snapshot()
+			if snapshot.Commit != "" && snapshot.Commit != known {
+				writeJSON(w, watchResponse{
+					Commit:   snapshot.Commit,
+					Previous: snapshot.Previous,
+					Changes:  snapshot.LastChanges,
+				})
+				return
+			}
+
+			select {
+			case <-events:
+			case <-timer.C:
+				w.WriteHeader(http.StatusNotModified)
+				return
+			case <-r.Context().Done():
+				// either the client went away or the server is shutting down
+				http.Error(w, "Shutting down", http.StatusServiceUnavailable)
+				return
+			}
+		}
+	}))
+
+	mux.HandleFunc("/encrypt", apiHandler(http.MethodPost, ScopeTrigger, authorized, func(w http.ResponseWriter, r *http.Request) {
+		if ValueCipher == nil {
+			http.Error(w, "No encryption key configured", http.StatusNotFound)
+			return
+		}
+		plaintext, err := io.ReadAll(io.LimitReader(r.Body, maxCipherBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		value, err := ValueCipher.Encrypt(plaintext)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(value))
+	}))
+
+	mux.HandleFunc("/decrypt", apiHandler(http.MethodPost, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		if ValueCipher == nil {
+			http.Error(w, "No encryption key configured", http.StatusNotFound)
+			return
+		}
+		value, err := io.ReadAll(io.LimitReader(r.Body, maxCipherBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		plaintext, err := ValueCipher.Decrypt(string(value))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(plaintext)
+	}))
+
+	mux.HandleFunc("/sync", apiHandler(http.MethodPost, ScopeTrigger, authorized, func(w http.ResponseWriter, r *http.Request) {
+		log.Printf("invoking webhook handler\n")
+		if err := actions.Sync("api", nil); err != nil {
+			log.Printf("webhook handler failed: %v\n", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	mux.HandleFunc("/rollback", apiHandler(http.MethodPost, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		if err := actions.Rollback(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	mux.HandleFunc("/ack", apiHandler(http.MethodPost, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		if Acks == nil {
+			http.Error(w, "Acknowledgments aren't enabled", http.StatusNotFound)
+			return
+		}
+		var nack error
+		if reason := r.FormValue("error"); reason != "" {
+			nack = errors.New(reason)
+		}
+		if err := Acks.Ack(r.FormValue("commit"), nack); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	mux.HandleFunc("/pause", apiHandler(http.MethodPost, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		CurrentStatus.SetPaused(true)
+		Events.Publish(Event{Type: EventPaused, Source: "api"})
+		writeJSON(w, CurrentStatus)
+	}))
+
+	mux.HandleFunc("/resume", apiHandler(http.MethodPost, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		CurrentStatus.SetPaused(false)
+		Events.Publish(Event{Type: EventResumed, Source: "api"})
+		writeJSON(w, CurrentStatus)
+	}))
+
+	// /admin/loglevel takes the level in the level query parameter or as the body, so a live instance
+	// can be debugged without a restart
+	mux.HandleFunc("/admin/loglevel", apiHandler(http.MethodPut, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		name := r.URL.Query().Get("level")
+		if name == "" {
+			body, err := io.ReadAll(io.LimitReader(r.Body, 64))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			name = string(body)
+		}
+		level, err := ParseLogLevel(name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if previous := SetLogLevel(level); previous != level {
+			log.Printf("log level changed from %s to %s\n", previous, level)
+		}
+		writeJSON(w, logLevelResponse{Level: level.String()})
+	}))
+
+	// /admin/writes lists the paths of the local folder other processes wrote with --watch-writes, which
+	// /admin/writes/confirm forgets, letting the next apply overwrite them
+	mux.HandleFunc("/admin/writes", apiHandler(http.MethodGet, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, writesResponse{Paths: LocalWrites.Written()})
+	}))
+	mux.HandleFunc("/admin/writes/confirm", apiHandler(http.MethodPost, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, writesResponse{Paths: LocalWrites.Confirm()})
+	}))
+
+	// /admin/config has the options the instance runs with, secrets masked
+	mux.HandleFunc("/admin/config", apiHandler(http.MethodGet, ScopeAdmin, authorized, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, EffectiveConfig())
+	}))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"strings"
+)
+
+// Scope is what a token may do on the API. Each scope includes the ones before it
+type Scope int
+
+const (
+	// ScopeRead reads the status, the metrics, the history and the files
+	ScopeRead Scope = iota
+	// ScopeTrigger also triggers syncs
+	ScopeTrigger
+	// ScopeAdmin also rolls back, pauses, resumes, acks and decrypts
+	ScopeAdmin
+)
+
+var scopeNames = []string{"read", "trigger", "admin"}
+
+func (s Scope) String() string {
+	if s < 0 || int(s) >= len(scopeNames) {
+		return fmt.Sprintf("Scope(%d)", int(s))
+	}
+	return scopeNames[s]
+}
+
+// ParseScope parses read, trigger or admin
+func ParseScope(name string) (Scope, error) {
+	for i, scopeName := range scopeNames {
+		if name == scopeName {
+			return Scope(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid scope %q, expected one of %s", name, strings.Join(scopeNames, ", "))
+}
+
+// APIToken is a token sent in --webhook-token-header, allowed to do what its scope includes
+type APIToken struct {
+	Name  string
+	Scope Scope
+	token string
+}
+
+// APITokens are all the tokens accepted, --webhook-token-value being the admin one
+type APITokens []APIToken
+
+// ParseAPIToken parses a name:scope:token spec. The token is everything after the second colon
+func ParseAPIToken(spec string) (APIToken, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return APIToken{}, fmt.Errorf("invalid API token %q, expected name:scope:token", spec)
+	}
+	scope, err := ParseScope(parts[1])
+	if err != nil {
+		return APIToken{}, fmt.Errorf("invalid API token %s: %w", parts[0], err)
+	}
+	return APIToken{Name: parts[0], Scope: scope, token: parts[2]}, nil
+}
+
+// ParseAPITokens parses all the specs, after the admin token of --webhook-token-value, if any
+func ParseAPITokens(adminToken string, specs []string) (APITokens, error) {
+	var tokens APITokens
+	if adminToken != "" {
+		tokens = append(tokens, APIToken{Name: "admin", Scope: ScopeAdmin, token: adminToken})
+	}
+	for _, spec := range specs {
+		token, err := ParseAPIToken(spec)
+		if err != nil {
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+// Allows is true if the token is one of the tokens and its scope includes scope. An empty token
+// is never allowed
+func (tokens APITokens) Allows(token string, scope Scope) bool {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return false
+	}
+	allowed := false
+	for _, t := range tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(t.token)) == 1 && t.Scope >= scope {
+			allowed = true
+		}
+	}
+	return allowed
+}
@@ -0,0 +1,79 @@
+package main
+
+import "testing"
+
+func TestParseAPIToken(t *testing.T) {
+	tests := []struct {
+		spec  string
+		want  APIToken
+		valid bool
+	}{
+		{"ci:trigger:t0k3n", APIToken{Name: "ci", Scope: ScopeTrigger, token: "t0k3n"}, true},
+		{"dash:read:with:colons", APIToken{Name: "dash", Scope: ScopeRead, token: "with:colons"}, true},
+		{"ops:admin:x", APIToken{Name: "ops", Scope: ScopeAdmin, token: "x"}, true},
+		{"ci:write:t0k3n", APIToken{}, false},
+		{"ci:read:", APIToken{}, false},
+		{":read:t0k3n", APIToken{}, false},
+		{"ci:t0k3n", APIToken{}, false},
+	}
+	for _, test := range tests {
+		got, err := ParseAPIToken(test.spec)
+		if test.valid != (err == nil) {
+			t.Errorf("ParseAPIToken(%q) failed with %v", test.spec, err)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("ParseAPIToken(%q) = %+v, want %+v", test.spec, got, test.want)
+		}
+	}
+}
+
+func TestAPITokensAllows(t *testing.T) {
+	tokens, err := ParseAPITokens("admin-token", []string{"dash:read:read-token", "ci:trigger:trigger-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token string
+		scope Scope
+		want  bool
+	}{
+		{"read-token", ScopeRead, true},
+		{"read-token", ScopeTrigger, false},
+		{"read-token", ScopeAdmin, false},
+		{"trigger-token", ScopeRead, true},
+		{"trigger-token", ScopeTrigger, true},
+		{"trigger-token", ScopeAdmin, false},
+		{"admin-token", ScopeRead, true},
+		{"admin-token", ScopeTrigger, true},
+		{"admin-token", ScopeAdmin, true},
+		{" admin-token ", ScopeAdmin, true},
+		{"admin-token2", ScopeRead, false},
+		{"unknown", ScopeRead, false},
+		{"", ScopeRead, false},
+		{"  ", ScopeRead, false},
+	}
+	for _, test := range tests {
+		if got := tokens.Allows(test.token, test.scope); got != test.want {
+			t.Errorf("Allows(%q, %s) = %v, want %v", test.token, test.scope, got, test.want)
+		}
+	}
+}
+
+func TestAPITokensWithoutAdminToken(t *testing.T) {
+	tokens, err := ParseAPITokens("", []string{"dash:read:read-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tokens) != 1 {
+		t.Fatalf("ParseAPITokens added %d tokens, want 1", len(tokens))
+	}
+	for _, scope := range []Scope{ScopeRead, ScopeTrigger, ScopeAdmin} {
+		if tokens.Allows("", scope) {
+			t.Errorf("Allows(\"\", %s) = true without an admin token", scope)
+		}
+	}
+	if !tokens.Allows("read-token", ScopeRead) {
+		t.Errorf("Allows(read-token, read) = false")
+	}
+}
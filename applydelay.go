@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"hash/fnv"
+	"log"
+	"time"
+)
+
+// applyDelaySource is the trigger of the sync once the apply delay of a commit is over
+const applyDelaySource = "apply-delay"
+
+// errApplyDelayed is returned by Sync when the new commit waits for the apply delay of this host
+var errApplyDelayed = errors.New("waiting for the apply delay")
+
+// hashedDelay spreads the keys, like hostnames, evenly over the window in whole seconds, always giving
+// the same key the same delay, so a fleet applies a new commit gradually and in the same order
+func hashedDelay(key string, window time.Duration) time.Duration {
+	seconds := uint64(window / time.Second)
+	if seconds == 0 {
+		return 0
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(key))
+	return time.Duration(hash.Sum64()%seconds) * time.Second
+}
+
+// delayApply returns errApplyDelayed until ApplyDelay has passed since the commit was first seen,
+// queueing a sync for when it does. A newer commit restarts the delay
+func (gitRepo *GitRepo) delayApply(commit string) error {
+	if gitRepo.ApplyDelay <= 0 {
+		return nil
+	}
+	gitRepo.stateMu.Lock()
+	if gitRepo.delayedCommit != commit {
+		gitRepo.delayedCommit = commit
+		gitRepo.delayedUntil = time.Now().Add(gitRepo.ApplyDelay)
+		if gitRepo.delayTimer != nil {
+			gitRepo.delayTimer.Stop()
+		}
+		gitRepo.delayTimer = time.AfterFunc(gitRepo.ApplyDelay, func() {
+			if err := Triggers.Add(applyDelaySource, map[string]string{"commit": commit}); err != nil {
+				log.Printf("failed to queue the sync after the apply delay: %v\n", err)
+			}
+		})
+		log.Printf("applying commit %s in %v, at %s\n", shortCommit(commit), gitRepo.ApplyDelay, gitRepo.delayedUntil.Format(time.RFC3339))
+	}
+	until := gitRepo.delayedUntil
+	gitRepo.stateMu.Unlock()
+	if time.Now().Before(until) {
+		return errApplyDelayed
+	}
+	return nil
+}
+
+// delayed returns the commit waiting for the apply delay, and when it's over
+func (gitRepo *GitRepo) delayed() (string, time.Time) {
+	gitRepo.stateMu.RLock()
+	defer gitRepo.stateMu.RUnlock()
+	return gitRepo.delayedCommit, gitRepo.delayedUntil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+)
+
+// applyLocks serialize the applies to each destination, so concurrent syncs, even of repos mapped to
+// the same folder, never write it at the same time
+var applyLocks = struct {
+	sync.Mutex
+	folders map[string]*sync.Mutex
+}{folders: make(map[string]*sync.Mutex)}
+
+// lockApply waits for the other applies to the local folder, or to the in-memory tree, returning the
+// function that lets the next one in
+func (gitRepo *GitRepo) lockApply(localFolder string) func() {
+	key := localFolder
+	if gitRepo.Memory != nil {
+		key = fmt.Sprintf("memory:%p", gitRepo.Memory)
+	} else if abs, err := filepath.Abs(localFolder); err == nil {
+		key = abs
+	}
+	applyLocks.Lock()
+	lock, ok := applyLocks.folders[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		applyLocks.folders[key] = lock
+	}
+	applyLocks.Unlock()
+	lock.Lock()
+	return lock.Unlock
+}
+
+// GitRepoState is what's applied, as of a point in time
+type GitRepoState struct {
+	Commit   string
+	Previous string
+	Info     CommitInfo
+	Changes  SyncChanges
+	Diff     *DiffSummary
+	Message  string
+	Config   *RepoConfig
+}
+
+// State returns what's applied. It's safe to call while a sync is running, which it doesn't wait for
+func (gitRepo *GitRepo) State() GitRepoState {
+	gitRepo.stateMu.RLock()
+	defer gitRepo.stateMu.RUnlock()
+	return GitRepoState{
+		Commit:   gitRepo.lastFetchedCommit,
+		Previous: gitRepo.previousCommit,
+		Info:     gitRepo.lastCommitInfo,
+		Changes:  gitRepo.lastChanges,
+		Diff:     gitRepo.lastDiff,
+		Message:  gitRepo.lastMessage,
+		Config:   gitRepo.repoConfig,
+	}
+}
+
+// Skip leaves the commit unapplied until a newer one comes
+func (gitRepo *GitRepo) Skip(commit string) {
+	gitRepo.stateMu.Lock()
+	defer gitRepo.stateMu.Unlock()
+	gitRepo.skippedCommit = commit
+}
+
+// ForgetPrevious drops the commit Rollback would go back to
+func (gitRepo *GitRepo) ForgetPrevious() {
+	gitRepo.stateMu.Lock()
+	commit := gitRepo.lastFetchedCommit
+	gitRepo.previousCommit = ""
+	gitRepo.stateMu.Unlock()
+	Store.SaveApplied(commit, "")
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupSuffix is the extension of the snapshots, also used to find them when rotating
+const backupSuffix = ".tar.gz"
+
+// backupTimeFormat starts the names of the snapshots, so they sort by time
+const backupTimeFormat = "20060102T150405.000Z"
+
+// Backups snapshots the local folder as it was before each apply, keeping the latest ones
+type Backups struct {
+	dir    string
+	keep   int
+	maxAge time.Duration
+}
+
+// NewBackups returns the backups in dir, or nil if it's empty. A keep of 0 keeps every snapshot, and a
+// maxAge of 0 keeps them regardless of their age
+func NewBackups(dir string, keep int, maxAge time.Duration) (*Backups, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create the backup dir %s: %w", dir, err)
+	}
+	return &Backups{dir: dir, keep: keep, maxAge: maxAge}, nil
+}
+
+// Snapshot archives the folder into the backup dir, named after the time and the label, e.g. the
+// commit that was live, then removes the oldest snapshots. A missing or empty folder isn't archived
+func (b *Backups) Snapshot(folder, label string) (string, error) {
+	if b == nil {
+		return "", nil
+	}
+	entries, err := os.ReadDir(folder)
+	if os.IsNotExist(err) || (err == nil && len(entries) == 0) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %w", folder, err)
+	}
+
+	name := time.Now().UTC().Format(backupTimeFormat) + "-" + label + backupSuffix
+	file, err := os.CreateTemp(b.dir, ".snapshot-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create backup: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := archiveFolder(file, folder); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", folder, err)
+	}
+	if err := file.Close(); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	path := filepath.Join(b.dir, name)
+	// readers never see a half-written snapshot
+	if err := os.Rename(file.Name(), path); err != nil {
+		return "", fmt.Errorf("failed to write backup: %w", err)
+	}
+	log.Printf("backed up %s to %s\n", folder, path)
+
+	if err := b.rotate(); err != nil {
+		log.Printf("failed to remove old backups: %v\n", err)
+	}
+	return path, nil
+}
+
+// rotate removes all but the latest keep snapshots, and the ones older than maxAge. The latest one is
+// always kept, so there's something to restore even after a long time without applies
+func (b *Backups) rotate() error {
+	if b == nil || (b.keep <= 0 && b.maxAge <= 0) {
+		return nil
+	}
+	entries, err := os.ReadDir(b.dir)
+	if err != nil {
+		return err
+	}
+	var snapshots []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), backupSuffix) {
+			snapshots = append(snapshots, entry.Name())
+		}
+	}
+	// the names start with the time, so they sort oldest first
+	sort.Strings(snapshots)
+	for len(snapshots) > 1 && ((b.keep > 0 && len(snapshots) > b.keep) || b.expired(snapshots[0])) {
+		if err := os.Remove(filepath.Join(b.dir, snapshots[0])); err != nil {
+			return err
+		}
+		log.Printf("removed old backup %s\n", snapshots[0])
+		Metrics.Add("git_config_server_gc_removed_total", 1, "kind", "backup")
+		snapshots = snapshots[1:]
+	}
+	return nil
+}
+
+// expired is true if the snapshot was taken more than maxAge ago, going by the time in its name
+func (b *Backups) expired(name string) bool {
+	if b.maxAge <= 0 {
+		return false
+	}
+	prefix, _, _ := strings.Cut(name, "-")
+	taken, err := time.Parse(backupTimeFormat, prefix)
+	return err == nil && time.Since(taken) > b.maxAge
+}
+
+// archiveFolder writes the folder as a gzipped tarball, with paths relative to it
+func archiveFolder(w io.Writer, folder string) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	err := filepath.Walk(folder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(folder, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+		if info.Mode()&os.ModeSocket != 0 {
+			// sockets can't be archived, nor restored
+			return nil
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// isInside is true if path is dir or somewhere inside it
+func isInside(path, dir string) bool {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
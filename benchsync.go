@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// benchFilesPerDir is how many files the generated trees have in each directory
+const benchFilesPerDir = 100
+
+// BenchSyncCommand times SyncDirs on a generated tree, to check a change doesn't slow down the syncs of
+// large trees
+type BenchSyncCommand struct {
+	Files   int           `long:"files" default:"100000" description:"Files of the generated tree"`
+	Changed float64       `long:"changed" default:"1" description:"Percentage of the files modified, added and removed for the sync of a changed tree"`
+	Rounds  int           `long:"rounds" default:"3" description:"Syncs of the unchanged tree, the fastest being reported"`
+	Dir     string        `long:"dir" description:"Directory to generate the trees in, a temporary one by default. Use one on the filesystem of the local folder"`
+	Budget  time.Duration `long:"budget" description:"Fail if the fastest sync of the unchanged tree takes longer, e.g. 2s, as a performance regression check"`
+}
+
+func addBenchSyncCommand(parser *flags.Parser) {
+	_, err := parser.AddCommand(
+		"bench-sync",
+		"Time the syncs of a large tree",
+		"Generates a tree of --files files and times syncing it to an empty folder, syncing it again unchanged and syncing it after changing some of the files, printing the time spent scanning and applying",
+		&BenchSyncCommand{},
+	)
+	CheckErr(err)
+}
+
+// benchResult is the timing of a scenario of bench-sync
+type benchResult struct {
+	name    string
+	timings syncTimings
+	changes SyncChanges
+}
+
+func (c *BenchSyncCommand) Execute(args []string) error {
+	if c.Files <= 0 || c.Rounds <= 0 || c.Changed < 0 || c.Changed > 100 {
+		return fmt.Errorf("--files and --rounds must be positive, and --changed between 0 and 100")
+	}
+	dir, err := os.MkdirTemp(c.Dir, "git-config-bench")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	if err := os.MkdirAll(dst, DirMode); err != nil {
+		return err
+	}
+	start := time.Now()
+	if err := writeBenchTree(src, 0, c.Files); err != nil {
+		return fmt.Errorf("failed to generate the tree: %w", err)
+	}
+	fmt.Printf("generated %d files in %s\n\n", c.Files, time.Since(start).Round(time.Millisecond))
+
+	var results []benchResult
+	sync := func(name string) error {
+		changes, timings, err := syncDirs(src, dst, nil)
+		if err != nil {
+			return fmt.Errorf("failed to sync the %s tree: %w", name, err)
+		}
+		results = append(results, benchResult{name, timings, changes})
+		return nil
+	}
+	if err := sync("new"); err != nil {
+		return err
+	}
+	var fastest time.Duration
+	for i := 0; i < c.Rounds; i++ {
+		if err := sync("unchanged"); err != nil {
+			return err
+		}
+		if took := results[len(results)-1].timings.Total(); fastest == 0 || took < fastest {
+			fastest = took
+		}
+	}
+	if changed := int(float64(c.Files) * c.Changed / 100); changed > 0 {
+		if err := changeBenchTree(src, c.Files, changed); err != nil {
+			return fmt.Errorf("failed to change the tree: %w", err)
+		}
+		if err := sync("changed"); err != nil {
+			return err
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TREE\tFILES\tSCAN\tAPPLY\tTOTAL\tFILES/S\tCHANGES")
+	for _, result := range results {
+		total := result.timings.Total()
+		changes := len(result.changes.Added) + len(result.changes.Modified) + len(result.changes.Removed)
+		fmt.Fprintf(w, "%s\t%d\t%s\t%s\t%s\t%.0f\t%d\n", result.name, result.timings.Files, result.timings.Scan.Round(time.Millisecond),
+			result.timings.Apply.Round(time.Millisecond), total.Round(time.Millisecond), float64(result.timings.Files)/total.Seconds(), changes)
+	}
+	w.Flush()
+
+	if c.Budget > 0 && fastest > c.Budget {
+		return fmt.Errorf("syncing the unchanged tree took %s, over the budget of %s", fastest.Round(time.Millisecond), c.Budget)
+	}
+	return nil
+}
+
+// writeBenchTree writes the files from..to of a generated tree, benchFilesPerDir in each directory
+func writeBenchTree(root string, from, to int) error {
+	for i := from; i < to; i++ {
+		path := benchFilePath(root, i)
+		if i == from || i%benchFilesPerDir == 0 {
+			if err := os.MkdirAll(filepath.Dir(path), DirMode); err != nil {
+				return err
+			}
+		}
+		content := fmt.Sprintf("# generated file %d\nkey = value-%d\nlist = [%d, %d, %d]\n", i, i, i, i*2, i*3)
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// changeBenchTree modifies, removes and adds changed files each to the tree of files files
+func changeBenchTree(root string, files, changed int) error {
+	step := files / changed
+	for i := 0; i < changed; i++ {
+		path := benchFilePath(root, i*step)
+		if err := os.WriteFile(path, []byte(fmt.Sprintf("# changed file %d\n", i*step)), 0o644); err != nil {
+			return err
+		}
+		if err := os.Remove(benchFilePath(root, i*step+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return writeBenchTree(root, files, files+changed)
+}
+
+// benchFilePath spreads the files over two levels of directories, like a config repo of many services
+func benchFilePath(root string, i int) string {
+	dir := i / benchFilesPerDir
+	return filepath.Join(root, fmt.Sprintf("service%03d", dir/benchFilesPerDir), fmt.Sprintf("env%02d", dir%benchFilesPerDir), fmt.Sprintf("file%06d.conf", i))
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// ChownRule sets the owner, group and mode of the paths in the local folder matching a
+// gitignore-style pattern, like certs/**=root:ssl-cert:0640. Any of the three may be left empty
+type ChownRule struct {
+	text    string
+	pattern gitignore.Pattern
+	uid     int
+	gid     int
+	mode    os.FileMode
+}
+
+// ParseChownRule parses a --chown-rule, looking up the user and group, which may also be numeric
+func ParseChownRule(rule string) (ChownRule, error) {
+	pattern, spec, ok := strings.Cut(rule, "=")
+	parts := strings.Split(spec, ":")
+	if !ok || pattern == "" || len(parts) > 3 {
+		return ChownRule{}, fmt.Errorf("invalid --chown-rule %q, expected pattern=owner:group:mode", rule)
+	}
+	parts = append(parts, "", "")[:3]
+	parsed := ChownRule{text: rule, pattern: gitignore.ParsePattern(pattern, nil), uid: -1, gid: -1}
+
+	if owner := parts[0]; owner != "" {
+		uid, err := strconv.Atoi(owner)
+		if err != nil {
+			u, err := user.Lookup(owner)
+			if err != nil {
+				return ChownRule{}, fmt.Errorf("invalid --chown-rule %q: %w", rule, err)
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+		parsed.uid = uid
+	}
+	if group := parts[1]; group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return ChownRule{}, fmt.Errorf("invalid --chown-rule %q: %w", rule, err)
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+		parsed.gid = gid
+	}
+	if mode := parts[2]; mode != "" {
+		m, err := strconv.ParseUint(mode, 8, 32)
+		if err != nil || m > 0o7777 {
+			return ChownRule{}, fmt.Errorf("invalid --chown-rule %q: %q isn't an octal mode like 0640", rule, mode)
+		}
+		parsed.mode = os.FileMode(m)
+	}
+	return parsed, nil
+}
+
+// ChownRules are applied in order, so the last matching rule wins
+type ChownRules []ChownRule
+
+// match returns the last rule matching the path, nil if none does
+func (rules ChownRules) match(slashPath string, isDir bool) *ChownRule {
+	for i := len(rules) - 1; i >= 0; i-- {
+		if rules[i].pattern.Match(strings.Split(slashPath, "/"), isDir) == gitignore.Exclude {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+// Apply sets the owner, group and mode of the matching rule on the path, if any
+func (rules ChownRules) Apply(path, slashPath string, isDir bool) error {
+	rule := rules.match(slashPath, isDir)
+	if rule == nil {
+		return nil
+	}
+	if rule.uid != -1 || rule.gid != -1 {
+		if err := os.Lchown(path, rule.uid, rule.gid); err != nil {
+			return fmt.Errorf("failed to apply --chown-rule %s to %s: %w", rule.text, path, err)
+		}
+	}
+	if rule.mode != 0 {
+		mode := rule.mode
+		if isDir {
+			// directories can only be listed with the x bit, given along with r, like 0640 to 0750
+			mode |= (mode & 0o444) >> 2
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			return fmt.Errorf("failed to apply --chown-rule %s to %s: %w", rule.text, path, err)
+		}
+	}
+	return nil
+}
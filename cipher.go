@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// cipherPrefix marks encrypted values inline in config files, like {cipher}3f2a...
+const cipherPrefix = "{cipher}"
+
+var cipherValuePattern = regexp.MustCompile(`\{cipher\}([0-9a-fA-F]+)`)
+
+// ValueCipher encrypts and decrypts the {cipher} values. It's nil unless --encrypt-key is set
+var ValueCipher *Cipher
+
+// Cipher encrypts values with AES-256-GCM, the key being the SHA-256 of the secret
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(secret string) (*Cipher, error) {
+	if secret == "" {
+		return nil, errors.New("empty encryption key")
+	}
+	key := sha256.Sum256([]byte(secret))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead: aead}, nil
+}
+
+// Encrypt returns the {cipher} value for the plaintext, with a random nonce
+func (c *Cipher) Encrypt(plaintext []byte) (string, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	sealed := c.aead.Seal(nonce, nonce, plaintext, nil)
+	return cipherPrefix + hex.EncodeToString(sealed), nil
+}
+
+// Decrypt accepts a {cipher} value, with or without the prefix
+func (c *Cipher) Decrypt(value string) ([]byte, error) {
+	sealed, err := hex.DecodeString(strings.TrimPrefix(strings.TrimSpace(value), cipherPrefix))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encrypted value: %w", err)
+	}
+	if len(sealed) < c.aead.NonceSize() {
+		return nil, errors.New("invalid encrypted value: too short")
+	}
+	nonce, ciphertext := sealed[:c.aead.NonceSize()], sealed[c.aead.NonceSize():]
+	plaintext, err := c.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("failed to decrypt value: wrong key or corrupted data")
+	}
+	return plaintext, nil
+}
+
+// DecryptAll replaces every {cipher} value in the content by its plaintext
+func (c *Cipher) DecryptAll(content []byte) ([]byte, error) {
+	if !bytes.Contains(content, []byte(cipherPrefix)) {
+		return content, nil
+	}
+	var firstErr error
+	decrypted := cipherValuePattern.ReplaceAllFunc(content, func(match []byte) []byte {
+		plaintext, err := c.Decrypt(string(match))
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return match
+		}
+		return plaintext
+	})
+	return decrypted, firstErr
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCipherRoundTrip(t *testing.T) {
+	c, err := NewCipher("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, plaintext := range []string{"", "password", "multi\nline: value", strings.Repeat("x", 10000)} {
+		value, err := c.Encrypt([]byte(plaintext))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(value, cipherPrefix) || (plaintext != "" && strings.Contains(value, plaintext)) {
+			t.Fatalf("encrypted %q to %q", plaintext, value)
+		}
+		for _, encrypted := range []string{value, strings.TrimPrefix(value, cipherPrefix), " " + value + "\n"} {
+			decrypted, err := c.Decrypt(encrypted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decrypted) != plaintext {
+				t.Errorf("decrypted %q, want %q", decrypted, plaintext)
+			}
+		}
+	}
+	first, _ := c.Encrypt([]byte("same"))
+	second, _ := c.Encrypt([]byte("same"))
+	if first == second {
+		t.Errorf("the same plaintext was encrypted to the same value twice")
+	}
+}
+
+func TestCipherTampered(t *testing.T) {
+	c, err := NewCipher("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewCipher("other key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := c.Encrypt([]byte("password"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// flips a bit of the last byte, in the tag
+	last := value[len(value)-1]
+	flipped := "0"
+	if last == '0' {
+		flipped = "1"
+	}
+	tests := map[string]string{
+		"flipped bit":   value[:len(value)-1] + flipped,
+		"truncated":     value[:len(value)-2],
+		"too short":     cipherPrefix + "00ff",
+		"not hex":       cipherPrefix + "zz",
+		"empty":         cipherPrefix,
+		"nonce swapped": cipherPrefix + strings.Repeat("0", 24) + value[len(cipherPrefix)+24:],
+	}
+	for name, tampered := range tests {
+		t.Run(name, func(t *testing.T) {
+			if plaintext, err := c.Decrypt(tampered); err == nil {
+				t.Errorf("decrypted %q to %q", tampered, plaintext)
+			}
+		})
+	}
+	if _, err := other.Decrypt(value); err == nil {
+		t.Errorf("decrypted with the wrong key")
+	}
+	if _, err := NewCipher(""); err == nil {
+		t.Errorf("accepted an empty key")
+	}
+}
+
+func TestCipherDecryptAll(t *testing.T) {
+	c, err := NewCipher("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, _ := c.Encrypt([]byte("admin"))
+	password, _ := c.Encrypt([]byte("s3cret"))
+	content := "user: " + user + "\npassword: \"" + password + "\"\nplain: value\n"
+	decrypted, err := c.DecryptAll([]byte(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "user: admin\npassword: \"s3cret\"\nplain: value\n"; string(decrypted) != want {
+		t.Errorf("decrypted to %q, want %q", decrypted, want)
+	}
+
+	other, _ := NewCipher("other key")
+	foreign, _ := other.Encrypt([]byte("foreign"))
+	content = "a: " + user + "\nb: " + foreign + "\n"
+	decrypted, err = c.DecryptAll([]byte(content))
+	if err == nil {
+		t.Errorf("decrypted a value of another key")
+	}
+	if want := "a: admin\nb: " + foreign + "\n"; string(decrypted) != want {
+		t.Errorf("decrypted to %q, want %q", decrypted, want)
+	}
+}
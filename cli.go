@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// StatusCommand prints the status of the running instance
+type StatusCommand struct{}
+
+// SyncCommand asks the running instance to sync now
+type SyncCommand struct{}
+
+// PauseCommand stops the running instance from syncing until resumed
+type PauseCommand struct{}
+
+// ResumeCommand resumes syncing after a pause
+type ResumeCommand struct{}
+
+// LogLevelCommand changes the log level of the running instance
+type LogLevelCommand struct {
+	Args struct {
+		Level string `positional-arg-name:"level" description:"info or debug"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+// HistoryCommand prints the recent sync attempts of the running instance
+type HistoryCommand struct {
+	Limit int `short:"n" long:"limit" default:"20" description:"Maximum number of entries to show"`
+}
+
+func addControlCommands(parser *flags.Parser) {
+	commands := []struct {
+		name, short, long string
+		data              any
+	}{
+		{"status", "Show the status of the running instance", "Prints the status of the running instance, reached via the control socket or the webhook port", &StatusCommand{}},
+		{"sync", "Sync the running instance now", "Asks the running instance to check the repository right away", &SyncCommand{}},
+		{"pause", "Pause syncing", "Stops the running instance from syncing until resumed", &PauseCommand{}},
+		{"resume", "Resume syncing", "Resumes syncing after a pause", &ResumeCommand{}},
+		{"history", "Show the recent syncs", "Prints the recent sync attempts of the running instance", &HistoryCommand{}},
+		{"loglevel", "Change the log level", "Changes the log level of the running instance to info or debug, without restarting it", &LogLevelCommand{}},
+	}
+	for _, c := range commands {
+		_, err := parser.AddCommand(c.name, c.short, c.long, c.data)
+		CheckErr(err)
+	}
+}
+
+func (c *StatusCommand) Execute(args []string) error {
+	return printAPIResponse(http.MethodGet, "/status")
+}
+
+func (c *SyncCommand) Execute(args []string) error {
+	if _, err := callAPI(http.MethodPost, "/sync"); err != nil {
+		return err
+	}
+	fmt.Println("sync requested")
+	return nil
+}
+
+func (c *PauseCommand) Execute(args []string) error {
+	return printAPIResponse(http.MethodPost, "/pause")
+}
+
+func (c *ResumeCommand) Execute(args []string) error {
+	return printAPIResponse(http.MethodPost, "/resume")
+}
+
+func (c *LogLevelCommand) Execute(args []string) error {
+	if _, err := ParseLogLevel(c.Args.Level); err != nil {
+		return err
+	}
+	return printAPIResponse(http.MethodPut, "/admin/loglevel?level="+url.QueryEscape(c.Args.Level))
+}
+
+func (c *HistoryCommand) Execute(args []string) error {
+	body, err := callAPI(http.MethodGet, "/history")
+	if err != nil {
+		return err
+	}
+	var history []SyncRecord
+	if err := json.Unmarshal(body, &history); err != nil {
+		return fmt.Errorf("failed to parse history: %w", err)
+	}
+	if c.Limit > 0 && len(history) > c.Limit {
+		history = history[len(history)-c.Limit:]
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tTRIGGER\tCOMMIT\tRESULT")
+	for _, record := range history {
+		result := "unchanged"
+		if record.Error != "" {
+			result = "error: " + record.Error
+		} else if record.Changed {
+			result = "applied"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", record.Time.Local().Format(time.RFC3339), record.Trigger, shortCommit(record.Commit), result)
+	}
+	return w.Flush()
+}
+
+// printAPIResponse calls the API and prints the indented JSON response
+func printAPIResponse(method, path string) error {
+	body, err := callAPI(method, path)
+	if err != nil {
+		return err
+	}
+	var out bytes.Buffer
+	if err := json.Indent(&out, body, "", "  "); err != nil {
+		return fmt.Errorf("failed to parse response: %w", err)
+	}
+	if !bytes.HasSuffix(out.Bytes(), []byte("\n")) {
+		out.WriteByte('\n')
+	}
+	_, err = os.Stdout.Write(out.Bytes())
+	return err
+}
+
+// callAPI sends a request to the running instance, preferring the control socket over the webhook port
+func callAPI(method, path string) ([]byte, error) {
+	client := http.DefaultClient
+	baseURL := ""
+
+	switch {
+	case Options.ControlSocket != "":
+		client = &http.Client{Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var dialer net.Dialer
+				return dialer.DialContext(ctx, "unix", Options.ControlSocket)
+			},
+		}}
+		baseURL = "http://control-socket"
+	case Options.WebhookPort != 0:
+		baseURL = fmt.Sprintf("http://127.0.0.1:%d", Options.WebhookPort)
+	default:
+		return nil, fmt.Errorf("no control socket or webhook port configured to reach the running instance")
+	}
+
+	req, err := http.NewRequest(method, baseURL+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if Options.WebhookTokenHeader != "" {
+		req.Header.Set(Options.WebhookTokenHeader, Options.WebhookTokenValue)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach the running instance: %w", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, bytes.TrimSpace(body))
+	}
+	return body, nil
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 8 {
+		return commit[:8]
+	}
+	return commit
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// SyncVars are the placeholders of --restart-command and --pre-update-command, like {{.Commit}}
+type SyncVars struct {
+	Commit      string
+	ShortCommit string
+	Previous    string
+	Branch      string
+	URL         string
+	Author      string
+	Email       string
+	Subject     string
+	Message     string
+	Committer   string
+	Parent      string
+	CommitTime  time.Time
+	Trigger     string
+	LocalFolder string
+}
+
+// SyncVars describes the commit that's applied, for the sync from trigger
+func (gitRepo *GitRepo) SyncVars(trigger string) SyncVars {
+	state := gitRepo.State()
+	info := state.Info
+	return SyncVars{
+		Commit:      state.Commit,
+		ShortCommit: shortCommit(state.Commit),
+		Previous:    state.Previous,
+		Branch:      gitRepo.Branch,
+		URL:         gitRepo.URL,
+		Author:      info.Author,
+		Email:       info.Email,
+		Subject:     info.Subject,
+		Message:     info.Message,
+		Committer:   info.Committer,
+		Parent:      info.Parent(),
+		CommitTime:  info.Time,
+		Trigger:     trigger,
+		LocalFolder: Options.LocalFolder,
+	}
+}
+
+// CommandTemplate is a command string with Go template placeholders, resolved on every run. The quote
+// function shell-quotes a value, e.g. {{quote .Subject}}
+type CommandTemplate struct {
+	text string
+	tmpl *template.Template
+}
+
+// ParseCommandTemplate parses the command, so mistakes are found on startup. A command without
+// placeholders renders as is
+func ParseCommandTemplate(name, text string) (*CommandTemplate, error) {
+	tmpl, err := template.New(name).
+		Option("missingkey=error").
+		Funcs(template.FuncMap{"quote": func(s string) string { return shellquote.Join(s) }}).
+		Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid placeholders in %s: %w", name, err)
+	}
+	t := &CommandTemplate{text: text, tmpl: tmpl}
+	// catch unknown fields now rather than on the first sync
+	if _, err := t.Render(SyncVars{}); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+func (t *CommandTemplate) Render(vars SyncVars) (string, error) {
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, vars); err != nil {
+		return "", fmt.Errorf("failed to resolve the placeholders in %s: %w", t.tmpl.Name(), err)
+	}
+	return b.String(), nil
+}
+
+// Args renders the command and splits it into arguments, as a shell would without running one
+func (t *CommandTemplate) Args(vars SyncVars) ([]string, error) {
+	command, err := t.Render(vars)
+	if err != nil {
+		return nil, err
+	}
+	args, err := shellquote.Split(command)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", t.tmpl.Name(), err)
+	}
+	if len(args) == 0 {
+		return nil, fmt.Errorf("%s is empty", t.tmpl.Name())
+	}
+	return args, nil
+}
+
+func (t *CommandTemplate) String() string {
+	return t.text
+}
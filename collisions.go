@@ -0,0 +1,69 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"runtime"
+	"strings"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// foldNames folds the case of the names the way case-insensitive filesystems compare them
+var foldNames = cases.Fold()
+
+// checkCollisions returns whether --filename-collisions refuses the trees with colliding names: with
+// auto, only where the filesystems usually ignore case or normalize Unicode names
+func checkCollisions(mode string) (bool, error) {
+	switch mode {
+	case "fail":
+		return true, nil
+	case "ignore":
+		return false, nil
+	case "auto":
+		return runtime.GOOS == "windows" || runtime.GOOS == "darwin", nil
+	}
+	return false, fmt.Errorf("invalid --filename-collisions %q, expected auto, fail or ignore", mode)
+}
+
+// checkNameCollisions refuses a tree with synced paths that only differ in case or Unicode
+// normalization (NFC or NFD), since a case-insensitive or normalizing filesystem would only keep one
+// of them. Directories that collide are merged by such filesystems, so only the paths inside them are
+// checked
+func checkNameCollisions(files fs.FS, config *RepoConfig) error {
+	type seenPath struct {
+		path  string
+		isDir bool
+	}
+	seen := make(map[string]seenPath)
+	var collisions []string
+	err := fs.WalkDir(files, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		if isGitMetadata(path) || !config.Synced(path, entry.IsDir()) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		key := foldNames.String(norm.NFC.String(path))
+		if other, ok := seen[key]; ok && !(other.isDir && entry.IsDir()) {
+			collisions = append(collisions, other.path+" and "+path)
+			return nil
+		}
+		seen[key] = seenPath{path: path, isDir: entry.IsDir()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(collisions) > 0 {
+		return fmt.Errorf("refusing to sync paths that would overwrite each other on a case-insensitive or normalizing filesystem: %s", strings.Join(collisions, ", "))
+	}
+	return nil
+}
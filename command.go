@@ -6,44 +6,111 @@ import (
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 type Command struct {
-	Args        []string
-	Pid         int
-	RestartArgs []string
-	cmd         *exec.Cmd
-	sigCh       chan os.Signal
-	exitCh      chan int
-	errorCh     chan error
-	ctx         context.Context
-	cancel      context.CancelFunc
-	exitCode    int
+	Args           []string
+	Pid            int
+	RestartCommand *CommandTemplate
+	// Compose, if set, is brought up to date instead of restarting the application
+	Compose         *ComposeProject
+	StopGracePeriod time.Duration
+	OnExit          func(exitCode int, requested bool)
+	// RestartPolicy is how the restart command is run and how restarts are checked
+	RestartPolicy RestartPolicy
+	// Sandbox, if set, restricts the application through a helper that execs it
+	Sandbox *Sandbox
+	// Dir is the working directory, the current one if empty
+	Dir string
+	// Env is added to the environment of this process
+	Env []string
+	// Stdin, if set, is the application's stdin, unless it gets a terminal with TTY
+	Stdin *os.File
+	// TTY gives the application a pseudo-terminal, relaying this process's terminal to it
+	TTY           bool
+	stopRequested bool
+	cmd           *exec.Cmd
+	sigCh         chan os.Signal
+	exitCh        chan int
+	errorCh       chan error
+	ctx           context.Context
+	cancel        context.CancelFunc
+	exitCode      int
 }
 
-func NewCommand(ctx context.Context, args []string, restartArgs []string) *Command {
+func NewCommand(ctx context.Context, args []string, restartCommand *CommandTemplate, stopGracePeriod time.Duration) *Command {
 	return &Command{
-		Args:        args,
-		RestartArgs: restartArgs,
-		Pid:         -1,
-		ctx:         ctx,
+		Args:            args,
+		RestartCommand:  restartCommand,
+		StopGracePeriod: stopGracePeriod,
+		Pid:             -1,
+		ctx:             ctx,
 	}
 }
 
+// Start starts the application. Without args there's nothing to start, when only the processes of
+// --processes-file are supervised
 func (c *Command) Start() error {
+	if len(c.Args) == 0 {
+		return nil
+	}
 	if c.IsRunning() {
 		return fmt.Errorf("command %v is already running", c)
 	}
+	args := c.Args
+	if c.Sandbox != nil {
+		var err error
+		if args, err = c.Sandbox.Wrap(args); err != nil {
+			return err
+		}
+	}
 	ctx, cancel := context.WithCancel(c.ctx)
-	c.cmd = exec.CommandContext(ctx, c.Args[0], c.Args[1:]...)
+	c.stopRequested = false
+	c.cmd = exec.CommandContext(ctx, args[0], args[1:]...)
 	c.cmd.Stdout = os.Stdout
 	c.cmd.Stderr = os.Stderr
+	c.cmd.Dir = c.Dir
+	if len(c.Env) > 0 || ChildEnv != nil {
+		c.cmd.Env = append(ChildEnv.Environ(), c.Env...)
+	}
+
+	// on cancel, ask the process to stop and only kill it after the grace period
+	configureProcess(c.cmd)
+	var tty *ttySession
+	if c.TTY {
+		var err error
+		if tty, err = attachTTY(c.cmd); err != nil {
+			cancel()
+			return err
+		}
+	} else if c.Stdin != nil {
+		c.cmd.Stdin = c.Stdin
+	}
+	c.cmd.Cancel = func() error {
+		return interruptProcess(c.cmd)
+	}
+	c.cmd.WaitDelay = c.StopGracePeriod
 
 	log.Printf("starting command: %v", c)
 	err := c.cmd.Start()
 	if err != nil {
+		cancel()
+		if tty != nil {
+			tty.close()
+		}
 		return err
 	}
+	if tty != nil {
+		tty.started()
+	}
+	release, err := attachProcess(c.cmd)
+	if err != nil {
+		log.Printf("failed to track the process tree of %v: %v\n", c, err)
+		release = func() {}
+	}
 	c.cancel = cancel
 	c.exitCh = make(chan int, 1)
 	c.errorCh = make(chan error, 1)
@@ -59,7 +126,11 @@ func (c *Command) Start() error {
 		defer close(c.errorCh)
 		defer cancel()
 
+		release()
 		err := c.cmd.Wait()
+		if tty != nil {
+			tty.close()
+		}
 		c.sigCh = nil
 		c.exitCode = 0
 
@@ -67,6 +138,10 @@ func (c *Command) Start() error {
 			if exitError, ok := err.(*exec.ExitError); ok {
 				c.exitCode = exitError.ExitCode()
 				c.exitCh <- c.exitCode
+			} else if c.cmd.ProcessState != nil {
+				// exited on its own after being asked to stop
+				c.exitCode = c.cmd.ProcessState.ExitCode()
+				c.exitCh <- c.exitCode
 			} else {
 				log.Printf("command failed: %v\n", err)
 				c.errorCh <- err
@@ -74,6 +149,9 @@ func (c *Command) Start() error {
 			}
 		}
 		log.Printf("command %v finished with exit code %d\n", c, c.exitCode)
+		if c.OnExit != nil {
+			c.OnExit(c.exitCode, c.stopRequested)
+		}
 	}()
 
 	return nil
@@ -86,12 +164,16 @@ func (c *Command) IsRunning() bool {
 func (c *Command) Stop() error {
 	cancel := c.cancel
 
+	if len(c.Args) == 0 {
+		return nil
+	}
 	if cancel == nil {
 		log.Printf("already stopped\n")
 		return nil
 	}
 
 	log.Printf("cancelling command context\n")
+	c.stopRequested = true
 	cancel()
 	select {
 	case err := <-c.errorCh:
@@ -105,16 +187,29 @@ func (c *Command) Stop() error {
 	return nil
 }
 
-func (c *Command) Restart() error {
-	if len(c.RestartArgs) > 0 {
-		log.Printf("executing restart command\n")
-		cmd := exec.Command(c.RestartArgs[0], c.RestartArgs[1:]...)
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
-		if err != nil {
-			return fmt.Errorf("failed to restart command: %w", err)
+// Restart brings the compose project up to date or runs the restart command, with the placeholders
+// resolved from vars, or stops and starts the application if there's neither. If the restart command
+// still fails, the application is stopped and started instead when the policy falls back to it. An
+// application that isn't running is started rather than given to the restart command
+func (c *Command) Restart(vars SyncVars) error {
+	if c.Compose != nil {
+		return c.Compose.Up(c.ctx)
+	}
+	if len(c.Args) > 0 && c.RestartCommand != nil && !c.IsRunning() {
+		log.Printf("command %s isn't running, starting it instead of running the restart command\n", c.Args[0])
+		if err := c.Start(); err != nil {
+			return fmt.Errorf("failed to start command again: %w", err)
 		}
+		return c.RestartPolicy.verify()
+	}
+	if c.RestartCommand != nil {
+		err := c.runRestartCommand(vars)
+		if err == nil || len(c.Args) == 0 || !c.RestartPolicy.Fallback {
+			return err
+		}
+		log.Printf("%v, stopping and starting the application instead\n", err)
+	}
+	if len(c.Args) == 0 {
 		return nil
 	}
 
@@ -131,7 +226,7 @@ func (c *Command) Restart() error {
 	}
 
 	log.Printf("Command running with pid=%d", c.Pid)
-	return nil
+	return c.RestartPolicy.verify()
 }
 
 func (c *Command) String() string {
@@ -142,23 +237,40 @@ func (c *Command) String() string {
 	}
 }
 
-func runShellCommand(shellCommand, runner, workingDir string) error {
+// shellArgs returns the arguments to make the runner execute a command string
+func shellArgs(runner, shellCommand string) []string {
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(runner), filepath.Ext(runner)))
+	switch name {
+	case "cmd":
+		return []string{"/C", shellCommand}
+	case "powershell", "pwsh":
+		return []string{"-NoProfile", "-Command", shellCommand}
+	default:
+		return []string{"-c", shellCommand}
+	}
+}
 
-	cmd := exec.Command(runner, "-c", shellCommand)
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
-	if workingDir != "" {
-		cmd.Dir = workingDir
-	} else {
+// runShellCommand runs the command string with the runner, adding env to the environment. name identifies
+// it in the HookFinished event
+func runShellCommand(ctx context.Context, name, shellCommand, runner, workingDir string, env ...string) error {
+	if workingDir == "" {
 		dir, err := os.Getwd()
 		if err != nil {
 			return fmt.Errorf("failed to get cwd: %w", err)
 		}
-		cmd.Dir = dir
+		workingDir = dir
 	}
 
-	log.Printf("running command with runner %s on cwd=%s: %s\n", runner, cmd.Dir, shellCommand)
-	if err := cmd.Run(); err != nil {
+	log.Printf("running command with runner %s on cwd=%s: %s\n", runner, workingDir, shellCommand)
+	err := runProcess(ctx, name, name, func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, runner, shellArgs(runner, shellCommand)...)
+		if len(env) > 0 {
+			cmd.Env = append(os.Environ(), env...)
+		}
+		cmd.Dir = workingDir
+		return cmd
+	})
+	if err != nil {
 		return fmt.Errorf("failed to run shell command: %w", err)
 	}
 
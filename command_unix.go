@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// configureProcess puts the child in its own process group, so the whole tree can be signaled at once
+func configureProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// attachProcess returns the function waiting for the child to exit and killing the leftovers in its
+// process group. It's called before Wait reaps the child, which keeps the group ID from being reused
+func attachProcess(cmd *exec.Cmd) (func(), error) {
+	pid := cmd.Process.Pid
+	return func() {
+		if err := waitExited(pid); err == nil {
+			_ = syscall.Kill(-pid, syscall.SIGKILL)
+		}
+	}, nil
+}
+
+// interruptProcess asks the child process group to terminate gracefully
+func interruptProcess(cmd *exec.Cmd) error {
+	err := syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+	if errors.Is(err, syscall.ESRCH) {
+		return os.ErrProcessDone
+	}
+	return err
+}
+
+// isHookExecutable is true for files with any executable bit set
+func isHookExecutable(info os.FileInfo) bool {
+	return IsExecAny(info)
+}
@@ -0,0 +1,85 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// configureProcess starts the child in a new process group, so it can receive CTRL_BREAK events
+// without them reaching this process too
+func configureProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{CreationFlags: windows.CREATE_NEW_PROCESS_GROUP}
+}
+
+// attachProcess assigns the child to a job object that kills the whole process tree when closed, returning
+// the function waiting for the child to exit and closing it
+func attachProcess(cmd *exec.Cmd) (func(), error) {
+	job, err := windows.CreateJobObject(nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create job object: %w", err)
+	}
+
+	info := windows.JOBOBJECT_EXTENDED_LIMIT_INFORMATION{
+		BasicLimitInformation: windows.JOBOBJECT_BASIC_LIMIT_INFORMATION{
+			LimitFlags: windows.JOB_OBJECT_LIMIT_KILL_ON_JOB_CLOSE,
+		},
+	}
+	_, err = windows.SetInformationJobObject(
+		job,
+		windows.JobObjectExtendedLimitInformation,
+		uintptr(unsafe.Pointer(&info)),
+		uint32(unsafe.Sizeof(info)),
+	)
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to configure job object: %w", err)
+	}
+
+	process, err := windows.OpenProcess(windows.PROCESS_SET_QUOTA|windows.PROCESS_TERMINATE|windows.SYNCHRONIZE, false, uint32(cmd.Process.Pid))
+	if err != nil {
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to open process %d: %w", cmd.Process.Pid, err)
+	}
+
+	if err := windows.AssignProcessToJobObject(job, process); err != nil {
+		windows.CloseHandle(process)
+		windows.CloseHandle(job)
+		return nil, fmt.Errorf("failed to assign process %d to job object: %w", cmd.Process.Pid, err)
+	}
+
+	return func() {
+		windows.WaitForSingleObject(process, windows.INFINITE)
+		windows.CloseHandle(process)
+		windows.CloseHandle(job)
+	}, nil
+}
+
+// interruptProcess sends a CTRL_BREAK event to the child process group
+func interruptProcess(cmd *exec.Cmd) error {
+	err := windows.GenerateConsoleCtrlEvent(windows.CTRL_BREAK_EVENT, uint32(cmd.Process.Pid))
+	if err != nil {
+		// no console attached, so there's no graceful way to ask
+		if killErr := cmd.Process.Kill(); killErr != nil {
+			return os.ErrProcessDone
+		}
+	}
+	return nil
+}
+
+// isHookExecutable is true for files Windows can run directly, going by the extension
+func isHookExecutable(info os.FileInfo) bool {
+	switch strings.ToLower(filepath.Ext(info.Name())) {
+	case ".exe", ".bat", ".cmd", ".com":
+		return true
+	}
+	return false
+}
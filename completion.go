@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// CompletionCommand prints a shell completion script. The scripts call back into this binary
+// with GO_FLAGS_COMPLETION set, so they never get out of sync with the flags
+type CompletionCommand struct {
+	Name string `long:"name" description:"Name of the command to complete (default: this executable's name)"`
+	Args struct {
+		Shell string `positional-arg-name:"shell" description:"One of bash, zsh or fish"`
+	} `positional-args:"yes" required:"yes"`
+}
+
+const bashCompletion = `# bash completion for {{name}}
+_{{func}}() {
+    local args=("${COMP_WORDS[@]:1:$COMP_CWORD}")
+    local IFS=$'\n'
+    COMPREPLY=($(GO_FLAGS_COMPLETION=1 "${COMP_WORDS[0]}" "${args[@]}" 2>/dev/null))
+    return 0
+}
+complete -o default -F _{{func}} {{name}}
+`
+
+const zshCompletion = `#compdef {{name}}
+_{{func}}() {
+    local -a completions
+    completions=("${(@f)$(GO_FLAGS_COMPLETION=1 ${words[1]} "${(@)words[2,$CURRENT]}" 2>/dev/null)}")
+    compadd -a completions
+}
+compdef _{{func}} {{name}}
+`
+
+const fishCompletion = `# fish completion for {{name}}
+function __{{func}}_complete
+    set -l args (commandline -opc)[2..-1] (commandline -ct)
+    env GO_FLAGS_COMPLETION=1 {{name}} $args 2>/dev/null
+end
+complete -c {{name}} -f -a '(__{{func}}_complete)'
+`
+
+func addCompletionCommand(parser *flags.Parser) {
+	_, err := parser.AddCommand(
+		"completion",
+		"Generate shell completions",
+		"Prints a completion script for bash, zsh or fish. For example: source <(git-config-server completion bash)",
+		&CompletionCommand{},
+	)
+	CheckErr(err)
+}
+
+func (c *CompletionCommand) Execute(args []string) error {
+	name := c.Name
+	if name == "" {
+		name = filepath.Base(os.Args[0])
+	}
+
+	var script string
+	switch c.Args.Shell {
+	case "bash":
+		script = bashCompletion
+	case "zsh":
+		script = zshCompletion
+	case "fish":
+		script = fishCompletion
+	default:
+		return fmt.Errorf("unsupported shell %q, expected bash, zsh or fish", c.Args.Shell)
+	}
+
+	funcName := regexp.MustCompile(`[^A-Za-z0-9_]`).ReplaceAllString(name, "_")
+	script = strings.NewReplacer("{{name}}", name, "{{func}}", funcName).Replace(script)
+	_, err := fmt.Print(script)
+	return err
+}
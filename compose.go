@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// ComposeProject brings a Docker Compose project whose compose file is synced up to date, like
+// docker compose up -d, making the server a minimal GitOps agent for a single Docker host
+type ComposeProject struct {
+	Name string
+	// File is the compose file, relative to Dir. Empty lets compose look for its default names
+	File string
+	Dir  string
+	// Command is the compose CLI, like docker compose or docker-compose
+	Command []string
+}
+
+// NewComposeProject returns nil without a project name
+func NewComposeProject(name, file, dir, command string) (*ComposeProject, error) {
+	if name == "" {
+		return nil, nil
+	}
+	split, err := shellquote.Split(command)
+	if err != nil || len(split) == 0 {
+		return nil, fmt.Errorf("invalid --compose-command %q", command)
+	}
+	if _, err := exec.LookPath(split[0]); err != nil {
+		return nil, fmt.Errorf("--restart-compose needs %s in the PATH: %w", split[0], err)
+	}
+	// compose runs in the folder, so it can't be relative to the current one
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ComposeProject{Name: name, File: file, Dir: dir, Command: split}, nil
+}
+
+// Up creates, recreates or removes the services whose definition changed, leaving the others running
+func (p *ComposeProject) Up(ctx context.Context) error {
+	args := append([]string(nil), p.Command[1:]...)
+	args = append(args, "--project-name", p.Name, "--project-directory", p.Dir)
+	if p.File != "" {
+		args = append(args, "--file", p.File)
+	}
+	args = append(args, "up", "--detach", "--remove-orphans")
+	log.Printf("bringing compose project %s up to date\n", p.Name)
+	err := runProcess(ctx, "restart", "compose", func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, p.Command[0], args...)
+		cmd.Dir = p.Dir
+		return cmd
+	})
+	if err != nil {
+		return fmt.Errorf("failed to bring compose project %s up: %w", p.Name, err)
+	}
+	return nil
+}
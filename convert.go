@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config formats a structured file can be converted from and to
+const (
+	FormatJSON       = "json"
+	FormatYAML       = "yaml"
+	FormatProperties = "properties"
+	FormatEnv        = "env"
+)
+
+var errUnstructured = errors.New("not a structured config file")
+
+// configFormat guesses the format from the file name
+func configFormat(name string) (string, error) {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json":
+		return FormatJSON, nil
+	case ".yaml", ".yml":
+		return FormatYAML, nil
+	case ".properties":
+		return FormatProperties, nil
+	case ".env":
+		return FormatEnv, nil
+	}
+	if strings.ToLower(filepath.Base(name)) == ".env" {
+		return FormatEnv, nil
+	}
+	return "", fmt.Errorf("%s is %w", name, errUnstructured)
+}
+
+// validFormat is true for the formats RenderConfig supports
+func validFormat(format string) bool {
+	switch format {
+	case FormatJSON, FormatYAML, FormatProperties, FormatEnv:
+		return true
+	}
+	return false
+}
+
+// formatContentType is the media type served for each format
+func formatContentType(format string) string {
+	switch format {
+	case FormatJSON:
+		return "application/json"
+	case FormatYAML:
+		return "application/yaml"
+	default:
+		return "text/plain; charset=utf-8"
+	}
+}
+
+// ConvertConfig parses the file according to its name and renders it in the requested format
+func ConvertConfig(name string, content []byte, format string) ([]byte, error) {
+	from, err := configFormat(name)
+	if err != nil {
+		return nil, err
+	}
+	tree, err := ParseConfig(from, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s as %s: %w", name, from, err)
+	}
+	return RenderConfig(format, tree)
+}
+
+// ParseConfig parses the content into nested maps, lists and scalars. Dotted properties keys become
+// nested maps, while env files stay flat
+func ParseConfig(format string, content []byte) (map[string]any, error) {
+	switch format {
+	case FormatJSON:
+		var tree map[string]any
+		if err := json.Unmarshal(content, &tree); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	case FormatYAML:
+		var tree any
+		if err := yaml.Unmarshal(content, &tree); err != nil {
+			return nil, err
+		}
+		if tree == nil {
+			return map[string]any{}, nil
+		}
+		normalized, ok := normalizeYAML(tree).(map[string]any)
+		if !ok {
+			return nil, errors.New("the document isn't a mapping")
+		}
+		return normalized, nil
+	case FormatProperties:
+		flat, err := parseProperties(content)
+		if err != nil {
+			return nil, err
+		}
+		return unflatten(flat), nil
+	case FormatEnv:
+		flat, err := parseEnv(content)
+		if err != nil {
+			return nil, err
+		}
+		tree := make(map[string]any, len(flat))
+		for key, value := range flat {
+			tree[key] = value
+		}
+		return tree, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// RenderConfig writes the tree in the format
+func RenderConfig(format string, tree map[string]any) ([]byte, error) {
+	switch format {
+	case FormatJSON:
+		out, err := json.MarshalIndent(tree, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(out, '\n'), nil
+	case FormatYAML:
+		var b bytes.Buffer
+		encoder := yaml.NewEncoder(&b)
+		encoder.SetIndent(2)
+		if err := encoder.Encode(tree); err != nil {
+			return nil, err
+		}
+		if err := encoder.Close(); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	case FormatProperties:
+		var b bytes.Buffer
+		flat := flatten(tree)
+		for _, key := range sortedKeys(flat) {
+			fmt.Fprintf(&b, "%s=%s\n", escapeProperty(key, true), escapeProperty(flat[key], false))
+		}
+		return b.Bytes(), nil
+	case FormatEnv:
+		var b bytes.Buffer
+		env := make(map[string]string)
+		for key, value := range flatten(tree) {
+			env[envKey(key)] = value
+		}
+		for _, key := range sortedKeys(env) {
+			fmt.Fprintf(&b, "%s=%s\n", key, quoteEnv(env[key]))
+		}
+		return b.Bytes(), nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+// normalizeYAML turns the maps with non-string keys yaml.v3 may produce into map[string]any
+func normalizeYAML(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, item := range v {
+			v[key] = normalizeYAML(item)
+		}
+		return v
+	case map[any]any:
+		m := make(map[string]any, len(v))
+		for key, item := range v {
+			m[fmt.Sprint(key)] = normalizeYAML(item)
+		}
+		return m
+	case []any:
+		for i, item := range v {
+			v[i] = normalizeYAML(item)
+		}
+		return v
+	}
+	return value
+}
+
+// flatten joins the nested keys with dots and indexes lists like key[0]
+func flatten(tree map[string]any) map[string]string {
+	flat := make(map[string]string)
+	var walk func(prefix string, value any)
+	walk = func(prefix string, value any) {
+		switch v := value.(type) {
+		case map[string]any:
+			for key, item := range v {
+				if prefix != "" {
+					key = prefix + "." + key
+				}
+				walk(key, item)
+			}
+		case []any:
+			for i, item := range v {
+				walk(fmt.Sprintf("%s[%d]", prefix, i), item)
+			}
+		default:
+			flat[prefix] = scalarString(v)
+		}
+	}
+	walk("", tree)
+	return flat
+}
+
+// unflatten nests the dotted keys. A key that's both a value and a parent is kept flat
+func unflatten(flat map[string]string) map[string]any {
+	tree := make(map[string]any)
+	for _, key := range sortedKeys(flat) {
+		parts := strings.Split(key, ".")
+		node := tree
+		nested := true
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part]
+			if !ok {
+				child = make(map[string]any)
+				node[part] = child
+			}
+			childMap, ok := child.(map[string]any)
+			if !ok {
+				nested = false
+				break
+			}
+			node = childMap
+		}
+		last := parts[len(parts)-1]
+		if _, isParent := node[last].(map[string]any); !nested || isParent {
+			tree[key] = flat[key]
+			continue
+		}
+		node[last] = flat[key]
+	}
+	return tree
+}
+
+func scalarString(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// parseProperties reads a Java .properties file: key=value, key: value or key value, with
+// # and ! comments, backslash escapes and line continuations
+func parseProperties(content []byte) (map[string]string, error) {
+	flat := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	var logical strings.Builder
+	for scanner.Scan() {
+		line := strings.TrimLeft(scanner.Text(), " \t\f")
+		if logical.Len() == 0 && (line == "" || line[0] == '#' || line[0] == '!') {
+			continue
+		}
+		if trailingBackslashes(line)%2 == 1 {
+			logical.WriteString(line[:len(line)-1])
+			continue
+		}
+		logical.WriteString(line)
+		key, value := splitProperty(logical.String())
+		logical.Reset()
+		flat[unescapeProperty(key)] = unescapeProperty(value)
+	}
+	if logical.Len() > 0 {
+		key, value := splitProperty(logical.String())
+		flat[unescapeProperty(key)] = unescapeProperty(value)
+	}
+	return flat, scanner.Err()
+}
+
+func trailingBackslashes(line string) int {
+	n := 0
+	for i := len(line) - 1; i >= 0 && line[i] == '\\'; i-- {
+		n++
+	}
+	return n
+}
+
+// splitProperty splits at the first unescaped =, : or whitespace
+func splitProperty(line string) (string, string) {
+	for i := 0; i < len(line); i++ {
+		switch line[i] {
+		case '\\':
+			i++
+		case '=', ':':
+			return line[:i], strings.TrimLeft(line[i+1:], " \t\f")
+		case ' ', '\t', '\f':
+			rest := strings.TrimLeft(line[i:], " \t\f")
+			if rest != "" && (rest[0] == '=' || rest[0] == ':') {
+				rest = rest[1:]
+			}
+			return line[:i], strings.TrimLeft(rest, " \t\f")
+		}
+	}
+	return line, ""
+}
+
+func unescapeProperty(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i == len(s)-1 {
+			b.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 't':
+			b.WriteByte('\t')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 'f':
+			b.WriteByte('\f')
+		case 'u':
+			if i+4 < len(s) {
+				if r, err := strconv.ParseUint(s[i+1:i+5], 16, 32); err == nil {
+					b.WriteRune(rune(r))
+					i += 4
+					continue
+				}
+			}
+			b.WriteByte('u')
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func escapeProperty(s string, isKey bool) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case r == '\\':
+			b.WriteString(`\\`)
+		case r == '\n':
+			b.WriteString(`\n`)
+		case r == '\r':
+			b.WriteString(`\r`)
+		case r == '\t':
+			b.WriteString(`\t`)
+		case isKey && (r == '=' || r == ':' || r == ' '):
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case !isKey && i == 0 && r == ' ':
+			b.WriteString(`\ `)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// parseEnv reads a dotenv file: KEY=value lines, optionally prefixed by export, with single or
+// double quoted values
+func parseEnv(content []byte) (map[string]string, error) {
+	flat := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return nil, fmt.Errorf("line %d: missing =", lineNumber)
+		}
+		key = strings.TrimSpace(key)
+		value = strings.TrimSpace(value)
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+			}
+			value = unquoted
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			if comment := strings.Index(value, " #"); comment >= 0 {
+				value = strings.TrimSpace(value[:comment])
+			}
+		}
+		flat[key] = value
+	}
+	return flat, scanner.Err()
+}
+
+// envKey turns a flattened key like db.hosts[0] into DB_HOSTS_0
+func envKey(key string) string {
+	var b strings.Builder
+	for _, r := range strings.ToUpper(key) {
+		switch {
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+			b.WriteRune(r)
+		case r == ']':
+		default:
+			b.WriteByte('_')
+		}
+	}
+	return b.String()
+}
+
+func quoteEnv(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\r\"'#$\\`") {
+		return strconv.Quote(value)
+	}
+	return value
+}
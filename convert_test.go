@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestConvertConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		format  string
+		want    string
+	}{
+		{
+			name:    "app.yaml",
+			content: "db:\n  host: localhost\n  port: 5432\nhosts: [a, b]\n",
+			format:  FormatProperties,
+			want:    "db.host=localhost\ndb.port=5432\nhosts[0]=a\nhosts[1]=b\n",
+		},
+		{
+			name:    "app.yml",
+			content: "db:\n  host: localhost\n",
+			format:  FormatEnv,
+			want:    "DB_HOST=localhost\n",
+		},
+		{
+			name:    "app.properties",
+			content: "# comment\ndb.host = localhost\ndb.port: 5432\nlong=first \\\n    second\n",
+			format:  FormatJSON,
+			want:    "{\n  \"db\": {\n    \"host\": \"localhost\",\n    \"port\": \"5432\"\n  },\n  \"long\": \"first second\"\n}\n",
+		},
+		{
+			name:    "app.json",
+			content: `{"db": {"host": "localhost", "port": 5432}, "debug": true}`,
+			format:  FormatYAML,
+			want:    "db:\n  host: localhost\n  port: 5432\ndebug: true\n",
+		},
+		{
+			name:    ".env",
+			content: "export NAME=app # trailing comment\nQUOTED=\"a b\\n\"\nSINGLE='$literal'\n",
+			format:  FormatEnv,
+			want:    "NAME=app\nQUOTED=\"a b\\n\"\nSINGLE=\"$literal\"\n",
+		},
+		{
+			name:    "keys.properties",
+			content: "key\\ with\\:colon=value\nunicode=caf\\u00e9\n",
+			format:  FormatProperties,
+			want:    "key\\ with\\:colon=value\nunicode=café\n",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name+" to "+test.format, func(t *testing.T) {
+			got, err := ConvertConfig(test.name, []byte(test.content), test.format)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != test.want {
+				t.Errorf("got\n%s\nwant\n%s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConvertConfigErrors(t *testing.T) {
+	if _, err := ConvertConfig("notes.txt", []byte("text"), FormatJSON); !errors.Is(err, errUnstructured) {
+		t.Errorf("converted a text file: %v", err)
+	}
+	if _, err := ConvertConfig("list.yaml", []byte("- a\n- b\n"), FormatJSON); err == nil {
+		t.Errorf("converted a yaml list")
+	}
+	if _, err := ConvertConfig(".env", []byte("NO_EQUALS\n"), FormatJSON); err == nil {
+		t.Errorf("converted an env line without =")
+	}
+	if _, err := ConvertConfig("app.json", []byte("{}"), "toml"); err == nil {
+		t.Errorf("rendered an unknown format")
+	}
+}
+
+func TestUnflatten(t *testing.T) {
+	got := unflatten(map[string]string{"a.b": "1", "a.c": "2", "x": "3", "x.y": "4"})
+	want := map[string]any{
+		"a":   map[string]any{"b": "1", "c": "2"},
+		"x":   "3",
+		"x.y": "4",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -2,87 +2,389 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 
 	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
 )
 
-// SyncDirs recursively synchronizes two directories.
+// SyncChanges lists the paths SyncDirs changed in the destination, relative to it and with forward slashes
+type SyncChanges struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+	// Preserved are the paths of the destination left alone since they're gitignored in the source or
+	// protected by its .gitsync.yaml, directories ending with /. They aren't changes
+	Preserved []string `json:"preserved,omitempty"`
+}
+
+// Empty is true if nothing changed
+func (c SyncChanges) Empty() bool {
+	return len(c.Added) == 0 && len(c.Modified) == 0 && len(c.Removed) == 0
+}
+
+// reversed are the changes undoing these ones
+func (c SyncChanges) reversed() SyncChanges {
+	return SyncChanges{Added: c.Removed, Modified: c.Modified, Removed: c.Added, Preserved: c.Preserved}
+}
+
+// SyncDirs recursively synchronizes two directories, returning what changed in the destination.
+//
+// Both are walked once, together, comparing their files before anything is written. Then, delete all
+// items in the destination that don't match the source: either they don't exist in the source, or
+// are files in the destination and directories in the source or vice-versa. However, items that are
+// .gitignored in the source are preserved in the destination.
+//
+// Then copy all files whose contents differ, overwriting, creating the directories of the source on
+// their way. How long each phase took is exported as metrics.
+//
+// The preserved paths, relative to the destination and with forward slashes, are never deleted
+// either: they're files written into the destination after the sync, like --merge-output.
 //
-// First, delete all items in the destination that don't match the source: either they don't
-// exist in the source, or are files in the destination and directories in the source or vice-versa.
-// However, items that are .gitignored in the source are preserved in the destination.
+// The .git of the source is never copied, and the one of the destination is removed like any other
+// path, unless config keeps it for --include-git-dir.
 //
-// Then copy all files, overwriting. Then, create all directories in the source and recursively
-// sync them too
-func SyncDirs(src, dst string) error {
-	// Load .gitignore patterns from source
-	gitignoreMatcher := loadGitignorePatterns(src)
+// config, from the .gitsync.yaml of the source, may leave paths out of the sync, which are then
+// deleted from the destination like any other, and protect paths in the destination. Its directory
+// policies may keep the extra files of a directory, force the permissions of the files written or
+// render them as templates. It may be nil
+//
+// Nothing is written outside dst: the sync is refused if a symlink in src points outside of it, and a
+// file isn't written if a directory on its way in dst is a symlink leading outside of dst. The symlinks
+// to directories of src are followed, unless they point to a directory they're in, which is refused.
+//
+// Sockets, named pipes and devices are skipped with a warning, in src and in dst, and so are the mount
+// points of other filesystems in dst: they're never removed, nor is anything inside them. A directory
+// that has any of them is emptied around them instead of removed
+func SyncDirs(src, dst string, config *RepoConfig, preserve ...string) (SyncChanges, error) {
+	changes, timings, err := syncDirs(src, dst, config, preserve...)
+	recordSyncTimings(timings)
+	return changes, err
+}
+
+// recordRemoval adds a file or directory of dst about to be removed to the diff summary. The content of
+// a file replaced rather than removed is kept in replacedContents for when it's written again
+func recordRemoval(diffs *DiffSummary, replacedContents map[string][]byte, path, slashPath string, info os.FileInfo, removed bool) error {
+	if info.IsDir() {
+		if removed {
+			return diffs.recordRemovedDir(path, slashPath)
+		}
+		return nil
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if removed {
+		diffs.record(slashPath, content, nil)
+	} else {
+		replacedContents[slashPath] = content
+	}
+	return nil
+}
+
+// recordWrite adds a file about to be written to dst to the diff summary
+func recordWrite(diffs *DiffSummary, replacedContents map[string][]byte, path, dstPath, slashPath string, transformed []byte) error {
+	old, replaced := replacedContents[slashPath]
+	if !replaced {
+		var err error
+		if old, err = os.ReadFile(dstPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	content := transformed
+	if content == nil {
+		var err error
+		if content, err = os.ReadFile(path); err != nil {
+			return err
+		}
+	}
+	diffs.record(slashPath, old, content)
+	return nil
+}
 
-	// Delete items in the destination that don't match the source
+// makeParents creates the missing directories on the way to a file, applying their --chown-rule
+func makeParents(dst, slashPath string, config *RepoConfig) error {
+	parts := strings.Split(slashPath, "/")
+	for i := 1; i < len(parts); i++ {
+		slashDir := strings.Join(parts[:i], "/")
+		dir := filepath.Join(dst, filepath.FromSlash(slashDir))
+		if _, err := os.Lstat(dir); err == nil {
+			continue
+		}
+		if err := os.MkdirAll(dir, DirMode); err != nil {
+			return fmt.Errorf("failed to create dst dir %s: %w", dir, err)
+		}
+		if err := config.applyOwnership(dir, slashDir, true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneEmptyDirs removes the directories left empty in dst, deepest first so their parents may be
+// removed too. The ones that are gitignored, protected, preserved or under a policy that doesn't prune
+// are kept, and so is the .git folder
+func pruneEmptyDirs(dst string, config *RepoConfig, gitignoreMatcher gitignore.Matcher, preserved map[string]bool, changes *SyncChanges) error {
+	var dirs []string
+	dstFilesystems := newFilesystems(dst)
 	err := filepath.Walk(dst, func(path string, info os.FileInfo, err error) error {
 		if err != nil {
 			return err
 		}
 		relPath, err := filepath.Rel(dst, path)
 		if err != nil {
-			return fmt.Errorf("failed to relativize path %s inside %s: %w", dst, path, err)
+			return err
 		}
-
-		// Check if this path is gitignored
-		// Convert to forward slashes for gitignore matching
-		gitignorePath := filepath.ToSlash(relPath)
-		if gitignoreMatcher.Match(strings.Split(gitignorePath, "/"), info.IsDir()) {
-			// This file/directory is gitignored, so preserve it in destination
-			if info.IsDir() {
-				return filepath.SkipDir
-			}
+		slashPath := filepath.ToSlash(relPath)
+		if !info.IsDir() || slashPath == "." {
 			return nil
 		}
-
-		srcPath := filepath.Join(src, relPath)
-		srcInfo, err := os.Stat(srcPath)
-
-		if os.IsNotExist(err) || (srcInfo.IsDir() != info.IsDir()) || (IsExecAny(srcInfo) != IsExecAny(info)) {
-			err := os.RemoveAll(path)
-			if err != nil {
-				return fmt.Errorf("failed to remove dst file or dir %s: %w", dst, err)
-			}
+		if isGitMetadata(slashPath) || gitignoreMatcher.Match(strings.Split(slashPath, "/"), true) || config.Protected(slashPath, true) || dstFilesystems.isMountPoint(info) {
+			return filepath.SkipDir
+		}
+		if !preserved[slashPath] && !hasPreservedChild(preserved, slashPath) && config.policy(slashPath).prunes() {
+			dirs = append(dirs, slashPath)
 		}
 		return nil
 	})
-	if err != nil && !os.IsNotExist(err) {
-		return fmt.Errorf("failed to remove non-matching dst dir: %w", err)
+	if err != nil {
+		return fmt.Errorf("failed to look for empty dirs in %s: %w", dst, err)
 	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		path := filepath.Join(dst, filepath.FromSlash(dirs[i]))
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return fmt.Errorf("failed to look for empty dirs in %s: %w", dst, err)
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			return fmt.Errorf("failed to remove the empty dir %s: %w", path, err)
+		}
+		changes.recordRemoved(dirs[i], true)
+	}
+	return nil
+}
 
-	// Copy files and create directories from source to destination
-	err = filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+// transformFile returns what's written for a source file that isn't copied as is: rendered if a
+// policy templates it, stamped if the .gitsync.yaml says so, with its {cipher} values decrypted for
+// --decrypt-on-apply, then with its line endings converted for --eol. It's nil for plain copies
+func transformFile(config *RepoConfig, path, slashPath string) ([]byte, error) {
+	if config == nil {
+		return nil, nil
+	}
+	policy := config.policy(slashPath)
+	templated := policy != nil && policy.Template
+	stamped := config.stamps(slashPath)
+	if !templated && !stamped && config.decrypt == nil && config.eol == nil {
+		return nil, nil
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read source file at %s: %w", path, err)
+	}
+	if templated {
+		if content, err = config.render(slashPath, content); err != nil {
+			return nil, err
+		}
+	}
+	if stamped {
+		content = config.stampTokens(content)
+	}
+	decrypted := false
+	if config.decrypt != nil && bytes.Contains(content, []byte(cipherPrefix)) {
+		if content, err = config.decrypt.DecryptAll(content); err != nil {
+			return nil, fmt.Errorf("failed to decrypt %s: %w", slashPath, err)
+		}
+		decrypted = true
+	}
+	transformed := templated || stamped || decrypted
+	if config.eol != nil {
+		if converted := config.eol.convert(slashPath, content); converted != nil {
+			return converted, nil
+		}
+	}
+	if !transformed {
+		return nil, nil
+	}
+	return content, nil
+}
+
+// applyPolicyMode sets the permissions of a written file to the ones of its directory policy, if any
+func applyPolicyMode(policy *DirPolicy, dst string) error {
+	if policy == nil || policy.mode == 0 {
+		return nil
+	}
+	info, err := os.Stat(dst)
+	if err != nil {
+		return fmt.Errorf("failed to stat dest file at %s: %w", dst, err)
+	}
+	if info.Mode().Perm() == policy.mode {
+		return nil
+	}
+	if err := os.Chmod(dst, policy.mode); err != nil {
+		return fmt.Errorf("failed to chmod dest file at %s: %w", dst, err)
+	}
+	return nil
+}
+
+// safeDestination refuses dstPath if it's outside root, or if a directory on its way is a symlink
+// leading outside of root
+func safeDestination(root, dstPath string) error {
+	relPath, err := filepath.Rel(root, dstPath)
+	if err != nil || !filepath.IsLocal(relPath) {
+		return fmt.Errorf("refusing to write %s, which is outside of %s", dstPath, root)
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if os.IsNotExist(err) {
+		// it's created along with the path, with no symlinks on the way
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to resolve the dst dir %s: %w", root, err)
+	}
+	current := root
+	for _, part := range strings.Split(filepath.Dir(relPath), string(filepath.Separator)) {
+		if part == "." {
+			continue
+		}
+		current = filepath.Join(current, part)
+		info, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			return nil
+		}
 		if err != nil {
 			return err
 		}
-		relPath, err := filepath.Rel(src, path)
-		if err != nil {
-			return fmt.Errorf("failed to relativize %s inside the source %s: %w", src, path, err)
-		}
-		dstPath := filepath.Join(dst, relPath)
-		if info.IsDir() {
-			err := os.MkdirAll(dstPath, 0775)
-			if err != nil {
-				return fmt.Errorf("failed to create dst dir %s: %w", dstPath, err)
-			}
-			return nil
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil || !isInside(target, realRoot) {
+			return fmt.Errorf("refusing to write %s, since %s is a symlink leading outside of %s", dstPath, current, root)
+		}
+	}
+	return nil
+}
+
+// hasPreservedChild is true if a preserved path is inside the directory, which then can't be removed
+func hasPreservedChild(preserved map[string]bool, slashDir string) bool {
+	for p := range preserved {
+		if strings.HasPrefix(p, slashDir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// isGitMetadata is true for paths inside the .git folder, which aren't reported as changes
+func isGitMetadata(slashPath string) bool {
+	return slashPath == ".git" || strings.HasPrefix(slashPath, ".git/")
+}
+
+func (c *SyncChanges) recordAdded(slashPath string) {
+	if !isGitMetadata(slashPath) {
+		c.Added = append(c.Added, slashPath)
+	}
+}
+
+func (c *SyncChanges) recordModified(slashPath string) {
+	if !isGitMetadata(slashPath) {
+		c.Modified = append(c.Modified, slashPath)
+	}
+}
+
+func (c *SyncChanges) recordRemoved(slashPath string, isDir bool) {
+	if isDir {
+		slashPath += "/"
+	}
+	if !isGitMetadata(slashPath) {
+		c.Removed = append(c.Removed, slashPath)
+	}
+}
+
+func (c *SyncChanges) recordPreserved(slashPath string, isDir bool) {
+	if isDir {
+		slashPath += "/"
+	}
+	if !isGitMetadata(slashPath) {
+		c.Preserved = append(c.Preserved, slashPath)
+	}
+}
+
+// sameContents is true if both files exist and have the same bytes
+func sameContents(a, b string) (bool, error) {
+	aInfo, err := os.Stat(a)
+	if err != nil {
+		return false, err
+	}
+	bInfo, err := os.Stat(b)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if aInfo.Size() != bInfo.Size() || bInfo.IsDir() {
+		return false, nil
+	}
+	return sameBytes(a, b, aInfo.Size())
+}
+
+// compareBuffers are reused to compare the files, a half for each
+var compareBuffers = sync.Pool{New: func() any {
+	buf := make([]byte, 64*1024)
+	return &buf
+}}
+
+// sameBytes is true if both files have the same bytes, their sizes being known to be size. Reading
+// exactly that much takes a single read of each small file
+func sameBytes(a, b string, size int64) (bool, error) {
+	aFile, err := os.Open(a)
+	if err != nil {
+		return false, err
+	}
+	defer aFile.Close()
+	bFile, err := os.Open(b)
+	if err != nil {
+		return false, err
+	}
+	defer bFile.Close()
+
+	buf := compareBuffers.Get().(*[]byte)
+	defer compareBuffers.Put(buf)
+	aBuf, bBuf := (*buf)[:len(*buf)/2], (*buf)[len(*buf)/2:]
+	for remaining := size; remaining > 0; {
+		n := int(min(remaining, int64(len(aBuf))))
+		if _, err := io.ReadFull(aFile, aBuf[:n]); err != nil {
+			return false, ignoreShortRead(err)
+		}
+		if _, err := io.ReadFull(bFile, bBuf[:n]); err != nil {
+			return false, ignoreShortRead(err)
 		}
-		mode := info.Mode().Perm()
-		userExecutableBit := mode & 0100
-		if err := copyFile(path, dstPath, userExecutableBit != 0); err != nil {
-			return fmt.Errorf("failed to copy source dir %s to %s: %w", path, dstPath, err)
+		if !bytes.Equal(aBuf[:n], bBuf[:n]) {
+			return false, nil
 		}
+		remaining -= int64(n)
+	}
+	return true, nil
+}
+
+// ignoreShortRead ignores the end of a file that shrank while it was compared, which then differs
+func ignoreShortRead(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
 		return nil
-	})
+	}
 	return err
 }
 
@@ -90,27 +392,31 @@ func SyncDirs(src, dst string) error {
 func copyFile(src, dst string, setExecutableBit bool) error {
 	srcFile, err := os.Open(src)
 	if err != nil {
-		return fmt.Errorf("failed to open source file at %s: %w", srcFile, err)
+		return fmt.Errorf("failed to open source file at %s: %w", src, err)
 	}
 	defer srcFile.Close()
 
 	dstFile, err := os.Create(dst)
 	if err != nil {
-		return fmt.Errorf("failed to create dest file at %s: %w", dstFile, err)
+		return fmt.Errorf("failed to create dest file at %s: %w", dst, err)
 	}
 	defer dstFile.Close()
 
 	_, err = io.Copy(dstFile, srcFile)
 	if err != nil {
-		return fmt.Errorf("failed to copy source file %s to dest file at %s: %w", srcFile, dstFile, err)
+		return fmt.Errorf("failed to copy source file %s to dest file at %s: %w", src, dst, err)
 	}
 	if err := dstFile.Close(); err != nil {
-		return fmt.Errorf("failed to close dest file at %s: %w", dstFile, err)
+		return fmt.Errorf("failed to close dest file at %s: %w", dst, err)
 	}
 	if !setExecutableBit {
 		return nil
 	}
+	return addUserExecutableBit(dst)
+}
 
+// addUserExecutableBit makes the file executable by its owner
+func addUserExecutableBit(dst string) error {
 	// Get current permissions and add user executable bit (like chmod u+x)
 	info, err := os.Stat(dst)
 	if err != nil {
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+)
+
+func TestSyncDirsSpecialFiles(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{"a.conf": "a"})
+	writeTree(t, dst, map[string]string{"old/": ""})
+	for _, fifo := range []string{filepath.Join(src, "src.fifo"), filepath.Join(dst, "dst.fifo"), filepath.Join(dst, "old", "inner.fifo")} {
+		if err := syscall.Mkfifo(fifo, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := SyncDirs(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, kept := range []string{"dst.fifo", "old/inner.fifo"} {
+		if info, err := os.Lstat(filepath.Join(dst, filepath.FromSlash(kept))); err != nil || info.Mode()&os.ModeNamedPipe == 0 {
+			t.Errorf("the named pipe %s of dst wasn't left alone: %v", kept, err)
+		}
+	}
+	if _, err := os.Lstat(filepath.Join(dst, "src.fifo")); !os.IsNotExist(err) {
+		t.Errorf("the named pipe of src was synced")
+	}
+}
+
+func TestSyncDirsMountPoints(t *testing.T) {
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, src, map[string]string{"a.conf": "a"})
+	writeTree(t, dst, map[string]string{"mnt/": ""})
+	mnt := filepath.Join(dst, "mnt")
+	if err := syscall.Mount("tmpfs", mnt, "tmpfs", 0, ""); err != nil {
+		t.Skipf("can't mount a tmpfs to test with: %v", err)
+	}
+	defer syscall.Unmount(mnt, 0)
+	writeTree(t, mnt, map[string]string{"data": "d"})
+
+	changes, err := SyncDirs(src, dst, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Removed) > 0 {
+		t.Errorf("removed %v", changes.Removed)
+	}
+	if got, want := readTree(t, mnt), map[string]string{"data": "d"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("the mount point has %v", sortedKeys(got))
+	}
+}
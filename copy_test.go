@@ -0,0 +1,328 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSafeDestination(t *testing.T) {
+	dir := t.TempDir()
+	root, outside := filepath.Join(dir, "root"), filepath.Join(dir, "outside")
+	writeTree(t, root, map[string]string{"sub/": ""})
+	writeTree(t, outside, map[string]string{"secret.conf": "s"})
+	if err := os.Symlink(outside, filepath.Join(root, "out")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("sub", filepath.Join(root, "in")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join("..", "outside"), filepath.Join(root, "sub", "up")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		root string
+		path string
+		safe bool
+	}{
+		{"file in root", root, "a.conf", true},
+		{"file in a subdirectory", root, "sub/a.conf", true},
+		{"missing directories", root, "new/dir/a.conf", true},
+		{"symlink to a directory inside", root, "in/a.conf", true},
+		{"missing root", filepath.Join(dir, "missing"), "a/b.conf", true},
+		{"parent of root", root, "../a.conf", false},
+		{"dot dot in the middle", root, "sub/../../outside/a.conf", false},
+		{"absolute symlink leading outside", root, "out/a.conf", false},
+		{"relative symlink leading outside", root, "sub/up/a.conf", false},
+		{"deeper under a symlink leading outside", root, "out/new/a.conf", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// not joined, which would clean the .. away
+			dstPath := test.root + string(filepath.Separator) + filepath.FromSlash(test.path)
+			err := safeDestination(test.root, dstPath)
+			if test.safe && err != nil {
+				t.Errorf("refused %s: %v", test.path, err)
+			}
+			if !test.safe && err == nil {
+				t.Errorf("accepted %s", test.path)
+			}
+		})
+	}
+}
+
+func TestSyncDirsSymlinks(t *testing.T) {
+	tests := []struct {
+		name string
+		// links are created in src after the files, by their path, pointing to their target
+		links map[string]string
+		want  map[string]string
+		err   string
+	}{
+		{
+			name:  "file inside src",
+			links: map[string]string{"link.conf": "a/a.conf"},
+			want:  map[string]string{"a/": "", "a/a.conf": "a", "link.conf": "a"},
+		},
+		{
+			name:  "directory inside src",
+			links: map[string]string{"b": "a"},
+			want:  map[string]string{"a/": "", "a/a.conf": "a", "b/": "", "b/a.conf": "a"},
+		},
+		{
+			name:  "relative link outside src",
+			links: map[string]string{"escape.conf": "../outside.conf"},
+			err:   "points outside of the repo",
+		},
+		{
+			name:  "absolute link outside src",
+			links: map[string]string{"shadow": "/etc"},
+			err:   "points outside of the repo",
+		},
+		{
+			name:  "broken link",
+			links: map[string]string{"broken.conf": "missing.conf"},
+			err:   "broken symlink",
+		},
+		{
+			name:  "directory it's in",
+			links: map[string]string{"a/self": ".."},
+			err:   "points to a directory it's in",
+		},
+		{
+			name:  "loop through two links",
+			links: map[string]string{"a/to-c": "../c", "c/to-a": "../a"},
+			err:   "points to a directory it's in",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			src, dst := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+			writeTree(t, src, map[string]string{"a/a.conf": "a"})
+			writeTree(t, dir, map[string]string{"outside.conf": "secret"})
+			for link, target := range test.links {
+				path := filepath.Join(src, filepath.FromSlash(link))
+				os.MkdirAll(filepath.Dir(path), 0o755)
+				if err := os.Symlink(filepath.FromSlash(target), path); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err := SyncDirs(src, dst, nil)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one with %q", err, test.err)
+				}
+				if _, statErr := os.Stat(dst); !os.IsNotExist(statErr) {
+					t.Errorf("dst was written before the sync was refused")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, dst); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("synced %v, want %v", sortedKeys(got), sortedKeys(test.want))
+			}
+		})
+	}
+}
+
+func TestSyncDirsSymlinkInDst(t *testing.T) {
+	dir := t.TempDir()
+	src, dst, outside := filepath.Join(dir, "src"), filepath.Join(dir, "dst"), filepath.Join(dir, "outside")
+	writeTree(t, src, map[string]string{"sub/f.conf": "f"})
+	writeTree(t, outside, map[string]string{"keep.conf": "k"})
+	os.MkdirAll(dst, 0o755)
+	if err := os.Symlink(outside, filepath.Join(dst, "sub")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SyncDirs(src, dst, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readTree(t, outside), map[string]string{"keep.conf": "k"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("wrote outside of dst through a symlink: %v", sortedKeys(got))
+	}
+	if info, err := os.Lstat(filepath.Join(dst, "sub")); err != nil || !info.IsDir() {
+		t.Errorf("the symlink of dst wasn't replaced by a directory: %v", err)
+	}
+}
+
+// syncTest syncs the src tree over the dst tree, with the .gitsync.yaml of src if it has one
+func syncTest(t *testing.T, src, dst map[string]string, configure func(config *RepoConfig), preserve ...string) (string, SyncChanges, error) {
+	t.Helper()
+	dir := t.TempDir()
+	srcDir, dstDir := filepath.Join(dir, "src"), filepath.Join(dir, "dst")
+	writeTree(t, srcDir, src)
+	writeTree(t, dstDir, dst)
+	os.MkdirAll(srcDir, 0o755)
+	os.MkdirAll(dstDir, 0o755)
+	config, err := LoadRepoConfig(os.DirFS(srcDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configure != nil {
+		configure(config)
+	}
+	changes, err := SyncDirs(srcDir, dstDir, config, preserve...)
+	return dstDir, changes, err
+}
+
+func TestSyncDirs(t *testing.T) {
+	tests := []struct {
+		name      string
+		src       map[string]string
+		dst       map[string]string
+		configure func(config *RepoConfig)
+		preserve  []string
+		want      map[string]string
+		changes   SyncChanges
+	}{
+		{
+			name: "added, modified and removed",
+			src:  map[string]string{"a.conf": "a2", "same.conf": "s", "sub/b.conf": "b"},
+			dst:  map[string]string{"a.conf": "a1", "same.conf": "s", "old.conf": "o", "gone/c.conf": "c"},
+			want: map[string]string{"a.conf": "a2", "same.conf": "s", "sub/": "", "sub/b.conf": "b"},
+			changes: SyncChanges{
+				Added:    []string{"sub/b.conf"},
+				Modified: []string{"a.conf"},
+				Removed:  []string{"gone/", "old.conf"},
+			},
+		},
+		{
+			name:     "gitignored and preserved paths",
+			src:      map[string]string{".gitignore": "*.log\ncache/\n", "a.conf": "a"},
+			dst:      map[string]string{"app.log": "l", "cache/x": "x", "merged.yaml": "m", "stale.conf": "s"},
+			preserve: []string{"merged.yaml"},
+			want:     map[string]string{".gitignore": "*.log\ncache/\n", "a.conf": "a", "app.log": "l", "cache/": "", "cache/x": "x", "merged.yaml": "m"},
+			changes: SyncChanges{
+				Added:     []string{".gitignore", "a.conf"},
+				Removed:   []string{"stale.conf"},
+				Preserved: []string{"app.log", "cache/"},
+			},
+		},
+		{
+			name:    "protected paths",
+			src:     map[string]string{".gitsync.yaml": "protect: [local.conf]\n", "local.conf": "repo"},
+			dst:     map[string]string{".gitsync.yaml": "protect: [local.conf]\n", "local.conf": "edited"},
+			want:    map[string]string{".gitsync.yaml": "protect: [local.conf]\n", "local.conf": "edited"},
+			changes: SyncChanges{Preserved: []string{"local.conf"}},
+		},
+		{
+			name: "keep markers",
+			src:  map[string]string{"a.conf": "a"},
+			dst:  map[string]string{"a.conf": "a", "empty/": "", "kept/.keep": "", "kept/old.conf": "o"},
+			configure: func(config *RepoConfig) {
+				config.pruneEmpty = true
+				config.keepMarkers = []string{".keep"}
+			},
+			want:    map[string]string{"a.conf": "a", "kept/": "", "kept/.keep": ""},
+			changes: SyncChanges{Removed: []string{"kept/old.conf", "empty/"}},
+		},
+		{
+			name: "files replaced by directories and directories by files",
+			src:  map[string]string{"x": "file", "y/z": "inside"},
+			dst:  map[string]string{"x/inner": "i", "y": "file"},
+			want: map[string]string{"x": "file", "y/": "", "y/z": "inside"},
+			// the replaced paths are modified rather than removed
+			changes: SyncChanges{
+				Added:    []string{"y/z"},
+				Modified: []string{"x"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst, changes, err := syncTest(t, test.src, test.dst, test.configure, test.preserve...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readTree(t, dst); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("synced %v, want %v", sortedKeys(got), sortedKeys(test.want))
+			}
+			if !reflect.DeepEqual(normalizeChanges(changes), normalizeChanges(test.changes)) {
+				t.Errorf("changes are %+v, want %+v", changes, test.changes)
+			}
+		})
+	}
+}
+
+// normalizeChanges sorts the changes, leaving out the empty lists
+func normalizeChanges(changes SyncChanges) [][]string {
+	var lists [][]string
+	for _, list := range [][]string{changes.Added, changes.Modified, changes.Removed, changes.Preserved} {
+		sorted := append([]string{}, list...)
+		sort.Strings(sorted)
+		lists = append(lists, sorted)
+	}
+	return lists
+}
+
+func BenchmarkSyncDirs(b *testing.B) {
+	const files = 10000
+	dir := b.TempDir()
+	src := filepath.Join(dir, "src")
+	if err := writeBenchTree(src, 0, files); err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("new", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			dst := filepath.Join(dir, "new")
+			if err := os.RemoveAll(dst); err != nil {
+				b.Fatal(err)
+			}
+			b.StartTimer()
+			if _, err := SyncDirs(src, dst, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("unchanged", func(b *testing.B) {
+		dst := filepath.Join(dir, "unchanged")
+		if _, err := SyncDirs(src, dst, nil); err != nil {
+			b.Fatal(err)
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := SyncDirs(src, dst, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestSyncDirsDecrypt(t *testing.T) {
+	c, err := NewCipher("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	password, err := c.Encrypt([]byte("s3cret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst, _, err := syncTest(t, map[string]string{"db.conf": "password = " + password + "\n", "plain.conf": "p"}, nil, func(config *RepoConfig) {
+		config.decrypt = c
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := readTree(t, dst), map[string]string{"db.conf": "password = s3cret\n", "plain.conf": "p"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("synced %v, want %v", got, want)
+	}
+
+	other, _ := NewCipher("other key")
+	_, _, err = syncTest(t, map[string]string{"db.conf": "password = " + password + "\n"}, nil, func(config *RepoConfig) {
+		config.decrypt = other
+	})
+	if err == nil {
+		t.Errorf("synced a value encrypted with another key")
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+)
+
+// errDependencyFailed marks the nodes not run because one of their dependencies failed
+var errDependencyFailed = errors.New("dependency failed")
+
+// checkDAG checks that the dependencies are known nodes, or satisfy known, and that they have no cycles
+func checkDAG(nodes []string, deps map[string][]string, known func(name string) bool) error {
+	isNode := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		isNode[node] = true
+	}
+	for _, node := range nodes {
+		for _, dep := range deps[node] {
+			if !isNode[dep] && (known == nil || !known(dep)) {
+				return fmt.Errorf("%s depends on %s, which isn't defined", node, dep)
+			}
+		}
+	}
+
+	const (
+		visiting = 1
+		visited  = 2
+	)
+	state := make(map[string]int, len(nodes))
+	var visit func(node string, path []string) error
+	visit = func(node string, path []string) error {
+		switch state[node] {
+		case visiting:
+			return fmt.Errorf("dependency cycle: %v", append(path, node))
+		case visited:
+			return nil
+		}
+		state[node] = visiting
+		for _, dep := range deps[node] {
+			if isNode[dep] {
+				if err := visit(dep, append(path, node)); err != nil {
+					return err
+				}
+			}
+		}
+		state[node] = visited
+		return nil
+	}
+	for _, node := range nodes {
+		if err := visit(node, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runDAG runs every node once its dependencies among the nodes succeeded, as many at once as it can.
+// Dependencies outside the nodes are taken as satisfied. The nodes depending on a failed one aren't run.
+// It returns the errors of the nodes that failed, in the order of the nodes
+func runDAG(ctx context.Context, nodes []string, deps map[string][]string, run func(ctx context.Context, node string) error) error {
+	done := make(map[string]chan struct{}, len(nodes))
+	for _, node := range nodes {
+		done[node] = make(chan struct{})
+	}
+	var mu sync.Mutex
+	errs := make(map[string]error, len(nodes))
+
+	var wg sync.WaitGroup
+	for _, node := range nodes {
+		node := node
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(done[node])
+			var err error
+			for _, dep := range deps[node] {
+				ch, ok := done[dep]
+				if !ok {
+					continue
+				}
+				<-ch
+				mu.Lock()
+				depErr := errs[dep]
+				mu.Unlock()
+				if depErr != nil {
+					log.Printf("skipping %s, since %s failed\n", node, dep)
+					err = errDependencyFailed
+					break
+				}
+			}
+			if err == nil {
+				err = run(ctx, node)
+			}
+			if err != nil {
+				mu.Lock()
+				errs[node] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var failed []error
+	for _, node := range nodes {
+		if err := errs[node]; err != nil && err != errDependencyFailed {
+			failed = append(failed, err)
+		}
+	}
+	return errors.Join(failed...)
+}
+
+// topoSort orders the nodes after their dependencies, keeping their order otherwise. The dependencies
+// must have been checked by checkDAG
+func topoSort(nodes []string, deps map[string][]string) []string {
+	placed := make(map[string]bool, len(nodes))
+	isNode := make(map[string]bool, len(nodes))
+	for _, node := range nodes {
+		isNode[node] = true
+	}
+	sorted := make([]string, 0, len(nodes))
+	for len(sorted) < len(nodes) {
+		for _, node := range nodes {
+			if placed[node] {
+				continue
+			}
+			ready := true
+			for _, dep := range deps[node] {
+				if isNode[dep] && !placed[dep] {
+					ready = false
+				}
+			}
+			if ready {
+				placed[node] = true
+				sorted = append(sorted, node)
+			}
+		}
+	}
+	return sorted
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// setupDataDir confines the writes outside the local folder to dir, so the root filesystem can be
+// read-only. Temporary clones and the ref cache go to dir/tmp, which is made the temporary directory
+// of this process and of the commands and hooks it runs. Leftovers from a previous run are removed
+func setupDataDir(dir string) error {
+	tmp, err := filepath.Abs(filepath.Join(dir, "tmp"))
+	if err != nil {
+		return err
+	}
+	if err := os.RemoveAll(tmp); err != nil {
+		return fmt.Errorf("failed to clean %s: %w", tmp, err)
+	}
+	if err := os.MkdirAll(tmp, 0o700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", tmp, err)
+	}
+
+	// os.TempDir reads TMPDIR on Unix and TMP or TEMP on Windows
+	for _, name := range []string{"TMPDIR", "TMP", "TEMP"} {
+		if err := os.Setenv(name, tmp); err != nil {
+			return err
+		}
+	}
+	log.Printf("writing temporary files to %s\n", tmp)
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+// DeployTagger moves a lightweight tag of the config repo, like deployed/<host>, to every commit applied
+// successfully, so the repo records what's live. Pushes run in the background, and a push is dropped
+// if a newer commit was applied in the meantime
+type DeployTagger struct {
+	Tag     string
+	gitRepo *GitRepo
+
+	mu     sync.Mutex
+	latest string
+}
+
+// DeployTag tags the applied commits with --deploy-tag, if set
+var DeployTag *DeployTagger
+
+// NewDeployTagger renders the {{.Host}} placeholder of the tag, returning nil without a tag
+func NewDeployTagger(gitRepo *GitRepo, tag string) (*DeployTagger, error) {
+	if tag == "" {
+		return nil, nil
+	}
+	tmpl, err := template.New("--deploy-tag").Option("missingkey=error").Parse(tag)
+	if err != nil {
+		return nil, fmt.Errorf("invalid placeholders in --deploy-tag: %w", err)
+	}
+	host, _ := os.Hostname()
+	var b strings.Builder
+	if err := tmpl.Execute(&b, struct{ Host string }{host}); err != nil {
+		return nil, fmt.Errorf("invalid placeholders in --deploy-tag: %w", err)
+	}
+	if b.Len() == 0 || strings.ContainsAny(b.String(), " ~^:?*[\\") || strings.Contains(b.String(), "..") {
+		return nil, fmt.Errorf("invalid --deploy-tag %q, not a valid tag name", b.String())
+	}
+	return &DeployTagger{Tag: b.String(), gitRepo: gitRepo}, nil
+}
+
+// Push moves the tag to the commit in the background. A nil tagger pushes nothing
+func (t *DeployTagger) Push(commit string) {
+	if t == nil || commit == "" {
+		return
+	}
+	t.mu.Lock()
+	t.latest = commit
+	t.mu.Unlock()
+	go func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		if commit != t.latest {
+			return
+		}
+		if err := t.push(context.Background(), commit); err != nil {
+			log.Printf("failed to push tag %s: %v\n", t.Tag, err)
+			return
+		}
+		log.Printf("tag %s moved to commit %s\n", t.Tag, shortCommit(commit))
+	}()
+}
+
+// push fetches the branch, the full history if the commit isn't its head anymore, so the tag can point
+// to a commit the remote already has
+func (t *DeployTagger) push(ctx context.Context, commit string) error {
+	auth := &http.BasicAuth{Username: t.gitRepo.username, Password: t.gitRepo.password}
+	options := &git.CloneOptions{
+		URL:           t.gitRepo.URL,
+		Depth:         1,
+		SingleBranch:  true,
+		NoCheckout:    true,
+		ReferenceName: plumbing.NewBranchReferenceName(t.gitRepo.Branch),
+		Auth:          auth,
+	}
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), nil, options)
+	if err != nil {
+		return err
+	}
+	hash := plumbing.NewHash(commit)
+	if _, err := repo.CommitObject(hash); err != nil {
+		options.Depth = 0
+		options.SingleBranch = false
+		if repo, err = git.CloneContext(ctx, memory.NewStorage(), nil, options); err != nil {
+			return err
+		}
+		if _, err := repo.CommitObject(hash); err != nil {
+			return fmt.Errorf("commit %s not found: %w", commit, err)
+		}
+	}
+
+	refName := plumbing.NewTagReferenceName(t.Tag)
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(refName, hash)); err != nil {
+		return err
+	}
+	err = repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec("+" + refName + ":" + refName)},
+		Auth:       auth,
+	})
+	if err == git.NoErrAlreadyUpToDate {
+		return nil
+	}
+	return err
+}
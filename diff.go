@@ -0,0 +1,366 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/utils/diff"
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+const (
+	// diffTimeout bounds the time spent diffing a single file, after which the diff may not be minimal
+	diffTimeout = time.Second
+	// diffContextLines are the unchanged lines shown around the changes in the unified diffs
+	diffContextLines = 3
+	// maxSummaryFiles is how many files the summary lists, the others are only counted
+	maxSummaryFiles = 50
+)
+
+// statusLetters are the ones git status uses for the file statuses
+var statusLetters = map[string]byte{"added": 'A', "modified": 'M', "removed": 'D', "renamed": 'R'}
+
+// FileDiff describes how a synced file changed
+type FileDiff struct {
+	Path string `json:"path"`
+	// From is the previous path of a renamed file
+	From string `json:"from,omitempty"`
+	// Status is added, modified, removed or renamed
+	Status       string `json:"status"`
+	LinesAdded   int    `json:"lines_added"`
+	LinesRemoved int    `json:"lines_removed"`
+	Binary       bool   `json:"binary,omitempty"`
+
+	hash  [sha256.Size]byte
+	patch string
+}
+
+// DiffSummary collects how the files changed in a sync, for the logs and notifications. The unified
+// diffs are only kept with patches set
+type DiffSummary struct {
+	Files   []FileDiff
+	patches bool
+}
+
+// record adds the change of a file, old or new being nil if it didn't exist before or after
+func (d *DiffSummary) record(slashPath string, old, new []byte) {
+	if d == nil || isGitMetadata(slashPath) {
+		return
+	}
+	file := FileDiff{Path: slashPath, Status: "modified"}
+	switch {
+	case old == nil:
+		file.Status = "added"
+		file.hash = sha256.Sum256(new)
+	case new == nil:
+		file.Status = "removed"
+		file.hash = sha256.Sum256(old)
+	}
+	file.Binary = isBinary(old) || isBinary(new)
+	if !file.Binary {
+		diffs := diff.DoWithTimeout(string(old), string(new), diffTimeout)
+		for _, change := range diffs {
+			switch change.Type {
+			case diffmatchpatch.DiffInsert:
+				file.LinesAdded += strings.Count(change.Text, "\n") + missingNewline(change.Text)
+			case diffmatchpatch.DiffDelete:
+				file.LinesRemoved += strings.Count(change.Text, "\n") + missingNewline(change.Text)
+			}
+		}
+		if d.patches {
+			file.patch = unifiedDiff(slashPath, old == nil, new == nil, diffs)
+		}
+	}
+	d.Files = append(d.Files, file)
+}
+
+// recordRemovedDir adds the files of a directory about to be removed
+func (d *DiffSummary) recordRemovedDir(dir, slashDir string) error {
+	if d == nil {
+		return nil
+	}
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.Type().IsRegular() {
+			return err
+		}
+		relPath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		d.record(slashDir+"/"+filepath.ToSlash(relPath), content, nil)
+		return nil
+	})
+}
+
+// finish pairs the removed and added files with the same content as renames, and sorts the files
+func (d *DiffSummary) finish() {
+	if d == nil {
+		return
+	}
+	removed := make(map[[sha256.Size]byte]int)
+	for i, file := range d.Files {
+		if file.Status == "removed" {
+			removed[file.hash] = i
+		}
+	}
+	dropped := make(map[int]bool)
+	for i, file := range d.Files {
+		j, ok := removed[file.hash]
+		if file.Status != "added" || !ok || dropped[j] {
+			continue
+		}
+		d.Files[i] = FileDiff{Path: file.Path, From: d.Files[j].Path, Status: "renamed", Binary: file.Binary}
+		dropped[j] = true
+	}
+	files := d.Files[:0]
+	for i, file := range d.Files {
+		if !dropped[i] {
+			files = append(files, file)
+		}
+	}
+	d.Files = files
+	sort.Slice(d.Files, func(i, j int) bool {
+		return d.Files[i].Path < d.Files[j].Path
+	})
+}
+
+// reversed is the diff undoing this one, from the new files back to the old ones
+func (d *DiffSummary) reversed() *DiffSummary {
+	if d == nil {
+		return nil
+	}
+	reversed := &DiffSummary{Files: make([]FileDiff, len(d.Files)), patches: d.patches}
+	for i, file := range d.Files {
+		file.LinesAdded, file.LinesRemoved = file.LinesRemoved, file.LinesAdded
+		switch file.Status {
+		case "added":
+			file.Status = "removed"
+		case "removed":
+			file.Status = "added"
+		case "renamed":
+			file.Path, file.From = file.From, file.Path
+		}
+		file.patch = reversedPatch(file.patch)
+		reversed.Files[i] = file
+	}
+	sort.Slice(reversed.Files, func(i, j int) bool {
+		return reversed.Files[i].Path < reversed.Files[j].Path
+	})
+	return reversed
+}
+
+// reversedPatch swaps the sides of a unified diff of unifiedDiff
+func reversedPatch(patch string) string {
+	var b strings.Builder
+	lines := strings.SplitAfter(patch, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			from, to := strings.TrimPrefix(line, "--- "), strings.TrimPrefix(lines[i+1], "+++ ")
+			from, to = swapDiffSide(to, "b/", "a/"), swapDiffSide(from, "a/", "b/")
+			b.WriteString("--- " + from + "+++ " + to)
+			i++
+		case strings.HasPrefix(line, "@@ "):
+			var oldStart, oldCount, newStart, newCount int
+			if _, err := fmt.Sscanf(line, "@@ -%d,%d +%d,%d @@", &oldStart, &oldCount, &newStart, &newCount); err != nil {
+				b.WriteString(line)
+				continue
+			}
+			fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n", newStart, newCount, oldStart, oldCount)
+		case strings.HasPrefix(line, "+"):
+			b.WriteString("-" + line[1:])
+		case strings.HasPrefix(line, "-"):
+			b.WriteString("+" + line[1:])
+		default:
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// swapDiffSide changes the a/ or b/ prefix of a path of a patch header, leaving /dev/null alone
+func swapDiffSide(header, prefix, swapped string) string {
+	if rest, ok := strings.CutPrefix(header, prefix); ok {
+		return swapped + rest
+	}
+	return header
+}
+
+// Lines returns the lines added and removed across the files
+func (d *DiffSummary) Lines() (added, removed int) {
+	if d == nil {
+		return 0, 0
+	}
+	for _, file := range d.Files {
+		added += file.LinesAdded
+		removed += file.LinesRemoved
+	}
+	return added, removed
+}
+
+// Renamed counts the renamed files
+func (d *DiffSummary) Renamed() int {
+	renamed := 0
+	if d != nil {
+		for _, file := range d.Files {
+			if file.Status == "renamed" {
+				renamed++
+			}
+		}
+	}
+	return renamed
+}
+
+// String is a concise summary, a line with the totals then one per file, like M app.conf (+2 -1)
+func (d *DiffSummary) String() string {
+	if d == nil || len(d.Files) == 0 {
+		return "no files changed"
+	}
+	added, removed := d.Lines()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d files changed, +%d -%d", len(d.Files), added, removed)
+	if renamed := d.Renamed(); renamed > 0 {
+		fmt.Fprintf(&b, ", %d renamed", renamed)
+	}
+	for i, file := range d.Files {
+		if i == maxSummaryFiles {
+			fmt.Fprintf(&b, "\n  ... and %d more", len(d.Files)-i)
+			break
+		}
+		b.WriteString("\n  ")
+		switch {
+		case file.Status == "renamed":
+			fmt.Fprintf(&b, "R %s -> %s", file.From, file.Path)
+		case file.Binary:
+			fmt.Fprintf(&b, "%c %s (binary)", statusLetters[file.Status], file.Path)
+		default:
+			fmt.Fprintf(&b, "%c %s (+%d -%d)", statusLetters[file.Status], file.Path, file.LinesAdded, file.LinesRemoved)
+		}
+	}
+	return b.String()
+}
+
+// Patch returns the unified diffs of the files, cut at limit bytes
+func (d *DiffSummary) Patch(limit int) string {
+	if d == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, file := range d.Files {
+		b.WriteString(file.patch)
+	}
+	patch := b.String()
+	if limit > 0 && len(patch) > limit {
+		cut := strings.LastIndexByte(patch[:limit], '\n') + 1
+		patch = patch[:cut] + fmt.Sprintf("... %d more bytes of diff not shown\n", len(patch)-cut)
+	}
+	return patch
+}
+
+// isBinary is true for content with a NUL byte at its start, like git decides
+func isBinary(content []byte) bool {
+	return bytes.IndexByte(content[:min(len(content), binarySniffLen)], 0) >= 0
+}
+
+func missingNewline(text string) int {
+	if text != "" && !strings.HasSuffix(text, "\n") {
+		return 1
+	}
+	return 0
+}
+
+// diffLine is a line of a unified diff, with its ' ', '-' or '+' prefix
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// unifiedDiff formats the line diffs of a file in the unified format, with diffContextLines lines of
+// context around the hunks
+func unifiedDiff(slashPath string, added, removed bool, diffs []diffmatchpatch.Diff) string {
+	var lines []diffLine
+	for _, change := range diffs {
+		op := byte(' ')
+		switch change.Type {
+		case diffmatchpatch.DiffInsert:
+			op = '+'
+		case diffmatchpatch.DiffDelete:
+			op = '-'
+		}
+		for _, line := range strings.SplitAfter(change.Text, "\n") {
+			if line != "" {
+				lines = append(lines, diffLine{op: op, text: strings.TrimSuffix(line, "\n")})
+			}
+		}
+	}
+
+	var b strings.Builder
+	from, to := "a/"+slashPath, "b/"+slashPath
+	if added {
+		from = "/dev/null"
+	}
+	if removed {
+		to = "/dev/null"
+	}
+	fmt.Fprintf(&b, "--- %s\n+++ %s\n", from, to)
+	oldLine, newLine := 1, 1
+	for start := 0; start < len(lines); {
+		first := start
+		for first < len(lines) && lines[first].op == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		// the hunk goes on while the next change is close enough for the contexts to touch
+		last := first
+		for i := first; i < len(lines) && i <= last+2*diffContextLines; i++ {
+			if lines[i].op != ' ' {
+				last = i
+			}
+		}
+		hunkStart := max(start, first-diffContextLines)
+		hunkEnd := min(len(lines), last+diffContextLines+1)
+		// what's skipped before the hunk is unchanged
+		oldLine += hunkStart - start
+		newLine += hunkStart - start
+		oldCount, newCount := 0, 0
+		var hunk strings.Builder
+		for _, line := range lines[hunkStart:hunkEnd] {
+			if line.op != '+' {
+				oldCount++
+			}
+			if line.op != '-' {
+				newCount++
+			}
+			hunk.WriteByte(line.op)
+			hunk.WriteString(line.text)
+			hunk.WriteByte('\n')
+		}
+		fmt.Fprintf(&b, "@@ -%d,%d +%d,%d @@\n%s", hunkStartLine(oldLine, oldCount), oldCount, hunkStartLine(newLine, newCount), newCount, hunk.String())
+		oldLine += oldCount
+		newLine += newCount
+		start = hunkEnd
+	}
+	return b.String()
+}
+
+// hunkStartLine is 0 for an empty side of a hunk, like diff does
+func hunkStartLine(line, count int) int {
+	if count == 0 {
+		return line - 1
+	}
+	return line
+}
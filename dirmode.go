@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+)
+
+// DirMode is the mode of the directories created in the local folder, like mkdir masked by the umask
+var DirMode os.FileMode = 0o775
+
+// parsePermissions parses the octal permissions of an option, like 0750
+func parsePermissions(option, value string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || m > 0o777 {
+		return 0, fmt.Errorf("invalid --%s %q, expected octal permissions like 0750", option, value)
+	}
+	return os.FileMode(m), nil
+}
+
+// applyUmask sets the umask of the process, for the files and directories written by the syncs, the
+// hooks and the application, logging the one it replaces
+func applyUmask(value string) error {
+	if !umaskSupported {
+		return fmt.Errorf("--umask isn't supported on this platform")
+	}
+	mask, err := parsePermissions("umask", value)
+	if err != nil {
+		return err
+	}
+	previous := setUmask(int(mask))
+	if previous != int(mask) {
+		log.Printf("umask changed from %04o to %04o\n", previous, mask)
+	}
+	return nil
+}
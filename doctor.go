@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/jessevdk/go-flags"
+)
+
+// doctorTimeout bounds each network check of doctor
+const doctorTimeout = 30 * time.Second
+
+// DoctorCommand checks the options like the startup does, times the remote, checks the webhook server
+// and prints the effective configuration, to troubleshoot a setup
+type DoctorCommand struct {
+	WebhookURL string `long:"webhook-url" description:"Public URL of the webhook server, like https://config.example.com, to check it's reachable from here"`
+}
+
+func addDoctorCommand(parser *flags.Parser) {
+	_, err := parser.AddCommand(
+		"doctor",
+		"Troubleshoot the setup",
+		"Runs the startup checks with the given options, times listing the refs of the remote and a shallow clone, checks the webhook server and prints the effective configuration, secrets masked. Pass the command after -- to check it too",
+		&DoctorCommand{},
+	)
+	CheckErr(err)
+}
+
+func (c *DoctorCommand) Execute(args []string) error {
+	// subcommands run before main expands the options
+	if err := expandOptions(&Options); err != nil {
+		return err
+	}
+	var err error
+	if DirMode, err = parsePermissions("dir-mode", Options.DirMode); err != nil {
+		return err
+	}
+	if Stages, err = NewStageSettings(Options.PreUpdateRunner, Options.LocalFolder, Options.HookRunners, Options.HookWorkDirs); err != nil {
+		return err
+	}
+	gitRepo := NewGitRepo(Options.RepoUrl, Options.RepoBranch, Options.RepoFolder, Options.Username, Options.Password)
+	gitRepo.Ref = Options.Ref
+	for _, source := range Options.Sources {
+		parsed, err := ParseSource(source, Options.Username, Options.Password)
+		if err != nil {
+			return err
+		}
+		gitRepo.Sources = append(gitRepo.Sources, parsed)
+	}
+	if err := checkSourceDirs(gitRepo.Sources); err != nil {
+		return err
+	}
+	ctx := context.Background()
+	failures := 0
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "CHECK\tRESULT")
+	for _, check := range startupChecks(gitRepo, args) {
+		checkCtx, cancel := context.WithTimeout(ctx, doctorTimeout)
+		err := check.run(checkCtx)
+		cancel()
+		var transient *transientRemoteError
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "%s\tok\n", check.name)
+		case errors.As(err, &transient):
+			fmt.Fprintf(w, "%s\twarning: %v\n", check.name, err)
+		default:
+			fmt.Fprintf(w, "%s\tFAILED: %v\n", check.name, err)
+			failures++
+		}
+	}
+	for _, timing := range c.timeRemote(ctx, gitRepo) {
+		fmt.Fprintln(w, timing)
+	}
+	for _, result := range c.checkWebhook(ctx) {
+		if strings.Contains(result, "FAILED") {
+			failures++
+		}
+		fmt.Fprintln(w, result)
+	}
+	w.Flush()
+
+	fmt.Println()
+	printEffectiveConfig(os.Stdout)
+
+	if failures > 0 {
+		return fmt.Errorf("%d checks failed", failures)
+	}
+	return nil
+}
+
+// timeRemote times listing the refs of the remote and a shallow clone of the branch, as table rows
+func (c *DoctorCommand) timeRemote(ctx context.Context, gitRepo *GitRepo) []string {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	started := time.Now()
+	if _, err := gitRepo.listRefs(ctx, 0); err != nil {
+		return []string{fmt.Sprintf("ls-remote\tskipped: %v", err)}
+	}
+	rows := []string{fmt.Sprintf("ls-remote\t%v", time.Since(started).Round(time.Millisecond))}
+
+	refName := plumbing.NewBranchReferenceName(gitRepo.Branch)
+	if gitRepo.Ref != "" {
+		if _, name, err := gitRepo.ResolveRef(ctx, gitRepo.Ref); err == nil && name != "" {
+			refName = name
+		}
+	}
+	dir, err := os.MkdirTemp("", "git-config-doctor")
+	if err != nil {
+		return append(rows, fmt.Sprintf("shallow clone\tFAILED: %v", err))
+	}
+	defer os.RemoveAll(dir)
+	started = time.Now()
+	if _, err := gitRepo.clone(ctx, dir, 1, refName, nil); err != nil {
+		return append(rows, fmt.Sprintf("shallow clone\tFAILED: %v", err))
+	}
+	size := folderSize(os.DirFS(dir))
+	return append(rows, fmt.Sprintf("shallow clone\t%v, %s", time.Since(started).Round(time.Millisecond), formatBytes(size)))
+}
+
+// checkWebhook checks the port of the webhook server is free or taken by a running instance, and that
+// --webhook-url reaches one, as table rows
+func (c *DoctorCommand) checkWebhook(ctx context.Context) []string {
+	var rows []string
+	if Options.WebhookPort > 0 {
+		address := fmt.Sprintf(":%d", Options.WebhookPort)
+		if listener, err := net.Listen("tcp", address); err == nil {
+			listener.Close()
+			rows = append(rows, fmt.Sprintf("webhook port\t%d is free", Options.WebhookPort))
+		} else if err := getHealth(ctx, fmt.Sprintf("http://127.0.0.1:%d", Options.WebhookPort)); err == nil {
+			rows = append(rows, fmt.Sprintf("webhook port\t%d is served by a running instance", Options.WebhookPort))
+		} else {
+			rows = append(rows, fmt.Sprintf("webhook port\tFAILED: %d is taken by something else: %v", Options.WebhookPort, err))
+		}
+	}
+	if c.WebhookURL != "" {
+		started := time.Now()
+		if err := getHealth(ctx, c.WebhookURL); err != nil {
+			rows = append(rows, fmt.Sprintf("webhook url\tFAILED: %v", err))
+		} else {
+			rows = append(rows, fmt.Sprintf("webhook url\treachable in %v", time.Since(started).Round(time.Millisecond)))
+		}
+	}
+	return rows
+}
+
+// getHealth checks that the webhook server at baseURL answers on /healthz
+func getHealth(ctx context.Context, baseURL string) error {
+	ctx, cancel := context.WithTimeout(ctx, doctorTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(baseURL, "/")+"/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("/healthz answered with status %d", resp.StatusCode)
+	}
+	return nil
+}
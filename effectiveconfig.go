@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// maskedSecret replaces the values of the options tagged secret
+const maskedSecret = "********"
+
+// ConfigValue is an option and the value it resolved to, from the flags, the environment and the env
+// files
+type ConfigValue struct {
+	Option string `json:"option"`
+	Env    string `json:"env,omitempty"`
+	// Value is a string, or a list of strings for the options that can be repeated
+	Value any `json:"value"`
+}
+
+// EffectiveConfig lists the options with their values. The secrets are masked, and so are the passwords
+// in URLs
+func EffectiveConfig() []ConfigValue {
+	value := reflect.ValueOf(&Options).Elem()
+	var config []ConfigValue
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		long := field.Tag.Get("long")
+		if long == "" {
+			continue
+		}
+		secret := field.Tag.Get("secret") != ""
+		entry := ConfigValue{Option: long, Env: field.Tag.Get("env")}
+		if items, ok := value.Field(i).Interface().([]string); ok {
+			masked := make([]string, len(items))
+			for j, item := range items {
+				masked[j] = maskConfigValue(item, secret)
+			}
+			entry.Value = masked
+		} else {
+			entry.Value = maskConfigValue(fmt.Sprint(value.Field(i).Interface()), secret)
+		}
+		config = append(config, entry)
+	}
+	return config
+}
+
+func maskConfigValue(value string, secret bool) string {
+	switch {
+	case value == "":
+		return ""
+	case secret:
+		return maskedSecret
+	case strings.Contains(value, "://"):
+		return redactURL(value)
+	}
+	return value
+}
+
+// printEffectiveConfig prints the options that have a value as a table
+func printEffectiveConfig(out io.Writer) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "OPTION\tENV\tVALUE")
+	for _, entry := range EffectiveConfig() {
+		value := fmt.Sprint(entry.Value)
+		if items, ok := entry.Value.([]string); ok {
+			value = strings.Join(items, ",")
+		}
+		if value == "" {
+			continue
+		}
+		fmt.Fprintf(w, "--%s\t%s\t%s\n", entry.Option, entry.Env, value)
+	}
+	w.Flush()
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/joho/godotenv"
+)
+
+// defaultEnvFile is loaded if it exists, unless --env-file or --no-env-file say otherwise
+const defaultEnvFile = ".env"
+
+// loadEnvFiles loads the files of --env-file, or ENV_FILE, into the environment before the options are
+// parsed, since they may set them. Later files override the earlier ones, and the variables already in
+// the environment are kept
+func loadEnvFiles(args []string) error {
+	files, disabled := envFileArgs(args)
+	if disabled {
+		return nil
+	}
+	if len(files) == 0 && os.Getenv("ENV_FILE") != "" {
+		files = strings.Split(os.Getenv("ENV_FILE"), ",")
+	}
+	if len(files) == 0 {
+		if _, err := os.Stat(defaultEnvFile); os.IsNotExist(err) {
+			return nil
+		}
+		files = []string{defaultEnvFile}
+	}
+	env, err := godotenv.Read(files...)
+	if err != nil {
+		return fmt.Errorf("failed to load the env files %s: %w", strings.Join(files, ", "), err)
+	}
+	for key, value := range env {
+		if _, ok := os.LookupEnv(key); !ok {
+			os.Setenv(key, value)
+		}
+	}
+	return nil
+}
+
+// envFileArgs finds --env-file and --no-env-file in the arguments, or NO_ENV_FILE in the environment
+func envFileArgs(args []string) (files []string, disabled bool) {
+	disabled, _ = strconv.ParseBool(os.Getenv("NO_ENV_FILE"))
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--":
+			return files, disabled
+		case arg == "--no-env-file":
+			disabled = true
+		case arg == "--env-file" && i+1 < len(args):
+			i++
+			files = append(files, args[i])
+		case strings.HasPrefix(arg, "--env-file="):
+			files = append(files, strings.TrimPrefix(arg, "--env-file="))
+		}
+	}
+	return files, disabled
+}
+
+// RepoEnv is the env file of --repo-env-file, loaded after every sync. Nil if there's none
+var RepoEnv *RepoEnvFile
+
+// RepoEnvFile puts the variables of an env file of the synced files in the environment of the hooks,
+// commands and application started after it was loaded. The variables of the server's own environment
+// are never changed
+type RepoEnvFile struct {
+	path string
+	mu   sync.Mutex
+	// set are the variables the file put in the environment
+	set map[string]bool
+}
+
+// NewRepoEnvFile makes the env file at path, relative to the local folder
+func NewRepoEnvFile(path, localFolder string) *RepoEnvFile {
+	if path == "" {
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(localFolder, path)
+	}
+	return &RepoEnvFile{path: path, set: make(map[string]bool)}
+}
+
+// Load puts the variables of the file in the environment, removing those it no longer has. A missing
+// file removes them all
+func (f *RepoEnvFile) Load() error {
+	if f == nil {
+		return nil
+	}
+	env, err := godotenv.Read(f.path)
+	if os.IsNotExist(err) {
+		env, err = nil, nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", f.path, err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key := range f.set {
+		if _, ok := env[key]; !ok {
+			os.Unsetenv(key)
+			delete(f.set, key)
+		}
+	}
+	var ignored []string
+	for key, value := range env {
+		if _, ok := os.LookupEnv(key); ok && !f.set[key] {
+			ignored = append(ignored, key)
+			continue
+		}
+		os.Setenv(key, value)
+		f.set[key] = true
+	}
+	if len(ignored) > 0 {
+		sort.Strings(ignored)
+		log.Printf("%s can't change %s, already in the environment\n", f.path, strings.Join(ignored, ", "))
+	}
+	return nil
+}
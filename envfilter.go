@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+)
+
+// ChildEnv filters the environment the application and the processes of --processes-file inherit. Nil
+// passes everything
+var ChildEnv *EnvFilter
+
+// EnvFilter passes the variables matching one of the allow patterns, or all without any, unless they
+// match one of the deny patterns. Patterns are globs like APP_* or *_TOKEN
+type EnvFilter struct {
+	allow []string
+	deny  []string
+}
+
+// NewEnvFilter checks the patterns, returning nil if there's none
+func NewEnvFilter(allow, deny []string) (*EnvFilter, error) {
+	var err error
+	f := &EnvFilter{}
+	if f.allow, err = envPatterns("--child-env-allow", allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = envPatterns("--child-env-deny", deny); err != nil {
+		return nil, err
+	}
+	if len(f.allow) == 0 && len(f.deny) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+// envPatterns checks the patterns of the option, skipping the empty ones
+func envPatterns(option string, patterns []string) ([]string, error) {
+	var valid []string
+	for _, pattern := range patterns {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern %q: %w", option, pattern, err)
+		}
+		valid = append(valid, pattern)
+	}
+	return valid, nil
+}
+
+// Allows is true if the variable is passed on
+func (f *EnvFilter) Allows(name string) bool {
+	if f == nil {
+		return true
+	}
+	if matchesAny(f.deny, name) {
+		return false
+	}
+	return len(f.allow) == 0 || matchesAny(f.allow, name)
+}
+
+// Environ is the environment of this process without the filtered variables
+func (f *EnvFilter) Environ() []string {
+	env := os.Environ()
+	if f == nil {
+		return env
+	}
+	kept := env[:0]
+	for _, entry := range env {
+		name, _, _ := strings.Cut(entry, "=")
+		if f.Allows(name) {
+			kept = append(kept, entry)
+		}
+	}
+	return kept
+}
+
+// Filtered lists the variables of this process that aren't passed on
+func (f *EnvFilter) Filtered() []string {
+	var names []string
+	for _, entry := range os.Environ() {
+		name, _, _ := strings.Cut(entry, "=")
+		if !f.Allows(name) {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// matchesAny is true if the name matches one of the patterns, regardless of the case on Windows, where
+// variable names aren't case sensitive
+func matchesAny(patterns []string, name string) bool {
+	if runtime.GOOS == "windows" {
+		name = strings.ToUpper(name)
+	}
+	for _, pattern := range patterns {
+		if runtime.GOOS == "windows" {
+			pattern = strings.ToUpper(pattern)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
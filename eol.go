@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strings"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	"github.com/go-git/go-git/v5/plumbing/format/gitattributes"
+)
+
+// binarySniffLen is how much of a file without a text attribute is checked for NUL bytes, like git does
+const binarySniffLen = 8000
+
+// eolConverter converts the line endings of the text files written to the local folder
+type eolConverter struct {
+	eol        string
+	attributes gitattributes.Matcher
+}
+
+// newEOLConverter converts to the line endings of --eol, lf, crlf or auto for the ones of this
+// platform, honoring the .gitattributes files of src. An empty mode converts nothing
+func newEOLConverter(mode, src string) (*eolConverter, error) {
+	eol, err := eolSequence(mode)
+	if err != nil || eol == "" {
+		return nil, err
+	}
+	patterns, err := gitattributes.ReadPatterns(osfs.New(src), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the .gitattributes files: %w", err)
+	}
+	return &eolConverter{eol: eol, attributes: gitattributes.NewMatcher(patterns)}, nil
+}
+
+// eolSequence returns the line ending of an --eol mode, empty if it's empty
+func eolSequence(mode string) (string, error) {
+	switch mode {
+	case "":
+		return "", nil
+	case "lf":
+		return "\n", nil
+	case "crlf":
+		return "\r\n", nil
+	case "auto":
+		if runtime.GOOS == "windows" {
+			return "\r\n", nil
+		}
+		return "\n", nil
+	}
+	return "", fmt.Errorf("invalid --eol %q, expected lf, crlf or auto", mode)
+}
+
+// attribute returns the last attribute of that name set for the path in the .gitattributes files
+func (c *eolConverter) attribute(path []string, name string) gitattributes.Attribute {
+	attributes, _ := c.attributes.Match(path, []string{name})
+	return attributes[name]
+}
+
+// convert returns the content with its line endings converted, or nil if it isn't text. Files are
+// text if their text attribute is set or, when it's unspecified or auto, if they have no NUL bytes.
+// An eol attribute takes precedence over --eol
+func (c *eolConverter) convert(slashPath string, content []byte) []byte {
+	path := strings.Split(slashPath, "/")
+	if binary := c.attribute(path, "binary"); binary != nil && binary.IsSet() {
+		return nil
+	}
+	text := c.attribute(path, "text")
+	if text != nil && text.IsUnset() {
+		return nil
+	}
+	if text == nil || text.IsUnspecified() || (text.IsValueSet() && text.Value() == "auto") {
+		if bytes.IndexByte(content[:min(len(content), binarySniffLen)], 0) >= 0 {
+			return nil
+		}
+	}
+
+	eol := c.eol
+	if attribute := c.attribute(path, "eol"); attribute != nil && attribute.IsValueSet() {
+		switch attribute.Value() {
+		case "lf":
+			eol = "\n"
+		case "crlf":
+			eol = "\r\n"
+		}
+	}
+	converted := bytes.ReplaceAll(content, []byte("\r\n"), []byte("\n"))
+	if eol == "\r\n" {
+		converted = bytes.ReplaceAll(converted, []byte("\n"), []byte("\r\n"))
+	}
+	return converted
+}
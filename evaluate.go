@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Evaluation generates a plain config file from a Jsonnet or CUE entrypoint in the repo folder, for
+// the applications that can't read those languages
+type Evaluation struct {
+	// Entrypoint is a .jsonnet file, or a .cue file or CUE package directory
+	Entrypoint string `yaml:"entrypoint"`
+	// Output is the file written, in the format of its extension: .json, .yaml, .properties or .env
+	Output string `yaml:"output"`
+}
+
+// evaluationTool returns the tool evaluating the entrypoint, jsonnet or cue
+func evaluationTool(entrypoint string) (string, error) {
+	switch strings.ToLower(path.Ext(entrypoint)) {
+	case ".jsonnet":
+		return "jsonnet", nil
+	case ".cue", "":
+		return "cue", nil
+	}
+	return "", fmt.Errorf("entrypoint %s isn't a .jsonnet or .cue file, or a CUE package directory", entrypoint)
+}
+
+// validate checks the evaluation once .gitsync.yaml is loaded, so mistakes are found before syncing
+func (e Evaluation) validate() error {
+	if !filepath.IsLocal(filepath.FromSlash(e.Entrypoint)) || !filepath.IsLocal(filepath.FromSlash(e.Output)) {
+		return fmt.Errorf("the entrypoint %q and output %q of an evaluation must be inside the repo folder", e.Entrypoint, e.Output)
+	}
+	if _, err := evaluationTool(e.Entrypoint); err != nil {
+		return err
+	}
+	if _, err := configFormat(e.Output); err != nil {
+		return fmt.Errorf("the output of %s: %w", e.Entrypoint, err)
+	}
+	return nil
+}
+
+// evaluate writes the outputs of the evaluations into src, the checked out repo folder, so they're
+// synced like the other files
+func (c *RepoConfig) evaluate(ctx context.Context, src string) error {
+	for _, evaluation := range c.Evaluate {
+		if err := evaluation.run(ctx, src); err != nil {
+			return fmt.Errorf("failed to evaluate %s: %w", evaluation.Entrypoint, err)
+		}
+	}
+	return nil
+}
+
+func (e Evaluation) run(ctx context.Context, src string) error {
+	tool, _ := evaluationTool(e.Entrypoint)
+	if _, err := exec.LookPath(tool); err != nil {
+		return fmt.Errorf("%s isn't in the PATH: %w", tool, err)
+	}
+	output := filepath.Join(src, filepath.FromSlash(e.Output))
+	if err := os.MkdirAll(filepath.Dir(output), 0o775); err != nil {
+		return err
+	}
+	evaluated, err := os.CreateTemp(filepath.Dir(output), ".evaluated-*.json")
+	if err != nil {
+		return err
+	}
+	evaluated.Close()
+	defer os.Remove(evaluated.Name())
+
+	entrypoint := filepath.FromSlash(e.Entrypoint)
+	var args []string
+	switch tool {
+	case "jsonnet":
+		args = []string{"--jpath", ".", "--output-file", evaluated.Name(), entrypoint}
+	case "cue":
+		args = []string{"export", "." + string(filepath.Separator) + entrypoint, "--out", "json", "--outfile", evaluated.Name(), "--force"}
+	}
+	log.Printf("evaluating %s into %s\n", e.Entrypoint, e.Output)
+	err = runProcess(ctx, "evaluate", e.Entrypoint, func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, tool, args...)
+		cmd.Dir = src
+		return cmd
+	})
+	if err != nil {
+		return err
+	}
+
+	content, err := os.ReadFile(evaluated.Name())
+	if err != nil {
+		return err
+	}
+	if format, _ := configFormat(e.Output); format != FormatJSON {
+		if content, err = ConvertConfig(evaluated.Name(), content, format); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(output, content, 0o664)
+}
@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// EventType identifies what happened
+type EventType string
+
+const (
+	EventSyncRequested     EventType = "SyncRequested"
+	EventSyncStarted       EventType = "SyncStarted"
+	EventSyncApplied       EventType = "SyncApplied"
+	EventSyncUnchanged     EventType = "SyncUnchanged"
+	EventSyncSkipped       EventType = "SyncSkipped"
+	EventSyncDeferred      EventType = "SyncDeferred"
+	EventSyncFailed        EventType = "SyncFailed"
+	EventValidationFailed  EventType = "ValidationFailed"
+	EventRestartRequested  EventType = "RestartRequested"
+	EventChildRestarted    EventType = "ChildRestarted"
+	EventChildExited       EventType = "ChildExited"
+	EventChildCrashed      EventType = "ChildCrashed"
+	EventProcessUnhealthy  EventType = "ProcessUnhealthy"
+	EventRollbackRequested EventType = "RollbackRequested"
+	EventRolledBack        EventType = "RolledBack"
+	EventApplyAcknowledged EventType = "ApplyAcknowledged"
+	EventPaused            EventType = "Paused"
+	EventResumed           EventType = "Resumed"
+	EventStale             EventType = "Stale"
+	EventFresh             EventType = "Fresh"
+	EventTooManyFailures   EventType = "TooManyFailures"
+	EventHookFinished      EventType = "HookFinished"
+	EventNomadJobSubmitted EventType = "NomadJobSubmitted"
+	EventNomadJobFailed    EventType = "NomadJobFailed"
+	EventExternalWrite     EventType = "ExternalWrite"
+)
+
+// Event is something that happened, published to all the sinks
+type Event struct {
+	Time   time.Time         `json:"time"`
+	Type   EventType         `json:"type"`
+	Host   string            `json:"host,omitempty"`
+	Source string            `json:"source,omitempty"`
+	Commit string            `json:"commit,omitempty"`
+	Error  string            `json:"error,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+	// Output is what a hook printed, kept out of the summary since it's already logged
+	Output string `json:"output,omitempty"`
+	// Diff summarizes how the files changed in a sync
+	Diff string `json:"diff,omitempty"`
+}
+
+// Summary is a one-line human description of the event
+func (e Event) Summary() string {
+	var b strings.Builder
+	b.WriteString(string(e.Type))
+	if e.Source != "" {
+		fmt.Fprintf(&b, " source=%s", e.Source)
+	}
+	if e.Commit != "" {
+		fmt.Fprintf(&b, " commit=%s", shortCommit(e.Commit))
+	}
+	for _, key := range sortedKeys(e.Fields) {
+		value := e.Fields[key]
+		if strings.ContainsAny(value, " \t\"") {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(&b, " %s=%s", key, value)
+	}
+	if e.Error != "" {
+		fmt.Fprintf(&b, " error=%q", e.Error)
+	}
+	return b.String()
+}
+
+// EventSink receives every published event. Sinks doing I/O over the network shouldn't block
+type EventSink interface {
+	Handle(event Event)
+}
+
+// EventBus fans out events to the sinks
+type EventBus struct {
+	mu    sync.Mutex
+	host  string
+	sinks []EventSink
+}
+
+var Events = NewEventBus(LogSink{})
+
+func NewEventBus(sinks ...EventSink) *EventBus {
+	host, _ := os.Hostname()
+	return &EventBus{host: host, sinks: sinks}
+}
+
+func (b *EventBus) AddSink(sink EventSink) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sinks = append(b.sinks, sink)
+}
+
+// Subscribe returns a channel receiving the events of the given types, or all of them if none is given,
+// until cancel is called. Events are dropped for subscribers that fall behind
+func (b *EventBus) Subscribe(types ...EventType) (events <-chan Event, cancel func()) {
+	sub := &subscriber{ch: make(chan Event, 16), types: make(map[EventType]bool)}
+	for _, t := range types {
+		sub.types[t] = true
+	}
+
+	b.mu.Lock()
+	b.sinks = append(b.sinks, sub)
+	b.mu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			b.mu.Lock()
+			defer b.mu.Unlock()
+			for i, sink := range b.sinks {
+				if sink == EventSink(sub) {
+					b.sinks = append(b.sinks[:i:i], b.sinks[i+1:]...)
+					break
+				}
+			}
+		})
+	}
+}
+
+// subscriber is the sink behind Subscribe
+type subscriber struct {
+	ch    chan Event
+	types map[EventType]bool
+}
+
+func (s *subscriber) Handle(event Event) {
+	if len(s.types) > 0 && !s.types[event.Type] {
+		return
+	}
+	select {
+	case s.ch <- event:
+	default:
+	}
+}
+
+// Publish timestamps the event and sends it to all sinks
+func (b *EventBus) Publish(event Event) Event {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	event.Host = b.host
+
+	b.mu.Lock()
+	sinks := append([]EventSink{}, b.sinks...)
+	b.mu.Unlock()
+
+	for _, sink := range sinks {
+		sink.Handle(event)
+	}
+	return event
+}
+
+// setupEventSinks configures the event sinks from the options
+func setupEventSinks() {
+	Events = NewEventBus(LogSink{}, MetricsSink{}, SystemdSink{})
+
+	if Options.AuditLog != "" {
+		Events.AddSink(NewFileSink(Options.AuditLog))
+	}
+	for _, url := range Options.EventWebhookURLs {
+		Events.AddSink(NewWebhookSink(url, Options.NotifyEvents))
+	}
+	if Options.SlackWebhookURL != "" {
+		Events.AddSink(NewSlackSink(Options.SlackWebhookURL, Options.NotifyEvents))
+	}
+}
+
+// LogSink writes events to the standard log
+type LogSink struct{}
+
+func (LogSink) Handle(event Event) {
+	log.Printf("event: %s\n", event.Summary())
+}
+
+// MetricsSink counts events by type
+type MetricsSink struct{}
+
+func (MetricsSink) Handle(event Event) {
+	Metrics.Add("git_config_server_events_total", 1, "type", string(event.Type))
+}
+
+// SystemdSink reports the sync outcome in the systemd service status
+type SystemdSink struct{}
+
+func (SystemdSink) Handle(event Event) {
+	switch event.Type {
+	case EventSyncApplied, EventSyncUnchanged:
+		sdNotify(fmt.Sprintf("STATUS=Synced commit %s at %s", event.Commit, event.Time.Format(time.RFC3339)))
+	case EventSyncFailed:
+		sdNotify(fmt.Sprintf("STATUS=Sync failed at %s: %s", event.Time.Format(time.RFC3339), event.Error))
+	}
+}
+
+// FileSink appends events as JSON lines to a file, serving as an audit log
+type FileSink struct {
+	mu   sync.Mutex
+	path string
+}
+
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (s *FileSink) Handle(event Event) {
+	if err := s.append(event); err != nil {
+		log.Printf("failed to write event to %s: %v\n", s.path, err)
+	}
+}
+
+func (s *FileSink) append(event Event) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to serialize event: %w", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	file, err := os.OpenFile(s.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// HTTPSink POSTs the selected events to a URL in the background
+type HTTPSink struct {
+	url    string
+	types  map[EventType]bool
+	format func(event Event) any
+}
+
+// NewWebhookSink posts the events as JSON. If types is empty, all events are sent
+func NewWebhookSink(url string, types []string) *HTTPSink {
+	return newHTTPSink(url, types, func(event Event) any {
+		return event
+	})
+}
+
+// NewSlackSink posts the events to a Slack incoming webhook. If types is empty, all events are sent
+func NewSlackSink(url string, types []string) *HTTPSink {
+	return newHTTPSink(url, types, func(event Event) any {
+		text := fmt.Sprintf("*git-config-server* on `%s`: %s", event.Host, event.Summary())
+		if event.Diff != "" {
+			text += "\n```\n" + event.Diff + "\n```"
+		}
+		return map[string]string{"text": text}
+	})
+}
+
+func newHTTPSink(url string, types []string, format func(event Event) any) *HTTPSink {
+	sink := &HTTPSink{url: url, types: make(map[EventType]bool), format: format}
+	for _, t := range types {
+		sink.types[EventType(strings.TrimSpace(t))] = true
+	}
+	return sink
+}
+
+func (s *HTTPSink) Handle(event Event) {
+	if len(s.types) > 0 && !s.types[event.Type] {
+		return
+	}
+	go func() {
+		if err := s.post(event); err != nil {
+			log.Printf("failed to send event %s: %v\n", event.Type, err)
+		}
+	}()
+}
+
+func (s *HTTPSink) post(event Event) error {
+	body, err := json.Marshal(s.format(event))
+	if err != nil {
+		return fmt.Errorf("failed to serialize event: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
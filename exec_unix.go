@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// doExec replaces the current process with the command
+func doExec(args ...string) {
+	cmd := args[0]
+
+	log.Printf("will now exec cmd=%s\n", cmd)
+	path, err := exec.LookPath(cmd)
+	if err != nil {
+		log.Fatalf("Failed to find command: %v", err)
+	}
+
+	err = syscall.Exec(path, args, os.Environ())
+	if err != nil {
+		log.Fatalf("Failed to exec command: %v", err)
+	}
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// doExec runs the command to completion and exits with its exit code, since Windows has no exec(2)
+func doExec(args ...string) {
+	log.Printf("will now run cmd=%s\n", args[0])
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	err := cmd.Run()
+	if err != nil {
+		var exitError *exec.ExitError
+		if errors.As(err, &exitError) {
+			os.Exit(exitError.ExitCode())
+		}
+		log.Fatalf("Failed to run command: %v", err)
+	}
+	os.Exit(0)
+}
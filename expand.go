@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// expandOptions resolves ${VAR} in the string options, like GIT_URL=https://${GIT_HOST}/org/repo.git.
+// The options tagged noexpand are left alone: the shell commands, which get their own variables when
+// they run, and the secrets
+func expandOptions(options any) error {
+	value := reflect.ValueOf(options).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		long := field.Tag.Get("long")
+		if long == "" || field.Tag.Get("noexpand") != "" {
+			continue
+		}
+		switch v := value.Field(i).Addr().Interface().(type) {
+		case *string:
+			expanded, err := expandVars(*v)
+			if err != nil {
+				return fmt.Errorf("invalid --%s: %w", long, err)
+			}
+			*v = expanded
+		case *[]string:
+			for j, item := range *v {
+				expanded, err := expandVars(item)
+				if err != nil {
+					return fmt.Errorf("invalid --%s: %w", long, err)
+				}
+				(*v)[j] = expanded
+			}
+		}
+	}
+	return nil
+}
+
+// expandVars replaces ${VAR} with the variable, failing if it isn't set, and ${VAR:-default} with
+// the default if it's unset or empty. $${ is a literal ${. HOSTNAME is the host name if it isn't set,
+// since shells don't export it
+func expandVars(s string) (string, error) {
+	if !strings.Contains(s, "${") {
+		return s, nil
+	}
+	var b strings.Builder
+	for {
+		start := strings.Index(s, "${")
+		if start < 0 {
+			b.WriteString(s)
+			return b.String(), nil
+		}
+		if start > 0 && s[start-1] == '$' {
+			b.WriteString(s[:start-1] + "${")
+			s = s[start+2:]
+			continue
+		}
+		end := strings.IndexByte(s[start:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unclosed ${ in %q", s)
+		}
+		name, fallback, hasDefault := strings.Cut(s[start+2:start+end], ":-")
+		if !isVarName(name) {
+			return "", fmt.Errorf("invalid variable name %q", name)
+		}
+		value, ok := lookupVar(name)
+		if value == "" && hasDefault {
+			value, ok = fallback, true
+		}
+		if !ok {
+			return "", fmt.Errorf("%s isn't set", name)
+		}
+		b.WriteString(s[:start] + value)
+		s = s[start+end+1:]
+	}
+}
+
+func lookupVar(name string) (string, bool) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true
+	}
+	if name == "HOSTNAME" {
+		if hostname, err := os.Hostname(); err == nil {
+			return hostname, true
+		}
+	}
+	return "", false
+}
+
+func isVarName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		letter := c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+		if !letter && (i == 0 || c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// gzipMinSize is the smallest file compressed for clients accepting gzip
+const gzipMinSize = 1024
+
+var (
+	errInvalidPath = errors.New("invalid path")
+	errIsDir       = errors.New("is a directory")
+)
+
+// resolveLocalFile maps a slash-separated path to the name of a regular file among the served files,
+// refusing anything outside them or in the .git folder
+func resolveLocalFile(files fs.FS, slashPath string) (string, fs.FileInfo, error) {
+	name := path.Clean(strings.TrimLeft(slashPath, "/"))
+	if !fs.ValidPath(name) || !filepath.IsLocal(filepath.FromSlash(name)) || isGitMetadata(name) {
+		return "", nil, fmt.Errorf("%w %q", errInvalidPath, slashPath)
+	}
+
+	info, err := fs.Stat(files, name)
+	if err != nil {
+		return "", nil, err
+	}
+	if info.IsDir() {
+		return "", nil, fmt.Errorf("%s %w", slashPath, errIsDir)
+	}
+	return name, info, nil
+}
+
+// rootFS serves the files of a folder on disk like os.DirFS, refusing the symlinks that resolve outside of it
+type rootFS struct {
+	dir  string
+	fsys fs.FS
+}
+
+func newRootFS(dir string) fs.FS {
+	return rootFS{dir: dir, fsys: os.DirFS(dir)}
+}
+
+func (r rootFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	root, err := filepath.EvalSymlinks(r.dir)
+	if err != nil {
+		return nil, err
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(r.dir, filepath.FromSlash(name)))
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || !filepath.IsLocal(rel) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+	}
+	return r.fsys.Open(name)
+}
+
+// fileHashes caches the content hashes by commit, name, size and modification time, so polling
+// clients don't cause the files to be read over and over
+type fileHashes struct {
+	mu     sync.Mutex
+	hashes map[string]fileHash
+}
+
+type fileHash struct {
+	size    int64
+	modTime time.Time
+	sum     string
+}
+
+func (h *fileHashes) get(files fs.FS, commit, name string, info fs.FileInfo) (string, error) {
+	key := commit + ":" + name
+	h.mu.Lock()
+	cached, ok := h.hashes[key]
+	h.mu.Unlock()
+	if ok && cached.size == info.Size() && cached.modTime.Equal(info.ModTime()) {
+		return cached.sum, nil
+	}
+
+	f, err := files.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.hashes == nil {
+		h.hashes = make(map[string]fileHash)
+	}
+	h.hashes[key] = fileHash{size: info.Size(), modTime: info.ModTime(), sum: sum}
+	return sum, nil
+}
+
+// registerFileHandlers serves the synced files on /files/<path>, or the ones at ?ref=, optionally converted
+// with ?format=, with strong ETags derived from the
+// applied commit and the file hash, conditional requests and gzip for larger files
+func registerFileHandlers(mux *http.ServeMux, authorized func(r *http.Request, scope Scope) bool) {
+	hashes := &fileHashes{}
+
+	mux.HandleFunc("/files/", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		files, commit, ok := requestRoot(w, r, r.URL.Query().Get("ref"))
+		if !ok {
+			return
+		}
+		name, info, err := resolveLocalFile(files, strings.TrimPrefix(r.URL.Path, "/files/"))
+		switch {
+		case errors.Is(err, errInvalidPath), errors.Is(err, errIsDir):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		case errors.Is(err, os.ErrNotExist):
+			http.NotFound(w, r)
+			return
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		sum, err := hashes.get(files, commit, name, info)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		etag := fmt.Sprintf(`"%s-%s"`, shortCommit(commit), sum[:16])
+
+		content, err := readServedFile(files, name)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		if format := r.URL.Query().Get("format"); format != "" {
+			if !validFormat(format) {
+				http.Error(w, fmt.Sprintf("unknown format %q, expected json, yaml, properties or env", format), http.StatusBadRequest)
+				return
+			}
+			content, err = ConvertConfig(info.Name(), content, format)
+			if errors.Is(err, errUnstructured) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			etag = strings.TrimSuffix(etag, `"`) + "-" + format + `"`
+			w.Header().Set("Content-Type", formatContentType(format))
+		}
+
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("X-Config-Commit", commit)
+		if err := signResponse(w, content); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(content) < gzipMinSize || !acceptsGzip(r) {
+			// ServeContent takes care of the conditional and range requests
+			w.Header().Set("ETag", etag)
+			http.ServeContent(w, r, info.Name(), info.ModTime(), bytes.NewReader(content))
+			return
+		}
+
+		// the compressed representation has different bytes, so it needs a different strong ETag
+		etag = strings.TrimSuffix(etag, `"`) + `-gzip"`
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		if notModified(r, etag, info.ModTime()) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		w.Header().Set("Content-Encoding", "gzip")
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", contentType(content, info.Name()))
+		}
+		gz := gzip.NewWriter(w)
+		if _, err := gz.Write(content); err != nil {
+			log.Printf("failed to write %s: %v\n", name, err)
+		}
+		if err := gz.Close(); err != nil {
+			log.Printf("failed to write %s: %v\n", name, err)
+		}
+	}))
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(encoding), ";")
+		if strings.TrimSpace(name) == "gzip" && strings.ReplaceAll(params, " ", "") != "q=0" {
+			return true
+		}
+	}
+	return false
+}
+
+// notModified evaluates If-None-Match, falling back to If-Modified-Since like RFC 9110 says
+func notModified(r *http.Request, etag string, modTime time.Time) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, candidate := range strings.Split(inm, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil {
+		return false
+	}
+	return !modTime.Truncate(time.Second).After(since)
+}
+
+// readServedFile reads a file to be served, decrypting its {cipher} values if there's a key
+func readServedFile(files fs.FS, name string) ([]byte, error) {
+	content, err := fs.ReadFile(files, name)
+	if err != nil {
+		return nil, err
+	}
+	if ValueCipher == nil {
+		return content, nil
+	}
+	return ValueCipher.DecryptAll(content)
+}
+
+// contentType guesses the type like http.ServeContent does: by extension, then by sniffing
+func contentType(content []byte, name string) string {
+	if ctype := mime.TypeByExtension(filepath.Ext(name)); ctype != "" {
+		return ctype
+	}
+	return http.DetectContentType(content)
+}
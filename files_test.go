@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestResolveLocalFile(t *testing.T) {
+	files := fstest.MapFS{
+		"app.conf":        {Data: []byte("a")},
+		"sub/nested.conf": {Data: []byte("n")},
+		".git/config":     {Data: []byte("[core]")},
+		".gitignore":      {Data: []byte("*.log")},
+	}
+	tests := []struct {
+		path string
+		name string
+		err  error
+	}{
+		{path: "app.conf", name: "app.conf"},
+		{path: "/app.conf", name: "app.conf"},
+		{path: "//sub/nested.conf", name: "sub/nested.conf"},
+		{path: "sub/../app.conf", name: "app.conf"},
+		{path: "sub/./nested.conf", name: "sub/nested.conf"},
+		{path: ".gitignore", name: ".gitignore"},
+		{path: "../app.conf", err: errInvalidPath},
+		{path: "sub/../../app.conf", err: errInvalidPath},
+		{path: "/../etc/passwd", err: errInvalidPath},
+		{path: ".git/config", err: errInvalidPath},
+		{path: ".git", err: errInvalidPath},
+		{path: "sub/../.git/config", err: errInvalidPath},
+		{path: "", err: errIsDir},
+		{path: "sub", err: errIsDir},
+		{path: "missing.conf", err: fs.ErrNotExist},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			name, _, err := resolveLocalFile(files, test.path)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("got error %v, want %v", err, test.err)
+			}
+			if name != test.name {
+				t.Errorf("resolved to %q, want %q", name, test.name)
+			}
+		})
+	}
+}
+
+func TestAppliedTree(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"app.conf":         "a",
+		"sub/nested.conf":  "n",
+		"untracked.conf":   "u",
+		"linked/real.conf": "r",
+	})
+	for link, target := range map[string]string{"alias.conf": "app.conf", "conf.d": "sub", "passwd": "/etc/passwd"} {
+		if err := os.Symlink(target, filepath.Join(dir, link)); err != nil {
+			t.Skipf("can't create symlinks: %v", err)
+		}
+	}
+
+	if _, err := fs.ReadFile(NewAppliedTree(dir).FS(), "app.conf"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v before anything was applied", err)
+	}
+	var tree *AppliedTree
+	if _, err := fs.ReadFile(tree.FS(), "app.conf"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got error %v without a tree", err)
+	}
+
+	files, err := syncedFiles(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delete(files, "untracked.conf")
+	tree = NewAppliedTree(dir)
+	tree.Set(files)
+	served := tree.FS()
+
+	tests := []struct {
+		path    string
+		content string
+		err     error
+	}{
+		{path: "app.conf", content: "a"},
+		{path: "alias.conf", content: "a"},
+		{path: "sub/nested.conf", content: "n"},
+		{path: "linked/real.conf", content: "r"},
+		{path: "conf.d/nested.conf", content: "n"},
+		{path: "untracked.conf", err: fs.ErrNotExist},
+		{path: "passwd", err: fs.ErrPermission},
+		{path: "sub", err: errIsDir},
+	}
+	for _, test := range tests {
+		t.Run(test.path, func(t *testing.T) {
+			name, _, err := resolveLocalFile(served, test.path)
+			if err == nil {
+				var content []byte
+				content, err = fs.ReadFile(served, name)
+				if err == nil && string(content) != test.content {
+					t.Errorf("got %q, want %q", content, test.content)
+				}
+			}
+			if !errors.Is(err, test.err) {
+				t.Errorf("got error %v, want %v", err, test.err)
+			}
+		})
+	}
+	if _, err := fs.ReadDir(served, "."); err == nil {
+		t.Errorf("listed the local folder")
+	}
+}
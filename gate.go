@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	gateTimeout = 10 * time.Second
+	// maxGateBody limits what's read of the gate responses, which are meant to be tiny
+	maxGateBody = 64 * 1024
+)
+
+// errSyncHeld is returned by Sync when the gate holds the new commit
+var errSyncHeld = errors.New("held by the gate")
+
+// gateDecision is the JSON the gate may answer with. A plain text body of hold holds every commit
+type gateDecision struct {
+	// Status is hold to defer every apply, anything else lets them through
+	Status string `json:"status"`
+	Reason string `json:"reason"`
+	// DeniedCommits are held even if the status isn't hold. Prefixes of the hashes are enough
+	DeniedCommits []string `json:"denied_commits"`
+}
+
+// checkGate asks GateURL whether the commit may be applied, passing the commit and this host as the
+// commit and host query parameters. A held commit returns an error wrapping errSyncHeld. If the gate
+// can't be asked, the commit is held too, unless GateFailOpen is set
+func (gitRepo *GitRepo) checkGate(ctx context.Context, commit string) error {
+	if gitRepo.GateURL == "" {
+		return nil
+	}
+	decision, err := askGate(ctx, gitRepo.GateURL, commit)
+	if err != nil {
+		if gitRepo.GateFailOpen {
+			log.Printf("applying commit %s without the gate: %v\n", shortCommit(commit), err)
+			return nil
+		}
+		return fmt.Errorf("%w, which couldn't be asked: %v", errSyncHeld, err)
+	}
+	reason := decision.Reason
+	if reason == "" {
+		reason = "no reason given"
+	}
+	if strings.EqualFold(decision.Status, "hold") {
+		return fmt.Errorf("%w: %s", errSyncHeld, reason)
+	}
+	for _, denied := range decision.DeniedCommits {
+		if len(denied) >= 4 && strings.HasPrefix(commit, strings.ToLower(denied)) {
+			return fmt.Errorf("%w, which denies commit %s: %s", errSyncHeld, shortCommit(commit), reason)
+		}
+	}
+	return nil
+}
+
+func askGate(ctx context.Context, gateURL, commit string) (*gateDecision, error) {
+	u, err := url.Parse(gateURL)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	query := u.Query()
+	query.Set("commit", commit)
+	query.Set("host", host)
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, gateTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s returned %s", gateURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxGateBody))
+	if err != nil {
+		return nil, err
+	}
+
+	var decision gateDecision
+	text := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(text, "{") {
+		decision.Status = text
+		return &decision, nil
+	}
+	if err := json.Unmarshal(body, &decision); err != nil {
+		return nil, fmt.Errorf("invalid response from %s: %w", gateURL, err)
+	}
+	return &decision, nil
+}
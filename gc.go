@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// gcInterval is how often the backups are checked for expiry, as they're otherwise only rotated when
+// a new one is taken
+const gcInterval = time.Hour
+
+// collectGarbage removes the expired backups every gcInterval until ctx is done. The ref cache is kept
+// under its limits as refs are checked out
+func collectGarbage(ctx context.Context, backups *Backups) {
+	if backups == nil || backups.maxAge <= 0 {
+		return
+	}
+	ticker := time.NewTicker(gcInterval)
+	defer ticker.Stop()
+	for {
+		if err := backups.rotate(); err != nil {
+			log.Printf("failed to remove old backups: %v\n", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -1,140 +1,778 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"os"
-	"path"
+	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/go-git/go-billy/v5/memfs"
 	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
 	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/go-git/go-git/v5/storage/memory"
 )
 
 type GitRepo struct {
-	URL               string
-	Branch            string
-	RepoFolder        string
-	username          string
-	password          string
+	URL        string
+	Branch     string
+	RepoFolder string
+	// Preserve lists the paths in the local folder that aren't in the repo but must be kept
+	Preserve []string
+	// Memory keeps the synced files instead of the local folder, which isn't touched, when set
+	Memory *MemoryTree
+	// Applied, if set, gets the files of every commit applied to the local folder
+	Applied *AppliedTree
+	// SkipSync, if set, leaves the new commits whose message matches it unapplied
+	SkipSync *regexp.Regexp
+	// NoRestart, if set, applies the new commits whose message matches it without restarting the application
+	NoRestart *regexp.Regexp
+	// Backups, if set, archives the local folder before it's changed
+	Backups *Backups
+	// VerifyApply checks the local folder against the repo after every apply
+	VerifyApply bool
+	// ManifestFile, if set, gets the SHA-256 of the synced files after every apply
+	ManifestFile string
+	// MaxFileSize and MaxTotalSize, if set, refuse the commits with bigger files
+	MaxFileSize  ByteSize
+	MaxTotalSize ByteSize
+	// EOL, if set, converts the line endings of the text files written to lf, crlf or auto
+	EOL string
+	// Decrypt, if set, decrypts the {cipher} values of the files written
+	Decrypt *Cipher
+	// CheckCollisions refuses the commits with paths that only differ in case or Unicode normalization
+	CheckCollisions bool
+	// Mtime sets the modification time of the files written to the commit time with "commit", or to
+	// the one of the checked out file with "source"
+	Mtime string
+	// PreserveXattrs keeps the extended attributes of the files replaced in the local folder
+	PreserveXattrs bool
+	// ChownRules set the owner, group and mode of the matching files written
+	ChownRules ChownRules
+	// PruneEmptyDirs removes the directories left empty in the local folder, unless they have one of the
+	// KeepMarkers
+	PruneEmptyDirs bool
+	KeepMarkers    []string
+	// Sources are composed into subdirectories of the repo folder on every sync
+	Sources []*Source
+	// Snapshots, if set, writes every applied tree to its own directory, the local folder being a
+	// symlink to the active one
+	Snapshots *SnapshotDirs
+	// IncludeGitDir writes the .git of the clone to the local folder too, pinned at the applied commit
+	IncludeGitDir bool
+	// ApplyDelay, if set, waits this long after a new commit is first seen before applying it
+	ApplyDelay time.Duration
+	// GateURL, if set, is asked before applying a new commit whether it's held
+	GateURL      string
+	GateFailOpen bool
+	// Ref, if set, is the revision expression synced instead of the head of Branch, like HEAD, a tag,
+	// a commit or main~2
+	Ref string
+	// Renderer, if set, generates the files synced from the ones in the repo folder
+	Renderer *Renderer
+	username string
+	password string
+
+	// stateMu guards what's applied, which is updated by Sync and Rollback while others read it
+	stateMu           sync.RWMutex
 	lastFetchedCommit string
+	previousCommit    string
+	lastChanges       SyncChanges
+	lastCommitInfo    CommitInfo
+	lastDiff          *DiffSummary
+	lastFiles         map[string]bool
+	lastMessage       string
+	repoConfig        *RepoConfig
+	skippedCommit     string
+	delayedCommit     string
+	delayedUntil      time.Time
+	delayTimer        *time.Timer
+	// replaced is what was applied before the last change, for Rollback to flip back to its snapshot
+	replaced appliedResult
+	// the polls of the remote, and how many found the branch moved since the one before
+	lastSeenCommit string
+	remoteChecks   int
+	remoteChanges  int
+
+	// the refs last advertised by the remote, reused for a while by ResolveRef
+	refsMu         sync.Mutex
+	remote         *git.Remote
+	advertisedRefs []*plumbing.Reference
+	advertisedAt   time.Time
+
+	// fetchRef is the ref cloned to get the commit to apply, empty to clone every branch
+	fetchRef plumbing.ReferenceName
+	// the last commit a --ref walking the history resolved to, and from which base
+	revisionBase   string
+	revisionCommit string
+}
+
+// errSyncSkipped is returned by Sync when the new commit asks not to be applied
+var errSyncSkipped = errors.New("skipped by its commit message")
+
+// CommitInfo describes the commit whose files are in the local folder
+type CommitInfo struct {
+	Hash    string    `json:"hash"`
+	Author  string    `json:"author"`
+	Email   string    `json:"email"`
+	Subject string    `json:"subject"`
+	Time    time.Time `json:"time"`
+	// AuthorTime is when the change was written, the start of its lead time
+	AuthorTime     time.Time `json:"author_time"`
+	Committer      string    `json:"committer,omitempty"`
+	CommitterEmail string    `json:"committer_email,omitempty"`
+	// Message is the full commit message, the subject included
+	Message string   `json:"message,omitempty"`
+	Parents []string `json:"parents,omitempty"`
+}
+
+// Parent is the first parent of the commit, empty for a root commit
+func (info CommitInfo) Parent() string {
+	if len(info.Parents) == 0 {
+		return ""
+	}
+	return info.Parents[0]
 }
 
 func NewGitRepo(url, branch, repoFolder, username, password string) *GitRepo {
 	return &GitRepo{
 		URL:        url,
 		Branch:     branch,
-		RepoFolder: strings.TrimLeft(repoFolder, "/"),
+		RepoFolder: strings.TrimLeft(filepath.ToSlash(repoFolder), "/"),
+		fetchRef:   plumbing.NewBranchReferenceName(branch),
 		username:   username,
 		password:   password,
 	}
 }
 
-// GitSync checks the remote repository for changes and synchronizes it
-func (gitRepo *GitRepo) Sync(localFolder string) (bool, error) {
-	lastCommit, err := gitRepo.GetLastCommit()
+// GitSync checks the remote repository for changes and synchronizes it, returning the commit applied or
+// nil if there was none. It's safe for concurrent use: the syncs to a folder are applied one at a time,
+// and a sync finding the commit already applied by the previous one does nothing
+func (gitRepo *GitRepo) Sync(ctx context.Context, localFolder string) (*CommitInfo, error) {
+	unlock := gitRepo.lockApply(localFolder)
+	defer unlock()
+
+	lastCommit, err := gitRepo.GetLastCommit(ctx)
 	if err != nil {
 		log.Printf("failed to get last commit: %v\n", err)
-		return false, err
+		return nil, err
 	}
 
-	if gitRepo.lastFetchedCommit == lastCommit {
+	state := gitRepo.State()
+	gitRepo.recordCheck(lastCommit)
+	debugf("remote is at %s, applied %s, skipped %s\n", lastCommit, orDash(state.Commit), orDash(gitRepo.skipped()))
+	sourcesChanged, err := gitRepo.checkSources(ctx)
+	if err != nil {
+		log.Printf("%v\n", err)
+		return nil, err
+	}
+	if (state.Commit == lastCommit && !sourcesChanged) || gitRepo.skipped() == lastCommit {
 		log.Printf("No changes in %s\n", gitRepo.URL)
-		return false, nil
+		return nil, nil
 	}
 
-	err = gitRepo.Fetch(lastCommit, localFolder)
+	// on startup there's nothing else to apply, so the commit is applied anyway, and so is the applied
+	// one when only the sources changed
+	var skip *regexp.Regexp
+	previous := state.Commit
+	if state.Commit == lastCommit {
+		previous = state.Previous
+	} else if state.Commit != "" {
+		skip = gitRepo.SkipSync
+		if err := gitRepo.delayApply(lastCommit); err != nil {
+			return nil, err
+		}
+		if err := gitRepo.checkGate(ctx, lastCommit); err != nil {
+			log.Printf("not applying commit %s yet: %v\n", shortCommit(lastCommit), err)
+			return nil, err
+		}
+	}
+	if err := LocalWrites.Check(); err != nil {
+		log.Printf("not applying commit %s: %v\n", shortCommit(lastCommit), err)
+		return nil, err
+	}
+	Store.BeginApply(lastCommit)
+	fetched, err := gitRepo.Fetch(ctx, lastCommit, localFolder, skip)
+	Store.EndApply()
+	if errors.Is(err, errSyncSkipped) {
+		log.Printf("commit %s is %v\n", lastCommit, err)
+		gitRepo.Skip(lastCommit)
+		return nil, err
+	}
 	if err != nil {
 		log.Printf("failed to fetch last commit: %v\n", err)
-		return false, err
+		return nil, err
 	}
 
-	gitRepo.lastFetchedCommit = lastCommit
-	return true, nil
+	gitRepo.sourcesApplied()
+	gitRepo.setApplied(lastCommit, previous, fetched)
+	return &fetched.info, nil
 }
 
-// Fetch fetches the files from the remote repository into a local folder
-func (gitRepo *GitRepo) Fetch(commit, localFolder string) error {
-	tmpDir, err := os.MkdirTemp("", "git")
-	if err != nil {
+// Rollback applies the commit that was live before the last change. Rolling back twice restores the last change
+func (gitRepo *GitRepo) Rollback(ctx context.Context, localFolder string) error {
+	unlock := gitRepo.lockApply(localFolder)
+	defer unlock()
+
+	state := gitRepo.State()
+	if state.Previous == "" {
+		return fmt.Errorf("no previous commit to roll back to")
+	}
+
+	log.Printf("Rolling back from commit %s to %s\n", state.Commit, state.Previous)
+	if fetched, ok := gitRepo.flipBack(state); ok {
+		gitRepo.setApplied(state.Previous, state.Commit, fetched)
+		return nil
+	}
+	if err := gitRepo.pinSources(ctx); err != nil {
 		return err
 	}
-	defer os.RemoveAll(tmpDir)
+	Store.BeginApply(state.Previous)
+	fetched, err := gitRepo.Fetch(ctx, state.Previous, localFolder, nil)
+	Store.EndApply()
+	if err != nil {
+		return fmt.Errorf("failed to fetch previous commit %s: %w", state.Previous, err)
+	}
 
-	log.Printf("Fetching commit %s of %s\n", gitRepo.URL, commit)
+	gitRepo.setApplied(state.Previous, state.Commit, fetched)
+	return nil
+}
 
-	repo, err := git.PlainClone(tmpDir, false, &git.CloneOptions{
-		URL:           gitRepo.URL,
-		Depth:         1,
-		SingleBranch:  true,
-		ReferenceName: plumbing.NewBranchReferenceName(gitRepo.Branch),
-		Auth: &http.BasicAuth{
-			Username: gitRepo.username,
-			Password: gitRepo.password,
-		},
-	})
+// appliedResult is the fetchResult of an applied commit
+type appliedResult struct {
+	commit string
+	fetchResult
+}
+
+// flipBack points the local folder back at the snapshot of the previous commit, if it's still there,
+// without fetching it again. The changes and the diff are the ones of the last change reversed, and the
+// paths kept by the last sync are carried over
+func (gitRepo *GitRepo) flipBack(state GitRepoState) (fetchResult, bool) {
+	gitRepo.stateMu.RLock()
+	replaced := gitRepo.replaced
+	gitRepo.stateMu.RUnlock()
+	if gitRepo.Snapshots == nil || replaced.commit != state.Previous {
+		return fetchResult{}, false
+	}
+	snapshot, ok := gitRepo.Snapshots.Existing(state.Previous)
+	if !ok {
+		return fetchResult{}, false
+	}
+	err := gitRepo.Snapshots.CarryOver(snapshot, state.Changes.Preserved)
+	if err == nil {
+		err = gitRepo.Snapshots.Flip(snapshot)
+	}
 	if err != nil {
-		return err
+		log.Printf("failed to flip back to the snapshot %s, fetching commit %s again: %v\n", snapshot, shortCommit(state.Previous), err)
+		return fetchResult{}, false
+	}
+	fetched := replaced.fetchResult
+	fetched.changes = state.Changes.reversed()
+	fetched.diff = state.Diff.reversed()
+	return fetched, true
+}
+
+// setApplied records the commit whose files were fetched, all at once for State, saving it in the store
+func (gitRepo *GitRepo) setApplied(commit, previous string, fetched fetchResult) {
+	defer Store.SaveApplied(commit, previous)
+	gitRepo.stateMu.Lock()
+	defer gitRepo.stateMu.Unlock()
+	gitRepo.replaced = appliedResult{gitRepo.lastFetchedCommit, fetchResult{
+		changes: gitRepo.lastChanges,
+		info:    gitRepo.lastCommitInfo,
+		diff:    gitRepo.lastDiff,
+		config:  gitRepo.repoConfig,
+		files:   gitRepo.lastFiles,
+	}}
+	gitRepo.lastFetchedCommit = commit
+	gitRepo.previousCommit = previous
+	gitRepo.lastChanges = fetched.changes
+	gitRepo.lastCommitInfo = fetched.info
+	gitRepo.lastDiff = fetched.diff
+	gitRepo.lastMessage = fetched.info.Message
+	gitRepo.repoConfig = fetched.config
+	gitRepo.lastFiles = fetched.files
+	gitRepo.Applied.Set(fetched.files)
+}
+
+// checkout clones the commit into cloneDir("shallow"), or with its history into cloneDir("full") if it
+// isn't the head of the branch, and checks it out
+func (gitRepo *GitRepo) checkout(ctx context.Context, cloneDir func(name string) string, commit string, progress io.Writer) (*object.Commit, plumbing.Hash, *git.Worktree, error) {
+	repo, err := gitRepo.clone(ctx, cloneDir("shallow"), 1, gitRepo.fetchRef, progress)
+	if err != nil {
+		return nil, plumbing.ZeroHash, nil, err
 	}
 
 	hash, err := repo.ResolveRevision(plumbing.Revision(commit))
 	if err != nil {
-		return err
+		// older commits aren't in the shallow clone, e.g. when rolling back
+		log.Printf("commit %s not found in the shallow clone, cloning the full history\n", commit)
+		repo, err = gitRepo.clone(ctx, cloneDir("full"), 0, gitRepo.fetchRef, progress)
+		if err != nil {
+			return nil, plumbing.ZeroHash, nil, err
+		}
+		hash, err = repo.ResolveRevision(plumbing.Revision(commit))
+		if err != nil {
+			return nil, plumbing.ZeroHash, nil, err
+		}
 	}
 
+	commitObject, err := repo.CommitObject(*hash)
+	if err != nil {
+		return nil, plumbing.ZeroHash, nil, fmt.Errorf("failed to read commit %s: %w", hash, err)
+	}
 	worktree, err := repo.Worktree()
 	if err != nil {
-		return err
+		return nil, plumbing.ZeroHash, nil, err
 	}
 
+	CurrentStatus.SetPhase("checkout")
 	err = worktree.Checkout(&git.CheckoutOptions{
 		Hash: *hash,
 	})
 	if err != nil {
-		return err
+		return nil, plumbing.ZeroHash, nil, err
 	}
+	return commitObject, *hash, worktree, nil
+}
 
-	log.Printf("Copying repo folder /%s to local folder %s\n", gitRepo.RepoFolder, localFolder)
+// discardSnapshot removes the snapshot of an apply that failed before it was flipped to
+func (gitRepo *GitRepo) discardSnapshot(applyFolder string) {
+	if gitRepo.Snapshots != nil {
+		gitRepo.Snapshots.Discard(applyFolder)
+	}
+}
 
-	repoSourceFolder := path.Join(tmpDir, gitRepo.RepoFolder)
-	err = SyncDirs(repoSourceFolder, localFolder)
+// writeGitDir syncs the .git of the clone to the local folder, its HEAD detached at the checked out
+// commit, so the application can run git log or git describe there. The remote URLs are written
+// without their credentials
+func writeGitDir(cloneDir, localFolder string) error {
+	dst := filepath.Join(localFolder, ".git")
+	if _, err := SyncDirs(filepath.Join(cloneDir, ".git"), dst, nil); err != nil {
+		return fmt.Errorf("failed to write %s: %w", dst, err)
+	}
+	repo, err := git.PlainOpen(localFolder)
 	if err != nil {
-		log.Printf("failed to copy folders: %v\n", err)
-		return err
+		return fmt.Errorf("failed to open %s: %w", dst, err)
+	}
+	config, err := repo.Config()
+	if err != nil {
+		return fmt.Errorf("failed to read the config of %s: %w", dst, err)
+	}
+	for _, remote := range config.Remotes {
+		for i, url := range remote.URLs {
+			remote.URLs[i] = redactURL(url)
+		}
 	}
+	return repo.SetConfig(config)
+}
 
-	return nil
+// reportPreserved logs how many paths of the local folder the sync left alone since they're gitignored
+// or protected, listing them at the debug level, so important files silently kept don't go unnoticed
+func reportPreserved(changes SyncChanges) {
+	Metrics.Set("git_config_server_preserved_paths", float64(len(changes.Preserved)))
+	if len(changes.Preserved) == 0 {
+		return
+	}
+	log.Printf("kept %d gitignored or protected paths of the local folder\n", len(changes.Preserved))
+	debugf("kept %s\n", strings.Join(changes.Preserved, ", "))
 }
 
-// GitGetLastCommit fetches the last known commit hash in the branch
-func (gitRepo *GitRepo) GetLastCommit() (string, error) {
-	log.Printf("Fetching branch %s of %s\n", gitRepo.URL, gitRepo.Branch)
+// skipped is the commit left unapplied by Skip
+func (gitRepo *GitRepo) skipped() string {
+	gitRepo.stateMu.RLock()
+	defer gitRepo.stateMu.RUnlock()
+	return gitRepo.skippedCommit
+}
+
+// fetchResult is what Fetch wrote, and where from
+type fetchResult struct {
+	changes SyncChanges
+	info    CommitInfo
+	diff    *DiffSummary
+	config  *RepoConfig
+	// files are the ones written to the local folder, nil in memory
+	files map[string]bool
+}
 
-	repo, err := git.Clone(memory.NewStorage(), nil, &git.CloneOptions{
+// Fetch fetches the files from the remote repository into a local folder. If the commit message matches
+// skip, nothing is written and errSyncSkipped is returned. The caller holds the apply lock of the folder
+func (gitRepo *GitRepo) Fetch(ctx context.Context, commit, localFolder string, skip *regexp.Regexp) (fetchResult, error) {
+	// in memory, the clones aren't written anywhere
+	var tmpDir string
+	if gitRepo.Memory == nil {
+		var err error
+		tmpDir, err = os.MkdirTemp("", "git")
+		if err != nil {
+			return fetchResult{}, err
+		}
+		defer os.RemoveAll(tmpDir)
+	}
+	cloneDir := func(name string) string {
+		if tmpDir == "" {
+			return ""
+		}
+		return filepath.Join(tmpDir, name)
+	}
+
+	log.Printf("Fetching commit %s of %s\n", gitRepo.URL, commit)
+	CurrentStatus.StartProgress(Options.ProgressInterval)
+	defer CurrentStatus.EndProgress()
+	CurrentStatus.SetPhase("clone")
+	progress := progressWriter{status: CurrentStatus}
+
+	commitObject, hash, worktree, err := gitRepo.checkout(ctx, cloneDir, commit, progress)
+	if err != nil {
+		return fetchResult{}, err
+	}
+	if skip != nil && skip.MatchString(commitObject.Message) {
+		return fetchResult{}, errSyncSkipped
+	}
+
+	var changes SyncChanges
+	var repoConfig *RepoConfig
+	var files map[string]bool
+	// the unified diffs are kept for --log-diff and the dashboard
+	diffs := &DiffSummary{patches: true}
+	if gitRepo.Memory != nil {
+		log.Printf("Loading repo folder /%s in memory\n", gitRepo.RepoFolder)
+		CurrentStatus.SetPhase("load")
+		files, err := chrootFS(worktree.Filesystem, gitRepo.RepoFolder)
+		if err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		config, err := LoadRepoConfig(files)
+		if err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		if len(config.Evaluate) > 0 {
+			return fetchResult{changes: changes}, fmt.Errorf("the evaluations of %s need the files on disk, not --in-memory", repoConfigFile)
+		}
+		if staged, err := Hooks.Has(HookPreApply); err != nil || staged {
+			if err == nil {
+				err = fmt.Errorf("the %s hooks need the files on disk, not --in-memory", HookPreApply)
+			}
+			return fetchResult{changes: changes}, err
+		}
+		if err := checkTreeSize(files, config, gitRepo.MaxFileSize, gitRepo.MaxTotalSize); err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		changes, err = gitRepo.Memory.Replace(filteredFS{fsys: files, config: config}, diffs)
+		if err != nil {
+			return fetchResult{changes: changes}, fmt.Errorf("failed to compare the files in memory: %w", err)
+		}
+		repoConfig = config
+	} else {
+		log.Printf("Copying repo folder /%s to local folder %s\n", gitRepo.RepoFolder, localFolder)
+
+		repoSourceFolder := filepath.Join(worktree.Filesystem.Root(), filepath.FromSlash(gitRepo.RepoFolder))
+		config, err := LoadRepoConfig(os.DirFS(repoSourceFolder))
+		if err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		if len(config.Evaluate) > 0 {
+			CurrentStatus.SetPhase("evaluate")
+			if err := config.evaluate(ctx, repoSourceFolder); err != nil {
+				return fetchResult{changes: changes}, err
+			}
+		}
+		if gitRepo.Renderer != nil {
+			CurrentStatus.SetPhase("render")
+			rendered := cloneDir("rendered")
+			if err := gitRepo.Renderer.Render(ctx, repoSourceFolder, rendered); err != nil {
+				return fetchResult{changes: changes}, err
+			}
+			repoSourceFolder = rendered
+		}
+		if len(gitRepo.Sources) > 0 {
+			CurrentStatus.SetPhase("compose")
+			if err := gitRepo.composeSources(ctx, repoSourceFolder, cloneDir("sources"), progress); err != nil {
+				return fetchResult{changes: changes}, err
+			}
+		}
+		if staged, err := Hooks.Has(HookPreApply); err != nil {
+			return fetchResult{changes: changes}, err
+		} else if staged {
+			CurrentStatus.SetPhase(HookPreApply)
+			event := Event{Time: time.Now(), Type: EventSyncStarted, Commit: hash.String()}
+			if err := Hooks.RunStaged(ctx, repoSourceFolder, event); err != nil {
+				return fetchResult{changes: changes}, err
+			}
+		}
+		if err := checkTreeSize(os.DirFS(repoSourceFolder), config, gitRepo.MaxFileSize, gitRepo.MaxTotalSize); err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		if gitRepo.CheckCollisions {
+			if err := checkNameCollisions(os.DirFS(repoSourceFolder), config); err != nil {
+				return fetchResult{changes: changes}, err
+			}
+		}
+		config.commit = hash.String()
+		config.mtime = gitRepo.Mtime
+		config.commitTime = commitObject.Committer.When
+		config.deployTime = time.Now()
+		config.xattrs = gitRepo.PreserveXattrs
+		config.chown = gitRepo.ChownRules
+		config.pruneEmpty = gitRepo.PruneEmptyDirs
+		config.keepMarkers = gitRepo.KeepMarkers
+		config.gitDir = gitRepo.IncludeGitDir
+		config.diff = diffs
+		config.decrypt = gitRepo.Decrypt
+		if config.eol, err = newEOLConverter(gitRepo.EOL, repoSourceFolder); err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		label := "initial"
+		if applied := gitRepo.State().Commit; applied != "" {
+			label = shortCommit(applied)
+		}
+		// with snapshots, the files are written to the next one, flipped to once they're all there
+		applyFolder, backupFolder := localFolder, localFolder
+		if gitRepo.Snapshots != nil {
+			backupFolder = gitRepo.Snapshots.Active()
+			if applyFolder, err = gitRepo.Snapshots.Prepare(hash.String()); err != nil {
+				return fetchResult{changes: changes}, err
+			}
+		}
+		if gitRepo.Backups != nil && backupFolder != "" {
+			CurrentStatus.SetPhase("backup")
+			if _, err := gitRepo.Backups.Snapshot(backupFolder, label); err != nil {
+				gitRepo.discardSnapshot(applyFolder)
+				return fetchResult{changes: changes}, err
+			}
+		}
+		CurrentStatus.SetPhase("copy")
+		changes, err = SyncDirs(repoSourceFolder, applyFolder, config, gitRepo.Preserve...)
+		if err != nil {
+			log.Printf("failed to copy folders: %v\n", err)
+			gitRepo.discardSnapshot(applyFolder)
+			return fetchResult{changes: changes}, err
+		}
+		reportPreserved(changes)
+		if gitRepo.IncludeGitDir {
+			if err := writeGitDir(worktree.Filesystem.Root(), applyFolder); err != nil {
+				gitRepo.discardSnapshot(applyFolder)
+				return fetchResult{changes: changes}, err
+			}
+		}
+		if gitRepo.Snapshots != nil {
+			if err := gitRepo.Snapshots.Flip(applyFolder); err != nil {
+				gitRepo.discardSnapshot(applyFolder)
+				return fetchResult{changes: changes}, err
+			}
+		}
+		CurrentStatus.SetPhase("verify")
+		if err := gitRepo.verifyApply(repoSourceFolder, applyFolder, config); err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		if files, err = syncedFiles(repoSourceFolder, config); err != nil {
+			return fetchResult{changes: changes}, err
+		}
+		repoConfig = config
+	}
+
+	subject, _, _ := strings.Cut(commitObject.Message, "\n")
+	var parents []string
+	for _, parent := range commitObject.ParentHashes {
+		parents = append(parents, parent.String())
+	}
+	info := CommitInfo{
+		Hash:           hash.String(),
+		Author:         commitObject.Author.Name,
+		Email:          commitObject.Author.Email,
+		Subject:        subject,
+		Time:           commitObject.Committer.When,
+		AuthorTime:     commitObject.Author.When,
+		Committer:      commitObject.Committer.Name,
+		CommitterEmail: commitObject.Committer.Email,
+		Message:        commitObject.Message,
+		Parents:        parents,
+	}
+	return fetchResult{changes: changes, info: info, diff: diffs, config: repoConfig, files: files}, nil
+}
+
+// clone clones the reference into dir, or every branch if it's empty. A depth of 0 clones the full history.
+// Without a dir, the repo and its worktree are kept in memory. The progress of the remote, if any, is
+// written to progress
+func (gitRepo *GitRepo) clone(ctx context.Context, dir string, depth int, refName plumbing.ReferenceName, progress io.Writer) (*git.Repository, error) {
+	debugf("cloning %s of %s to %s with depth %d\n", orDash(string(refName)), gitRepo.URL, orDash(dir), depth)
+	options := &git.CloneOptions{
 		URL:           gitRepo.URL,
-		Depth:         1,
-		SingleBranch:  true,
-		NoCheckout:    true,
-		ReferenceName: plumbing.NewBranchReferenceName(gitRepo.Branch),
+		Depth:         depth,
+		SingleBranch:  refName != "",
+		ReferenceName: refName,
+		Progress:      progress,
 		Auth: &http.BasicAuth{
 			Username: gitRepo.username,
 			Password: gitRepo.password,
 		},
-	})
+	}
+	if dir == "" {
+		return git.CloneContext(ctx, memory.NewStorage(), memfs.New(), options)
+	}
+	return git.PlainCloneContext(ctx, dir, false, options)
+}
+
+// GitGetLastCommit fetches the last known commit hash in the branch, or the one --ref resolves to. Only
+// the refs advertised by the remote are read, nothing is cloned unless the ref walks the history
+func (gitRepo *GitRepo) GetLastCommit(ctx context.Context) (string, error) {
+	if gitRepo.Ref != "" {
+		return gitRepo.resolveRevision(ctx)
+	}
+	log.Printf("Fetching branch %s of %s\n", gitRepo.URL, gitRepo.Branch)
+
+	refs, err := gitRepo.listRefs(ctx, 0)
 	if err != nil {
 		return "", err
 	}
-	ref, err := repo.Head()
+	refName := plumbing.NewBranchReferenceName(gitRepo.Branch)
+	gitRepo.fetchRef = refName
+	for _, ref := range refs {
+		if ref.Name() == refName && ref.Type() == plumbing.HashReference {
+			commit := ref.Hash().String()
+			log.Printf("last hash in branch %s: %v\n", gitRepo.Branch, commit)
+			return commit, nil
+		}
+	}
+	return "", fmt.Errorf("branch %s not found in %s", gitRepo.Branch, gitRepo.URL)
+}
+
+// listRefs returns the refs advertised by the remote, reusing the last ones if they're younger than
+// maxAge
+func (gitRepo *GitRepo) listRefs(ctx context.Context, maxAge time.Duration) ([]*plumbing.Reference, error) {
+	gitRepo.refsMu.Lock()
+	defer gitRepo.refsMu.Unlock()
+	if maxAge > 0 && gitRepo.advertisedRefs != nil && time.Since(gitRepo.advertisedAt) < maxAge {
+		debugf("reusing the %d references of %s listed %v ago\n", len(gitRepo.advertisedRefs), gitRepo.URL, time.Since(gitRepo.advertisedAt).Round(time.Millisecond))
+		return gitRepo.advertisedRefs, nil
+	}
+	if gitRepo.remote == nil {
+		gitRepo.remote = git.NewRemote(memory.NewStorage(), &config.RemoteConfig{
+			Name: git.DefaultRemoteName,
+			URLs: []string{gitRepo.URL},
+		})
+	}
+	refs, err := gitRepo.remote.ListContext(ctx, &git.ListOptions{
+		Auth: &http.BasicAuth{
+			Username: gitRepo.username,
+			Password: gitRepo.password,
+		},
+		PeelingOption: git.AppendPeeled,
+	})
 	if err != nil {
-		return "", err
+		return nil, fmt.Errorf("failed to list the references of %s: %w", redactURL(gitRepo.URL), err)
+	}
+	debugf("%s advertises %d references\n", gitRepo.URL, len(refs))
+	gitRepo.advertisedRefs = refs
+	gitRepo.advertisedAt = time.Now()
+	return refs, nil
+}
+
+// recordCheck counts a poll of the remote, and whether the branch moved since the previous one, so the
+// update period can be tuned by how often checks find changes
+func (gitRepo *GitRepo) recordCheck(commit string) {
+	gitRepo.stateMu.Lock()
+	defer gitRepo.stateMu.Unlock()
+	gitRepo.remoteChecks++
+	Metrics.Add("git_config_server_remote_checks_total", 1)
+	if commit != gitRepo.lastSeenCommit {
+		gitRepo.lastSeenCommit = commit
+		gitRepo.remoteChanges++
+		Metrics.Add("git_config_server_remote_changes_total", 1)
+	}
+	Metrics.Set("git_config_server_remote_change_ratio", float64(gitRepo.remoteChanges)/float64(gitRepo.remoteChecks))
+}
+
+// ResolveRef looks up a branch or tag in the remote, returning its full reference name and the hash it
+// points to. Anything else is assumed to be a commit hash, returned as is with an empty name
+func (gitRepo *GitRepo) ResolveRef(ctx context.Context, ref string) (string, plumbing.ReferenceName, error) {
+	refs, err := gitRepo.listRefs(ctx, refResolveTTL)
+	if err != nil {
+		return "", "", err
+	}
+
+	candidates := []plumbing.ReferenceName{
+		plumbing.ReferenceName(ref),
+		plumbing.NewBranchReferenceName(ref),
+		plumbing.NewTagReferenceName(ref),
 	}
-	commit := ref.Hash().String()
-	if commit == "" {
-		return "", fmt.Errorf("could not get commit hash")
+	for _, candidate := range candidates {
+		for _, r := range refs {
+			if r.Name() == candidate && r.Type() == plumbing.HashReference {
+				return r.Hash().String(), r.Name(), nil
+			}
+		}
 	}
 
-	log.Printf("last hash in branch %s: %v\n", gitRepo.Branch, commit)
-	return commit, nil
+	if len(ref) >= 4 && len(ref) <= 40 && isHex(ref) {
+		return ref, "", nil
+	}
+	return "", "", fmt.Errorf("%w %q", errUnknownRef, ref)
+}
+
+// Checkout clones the ref resolved by ResolveRef into dir, or in memory if it's empty, returning the
+// repo folder's files and the checked out commit
+func (gitRepo *GitRepo) Checkout(ctx context.Context, ref string, refName plumbing.ReferenceName, dir string) (fs.FS, string, error) {
+	var repo *git.Repository
+	var err error
+	if refName != "" {
+		repo, err = gitRepo.clone(ctx, dir, 1, refName, nil)
+	} else {
+		// commits can be anywhere in the history of any branch
+		repo, err = gitRepo.clone(ctx, dir, 0, "", nil)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return nil, "", err
+	}
+
+	var hash plumbing.Hash
+	if refName != "" {
+		head, err := repo.Head()
+		if err != nil {
+			return nil, "", err
+		}
+		hash = head.Hash()
+	} else {
+		resolved, err := repo.ResolveRevision(plumbing.Revision(ref))
+		if err != nil {
+			return nil, "", fmt.Errorf("commit %s not found: %w", ref, err)
+		}
+		if err := worktree.Checkout(&git.CheckoutOptions{Hash: *resolved}); err != nil {
+			return nil, "", err
+		}
+		hash = *resolved
+	}
+
+	if dir != "" {
+		return newRootFS(filepath.Join(dir, filepath.FromSlash(gitRepo.RepoFolder))), hash.String(), nil
+	}
+	files, err := chrootFS(worktree.Filesystem, gitRepo.RepoFolder)
+	if err != nil {
+		return nil, "", err
+	}
+	return files, hash.String(), nil
+}
+
+var errUnknownRef = errors.New("unknown ref")
+
+func isHex(s string) bool {
+	for _, r := range s {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", r) {
+			return false
+		}
+	}
+	return true
 }
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// TestGitRepoStateRace syncs and rolls back while the state is read, for go test -race to check
+func TestGitRepoStateRace(t *testing.T) {
+	repo, remote, _ := initRemote(t, map[string]string{"app.conf": "v0"})
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gitRepo := NewGitRepo(remote, "master", "", "", "")
+	local := t.TempDir()
+	ctx := context.Background()
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			state := gitRepo.State()
+			_ = state.Diff.String()
+			_ = state.Changes.Added
+			_ = gitRepo.skipped()
+			_, _ = gitRepo.delayed()
+			_ = appliedFields(gitRepo)
+			_ = gitRepo.SyncVars("test")
+			// like the poll of another sync
+			gitRepo.recordCheck("")
+		}
+	}()
+
+	for i := 1; i <= 3; i++ {
+		if err := os.WriteFile(filepath.Join(remote, "app.conf"), []byte(fmt.Sprintf("v%d", i)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := worktree.Add("app.conf"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := worktree.Commit("commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(int64(i), 0)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := gitRepo.Sync(ctx, local); err != nil {
+			t.Fatal(err)
+		}
+		if i > 1 {
+			if err := gitRepo.Rollback(ctx, local); err != nil {
+				t.Fatal(err)
+			}
+			gitRepo.Skip(gitRepo.State().Previous)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	content, err := os.ReadFile(filepath.Join(local, "app.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "v1" {
+		t.Errorf("got %q after rolling back from v3, want v1, which v3 replaced", content)
+	}
+}
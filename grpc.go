@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/diogenes1oliveira/git-config-server/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//go:generate protoc -I pb --go_out=pb --go_opt=paths=source_relative --go-grpc_out=pb --go-grpc_opt=paths=source_relative configserver.proto
+
+// GRPCServer serves the gRPC management API
+type GRPCServer struct {
+	pb.UnimplementedConfigServerServer
+
+	server   *grpc.Server
+	actions  APIActions
+	stopping chan struct{}
+}
+
+// StartGRPCServer binds the port and serves the gRPC API in the background. If tokenHeader is set,
+// calls must send a token in the metadata key of the same name, with the scope of the method, and
+// otherwise only TriggerSync can be called. Tenant tokens can only call GetFile for their own files
+func StartGRPCServer(port int, tokenHeader string, tokens APITokens, tenants Tenants, actions APIActions) (*GRPCServer, error) {
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %d: %w", port, err)
+	}
+
+	authorize := func(ctx context.Context, method string) error {
+		scope := ScopeRead
+		if method == pb.ConfigServer_TriggerSync_FullMethodName {
+			scope = ScopeTrigger
+		}
+		if tokenHeader == "" {
+			if scope == ScopeTrigger {
+				return nil
+			}
+			return status.Error(codes.PermissionDenied, "Not authorized")
+		}
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get(strings.ToLower(tokenHeader)) {
+			if tokens.Allows(value, scope) {
+				return nil
+			}
+		}
+		return status.Error(codes.PermissionDenied, "Not authorized")
+	}
+	authorizeTenant := func(ctx context.Context, slashPath string) bool {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get(strings.ToLower(tokenHeader)) {
+			if _, ok := tenants.Authorize(value, slashPath); ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	s := &GRPCServer{
+		actions:  actions,
+		stopping: make(chan struct{}),
+	}
+	s.server = grpc.NewServer(
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := authorize(ctx, info.FullMethod); err != nil {
+				getFile, ok := req.(*pb.GetFileRequest)
+				if !ok || info.FullMethod != pb.ConfigServer_GetFile_FullMethodName || !authorizeTenant(ctx, getFile.GetPath()) {
+					return nil, err
+				}
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := authorize(ss.Context(), info.FullMethod); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	)
+	pb.RegisterConfigServerServer(s.server, s)
+
+	log.Printf("starting gRPC server on port %d", port)
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			log.Printf("gRPC server stopped: %v\n", err)
+		}
+	}()
+	return s, nil
+}
+
+// Shutdown ends the watch streams, then waits for the running calls until ctx is done
+func (s *GRPCServer) Shutdown(ctx context.Context) {
+	close(s.stopping)
+	done := make(chan struct{})
+	go func() {
+		s.server.GracefulStop()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		s.server.Stop()
+	}
+}
+
+func (s *GRPCServer) GetStatus(ctx context.Context, req *pb.GetStatusRequest) (*pb.Status, error) {
+	snapshot := CurrentStatus.Snapshot()
+	return &pb.Status{
+		StartedAt:           timestamppb.New(snapshot.StartedAt),
+		Commit:              snapshot.Commit,
+		PreviousCommit:      snapshot.Previous,
+		LastSyncAt:          optionalTimestamp(snapshot.LastSyncAt),
+		LastSyncError:       snapshot.LastSyncError,
+		LastSuccessAt:       optionalTimestamp(snapshot.LastSuccessAt),
+		ConsecutiveFailures: int32(snapshot.Failures),
+		LastTrigger:         snapshot.LastTrigger,
+		ChildPid:            int32(snapshot.ChildPid),
+		ChildRunning:        snapshot.ChildRunning,
+		ChildRestarts:       int32(snapshot.ChildRestarts),
+		Paused:              snapshot.Paused,
+		LastChanges:         protoChanges(snapshot.LastChanges),
+	}, nil
+}
+
+func (s *GRPCServer) TriggerSync(ctx context.Context, req *pb.TriggerSyncRequest) (*pb.TriggerSyncResponse, error) {
+	if err := s.actions.Sync("grpc", nil); err != nil {
+		return nil, status.Error(codes.Unavailable, err.Error())
+	}
+	return &pb.TriggerSyncResponse{}, nil
+}
+
+func (s *GRPCServer) WatchChanges(req *pb.WatchChangesRequest, stream pb.ConfigServer_WatchChangesServer) error {
+	events, cancel := Events.Subscribe(EventSyncApplied, EventRolledBack)
+	defer cancel()
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-s.stopping:
+			return nil
+		case event := <-events:
+			snapshot := CurrentStatus.Snapshot()
+			err := stream.Send(&pb.ChangeEvent{
+				Time:           timestamppb.New(event.Time),
+				Type:           string(event.Type),
+				Source:         event.Source,
+				Commit:         event.Commit,
+				PreviousCommit: snapshot.Previous,
+				Changes:        protoChanges(snapshot.LastChanges),
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *GRPCServer) GetFile(ctx context.Context, req *pb.GetFileRequest) (*pb.File, error) {
+	files := servedFS()
+	name, info, err := resolveLocalFile(files, req.GetPath())
+	switch {
+	case errors.Is(err, errInvalidPath), errors.Is(err, errIsDir):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, os.ErrNotExist):
+		return nil, status.Errorf(codes.NotFound, "%s not found", req.GetPath())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	content, err := readServedFile(files, name)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &pb.File{
+		Path:    strings.TrimLeft(req.GetPath(), "/"),
+		Content: content,
+		Mode:    uint32(info.Mode().Perm()),
+		Commit:  CurrentStatus.Snapshot().Commit,
+	}, nil
+}
+
+func optionalTimestamp(t *time.Time) *timestamppb.Timestamp {
+	if t == nil {
+		return nil
+	}
+	return timestamppb.New(*t)
+}
+
+func protoChanges(changes *SyncChanges) *pb.Changes {
+	if changes == nil {
+		return nil
+	}
+	return &pb.Changes{
+		Added:    changes.Added,
+		Modified: changes.Modified,
+		Removed:  changes.Removed,
+	}
+}
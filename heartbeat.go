@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// heartbeatTimeout bounds each POST, so a slow endpoint doesn't delay the next beats
+const heartbeatTimeout = 10 * time.Second
+
+// HeartbeatPayload is POSTed as JSON on every beat
+type HeartbeatPayload struct {
+	Host      string    `json:"host"`
+	Version   string    `json:"version"`
+	Build     BuildInfo `json:"build"`
+	Repo      string    `json:"repo"`
+	Branch    string    `json:"branch"`
+	Ref       string    `json:"ref,omitempty"`
+	Commit    string    `json:"commit,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	SentAt    time.Time `json:"sent_at"`
+	// Health is ok, failing, not_ready, paused or stopping
+	Health              string     `json:"health"`
+	Reason              string     `json:"reason,omitempty"`
+	LastSyncAt          *time.Time `json:"last_sync_at,omitempty"`
+	LastSuccessAt       *time.Time `json:"last_success_at,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	ChildRunning        bool       `json:"child_running"`
+}
+
+// HeartbeatSender POSTs the state of the instance to a central URL every interval, so a fleet can be
+// inventoried without scraping each instance
+type HeartbeatSender struct {
+	url      string
+	interval time.Duration
+	host     string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewHeartbeatSender returns the sender from the options, nil if --heartbeat-url isn't set
+func NewHeartbeatSender() (*HeartbeatSender, error) {
+	if Options.HeartbeatURL == "" {
+		return nil, nil
+	}
+	if _, err := url.ParseRequestURI(Options.HeartbeatURL); err != nil {
+		return nil, fmt.Errorf("invalid --heartbeat-url: %w", err)
+	}
+	if Options.HeartbeatInterval <= 0 {
+		return nil, fmt.Errorf("--heartbeat-interval must be positive")
+	}
+	host, _ := os.Hostname()
+	return &HeartbeatSender{url: Options.HeartbeatURL, interval: Options.HeartbeatInterval, host: host}, nil
+}
+
+// Start beats right away, then every interval
+func (h *HeartbeatSender) Start() {
+	h.stop = make(chan struct{})
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(h.interval)
+		defer ticker.Stop()
+		for {
+			h.beat("")
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Stop beats a last time, with the health set to stopping, so the instance isn't taken for lost
+func (h *HeartbeatSender) Stop() {
+	if h.stop != nil {
+		close(h.stop)
+		<-h.done
+	}
+	h.beat("stopping")
+}
+
+func (h *HeartbeatSender) beat(health string) {
+	body, err := json.Marshal(h.payload(health))
+	if err != nil {
+		log.Printf("failed to encode heartbeat: %v\n", err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), heartbeatTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("failed to send heartbeat: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("failed to send heartbeat: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("failed to send heartbeat: status %d\n", resp.StatusCode)
+	}
+}
+
+// payload describes the instance, its health being the given one if set
+func (h *HeartbeatSender) payload(health string) HeartbeatPayload {
+	snapshot := CurrentStatus.Snapshot()
+	payload := HeartbeatPayload{
+		Host:                h.host,
+		Version:             version,
+		Build:               GetBuildInfo(),
+		Repo:                redactURL(Options.RepoUrl),
+		Branch:              Options.RepoBranch,
+		Ref:                 Options.Ref,
+		Commit:              snapshot.Commit,
+		StartedAt:           snapshot.StartedAt,
+		SentAt:              time.Now(),
+		Health:              health,
+		LastSyncAt:          snapshot.LastSyncAt,
+		LastSuccessAt:       snapshot.LastSuccessAt,
+		ConsecutiveFailures: snapshot.Failures,
+		ChildRunning:        snapshot.ChildRunning,
+	}
+	if payload.Health != "" {
+		return payload
+	}
+	ready, reason := CurrentStatus.Ready(Options.MaxStaleness)
+	switch {
+	case snapshot.Paused:
+		payload.Health = "paused"
+	case snapshot.Failures > 0:
+		payload.Health, payload.Reason = "failing", snapshot.LastSyncError
+	case !ready:
+		payload.Health, payload.Reason = "not_ready", reason
+	default:
+		payload.Health = "ok"
+	}
+	return payload
+}
+
+// redactURL drops the credentials from the URL, if any
+func redactURL(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.User == nil {
+		return rawURL
+	}
+	u.User = nil
+	return u.String()
+}
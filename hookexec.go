@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// tailBuffer keeps the last limit bytes written to it
+type tailBuffer struct {
+	limit     int
+	buf       []byte
+	truncated bool
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.limit {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.limit:]...)
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+// runProcess runs a hook or shell command built by newCmd in its own process group, echoing its output
+// to stderr. After --hook-timeout the group is asked to stop, and killed after --stop-grace-period.
+// On Linux and Windows, anything left running when the command exits is killed too. The outcome is
+// published as a HookFinished event, with the tail of the output
+func runProcess(ctx context.Context, stage, name string, newCmd func(ctx context.Context) *exec.Cmd) error {
+	parent := ctx
+	if Options.HookTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, Options.HookTimeout)
+		defer cancel()
+	}
+
+	cmd := newCmd(ctx)
+	output := &tailBuffer{limit: Options.HookOutputLimit}
+	// a single writer for both streams, so they're captured in order
+	writer := io.MultiWriter(os.Stderr, output)
+	cmd.Stdout = writer
+	cmd.Stderr = writer
+	configureProcess(cmd)
+	cmd.Cancel = func() error {
+		return interruptProcess(cmd)
+	}
+	cmd.WaitDelay = Options.StopGracePeriod
+
+	started := time.Now()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	release, err := attachProcess(cmd)
+	if err != nil {
+		log.Printf("failed to track the process tree of %s: %v\n", name, err)
+		release = func() {}
+	}
+	release()
+	err = cmd.Wait()
+	if errors.Is(err, exec.ErrWaitDelay) {
+		// it exited, but something it started kept the output open until killed
+		err = nil
+	}
+
+	event := Event{
+		Type: EventHookFinished,
+		Fields: map[string]string{
+			"stage":     stage,
+			"hook":      name,
+			"exit_code": strconv.Itoa(cmd.ProcessState.ExitCode()),
+			"duration":  time.Since(started).Round(time.Millisecond).String(),
+		},
+		Output: string(output.buf),
+	}
+	switch {
+	case errors.Is(parent.Err(), context.DeadlineExceeded):
+		// the sync itself ran out of time
+		err = fmt.Errorf("cancelled by the sync deadline")
+		event.Fields["timed_out"] = "true"
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		err = fmt.Errorf("timed out after %v", Options.HookTimeout)
+		event.Fields["timed_out"] = "true"
+	}
+	if output.truncated {
+		event.Fields["output_truncated"] = "true"
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	Events.Publish(event)
+	return err
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Hook stages, each a subdirectory of the hooks directory
+const (
+	// HookPreApply hooks run on the new files before they're applied, in the directory they're staged in,
+	// and may change them. A failure aborts the update, leaving the local folder as it was
+	HookPreApply = "pre-apply"
+	// HookValidate hooks check the synced files before anything else runs. A failure aborts the update,
+	// writing the files of the previous commit back
+	HookValidate = "validate"
+	// HookPreUpdate hooks run right before the application is restarted. A failure aborts the update
+	// like a validation failure
+	HookPreUpdate = "pre-update"
+	// HookPostUpdate hooks run after the application was restarted. Failures are only logged
+	HookPostUpdate = "post-update"
+	// HookDeployFailed hooks run when a deployment integration, like the Nomad jobs, fails after an
+	// update. Failures are only logged
+	HookDeployFailed = "deploy-failed"
+)
+
+// hookDependsFile, in a stage directory, lists what each hook of the stage depends on
+const hookDependsFile = ".depends.yaml"
+
+// HookRunner runs the executables in <dir>/<stage>/ in lexical order, with the event JSON on stdin, or
+// every file with the runner of the stage if it has one. With a .depends.yaml in the stage directory,
+// they run as soon as what they depend on is done instead
+type HookRunner struct {
+	Dir string
+}
+
+// Hooks runs the hooks in --hooks-dir. A runner without a directory does nothing
+var Hooks = &HookRunner{}
+
+// NewHookRunner creates a runner for the hooks directory
+func NewHookRunner(dir string) *HookRunner {
+	return &HookRunner{Dir: dir}
+}
+
+// Run runs every hook of the stage, stopping at the first one that fails
+func (h *HookRunner) Run(ctx context.Context, stage string, event Event) error {
+	return h.run(ctx, stage, event, Stages.WorkingDir(stage))
+}
+
+// RunStaged runs the pre-apply hooks on the files staged in dir, given in STAGED_DIR. It's also their
+// working directory, unless --hook-workdir sets another
+func (h *HookRunner) RunStaged(ctx context.Context, dir string, event Event) error {
+	err := h.run(ctx, HookPreApply, event, Stages.workingDir(HookPreApply, dir), "STAGED_DIR="+dir)
+	if err != nil {
+		return &preApplyError{err}
+	}
+	return nil
+}
+
+// Has is true if the stage has hooks
+func (h *HookRunner) Has(stage string) (bool, error) {
+	if h.Dir == "" {
+		return false, nil
+	}
+	hooks, err := h.List(stage)
+	return len(hooks) > 0, err
+}
+
+// run runs the hooks of the stage in workingDir, adding env to their environment
+func (h *HookRunner) run(ctx context.Context, stage string, event Event, workingDir string, env ...string) error {
+	if h.Dir == "" {
+		return nil
+	}
+	hooks, err := h.List(stage)
+	if err != nil {
+		return err
+	}
+	if len(hooks) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("failed to encode event for %s hooks: %w", stage, err)
+	}
+
+	deps, err := h.dependencies(stage)
+	if err != nil {
+		return err
+	}
+	if deps == nil {
+		for _, hook := range hooks {
+			if err := h.runHook(ctx, stage, hook, payload, event, workingDir, env); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	paths := make(map[string]string, len(hooks))
+	names := make([]string, 0, len(hooks))
+	for _, hook := range hooks {
+		paths[filepath.Base(hook)] = hook
+		names = append(names, filepath.Base(hook))
+	}
+	for name := range deps {
+		if _, ok := paths[name]; !ok {
+			return fmt.Errorf("invalid %s of the %s hooks: %s isn't a hook of the stage", hookDependsFile, stage, name)
+		}
+	}
+	if err := checkDAG(names, deps, Supervised.Has); err != nil {
+		return fmt.Errorf("invalid %s of the %s hooks: %w", hookDependsFile, stage, err)
+	}
+	return runDAG(ctx, names, deps, func(ctx context.Context, name string) error {
+		for _, dep := range deps[name] {
+			if _, ok := paths[dep]; ok {
+				continue
+			}
+			if err := Supervised.WaitReady(ctx, dep); err != nil {
+				return fmt.Errorf("%s hook %s failed: %w", stage, name, err)
+			}
+		}
+		return h.runHook(ctx, stage, paths[name], payload, event, workingDir, env)
+	})
+}
+
+// dependencies reads the .depends.yaml of the stage, mapping the hooks to the other hooks of the stage
+// or the processes of --processes-file they wait for. It's nil without one
+func (h *HookRunner) dependencies(stage string) (map[string][]string, error) {
+	path := filepath.Join(h.Dir, stage, hookDependsFile)
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	deps := make(map[string][]string)
+	if err := yaml.Unmarshal(content, &deps); err != nil {
+		return nil, fmt.Errorf("invalid %s: %w", path, err)
+	}
+	return deps, nil
+}
+
+// List returns the executables of the stage, sorted by name. A missing stage directory has no hooks
+func (h *HookRunner) List(stage string) ([]string, error) {
+	stageDir := filepath.Join(h.Dir, stage)
+	entries, err := os.ReadDir(stageDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s hooks in %s: %w", stage, stageDir, err)
+	}
+
+	var hooks []string
+	for _, entry := range entries {
+		// skip editor backups and dotfiles such as .gitkeep
+		if strings.HasPrefix(entry.Name(), ".") || strings.HasSuffix(entry.Name(), "~") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, fmt.Errorf("failed to stat hook %s: %w", entry.Name(), err)
+		}
+		// with a runner, scripts don't need to be executable
+		if info.IsDir() || (!isHookExecutable(info) && Stages.ScriptRunner(stage) == "") {
+			continue
+		}
+		hooks = append(hooks, filepath.Join(stageDir, entry.Name()))
+	}
+	sort.Strings(hooks)
+	return hooks, nil
+}
+
+func (h *HookRunner) runHook(ctx context.Context, stage, hook string, payload []byte, event Event, workingDir string, env []string) error {
+	log.Printf("running %s hook %s\n", stage, hook)
+	err := runProcess(ctx, stage, filepath.Base(hook), func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, hook)
+		if runner := Stages.ScriptRunner(stage); runner != "" {
+			cmd = exec.CommandContext(ctx, runner, scriptArgs(runner, hook)...)
+		}
+		cmd.Stdin = bytes.NewReader(payload)
+		cmd.Dir = workingDir
+		cmd.Env = append(os.Environ(),
+			"HOOK_STAGE="+stage,
+			"EVENT_TYPE="+string(event.Type),
+			"SYNC_COMMIT="+event.Commit,
+		)
+		cmd.Env = append(cmd.Env, webhookEnv(event)...)
+		cmd.Env = append(cmd.Env, env...)
+		return cmd
+	})
+	if err != nil {
+		return fmt.Errorf("%s hook %s failed: %w", stage, filepath.Base(hook), err)
+	}
+	return nil
+}
+
+// preApplyError is returned when a pre-apply hook refuses the staged files
+type preApplyError struct {
+	err error
+}
+
+func (e *preApplyError) Error() string {
+	return fmt.Sprintf("%s hooks refused the new files: %v", HookPreApply, e.err)
+}
+
+func (e *preApplyError) Unwrap() error {
+	return e.err
+}
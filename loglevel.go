@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// LogLevel is how much is logged: info, or debug for the details of every sync
+type LogLevel int32
+
+const (
+	LogInfo LogLevel = iota
+	LogDebug
+)
+
+var logLevelNames = []string{"info", "debug"}
+
+// currentLogLevel is set by --log-level, and changed at runtime on PUT /admin/loglevel
+var currentLogLevel atomic.Int32
+
+func (level LogLevel) String() string {
+	if level < 0 || int(level) >= len(logLevelNames) {
+		return fmt.Sprintf("LogLevel(%d)", int(level))
+	}
+	return logLevelNames[level]
+}
+
+// ParseLogLevel parses info or debug
+func ParseLogLevel(name string) (LogLevel, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for i, levelName := range logLevelNames {
+		if name == levelName {
+			return LogLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid log level %q, expected one of %s", name, strings.Join(logLevelNames, ", "))
+}
+
+// SetLogLevel changes the level, returning the previous one
+func SetLogLevel(level LogLevel) LogLevel {
+	return LogLevel(currentLogLevel.Swap(int32(level)))
+}
+
+// CurrentLogLevel is the level in use
+func CurrentLogLevel() LogLevel {
+	return LogLevel(currentLogLevel.Load())
+}
+
+// debugf logs only at the debug level
+func debugf(format string, args ...any) {
+	if CurrentLogLevel() >= LogDebug {
+		log.Printf("DEBUG "+format, args...)
+	}
+}
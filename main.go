@@ -2,217 +2,1377 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"os/exec"
 	"os/signal"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
 	"github.com/jessevdk/go-flags"
-	"github.com/joho/godotenv"
-	shellquote "github.com/kballard/go-shellquote"
 )
 
 var Options struct {
-	RepoUrl            string `short:"u" long:"url" description:"Git URL" env:"GIT_URL"`
-	RepoFolder         string `short:"r" long:"repo-folder" required:"false" default:"." description:"Git repo folder" env:"GIT_REPO_FOLDER"`
-	LocalFolder        string `short:"l" long:"local-folder" required:"false" default:"." description:"Git local folder" env:"GIT_LOCAL_FOLDER"`
-	RepoBranch         string `short:"b" long:"branch" default:"master" description:"Git branch" env:"GIT_BRANCH"`
-	Username           string `long:"username" description:"Git username" env:"GIT_USERNAME"`
-	Password           string `long:"password" description:"Git password" env:"GIT_PASSWORD"`
-	UpdatePeriod       int    `long:"update-period" default:"60" description:"Update period in seconds" env:"GIT_UPDATE_PERIOD"`
-	PreUpdateCommand   string `long:"pre-update-command" default:"true" description:"Shell command to run before restarting the application after an update. The working directory will be set to the local repo folder" env:"PRE_UPDATE_COMMAND"`
-	RestartCommand     string `long:"restart-command" default:"" description:"Shell command to run instead of stopping and starting the application after an update. If empty, will stop and start the application." env:"RESTART_COMMAND"`
-	PreUpdateRunner    string `long:"pre-update-runner" default:"bash" description:"Shell to run the pre-update command" env:"PRE_UPDATE_RUNNER"`
-	WebhookPort        int    `long:"webhook-port" default:"0" description:"Port to bind the webhook server to" env:"WEBHOOK_PORT"`
-	WebhookTokenValue  string `long:"webhook-token-value" default:"" description:"Token value to authenticate requests" env:"WEBHOOK_TOKEN_VALUE"`
-	WebhookTokenHeader string `long:"webhook-token-header" default:"" description:"Header with the token value" env:"WEBHOOK_TOKEN_HEADER"`
+	EnvFiles           []string      `long:"env-file" description:"File of KEY=value lines loaded into the environment on startup, before the other options, which it can set. Can be repeated, the later files overriding the earlier ones; the variables already in the environment are kept. Defaults to .env, if it exists" env:"ENV_FILE" env-delim:","`
+	NoEnvFile          bool          `long:"no-env-file" description:"Don't load any env file on startup, not even .env" env:"NO_ENV_FILE"`
+	RepoEnvFile        string        `long:"repo-env-file" default:"" description:"Env file in the local folder loaded after every sync, before the hooks, into the environment of the hooks, the commands and the application started after it. Variables removed from it are removed too, and those of the server's own environment are kept" env:"REPO_ENV_FILE"`
+	RepoUrl            string        `short:"u" long:"url" description:"Git URL" env:"GIT_URL"`
+	RepoFolder         string        `short:"r" long:"repo-folder" required:"false" default:"." description:"Git repo folder" env:"GIT_REPO_FOLDER"`
+	LocalFolder        string        `short:"l" long:"local-folder" required:"false" default:"." description:"Git local folder" env:"GIT_LOCAL_FOLDER"`
+	RepoBranch         string        `short:"b" long:"branch" default:"master" description:"Git branch" env:"GIT_BRANCH"`
+	Ref                string        `long:"ref" default:"" description:"Revision to sync instead of the head of --branch: HEAD, a branch, a tag, a full commit hash, or an expression on them like main~2 or v1.2.0^{}. Names are looked up as a full ref, then as a branch, then as a tag. Tags and names are resolved from the refs the remote advertises; ~ and ^ need a clone of the history, done again only when their base moves" env:"GIT_REF"`
+	Username           string        `long:"username" description:"Git username" env:"GIT_USERNAME"`
+	Password           string        `long:"password" description:"Git password" env:"GIT_PASSWORD" noexpand:"yes" secret:"yes"`
+	UpdatePeriod       int           `long:"update-period" default:"60" description:"Update period in seconds" env:"GIT_UPDATE_PERIOD"`
+	WaitForConfig      bool          `long:"wait-for-config" description:"Only start the application and the processes of --processes-file once the first sync went through. Otherwise they start on whatever the local folder has, and are restarted once it does. The first sync is tried again sooner than --update-period until then" env:"WAIT_FOR_CONFIG"`
+	SyncDeadline       time.Duration `long:"sync-deadline" default:"0" description:"Longest a sync can take, from the check of the remote to the restart, like 5m. A sync past it is cancelled and fails with a timeout; if the new files were already written, those of the previous commit are put back and the new commit is tried again by the next sync. 0 disables" env:"SYNC_DEADLINE"`
+	PreUpdateCommand   string        `long:"pre-update-command" default:"true" description:"Shell command to run before restarting the application after an update. The working directory will be set to the local repo folder. Placeholders like {{.Commit}}, {{.Branch}} or {{quote .Subject}} are resolved on every sync" env:"PRE_UPDATE_COMMAND" noexpand:"yes"`
+	RestartCommand     string        `long:"restart-command" default:"" description:"Shell command to run instead of stopping and starting the application after an update, with the runner in the working directory of the restart stage of --hook-runner and --hook-workdir, and the pid of the application in APP_PID. If empty, will stop and start the application. If the application isn't running, it's started instead. Placeholders like {{.Commit}}, {{.ShortCommit}}, {{.Previous}}, {{.Branch}}, {{.Trigger}} or {{quote .Subject}} are resolved on every restart" env:"RESTART_COMMAND" noexpand:"yes"`
+	RestartExec        bool          `long:"restart-exec" description:"Run --restart-command directly, split into arguments like a shell would, instead of with a runner. Pipes, redirections, && and variables like $APP_PID don't work then" env:"RESTART_EXEC"`
+	RestartRetries     int           `long:"restart-retries" default:"0" description:"How many more times the restart command is run when it fails, or when --restart-check doesn't pass after it" env:"RESTART_RETRIES"`
+	RestartRetryDelay  time.Duration `long:"restart-retry-delay" default:"5s" description:"Time to wait before running a failed restart command again" env:"RESTART_RETRY_DELAY"`
+	RestartFallback    string        `long:"restart-fallback" default:"stop-start" choice:"stop-start" choice:"none" description:"What to do when the restart command still fails after --restart-retries: stop and start the application, if there's one, or fail the restart" env:"RESTART_FALLBACK"`
+	RestartCheck       string        `long:"restart-check" default:"" description:"Check the application must pass after a restart: an http:// or https:// URL answering a GET with a 2xx or 3xx status, or a shell command exiting with 0, run like --restart-command. Checked every second until --restart-check-timeout" env:"RESTART_CHECK" noexpand:"yes"`
+	RestartCheckWait   time.Duration `long:"restart-check-timeout" default:"30s" description:"How long --restart-check has to pass after a restart" env:"RESTART_CHECK_TIMEOUT"`
+	PreUpdateRunner    string        `long:"pre-update-runner" default:"bash" description:"Shell to run the pre-update, restart, on-failure and on-stale commands and the validate commands of the repo, unless --hook-runner sets another for their stage" env:"PRE_UPDATE_RUNNER"`
+	HookRunners        []string      `long:"hook-runner" description:"Runner of a stage, as stage=runner, like on-failure=sh or validate=pwsh. It runs the commands of the stage instead of --pre-update-runner, and its executables in --hooks-dir, which are run directly otherwise. The stages are pre-apply, validate, pre-update, post-update, deploy-failed, restart, on-failure and on-stale. Can be repeated" env:"HOOK_RUNNERS" env-delim:","`
+	HookWorkDirs       []string      `long:"hook-workdir" description:"Working directory of the commands and the hooks of a stage, as stage=dir, like restart=/srv/app. Relative directories are in the local folder, which is the default. Can be repeated" env:"HOOK_WORKDIRS" env-delim:","`
+	WebhookPort        int           `long:"webhook-port" default:"0" description:"Port to bind the webhook server to" env:"WEBHOOK_PORT"`
+	WebhookTokenValue  string        `long:"webhook-token-value" default:"" description:"Token value to authenticate requests" env:"WEBHOOK_TOKEN_VALUE" noexpand:"yes" secret:"yes"`
+	WebhookTokenHeader string        `long:"webhook-token-header" default:"" description:"Header with the token value. Without it, the API can only trigger syncs" env:"WEBHOOK_TOKEN_HEADER"`
+	WebhookSecret      string        `long:"webhook-secret" default:"" description:"Secret the webhook deliveries on / are signed with, in X-Hub-Signature-256 or in X-Webhook-Signature along with X-Webhook-Timestamp. When set, the token isn't enough to trigger a sync" env:"WEBHOOK_SECRET" noexpand:"yes" secret:"yes"`
+	ReplayWindow       time.Duration `long:"webhook-replay-window" default:"5m" description:"How far X-Webhook-Timestamp can be from now, and how long the signatures of timestamped deliveries are remembered to refuse replays. Those of untimestamped deliveries are remembered for the last 100000" env:"WEBHOOK_REPLAY_WINDOW"`
+	WebhookPath        string        `long:"webhook-path" default:"/" description:"Path the webhook deliveries trigger syncs on, like /hooks. / takes any path the API doesn't" env:"WEBHOOK_PATH"`
+	WebhookRoutes      []string      `long:"webhook-route" description:"Extra path triggering syncs for the deliveries of a provider, checked its own way, as provider:/path:secret. github checks X-Hub-Signature-256, gitea X-Gitea-Signature, gitlab that X-Gitlab-Token is the secret; generic takes the token of --webhook-token-header and no secret. Can be repeated" env:"WEBHOOK_ROUTES" env-delim:"," noexpand:"yes" secret:"yes"`
+	AccessLogFormat    string        `long:"access-log" default:"clf" choice:"clf" choice:"json" choice:"off" description:"Format of the access log of the webhook server: the Common Log Format, one JSON object per request with its duration and the route that served it, or off" env:"ACCESS_LOG"`
+	AccessLogOutput    string        `long:"access-log-output" default:"stderr" description:"Where the access log goes: stdout, stderr or a file, appended to" env:"ACCESS_LOG_OUTPUT"`
+	TrustedProxies     []string      `long:"trusted-proxy" description:"CIDR or address of a proxy in front of the webhook server, like 10.0.0.0/8, whose X-Forwarded-For and X-Real-IP headers are believed for the client address in the logs and the rate limit. Can be repeated" env:"TRUSTED_PROXIES" env-delim:","`
+	RateLimit          float64       `long:"rate-limit" default:"0" description:"Requests per second each client can make to the webhook server, answered 429 above it. The health probes and the control socket aren't limited. 0 doesn't limit" env:"RATE_LIMIT"`
+	RateLimitBurst     int           `long:"rate-limit-burst" default:"20" description:"Requests a client can make at once before --rate-limit applies" env:"RATE_LIMIT_BURST"`
+	WebhookFailure     string        `long:"webhook-failure" default:"exit" choice:"exit" choice:"retry" description:"What to do when the webhook server stops serving on one of its listeners after the startup: exit with an error, so the orchestrator can reschedule, or listen again with a growing delay while the rest keeps running" env:"WEBHOOK_FAILURE"`
+	ReadHeaderTimeout  time.Duration `long:"http-read-header-timeout" default:"10s" description:"Longest the webhook server waits for the headers of a request, so slow clients can't hold connections open. 0 disables" env:"HTTP_READ_HEADER_TIMEOUT"`
+	ReadTimeout        time.Duration `long:"http-read-timeout" default:"1m" description:"Longest the webhook server takes reading a whole request, body included. 0 disables" env:"HTTP_READ_TIMEOUT"`
+	WriteTimeout       time.Duration `long:"http-write-timeout" default:"1m" description:"Longest the webhook server takes answering a request. /watch gets its timeout on top of it, and /ws isn't bound by it. 0 disables" env:"HTTP_WRITE_TIMEOUT"`
+	IdleTimeout        time.Duration `long:"http-idle-timeout" default:"2m" description:"Longest a keep-alive connection to the webhook server stays open between requests. 0 uses the read timeout" env:"HTTP_IDLE_TIMEOUT"`
+	MaxHeaderBytes     ByteSize      `long:"http-max-header-bytes" default:"1MiB" description:"Largest request headers the webhook server accepts, like 64KiB" env:"HTTP_MAX_HEADER_BYTES"`
+	ProcessesFile      string        `long:"processes-file" default:"" description:"YAML file of processes to supervise along with the application, in the local folder, each with its own restart rules, on_exit policy, health check and depends_on, the processes that must be ready before it starts. The application's command is optional with it" env:"PROCESSES_FILE"`
+	ChildEnvAllow      []string      `long:"child-env-allow" description:"Glob pattern of the environment variables the application and the processes of --processes-file inherit, like APP_* or PATH. Without any, they inherit all but the denied ones. Can be repeated" env:"CHILD_ENV_ALLOW" env-delim:","`
+	ChildEnvDeny       []string      `long:"child-env-deny" default:"GIT_PASSWORD" default:"WEBHOOK_TOKEN_VALUE" default:"WEBHOOK_SECRET" default:"WEBHOOK_ROUTES" default:"API_TOKENS" default:"TENANTS" default:"ENCRYPT_KEY" default:"SIGNING_KEY" default:"NOMAD_TOKEN" default:"SLACK_WEBHOOK_URL" description:"Glob pattern of the environment variables the application and the processes of --processes-file don't inherit, even if allowed. Defaults to the secrets of this server. Can be repeated" env:"CHILD_ENV_DENY" env-delim:","`
+	TTY                bool          `long:"tty" description:"Run the application in a pseudo-terminal, for programs that only color their output or prompt in one. The terminal of the server, if any, is relayed to it in raw mode, Ctrl-C included (Linux only). Without it, the application gets the server's stdin" env:"TTY"`
+	StopGracePeriod    time.Duration `long:"stop-grace-period" default:"10s" description:"Time to wait for the application to exit after asking it to stop (SIGTERM or CTRL_BREAK) before killing its process tree" env:"STOP_GRACE_PERIOD"`
+	ShutdownTimeout    time.Duration `long:"shutdown-timeout" default:"30s" description:"Maximum time for a clean shutdown before exiting with an error" env:"SHUTDOWN_TIMEOUT"`
+	ControlSocket      string        `long:"control-socket" default:"" description:"Unix socket to serve the API on for local control, used by the status, sync, pause, resume and history subcommands" env:"CONTROL_SOCKET"`
+	Version            bool          `short:"V" long:"version" description:"Print version and build information, then exit"`
+	CheckUpdate        bool          `long:"check-update" description:"Check GitHub releases for a newer version. With --version, prints the result; otherwise it's logged on startup" env:"CHECK_UPDATE"`
+	PrintConfig        bool          `long:"print-config" description:"Print the options as resolved from the flags, the environment and the env files, secrets masked, then exit"`
+	OnFailureCommand   string        `long:"on-failure-command" default:"" description:"Shell command to run when --max-consecutive-failures is reached, or right away when a commit exceeds --max-file-size or --max-total-size, with SYNC_ERROR and SYNC_FAILURES in the environment" env:"ON_FAILURE_COMMAND" noexpand:"yes"`
+	MaxFailures        int           `long:"max-consecutive-failures" default:"0" description:"Exit with an error after this many sync attempts fail in a row, so the orchestrator can reschedule. 0 disables" env:"MAX_CONSECUTIVE_FAILURES"`
+	MaxStaleness       time.Duration `long:"max-staleness" default:"0" description:"Mark the instance as not ready on /ready and fire the on-stale command if no sync succeeded for this long. 0 disables" env:"MAX_STALENESS"`
+	HooksDir           string        `long:"hooks-dir" default:"" description:"Directory with pre-apply/, validate/, pre-update/ and post-update/ subdirectories of executables to run in order on updates, with the event JSON on stdin. The pre-apply hooks run on the new files before they're applied, in the directory they're staged in, also in STAGED_DIR, and may change them; if one fails, the local folder is left as it was. A .depends.yaml in a stage maps its hooks to the hooks or processes they wait for, running the others at the same time. For webhook syncs, WEBHOOK_PAYLOAD has the path of the delivery's payload, along with WEBHOOK_PUSHER, WEBHOOK_COMPARE_URL, WEBHOOK_REF and WEBHOOK_AFTER when known" env:"HOOKS_DIR"`
+	GRPCPort           int           `long:"grpc-port" default:"0" description:"Port to serve the gRPC API on. Calls are authenticated with the webhook token, sent in the metadata key named after --webhook-token-header" env:"GRPC_PORT"`
+	APITokens          []string      `long:"api-token" description:"Extra token for the API, sent in --webhook-token-header, as name:scope:token. read tokens can only read the status, the metrics, the history and the files; trigger ones can also trigger syncs; admin ones can do anything, like --webhook-token-value. Can be repeated" env:"API_TOKENS" env-delim:"," noexpand:"yes" secret:"yes"`
+	Tenants            []string      `long:"tenant" description:"Tenant allowed to read only its files over /files and GetFile, as name:prefix:token. The token is sent in --webhook-token-header. Tenants authenticate by token only, as the server has no TLS to check client certificates with; terminate mTLS in a proxy in front of it. Can be repeated" env:"TENANTS" env-delim:"," noexpand:"yes" secret:"yes"`
+	EncryptKey         string        `long:"encrypt-key" default:"" description:"Secret for the {cipher} values: enables /encrypt and /decrypt and decrypts the values when serving files" env:"ENCRYPT_KEY" noexpand:"yes" secret:"yes"`
+	DecryptOnApply     bool          `long:"decrypt-on-apply" description:"Also decrypt the {cipher} values of the files written to the local folder, with --encrypt-key. Their plaintext is then on disk, so restrict their mode with a policy of .gitsync.yaml" env:"DECRYPT_ON_APPLY"`
+	MergeOutput        string        `long:"merge-output" default:"" description:"File in the local folder to write the merged config of --merge-app and --merge-profiles to after every sync. The format comes from its extension" env:"MERGE_OUTPUT"`
+	MergeApp           string        `long:"merge-app" default:"application" description:"Application whose layers are merged into --merge-output" env:"MERGE_APP"`
+	MergeProfiles      []string      `long:"merge-profiles" description:"Profiles whose layers are merged into --merge-output, later ones taking precedence. Can be repeated" env:"MERGE_PROFILES" env-delim:","`
+	DataDir            string        `long:"data-dir" default:"" description:"Writable directory for everything written outside the local folder, like the temporary clones, the ref cache and the pending triggers, so the root filesystem can be read-only. Commands and hooks get their TMPDIR inside it too" env:"DATA_DIR"`
+	SandboxNoNewPrivs  bool          `long:"sandbox-no-new-privs" description:"Run the application with no_new_privs, so setuid binaries and file capabilities can't raise its privileges (Linux only)" env:"SANDBOX_NO_NEW_PRIVS"`
+	SandboxDropCaps    []string      `long:"sandbox-drop-caps" description:"Capability to drop from the application, like NET_RAW, or ALL. Can be repeated (Linux only)" env:"SANDBOX_DROP_CAPS" env-delim:","`
+	SandboxSeccomp     string        `long:"sandbox-seccomp" default:"" description:"Compiled seccomp BPF filter to load in the application, as exported by libseccomp's seccomp_export_bpf. Implies --sandbox-no-new-privs (Linux only)" env:"SANDBOX_SECCOMP"`
+	SandboxPrivateTmp  bool          `long:"sandbox-private-tmp" description:"Give the application its own empty /tmp in a private mount namespace. Needs CAP_SYS_ADMIN (Linux only)" env:"SANDBOX_PRIVATE_TMP"`
+	InMemory           bool          `long:"in-memory" description:"Keep the synced files in memory and only serve them over the HTTP and gRPC APIs, never writing to the local folder" env:"IN_MEMORY"`
+	SigningKey         string        `long:"signing-key" default:"" description:"PEM private key (Ed25519, ECDSA or RSA) to sign the served config with, as a detached JWS in X-Config-Signature" env:"SIGNING_KEY" noexpand:"yes" secret:"yes"`
+	RefCacheSize       int           `long:"ref-cache-size" default:"8" description:"How many refs requested with ?ref= to keep checked out. 0 disables ?ref=" env:"REF_CACHE_SIZE"`
+	CacheMaxSize       ByteSize      `long:"cache-max-size" default:"0" description:"Most disk, or memory with --in-memory, the refs checked out for ?ref= may take, history included, like 512MiB. The least recently used ones are removed first. 0 only limits their number" env:"CACHE_MAX_SIZE"`
+	OnStaleCommand     string        `long:"on-stale-command" default:"" description:"Shell command to run once the config becomes stale, with STALE_SINCE in the environment" env:"ON_STALE_COMMAND" noexpand:"yes"`
+	AuditLog           string        `long:"audit-log" default:"" description:"File to append events (syncs, restarts, triggers) to as JSON lines. If empty, they're only logged" env:"AUDIT_LOG"`
+	EventWebhookURLs   []string      `long:"event-webhook-url" description:"URL to POST events to as JSON. Can be repeated" env:"EVENT_WEBHOOK_URLS" env-delim:","`
+	SlackWebhookURL    string        `long:"slack-webhook-url" default:"" description:"Slack incoming webhook URL to post events to" env:"SLACK_WEBHOOK_URL" secret:"yes"`
+	NotifyEvents       []string      `long:"notify-events" description:"Event types sent to the webhook and Slack sinks. Can be repeated; if empty, all events are sent" env:"NOTIFY_EVENTS" env-delim:","`
+	PushgatewayURL     string        `long:"pushgateway-url" default:"" description:"Prometheus Pushgateway to push the metrics to after every sync, every --push-interval and on exit, for runs too short to be scraped" env:"PUSHGATEWAY_URL"`
+	PushJob            string        `long:"push-job" default:"git_config_server" description:"Job the metrics are pushed under, along with the hostname as the instance" env:"PUSH_JOB"`
+	StatsDAddress      string        `long:"statsd-address" default:"" description:"host:port to send the metrics to over StatsD (UDP) after every sync, every --push-interval and on exit" env:"STATSD_ADDRESS"`
+	StatsDTags         bool          `long:"statsd-tags" description:"Send the metric labels as DogStatsD tags instead of appending their values to the names" env:"STATSD_TAGS"`
+	PushInterval       time.Duration `long:"push-interval" default:"30s" description:"How often to push the metrics to the Pushgateway and StatsD besides the syncs. 0 only pushes after syncs and on exit" env:"PUSH_INTERVAL"`
+	HeartbeatURL       string        `long:"heartbeat-url" default:"" description:"URL to POST a heartbeat to as JSON every --heartbeat-interval, with the host, the version, the applied commit and the health, to inventory a fleet. Credentials in the URL are sent with basic auth" env:"HEARTBEAT_URL"`
+	HeartbeatInterval  time.Duration `long:"heartbeat-interval" default:"1m" description:"How often to send the heartbeat" env:"HEARTBEAT_INTERVAL"`
+	HookTimeout        time.Duration `long:"hook-timeout" default:"5m" description:"Maximum run time of each hook and of the pre-update, restart, on-stale and on-failure commands. On timeout, its process group is stopped like the application and the hook fails. 0 disables" env:"HOOK_TIMEOUT"`
+	HookOutputLimit    int           `long:"hook-output-limit" default:"16384" description:"Bytes of the end of each hook's output to keep in its HookFinished event, e.g. in the audit log" env:"HOOK_OUTPUT_LIMIT"`
+	SkipSyncPattern    string        `long:"skip-sync-pattern" default:"(?i)\\[skip sync\\]" description:"Regular expression that leaves a new commit unapplied when its message matches, until a newer commit comes. The commit is still applied on startup. Empty disables" env:"SKIP_SYNC_PATTERN"`
+	NoRestartPattern   string        `long:"no-restart-pattern" default:"(?i)\\[no restart\\]" description:"Regular expression that applies a new commit without restarting the application when its message matches. Empty disables" env:"NO_RESTART_PATTERN"`
+	BackupDir          string        `long:"backup-dir" default:"" description:"Directory outside the local folder to archive the local folder to before every apply, as <time>-<live commit>.tar.gz. A failed backup aborts the apply. Empty disables" env:"BACKUP_DIR"`
+	BackupKeep         int           `long:"backup-keep" default:"10" description:"How many of the latest backups to keep in --backup-dir. 0 keeps them all" env:"BACKUP_KEEP"`
+	SnapshotKeep       time.Duration `long:"snapshot-keep" default:"0" description:"How long to keep the backups in --backup-dir, like 168h, checked hourly. The latest one is always kept. 0 keeps them regardless of their age" env:"SNAPSHOT_KEEP"`
+	VerifyApply        bool          `long:"verify-apply" description:"Hash the synced files after every apply and compare them with the repo. On a mismatch the commit is applied again, and the sync fails if it still doesn't match" env:"VERIFY_APPLY"`
+	ManifestFile       string        `long:"manifest-file" default:"" description:"File to write the SHA-256 of the synced files to after every apply, in the sha256sum format with paths relative to the local folder. Relative paths are inside the local folder" env:"MANIFEST_FILE"`
+	ProgressInterval   time.Duration `long:"progress-interval" default:"10s" description:"How often to log the progress of a running sync (phase, files and bytes copied, remote progress), which is also on /status. 0 disables the logs" env:"PROGRESS_INTERVAL"`
+	MaxFileSize        ByteSize      `long:"max-file-size" default:"0" description:"Refuse to sync a commit with a synced file bigger than this, like 10MB, running the on-failure command right away. 0 disables" env:"MAX_FILE_SIZE"`
+	MaxTotalSize       ByteSize      `long:"max-total-size" default:"0" description:"Refuse to sync a commit whose synced files add up to more than this, like 1GiB, running the on-failure command right away. 0 disables" env:"MAX_TOTAL_SIZE"`
+	EOL                string        `long:"eol" default:"" description:"Convert the line endings of the text files written to the local folder to lf, crlf or auto, the ones of this platform. The text and eol attributes of .gitattributes are honored, and files without a text attribute are text unless they have NUL bytes. Empty copies the files as is" env:"EOL"`
+	NameCollisions     string        `long:"filename-collisions" default:"auto" description:"What to do with commits whose paths only differ in case or Unicode normalization, which case-insensitive or normalizing filesystems can't keep apart: fail refuses them, ignore applies them, auto refuses them on Windows and macOS" env:"FILENAME_COLLISIONS"`
+	Mtime              string        `long:"mtime" default:"write" choice:"write" choice:"commit" choice:"source" description:"Modification time of the files written to the local folder: the time they're written, the time of the commit, or the one of the checked out file" env:"MTIME"`
+	PreserveXattrs     bool          `long:"preserve-xattrs" description:"Keep the extended attributes of the files in the local folder, like SELinux labels and ACLs, when a sync replaces them rather than rewriting them in place (Linux only)" env:"PRESERVE_XATTRS"`
+	ChownRules         []string      `long:"chown-rule" description:"Owner, group and mode of the files and directories in the local folder matching a gitignore-style pattern, as pattern=owner:group:mode, like certs/**=root:ssl-cert:0640. Any of them may be empty, and directories get x along with r. Applied after every sync when running as root; the last matching rule wins. Can be repeated" env:"CHOWN_RULES" env-delim:","`
+	PruneEmptyDirs     bool          `long:"prune-empty-dirs" description:"Remove the directories left empty in the local folder after a sync, like those whose files were all removed or excluded" env:"PRUNE_EMPTY_DIRS"`
+	KeepMarkers        []string      `long:"keep-marker" default:".keep" description:"Name of the files that keep their directory with --prune-empty-dirs. They're never removed from the local folder, even if they aren't in the repo. Can be repeated" env:"KEEP_MARKERS" env-delim:","`
+	Sources            []string      `long:"source" description:"Other repository composed into a subdirectory of the synced files on every sync, like shared org-wide config, as dir=url, optionally followed by //folder for a folder of it and #branch for another branch than master, like shared=https://github.com/org/config.git//prod#main. It uses the same credentials. The sync fails if the repo has something in that directory. A new commit in any of them applies the files again. Can be repeated" env:"SOURCES" env-delim:","`
+	SnapshotDir        string        `long:"snapshot-dir" default:"" description:"Write every applied tree to its own directory in this one, named after its commit, the local folder becoming a symlink to the active one. Applies and rollbacks flip the symlink at once, so the application never sees a half-written tree. The local folder must be a symlink, missing or empty" env:"SNAPSHOT_DIR"`
+	SnapshotCount      int           `long:"snapshot-count" default:"3" description:"Snapshots kept in --snapshot-dir, the active one included. At least 2, for rollbacks" env:"SNAPSHOT_COUNT"`
+	WatchWrites        string        `long:"watch-writes" default:"off" choice:"off" choice:"warn" choice:"block" description:"Watch the local folder between the applies for the files other processes write, like an application using it as scratch space, except the gitignored and protected ones: off, warn to log them, or block to also refuse the next apply until they're confirmed with POST /admin/writes/confirm (Linux only)" env:"WATCH_WRITES"`
+	DirMode            string        `long:"dir-mode" default:"0775" description:"Octal permissions of the directories created in the local folder, masked by the umask like mkdir, e.g. 0750 for a folder with secrets. A --chown-rule matching a directory takes precedence" env:"DIR_MODE"`
+	Umask              string        `long:"umask" description:"Octal umask set at startup, masking the permissions of everything written by the syncs, the hooks and the application, e.g. 0027. Defaults to the inherited one (not supported on Windows)" env:"UMASK"`
+	IncludeGitDir      bool          `long:"include-git-dir" description:"Also write a shallow .git to the local folder, its HEAD at the applied commit, so the application can run git log or git describe on its config. The remote URL is written without credentials. Without it, the .git of the local folder is removed" env:"INCLUDE_GIT_DIR"`
+	AckTimeout         time.Duration `long:"ack-timeout" default:"0" description:"Wait this long after every apply for the application to acknowledge it loaded the new files, with POST /ack or by touching --ack-file, rolling back to the previous commit otherwise. The rolled back commit isn't applied again until a newer one comes. 0 disables" env:"ACK_TIMEOUT"`
+	AckNotify          string        `long:"ack-notify" default:"" description:"How to tell the application to load the new files with --ack-timeout instead of restarting it: signal:NAME sends it a signal like signal:HUP, a URL gets a POST with the sync placeholders as JSON" env:"ACK_NOTIFY"`
+	AckFile            string        `long:"ack-file" default:"" description:"File the application touches to acknowledge an apply with --ack-timeout, which counts once it's modified after the notification" env:"ACK_FILE"`
+	StatusBranch       string        `long:"status-branch" default:"" description:"Branch to commit a JSON file with the result of every apply to (host, applied commit, time, result, error), pushed in the background, for a git view of which hosts run which commit. Created if missing. Empty disables" env:"STATUS_BRANCH"`
+	StatusRepoUrl      string        `long:"status-url" default:"" description:"Repository of --status-branch, with the same credentials. Defaults to the config repository" env:"STATUS_URL"`
+	StatusFile         string        `long:"status-file" default:"" description:"Path of the file of this host in --status-branch. Defaults to <hostname>.json" env:"STATUS_FILE"`
+	DeployTag          string        `long:"deploy-tag" default:"" description:"Lightweight tag pushed to the config repo, with the same credentials, pointing to every commit applied successfully (validated, restarted and acknowledged), like deployed/{{.Host}} for the hostname. Empty disables" env:"DEPLOY_TAG"`
+	ApplyDelayHash     time.Duration `long:"apply-delay-hash" default:"0" description:"Window to spread the applies of a new commit across a fleet over: each host waits a delay derived from the hash of --apply-delay-key, always the same, before applying it. The commit applied on startup isn't delayed. 0 disables" env:"APPLY_DELAY_HASH"`
+	ApplyDelayKey      string        `long:"apply-delay-key" default:"" description:"Key hashed into the delay of --apply-delay-hash, so hosts can be ordered explicitly. Defaults to the hostname" env:"APPLY_DELAY_KEY"`
+	GateURL            string        `long:"gate-url" default:"" description:"URL asked with a GET, with the commit and host query parameters, before applying a new commit. Answering hold, or JSON with a status of hold or the commit in denied_commits (and an optional reason), defers the apply until a later sync. The commit applied on startup isn't gated. Empty disables" env:"GATE_URL"`
+	GateFailOpen       bool          `long:"gate-fail-open" description:"Apply the new commits when --gate-url can't be reached or fails, instead of holding them" env:"GATE_FAIL_OPEN"`
+	Render             string        `long:"render" default:"" description:"Sync the output of kustomize build or helm template of the repo folder, one file per resource or template, instead of the folder itself: kustomize or helm, which must be in the PATH. The .gitsync.yaml of the repo folder still applies. Empty disables" env:"RENDER"`
+	RenderArgs         string        `long:"render-args" default:"" description:"Extra arguments of --render, like --values values-prod.yaml for helm" env:"RENDER_ARGS"`
+	RestartCompose     string        `long:"restart-compose" default:"" description:"Docker Compose project to bring up to date, like docker compose up -d, on startup and instead of restarting the application after an update, with a compose file in the local folder. Empty disables" env:"RESTART_COMPOSE"`
+	ComposeFile        string        `long:"compose-file" default:"" description:"Compose file of --restart-compose, relative to the local folder. Empty looks for the default names, like compose.yaml" env:"COMPOSE_FILE"`
+	ComposeCommand     string        `long:"compose-command" default:"docker compose" description:"Compose CLI of --restart-compose" env:"COMPOSE_COMMAND"`
+	NomadAddr          string        `long:"nomad-addr" default:"" description:"Nomad API address, like http://127.0.0.1:4646, to plan and run the job specs added or modified by every sync on. Jobs whose plan can't place every allocation aren't run, and fire NomadJobFailed events and the deploy-failed hooks. Removed specs are left running. Empty disables" env:"NOMAD_ADDR"`
+	NomadToken         string        `long:"nomad-token" default:"" description:"ACL token of --nomad-addr" env:"NOMAD_TOKEN" noexpand:"yes" secret:"yes"`
+	NomadJobs          []string      `long:"nomad-jobs" default:"*.nomad" default:"*.nomad.hcl" default:"*.nomad.json" description:"Gitignore-style patterns of the job specs submitted to --nomad-addr, HCL or JSON by their extension. Can be repeated" env:"NOMAD_JOBS" env-delim:","`
+	LogLevel           string        `long:"log-level" default:"info" choice:"info" choice:"debug" description:"info, or debug to also log the details of every sync. Can be changed at runtime with PUT /admin/loglevel or the loglevel subcommand" env:"LOG_LEVEL"`
+	LogDiff            bool          `long:"log-diff" description:"Log the unified diff of the files changed by every sync after its summary" env:"LOG_DIFF"`
+	LogDiffLimit       ByteSize      `long:"log-diff-limit" default:"64KiB" description:"Bytes of --log-diff logged per sync, the rest is cut. 0 logs it all" env:"LOG_DIFF_LIMIT"`
 
 	Cmd []string `no-flag:"yes"`
 }
 
 func main() {
-	envFile := os.Getenv("ENV_FILE")
-	if envFile == "" {
-		envFile = ".env"
+	if len(os.Args) > 1 && os.Args[1] == sandboxCommand {
+		runSandboxed(os.Args[2:])
 	}
-	err := godotenv.Load(envFile)
+	enterServiceDir()
+
+	err := loadEnvFiles(os.Args[1:])
 	if err != nil {
-		log.Println("failed to load .env")
+		log.Fatalf("%v\n", err)
 	}
 
 	parser := flags.NewParser(&Options, flags.Default)
+	parser.SubcommandsOptional = true
+	// without a command, it only syncs, like a daemon
+	parser.Usage = "[OPTIONS] [-- program [args...]]"
+	addServiceCommands(parser)
+	addControlCommands(parser)
+	addCompletionCommand(parser)
+	addDoctorCommand(parser)
+	addBenchSyncCommand(parser)
+	// the subcommands get the options expanded too
+	parser.CommandHandler = func(command flags.Commander, args []string) error {
+		if command == nil {
+			return nil
+		}
+		if err := expandOptions(&Options); err != nil {
+			return err
+		}
+		return command.Execute(args)
+	}
 	args, err := parser.Parse()
 	if err != nil {
+		if parser.Active != nil {
+			os.Exit(1)
+		}
 		panic(err)
 	}
-	if len(args) == 0 {
-		log.Fatalf("No command specified")
+	if parser.Active != nil {
+		return
+	}
+	if err := expandOptions(&Options); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if Options.Version {
+		fmt.Print(GetBuildInfo())
+		if Options.CheckUpdate {
+			latest, newer, err := CheckForUpdate(context.Background())
+			if err != nil {
+				log.Fatalf("%v\n", err)
+			}
+			if newer {
+				fmt.Printf("update available: %s\n", latest)
+			} else {
+				fmt.Printf("up to date (latest release: %s)\n", latest)
+			}
+		}
+		return
+	}
+	if Options.PrintConfig {
+		printEffectiveConfig(os.Stdout)
+		return
+	}
+	if Options.Umask != "" {
+		if err := applyUmask(Options.Umask); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+	if DirMode, err = parsePermissions("dir-mode", Options.DirMode); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if len(args) == 0 && Options.RepoUrl == "" {
+		log.Fatalf("No command specified, and no --url to sync")
+	}
+	if len(args) == 0 && Options.TTY {
+		log.Fatalf("--tty needs a command to run\n")
+	}
+
+	if Options.DataDir != "" {
+		// the store is locked first, so another instance on the same dir stops before touching it
+		if Store, err = OpenStateStore(filepath.Join(Options.DataDir, "state.db")); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		defer Store.Close()
+		if err := setupDataDir(Options.DataDir); err != nil {
+			log.Fatalf("invalid --data-dir: %v\n", err)
+		}
+		Triggers = NewTriggerStore(filepath.Join(Options.DataDir, "triggers"))
+	}
+
+	sandbox, err := NewSandbox()
+	if err != nil {
+		log.Fatalf("invalid sandbox: %v\n", err)
+	}
+
+	registerMetrics()
+	setupEventSinks()
+	if Store != nil {
+		Events.AddSink(Store)
+	}
+	savedState, err := Store.LoadState()
+	if err != nil {
+		log.Printf("%v\n", err)
+	}
+	CurrentStatus.LoadHistory(Store.History(historySize))
+	recordInterruptedApply(savedState)
+	pusher, err := NewMetricsPusher()
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if pusher != nil {
+		pusher.Start()
 	}
 
 	if Options.RepoUrl == "" {
+		if sandbox != nil {
+			if args, err = sandbox.Wrap(args); err != nil {
+				log.Fatalf("%v\n", err)
+			}
+		}
+		sdNotify("READY=1")
 		doExec(args...)
 	}
 
-	var beforeUpdate func() error
+	heartbeat, err := NewHeartbeatSender()
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if heartbeat != nil {
+		heartbeat.Start()
+	}
+
+	logLevel, err := ParseLogLevel(Options.LogLevel)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	SetLogLevel(logLevel)
 
+	gitRepo := NewGitRepo(Options.RepoUrl, Options.RepoBranch, Options.RepoFolder, Options.Username, Options.Password)
+	if Options.Ref != "" {
+		if _, err := parseRevision(Options.Ref); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		gitRepo.Ref = Options.Ref
+	}
+	var preUpdateCommand *CommandTemplate
 	if Options.PreUpdateCommand != "" {
-		beforeUpdate = func() error {
-			return runShellCommand(Options.PreUpdateCommand, Options.PreUpdateRunner, Options.LocalFolder)
+		preUpdateCommand, err = ParseCommandTemplate("pre-update command", Options.PreUpdateCommand)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	if Stages, err = NewStageSettings(Options.PreUpdateRunner, Options.LocalFolder, Options.HookRunners, Options.HookWorkDirs); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	Hooks = NewHookRunner(Options.HooksDir)
+	RepoEnv = NewRepoEnvFile(Options.RepoEnvFile, Options.LocalFolder)
+	if RepoEnv != nil && Options.InMemory {
+		log.Fatalf("--repo-env-file can't be used with --in-memory, which doesn't write to the local folder\n")
+	}
+	beforeUpdate := func(ctx context.Context, event Event) error {
+		if err := prepareUpdate(); err != nil {
+			return err
+		}
+		if err := Hooks.Run(ctx, HookValidate, event); err != nil {
+			return err
 		}
+		for _, validate := range gitRepo.State().Config.validateCommands() {
+			err := runShellCommand(ctx, "validate", validate, Stages.CommandRunner(HookValidate), Stages.WorkingDir(HookValidate), webhookEnv(event)...)
+			if err != nil {
+				return fmt.Errorf("%s validation failed: %w", repoConfigFile, err)
+			}
+		}
+		if preUpdateCommand != nil {
+			shellCommand, err := preUpdateCommand.Render(gitRepo.SyncVars(event.Source))
+			if err != nil {
+				return err
+			}
+			err = runShellCommand(ctx, "pre-update-command", shellCommand, Stages.CommandRunner(HookPreUpdate), Stages.WorkingDir(HookPreUpdate), webhookEnv(event)...)
+			if err != nil {
+				return err
+			}
+		}
+		return Hooks.Run(ctx, HookPreUpdate, event)
 	}
 
+	// ctx is cancelled on shutdown, aborting in-flight syncs
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	var restartArgs []string
+	exitCode := 0
+
+	var webhookServer *WebhookServer
+	var grpcServer *GRPCServer
+	var shutdownOnce sync.Once
+
+	// shutdown stops the API servers and cancels in-flight syncs. The main loop then stops
+	// the application before exiting
+	shutdown := func() {
+		shutdownOnce.Do(func() {
+			log.Printf("shutting down\n")
+			sdNotify("STOPPING=1")
+			time.AfterFunc(Options.ShutdownTimeout, func() {
+				log.Printf("shutdown did not finish within %v, exiting\n", Options.ShutdownTimeout)
+				os.Exit(1)
+			})
+
+			if webhookServer != nil {
+				shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), Options.ShutdownTimeout)
+				defer cancelShutdown()
+				if err := webhookServer.Shutdown(shutdownCtx); err != nil {
+					log.Printf("failed to stop webhook server: %v\n", err)
+				}
+			}
+			if grpcServer != nil {
+				shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), Options.ShutdownTimeout)
+				defer cancelShutdown()
+				grpcServer.Shutdown(shutdownCtx)
+			}
+			cancel()
+		})
+	}
+
+	stopService := startService(shutdown)
+	defer stopService()
+
+	if Options.CheckUpdate {
+		logUpdateCheck(ctx)
+	}
+
+	var restartCommand *CommandTemplate
 	if len(Options.RestartCommand) > 0 {
-		restartArgs, err = shellquote.Split(Options.RestartCommand)
+		restartCommand, err = ParseCommandTemplate("restart command", Options.RestartCommand)
 		if err != nil {
-			log.Fatalf("failed to parse restart command: %v\n", err)
+			log.Fatalf("%v\n", err)
+		}
+		if Options.RestartExec {
+			if _, err := restartCommand.Args(SyncVars{}); err != nil {
+				log.Fatalf("%v\n", err)
+			}
 		}
 	}
-	command := NewCommand(ctx, args, restartArgs)
-	gitRepo := NewGitRepo(Options.RepoUrl, Options.RepoBranch, Options.RepoFolder, Options.Username, Options.Password)
+	// the application outlives ctx, so it's only stopped after the syncs are done
+	command := NewCommand(context.Background(), args, restartCommand, Options.StopGracePeriod)
+	if ChildEnv, err = NewEnvFilter(Options.ChildEnvAllow, Options.ChildEnvDeny); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if filtered := ChildEnv.Filtered(); len(filtered) > 0 {
+		log.Printf("not passing %s to the application\n", strings.Join(filtered, ", "))
+	}
+	command.RestartPolicy = RestartPolicy{
+		Runner:       Stages.CommandRunner(StageRestart),
+		Dir:          Stages.WorkingDir(StageRestart),
+		Exec:         Options.RestartExec,
+		Retries:      Options.RestartRetries,
+		RetryDelay:   Options.RestartRetryDelay,
+		Check:        NewRestartCheck(Options.RestartCheck, Stages.CommandRunner(StageRestart)),
+		CheckTimeout: Options.RestartCheckWait,
+		Fallback:     Options.RestartFallback == "stop-start",
+	}
+	if len(args) == 0 && Options.ProcessesFile == "" {
+		log.Printf("no command specified, only syncing %s\n", Options.LocalFolder)
+	}
+	command.Sandbox = sandbox
+	command.Stdin = os.Stdin
+	command.TTY = Options.TTY
+	if command.Compose, err = NewComposeProject(Options.RestartCompose, Options.ComposeFile, Options.LocalFolder, Options.ComposeCommand); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if command.Compose != nil && (restartCommand != nil || Options.InMemory) {
+		log.Fatalf("--restart-compose can't be used with --restart-command or --in-memory\n")
+	}
+	command.OnExit = func(exitCode int, requested bool) {
+		CurrentStatus.RecordChildExit(exitCode)
+		if requested {
+			return
+		}
+		eventType := EventChildCrashed
+		if exitCode == 0 {
+			eventType = EventChildExited
+		}
+		Events.Publish(Event{Type: eventType, Fields: map[string]string{"exit_code": strconv.Itoa(exitCode)}})
+	}
+	if Options.ProcessesFile != "" {
+		if Supervised, err = LoadProcesses(Options.ProcessesFile, Options.LocalFolder, sandbox); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+	if Options.InMemory {
+		if Options.MergeOutput != "" {
+			log.Fatalf("--merge-output can't be used with --in-memory, which doesn't write to the local folder\n")
+		}
+		Tree = NewMemoryTree()
+		gitRepo.Memory = Tree
+	} else {
+		Applied = NewAppliedTree(Options.LocalFolder)
+		gitRepo.Applied = Applied
+	}
+	if Options.RefCacheSize > 0 {
+		Refs, err = NewRefCache(gitRepo, Options.RefCacheSize, int64(Options.CacheMaxSize))
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		defer Refs.Close()
+	}
+	if Options.SkipSyncPattern != "" {
+		if gitRepo.SkipSync, err = regexp.Compile(Options.SkipSyncPattern); err != nil {
+			log.Fatalf("invalid --skip-sync-pattern: %v\n", err)
+		}
+	}
+	if Options.NoRestartPattern != "" {
+		if gitRepo.NoRestart, err = regexp.Compile(Options.NoRestartPattern); err != nil {
+			log.Fatalf("invalid --no-restart-pattern: %v\n", err)
+		}
+	}
+	if Options.MergeOutput != "" {
+		gitRepo.Preserve = append(gitRepo.Preserve, filepath.ToSlash(filepath.Clean(Options.MergeOutput)))
+	}
+	if Options.VerifyApply || Options.ManifestFile != "" {
+		if Options.InMemory {
+			log.Fatalf("--verify-apply and --manifest-file can't be used with --in-memory, which doesn't write to the local folder\n")
+		}
+		gitRepo.VerifyApply = Options.VerifyApply
+		gitRepo.ManifestFile = Options.ManifestFile
+		if Options.ManifestFile != "" && !filepath.IsAbs(Options.ManifestFile) {
+			gitRepo.ManifestFile = filepath.Join(Options.LocalFolder, Options.ManifestFile)
+			gitRepo.Preserve = append(gitRepo.Preserve, filepath.ToSlash(filepath.Clean(Options.ManifestFile)))
+		}
+	}
+	gitRepo.MaxFileSize = Options.MaxFileSize
+	if _, err := eolSequence(Options.EOL); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	gitRepo.EOL = Options.EOL
+	gitRepo.Mtime = Options.Mtime
+	if Options.PreserveXattrs && !xattrsSupported {
+		log.Fatalf("--preserve-xattrs is only supported on Linux\n")
+	}
+	gitRepo.PreserveXattrs = Options.PreserveXattrs
+	gitRepo.PruneEmptyDirs = Options.PruneEmptyDirs
+	gitRepo.KeepMarkers = Options.KeepMarkers
+	if Options.IncludeGitDir && Options.InMemory {
+		log.Fatalf("--include-git-dir can't be used with --in-memory\n")
+	}
+	gitRepo.IncludeGitDir = Options.IncludeGitDir
+	for _, source := range Options.Sources {
+		parsed, err := ParseSource(source, Options.Username, Options.Password)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		gitRepo.Sources = append(gitRepo.Sources, parsed)
+	}
+	if err := checkSourceDirs(gitRepo.Sources); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if len(gitRepo.Sources) > 0 && Options.InMemory {
+		log.Fatalf("--source can't be used with --in-memory\n")
+	}
+	if Options.WatchWrites != "off" {
+		if Options.InMemory {
+			log.Fatalf("--watch-writes can't be used with --in-memory\n")
+		}
+		if !writeWatchSupported {
+			log.Fatalf("--watch-writes is only supported on Linux\n")
+		}
+		LocalWrites = NewWriteWatcher(Options.WatchWrites, Options.LocalFolder, gitRepo.Preserve, func(slashPath string, isDir bool) bool {
+			return gitRepo.State().Config.Protected(slashPath, isDir)
+		})
+		go func() {
+			if err := LocalWrites.Watch(ctx); err != nil {
+				log.Printf("failed to watch %s: %v\n", Options.LocalFolder, err)
+			}
+		}()
+	}
+	if Options.SnapshotDir != "" {
+		if Options.InMemory {
+			log.Fatalf("--snapshot-dir can't be used with --in-memory\n")
+		}
+		if gitRepo.Snapshots, err = NewSnapshotDirs(Options.SnapshotDir, Options.LocalFolder, Options.SnapshotCount); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+	}
+	statusURL := Options.StatusRepoUrl
+	if statusURL == "" {
+		statusURL = Options.RepoUrl
+		if Options.StatusBranch == Options.RepoBranch {
+			log.Fatalf("--status-branch can't be the synced branch %s\n", Options.RepoBranch)
+		}
+	}
+	if StatusBranch = NewStatusBranchWriter(statusURL, Options.StatusBranch, Options.StatusFile, Options.Username, Options.Password); StatusBranch != nil {
+		StatusBranch.Start()
+	}
+	if Options.ApplyDelayHash > 0 {
+		key := Options.ApplyDelayKey
+		if key == "" {
+			key, _ = os.Hostname()
+		}
+		gitRepo.ApplyDelay = hashedDelay(key, Options.ApplyDelayHash)
+		log.Printf("new commits are applied %v after they're seen\n", gitRepo.ApplyDelay)
+	}
+	if gitRepo.Renderer, err = NewRenderer(Options.Render, Options.RenderArgs); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if gitRepo.Renderer != nil && Options.InMemory {
+		log.Fatalf("--render can't be used with --in-memory\n")
+	}
+	if Nomad, err = NewNomadSubmitter(Options.NomadAddr, Options.NomadToken, Options.NomadJobs); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if Nomad != nil && Options.InMemory {
+		log.Fatalf("--nomad-addr can't be used with --in-memory\n")
+	}
+	gitRepo.GateURL = Options.GateURL
+	gitRepo.GateFailOpen = Options.GateFailOpen
+	if DeployTag, err = NewDeployTagger(gitRepo, Options.DeployTag); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if Acks, err = NewAcknowledger(Options.AckNotify, Options.AckFile, Options.AckTimeout); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if len(Options.ChownRules) > 0 {
+		if os.Geteuid() != 0 {
+			log.Printf("ignoring --chown-rule, since it's only applied when running as root\n")
+		} else {
+			for _, rule := range Options.ChownRules {
+				parsed, err := ParseChownRule(rule)
+				if err != nil {
+					log.Fatalf("%v\n", err)
+				}
+				gitRepo.ChownRules = append(gitRepo.ChownRules, parsed)
+			}
+		}
+	}
+	if gitRepo.CheckCollisions, err = checkCollisions(Options.NameCollisions); err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	gitRepo.MaxTotalSize = Options.MaxTotalSize
+	if Options.BackupDir != "" {
+		if Options.InMemory {
+			log.Fatalf("--backup-dir can't be used with --in-memory, which doesn't write to the local folder\n")
+		}
+		if isInside(Options.BackupDir, Options.LocalFolder) {
+			log.Fatalf("--backup-dir must be outside the local folder, which is overwritten on every sync\n")
+		}
+		if gitRepo.Backups, err = NewBackups(Options.BackupDir, Options.BackupKeep, Options.SnapshotKeep); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		go collectGarbage(ctx, gitRepo.Backups)
+	}
 
-	updateCh := make(chan struct{}, 5)
+	restartCh := make(chan string, 1)
+	rollbackCh := make(chan struct{}, 1)
 
-	if Options.WebhookPort != 0 {
-		err := StartWebhookServer(ctx, Options.WebhookPort, Options.WebhookTokenHeader, Options.WebhookTokenValue, func() error {
-			updateCh <- struct{}{}
+	actions := APIActions{
+		Sync: func(source string, metadata map[string]string) error {
+			Events.Publish(Event{Type: EventSyncRequested, Source: source, Fields: metadata})
+			if err := Triggers.Add(source, metadata); err != nil {
+				log.Printf("%v\n", err)
+			}
 			return nil
-		})
+		},
+		Rollback: func() error {
+			CurrentStatus.RecordTrigger("api:rollback")
+			Events.Publish(Event{Type: EventRollbackRequested, Source: "api"})
+			select {
+			case rollbackCh <- struct{}{}:
+				return nil
+			default:
+				return fmt.Errorf("a rollback is already pending")
+			}
+		},
+		State: gitRepo.State,
+	}
+
+	if Options.EncryptKey != "" {
+		ValueCipher, err = NewCipher(Options.EncryptKey)
+		if err != nil {
+			log.Fatalf("invalid --encrypt-key: %v\n", err)
+		}
+		if Options.WebhookPort != 0 && (Options.WebhookTokenHeader == "" || Options.WebhookTokenValue == "") {
+			log.Fatalf("--encrypt-key requires --webhook-token-header and --webhook-token-value to serve the API\n")
+		}
+	}
+	if Options.DecryptOnApply {
+		if ValueCipher == nil {
+			log.Fatalf("--decrypt-on-apply needs --encrypt-key\n")
+		}
+		if Options.InMemory {
+			log.Fatalf("--decrypt-on-apply can't be used with --in-memory, whose files are decrypted when served\n")
+		}
+		gitRepo.Decrypt = ValueCipher
+	}
+	if Options.SigningKey != "" {
+		Signer, err = LoadSigner(Options.SigningKey)
+		if err != nil {
+			log.Fatalf("invalid --signing-key: %v\n", err)
+		}
+	}
+
+	tenants, err := ParseTenants(Options.Tenants)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if len(tenants) > 0 && (Options.WebhookTokenHeader == "" || Options.WebhookTokenValue == "") {
+		log.Fatalf("--tenant requires --webhook-token-header and --webhook-token-value\n")
+	}
+	apiTokens, err := ParseAPITokens(Options.WebhookTokenValue, Options.APITokens)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	if len(Options.APITokens) > 0 && (Options.WebhookTokenHeader == "" || Options.WebhookTokenValue == "") {
+		log.Fatalf("--api-token requires --webhook-token-header and --webhook-token-value\n")
+	}
+
+	var verifier *WebhookVerifier
+	if Options.WebhookSecret != "" {
+		verifier = NewWebhookVerifier(Options.WebhookSecret, Options.ReplayWindow)
+	}
+
+	webhookPath, err := cleanWebhookPath(Options.WebhookPath)
+	if err != nil {
+		log.Fatalf("%v\n", err)
+	}
+	var webhookRoutes []*WebhookRoute
+	for _, spec := range Options.WebhookRoutes {
+		route, err := ParseWebhookRoute(spec, Options.ReplayWindow)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		webhookRoutes = append(webhookRoutes, route)
+	}
+
+	if Options.WebhookPort != 0 || Options.ControlSocket != "" {
+		Proxies, err = ParseTrustedProxies(Options.TrustedProxies)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if RateLimit, err = NewClientLimiter(Options.RateLimit, Options.RateLimitBurst); err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		if RateLimit != nil {
+			log.Printf("limiting each client to %g requests per second, in bursts of %d\n", Options.RateLimit, Options.RateLimitBurst)
+		}
+		AccessLog, err = NewAccessLogger(Options.AccessLogFormat, Options.AccessLogOutput)
+		if err != nil {
+			log.Fatalf("%v\n", err)
+		}
+		webhookServer, err = StartWebhookServer(Options.WebhookPort, Options.ControlSocket, Options.WebhookTokenHeader, apiTokens, tenants, verifier, webhookPath, webhookRoutes, actions)
 		if err != nil {
 			log.Fatalf("failed to start webhook server: %v\n", err)
 		}
 	}
+	if Options.GRPCPort != 0 {
+		grpcServer, err = StartGRPCServer(Options.GRPCPort, Options.WebhookTokenHeader, apiTokens, tenants, actions)
+		if err != nil {
+			log.Fatalf("failed to start gRPC server: %v\n", err)
+		}
+	}
 
+	// SIGTERM is what Docker and Kubernetes send on stop
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM, syscall.SIGQUIT)
 	go (func() {
-		for range c {
-			log.Printf("interrupt received\n")
-			cancel()
+		for sig := range c {
+			log.Printf("signal received: %v\n", sig)
+			go shutdown()
 		}
 	})()
 
+	if syncSignal != nil {
+		ctrl := make(chan os.Signal, 1)
+		signal.Notify(ctrl, syncSignal, restartSignal)
+		go (func() {
+			for sig := range ctrl {
+				switch sig {
+				case syncSignal:
+					source := "signal:SIGUSR1"
+					Events.Publish(Event{Type: EventSyncRequested, Source: source})
+					if err := Triggers.Add(source, nil); err != nil {
+						log.Printf("%v\n", err)
+					}
+				case restartSignal:
+					source := "signal:SIGUSR2"
+					CurrentStatus.RecordTrigger(source)
+					Events.Publish(Event{Type: EventRestartRequested, Source: source})
+					select {
+					case restartCh <- source:
+					default:
+						log.Printf("a restart is already pending, ignoring %v\n", sig)
+					}
+				}
+			}
+		})()
+	}
+
+	if err := checkStartup(ctx, gitRepo, args); err != nil {
+		log.Fatalf("%v\n", err)
+	}
 	gitInitialized := false
 
-	ok, err := InitializeGit(gitRepo, beforeUpdate)
+	CurrentStatus.RecordTrigger("startup")
+	triggers := Triggers.Take()
+	if len(triggers) > 0 {
+		log.Printf("processing %d triggers left by the previous run: %s\n", len(triggers), triggerSources(triggers))
+	}
+	// initialized finishes the first sync that went through, on startup or retrying it later
+	initialized := func(triggers []Trigger) {
+		gitInitialized = true
+		gitRepo.recoverState(savedState)
+		Triggers.Done(triggers)
+		Nomad.Submit(ctx, Options.LocalFolder, gitRepo.State().Changes)
+	}
+	applicationStarted := false
+	startApplication := func() {
+		applicationStarted = true
+		err := command.Start()
+		if err != nil {
+			log.Fatalf("command failed to even start: %v\n", err)
+		}
+		if command.IsRunning() {
+			CurrentStatus.RecordChild(command.Pid, false)
+		}
+		if err := Supervised.Start(); err != nil {
+			Supervised.Stop()
+			command.Stop()
+			restoreTerminal()
+			log.Fatalf("%v\n", err)
+		}
+	}
+
+	ok, err := InitializeGit(ctx, gitRepo, beforeUpdate)
 	if err != nil {
 		log.Fatalf("failed to initialize monitor: %v\n", err)
 	}
 	if ok {
-		gitInitialized = true
+		initialized(triggers)
+		if command.Compose != nil {
+			if err := command.Compose.Up(ctx); err != nil {
+				log.Printf("%v\n", err)
+			}
+		}
+	}
+	if ok || !Options.WaitForConfig {
+		startApplication()
+	} else {
+		log.Printf("the first sync failed, the application will start once it goes through\n")
 	}
+	sdNotify("READY=1")
 
-	err = command.Start()
-	if err != nil {
-		log.Fatalf("command failed to even start: %v\n", err)
+	var watchdogCh <-chan time.Time
+	if interval := sdWatchdogInterval(); interval > 0 {
+		log.Printf("sending systemd watchdog keepalives every %v\n", interval)
+		watchdog := time.NewTicker(interval)
+		defer watchdog.Stop()
+		watchdogCh = watchdog.C
+	}
+
+	updatePeriod := time.Duration(Options.UpdatePeriod) * time.Second
+	// until the first sync goes through, it's tried again sooner, backing off up to the update period
+	initRetry := initRetryMin
+	nextCheck := func() time.Duration {
+		if gitInitialized {
+			return updatePeriod
+		}
+		delay := min(initRetry, updatePeriod)
+		initRetry = min(2*initRetry, updatePeriod)
+		return delay
 	}
+	delay := nextCheck()
+	updateTimer := time.NewTimer(delay)
+	defer updateTimer.Stop()
 
 	done := false
+	staleAlerted := false
 
+	log.Printf("waiting %v before checking again\n", delay)
 	for !done {
-		log.Printf("waiting %d seconds before checking again\n", Options.UpdatePeriod)
 		select {
 		case <-ctx.Done():
 			log.Printf("interrupted, skipping update")
 			done = true
 			continue
-		case <-updateCh:
-		case <-time.After(time.Duration(Options.UpdatePeriod) * time.Second):
-			// pass
+		case <-watchdogCh:
+			// keepalives only go out while the loop is responsive
+			sdNotify("WATCHDOG=1")
+			continue
+		case err := <-webhookServer.Err():
+			log.Printf("%v\n", err)
+			var listenerErr *ListenerError
+			if Options.WebhookFailure == "retry" && errors.As(err, &listenerErr) {
+				go webhookServer.Relisten(ctx, listenerErr)
+			} else {
+				exitCode = 1
+				go shutdown()
+			}
+			continue
+		case source := <-restartCh:
+			if !applicationStarted {
+				log.Printf("the application isn't started yet, ignoring the restart\n")
+				continue
+			}
+			if err := restartApplication(command, gitRepo.SyncVars(source), source); err != nil {
+				log.Printf("failed to restart command: %v\n", err)
+			}
+			if err := Supervised.Restart(SyncChanges{}, source); err != nil {
+				log.Printf("%v\n", err)
+			}
+			continue
+		case <-rollbackCh:
+			if err := Rollback(ctx, gitRepo, command, beforeUpdate); err != nil {
+				log.Printf("failed to roll back: %v\n", err)
+			}
+			continue
+		case <-Triggers.Ready():
+			if !updateTimer.Stop() {
+				// the timer fired meanwhile, its sync is covered by this one
+				select {
+				case <-updateTimer.C:
+				default:
+				}
+			}
+		case <-updateTimer.C:
+			Triggers.Poll()
 		}
 
-		if !gitInitialized {
+		// the triggers stay pending until a sync after them goes through
+		triggers := Triggers.Take()
+		if len(triggers) == 0 {
+			// they were handled by the previous sync
+			updateTimer.Reset(updatePeriod)
+			continue
+		}
+		debugf("syncing for %d triggers: %s\n", len(triggers), triggerSources(triggers))
+		CurrentStatus.RecordTrigger(primarySource(triggers))
+		if CurrentStatus.Paused() {
+			log.Printf("syncing is paused, skipping update\n")
+		} else if !gitInitialized {
 			log.Printf("trying to initialize monitor\n")
-			ok, err := InitializeGit(gitRepo, beforeUpdate)
-			if err != nil && ok {
-				log.Printf("monitor initialized successfully\n")
-				gitInitialized = true
+			syncCtx, cancel := withSyncDeadline(ctx)
+			ok, err := InitializeGit(syncCtx, gitRepo, beforeUpdate)
+			cancel()
+			switch {
+			case err != nil:
+				log.Printf("failed to initialize monitor: %v\n", err)
+			case ok && !applicationStarted:
+				log.Printf("monitor initialized successfully, starting the application\n")
+				initialized(triggers)
+				if command.Compose != nil {
+					if err := command.Compose.Up(ctx); err != nil {
+						log.Printf("%v\n", err)
+					}
+				}
+				startApplication()
+			case ok:
+				// the application started without its config, so it's restarted on it
+				log.Printf("monitor initialized successfully, restarting the application\n")
+				initialized(triggers)
+				state := gitRepo.State()
+				if err := restartApplication(command, gitRepo.SyncVars("startup"), "startup"); err != nil {
+					log.Printf("failed to restart command: %v\n", err)
+					CurrentStatus.RecordError("restart", state.Commit, err)
+				}
+				if err := Supervised.Restart(state.Changes, "startup"); err != nil {
+					log.Printf("%v\n", err)
+					CurrentStatus.RecordError("restart", state.Commit, err)
+				}
 			}
-			continue
 		} else {
-			err := Check(gitRepo, command, beforeUpdate)
+			syncCtx, cancel := withSyncDeadline(ctx)
+			err := Check(syncCtx, gitRepo, command, beforeUpdate, triggers)
+			cancel()
 			if err != nil {
 				log.Fatalf("failed to check: %v\n", err)
 			}
+			if CurrentStatus.ConsecutiveFailures() == 0 {
+				Triggers.Done(triggers)
+			}
+		}
+		staleAlerted = checkStaleness(ctx, staleAlerted)
+
+		if Options.MaxFailures > 0 && CurrentStatus.ConsecutiveFailures() >= Options.MaxFailures {
+			onTooManyFailures(ctx)
+			exitCode = 1
+			// the servers are stopped before leaving the loop, which stops the application
+			shutdown()
+			done = true
+			continue
 		}
+
+		delay := nextCheck()
+		updateTimer.Reset(delay)
+		log.Printf("waiting %v before checking again\n", delay)
+	}
+
+	Supervised.Stop()
+	err = command.Stop()
+	restoreTerminal()
+	if err != nil {
+		log.Fatalf("stop command failed: %v\n", err)
+	}
+	if pusher != nil {
+		pusher.Stop()
 	}
+	if heartbeat != nil {
+		heartbeat.Stop()
+	}
+	if StatusBranch != nil {
+		StatusBranch.Stop()
+	}
+	log.Printf("shutdown complete\n")
+	if exitCode != 0 {
+		os.Exit(exitCode)
+	}
+}
 
-	if err := command.Stop(); err != nil {
-		log.Fatalf("stop command failed")
+// checkStaleness alerts when the config becomes stale, returning whether the alert is active. It only alerts
+// again after a successful sync
+func checkStaleness(ctx context.Context, alerted bool) bool {
+	if Options.MaxStaleness <= 0 {
+		return false
 	}
+	staleness := CurrentStatus.Staleness()
+	if staleness <= Options.MaxStaleness {
+		if alerted {
+			Events.Publish(Event{Type: EventFresh})
+		}
+		return false
+	}
+	if alerted {
+		return true
+	}
+
+	staleSince := time.Now().Add(-staleness).Format(time.RFC3339)
+	Events.Publish(Event{Type: EventStale, Fields: map[string]string{"since": staleSince}})
+
+	if Options.OnStaleCommand != "" {
+		err := runShellCommand(ctx, "on-stale-command", Options.OnStaleCommand, Stages.CommandRunner(StageOnStale), Stages.WorkingDir(StageOnStale), "STALE_SINCE="+staleSince)
+		if err != nil {
+			log.Printf("failed to run on-stale command: %v\n", err)
+		}
+	}
+	return true
+}
+
+// onTooManyFailures records that the failure limit was reached and runs the on-failure command
+func onTooManyFailures(ctx context.Context) {
+	snapshot := CurrentStatus.Snapshot()
+	log.Printf("%d consecutive sync failures, giving up\n", snapshot.Failures)
+	Events.Publish(Event{
+		Type:   EventTooManyFailures,
+		Error:  snapshot.LastSyncError,
+		Fields: map[string]string{"failures": strconv.Itoa(snapshot.Failures)},
+	})
+
+	runOnFailureCommand(ctx, snapshot.LastSyncError, snapshot.Failures)
 }
 
-func InitializeGit(gitRepo *GitRepo, beforeUpdate func() error) (bool, error) {
-	err := os.MkdirAll(Options.LocalFolder, 0o775)
+// runOnFailureCommand runs the on-failure command, if any, for the failed sync
+func runOnFailureCommand(ctx context.Context, syncError string, failures int) {
+	if Options.OnFailureCommand == "" {
+		return
+	}
+	err := runShellCommand(ctx, "on-failure-command", Options.OnFailureCommand, Stages.CommandRunner(StageOnFailure), Stages.WorkingDir(StageOnFailure),
+		"SYNC_ERROR="+syncError,
+		"SYNC_FAILURES="+strconv.Itoa(failures),
+	)
 	if err != nil {
-		return false, fmt.Errorf("failed to create local folder %s: %w", Options.LocalFolder, err)
+		log.Printf("failed to run on-failure command: %v\n", err)
+	}
+}
+
+// syncErrorCategory tells the commits refused for their size or by the pre-apply hooks apart from the
+// failures to sync
+func syncErrorCategory(err error) string {
+	var sizeErr *sizeLimitError
+	var hookErr *preApplyError
+	var writeErr *externalWriteError
+	switch {
+	case errors.As(err, &sizeErr) || errors.As(err, &hookErr):
+		return "validation"
+	case errors.As(err, &writeErr):
+		return "writes"
+	}
+	return "git"
+}
+
+// onSyncError runs the on-failure command right away for the errors retrying won't fix
+func onSyncError(ctx context.Context, err error) {
+	var sizeErr *sizeLimitError
+	if errors.As(err, &sizeErr) {
+		runOnFailureCommand(ctx, err.Error(), CurrentStatus.ConsecutiveFailures())
+	}
+}
+
+// initRetryMin is how long to wait before trying a failed first sync again, doubled on every failure
+const initRetryMin = time.Second
+
+func InitializeGit(ctx context.Context, gitRepo *GitRepo, beforeUpdate func(ctx context.Context, event Event) error) (bool, error) {
+	defer LocalWrites.Pause()()
+	if gitRepo.Memory == nil && gitRepo.Snapshots == nil {
+		err := os.MkdirAll(Options.LocalFolder, DirMode)
+		if err != nil {
+			return false, fmt.Errorf("failed to create local folder %s: %w", Options.LocalFolder, err)
+		}
 	}
 
 	ok := true
-	_, err = gitRepo.Sync(Options.LocalFolder)
+	var event Event
+	Events.Publish(Event{Type: EventSyncStarted, Source: "startup"})
+	info, err := gitRepo.Sync(ctx, Options.LocalFolder)
+	applied := info != nil
+	state := gitRepo.State()
 	if err != nil {
 		log.Printf("failed to synchronize Git to %s: %v\n", Options.LocalFolder, err)
+		event = Events.Publish(Event{Type: EventSyncFailed, Source: "startup", Error: err.Error()})
+		CurrentStatus.RecordSync("", false, err)
+		CurrentStatus.RecordError(syncErrorCategory(err), "", err)
+		StatusBranch.Record(CommitInfo{}, "failed", err)
+		onSyncError(ctx, err)
 		ok = false
+	} else {
+		event = Events.Publish(Event{Type: EventSyncApplied, Source: "startup", Commit: state.Commit, Fields: appliedFields(gitRepo), Diff: state.Diff.String()})
+		logDiff(gitRepo)
+		CurrentStatus.RecordSync(state.Commit, true, nil)
+		CurrentStatus.RecordChanges(state.Previous, state.Info, state.Changes)
 	}
 
 	if beforeUpdate != nil {
 		log.Println("running beforeUpdate func for the first time")
-		if err := beforeUpdate(); err != nil {
+		if err := beforeUpdate(ctx, event); err != nil {
 			log.Printf("failed to run beforeUpdate func for the first time: %v\n", err)
+			Events.Publish(Event{Type: EventValidationFailed, Source: "startup", Commit: state.Commit, Error: err.Error()})
+			CurrentStatus.RecordError("validation", state.Commit, err)
+			StatusBranch.Record(state.Info, "failed", err)
+			if applied {
+				restoreAfterValidation(ctx, gitRepo, "startup", err)
+			}
 			ok = false
 		}
 	}
+	if ok {
+		recordApplied(state.Info)
+	}
 
 	return ok, nil
 }
 
-func Check(gitRepo *GitRepo, command *Command, beforeUpdate func() error) error {
-	changed, err := gitRepo.Sync(Options.LocalFolder)
+// Check syncs for the triggers, attributing the sync to the primary one
+func Check(ctx context.Context, gitRepo *GitRepo, command *Command, beforeUpdate func(ctx context.Context, event Event) error, triggers []Trigger) error {
+	trigger := primarySource(triggers)
+	// the hooks and the restart may write to the local folder too
+	defer LocalWrites.Pause()()
+	Events.Publish(Event{Type: EventSyncStarted, Source: trigger, Fields: map[string]string{"triggers": triggerSources(triggers)}})
+	info, err := gitRepo.Sync(ctx, Options.LocalFolder)
+	changed := info != nil
+	state := gitRepo.State()
+	if errors.Is(err, errSyncSkipped) {
+		Events.Publish(Event{Type: EventSyncSkipped, Source: trigger, Commit: gitRepo.skipped()})
+		CurrentStatus.RecordSync(state.Commit, false, nil)
+		return nil
+	}
+	if errors.Is(err, errApplyDelayed) {
+		delayed, until := gitRepo.delayed()
+		Events.Publish(Event{Type: EventSyncDeferred, Source: trigger, Commit: delayed, Fields: map[string]string{"reason": "apply delay", "apply_at": until.Format(time.RFC3339)}})
+		CurrentStatus.RecordSync(state.Commit, false, nil)
+		return nil
+	}
+	if errors.Is(err, errSyncHeld) {
+		Events.Publish(Event{Type: EventSyncDeferred, Source: trigger, Error: err.Error(), Fields: map[string]string{"reason": "gate"}})
+		CurrentStatus.RecordSync(state.Commit, false, nil)
+		return nil
+	}
 	if err != nil {
+		err = deadlineError(ctx, err)
 		log.Printf("failed to check git repo to %s: %v\n", Options.LocalFolder, err)
+		Events.Publish(Event{Type: EventSyncFailed, Source: trigger, Error: err.Error()})
+		CurrentStatus.RecordSync("", false, err)
+		CurrentStatus.RecordError(syncErrorCategory(err), "", err)
+		StatusBranch.Record(CommitInfo{}, "failed", err)
+		onSyncError(ctx, err)
 		return nil
 	}
+	CurrentStatus.RecordSync(state.Commit, changed, nil)
+	if !changed {
+		Events.Publish(Event{Type: EventSyncUnchanged, Source: trigger, Commit: state.Commit})
+	}
 	if changed {
+		fields := appliedFields(gitRepo)
+		for key, value := range webhookFields(triggers) {
+			fields[key] = value
+		}
+		noRestart := true
+		restartSkipped := gitRepo.NoRestart != nil && gitRepo.NoRestart.MatchString(state.Message)
+		switch {
+		case restartSkipped:
+			log.Printf("not restarting the application, as asked by the message of commit %s\n", shortCommit(state.Commit))
+		case !state.Config.Restarts(state.Changes):
+			log.Printf("not restarting the application, since the %s restart rules don't match the changes\n", repoConfigFile)
+		default:
+			noRestart = false
+		}
+		if noRestart {
+			fields["restart"] = "skipped"
+		}
+		applied := Events.Publish(Event{Type: EventSyncApplied, Source: trigger, Commit: state.Commit, Fields: fields, Diff: state.Diff.String()})
+		logDiff(gitRepo)
+		CurrentStatus.RecordChanges(state.Previous, *info, state.Changes)
 		if beforeUpdate != nil {
 			log.Println("running beforeUpdate func")
-			err = beforeUpdate()
+			err = beforeUpdate(ctx, applied)
 			if err != nil {
+				err = deadlineError(ctx, err)
 				log.Printf("failed to run beforeUpdate func: %v\n", err)
+				Events.Publish(Event{Type: EventValidationFailed, Source: trigger, Commit: state.Commit, Error: err.Error()})
+				CurrentStatus.RecordError("validation", state.Commit, err)
+				recordDeployment(*info, err)
+				StatusBranch.Record(*info, "failed", err)
+				if errors.Is(err, errSyncDeadline) {
+					restoreAfterDeadline(ctx, gitRepo, err)
+				} else {
+					restoreAfterValidation(ctx, gitRepo, trigger, err)
+				}
 				return nil
 			}
 		}
-		err := command.Restart()
+		if noRestart {
+			recordDeployment(*info, nil)
+			recordApplied(*info)
+		} else if Acks != nil {
+			err := applyWithAck(ctx, gitRepo, command, trigger)
+			recordDeployment(*info, err)
+			if err != nil {
+				CurrentStatus.RecordError("ack", info.Hash, err)
+				StatusBranch.Record(*info, "failed", err)
+				return nil
+			}
+			recordApplied(*info)
+		} else {
+			err := restartApplication(command, gitRepo.SyncVars(trigger), "sync")
+			recordDeployment(*info, err)
+			if err != nil {
+				log.Printf("failed to restart command: %v\n", err)
+				CurrentStatus.RecordError("restart", info.Hash, err)
+				StatusBranch.Record(*info, "failed", err)
+				return nil
+			}
+			recordApplied(*info)
+		}
+		if !restartSkipped {
+			// each process has its own restart rules
+			if err := Supervised.Restart(state.Changes, trigger); err != nil {
+				log.Printf("%v\n", err)
+				CurrentStatus.RecordError("restart", info.Hash, err)
+			}
+		}
+		Nomad.Submit(ctx, Options.LocalFolder, state.Changes)
+		if err := Hooks.Run(ctx, HookPostUpdate, applied); err != nil {
+			log.Printf("failed to run post-update hooks: %v\n", err)
+			CurrentStatus.RecordError("hook", info.Hash, err)
+		}
+	}
+	return nil
+}
+
+// prepareUpdate loads the env file and merges the config of the files just written, before they're
+// validated
+func prepareUpdate() error {
+	if err := RepoEnv.Load(); err != nil {
+		return err
+	}
+	if Options.MergeOutput != "" {
+		err := WriteMergeOutput(Options.LocalFolder, Options.MergeOutput, Options.MergeApp, Options.MergeProfiles)
 		if err != nil {
-			log.Printf("failed to restart command: %v\n", err)
-			return nil
+			return fmt.Errorf("failed to merge config into %s: %w", Options.MergeOutput, err)
 		}
 	}
 	return nil
 }
 
-func CheckErr(err error) {
-	if err != nil {
-		panic(err)
+// restoreAfterValidation puts back the files of the previous commit once the new ones failed the
+// validation or the pre-update stage, so the application never reads files that were refused. The
+// refused commit is skipped until a newer one comes
+func restoreAfterValidation(ctx context.Context, gitRepo *GitRepo, trigger string, err error) {
+	refused := gitRepo.State()
+	if refused.Previous == "" {
+		log.Printf("no previous commit to restore, leaving the files of commit %s\n", shortCommit(refused.Commit))
+		return
+	}
+	log.Printf("restoring commit %s after commit %s was refused\n", shortCommit(refused.Previous), shortCommit(refused.Commit))
+	if rollbackErr := gitRepo.Rollback(ctx, Options.LocalFolder); rollbackErr != nil {
+		log.Printf("failed to restore commit %s: %v\n", shortCommit(refused.Previous), rollbackErr)
+		Events.Publish(Event{Type: EventSyncFailed, Source: trigger, Error: rollbackErr.Error()})
+		return
+	}
+	gitRepo.Skip(refused.Commit)
+	gitRepo.ForgetPrevious()
+	if prepareErr := prepareUpdate(); prepareErr != nil {
+		log.Printf("failed to prepare the restored files: %v\n", prepareErr)
 	}
+	restored := gitRepo.State()
+	fields := appliedFields(gitRepo)
+	fields["from"] = refused.Commit
+	Events.Publish(Event{Type: EventRolledBack, Source: "validation", Commit: restored.Commit, Error: err.Error(), Fields: fields})
+	Metrics.Add("git_config_server_rollbacks_total", 1)
+	CurrentStatus.RecordSync(restored.Commit, true, nil)
+	CurrentStatus.RecordChanges(restored.Previous, restored.Info, restored.Changes)
 }
 
-func doExec(args ...string) {
-	cmd := args[0]
+// Rollback pauses syncing and applies the previously applied commit, restarting the application.
+// Resuming will sync to the latest commit again
+func Rollback(ctx context.Context, gitRepo *GitRepo, command *Command, beforeUpdate func(ctx context.Context, event Event) error) error {
+	defer LocalWrites.Pause()()
+	CurrentStatus.SetPaused(true)
 
-	log.Printf("will now exec cmd=%s\n", cmd)
-	path, err := exec.LookPath(cmd)
+	from := gitRepo.State().Commit
+	err := gitRepo.Rollback(ctx, Options.LocalFolder)
 	if err != nil {
-		log.Fatalf("Failed to find command: %v", err)
+		Events.Publish(Event{Type: EventSyncFailed, Source: "rollback", Error: err.Error()})
+		CurrentStatus.RecordSync("", false, err)
+		CurrentStatus.RecordError("git", "", err)
+		return err
 	}
+	state := gitRepo.State()
+	fields := appliedFields(gitRepo)
+	fields["from"] = from
+	rolledBack := Events.Publish(Event{Type: EventRolledBack, Source: "api", Commit: state.Commit, Fields: fields})
+	Metrics.Add("git_config_server_rollbacks_total", 1)
+	CurrentStatus.RecordSync(state.Commit, true, nil)
+	CurrentStatus.RecordChanges(state.Previous, state.Info, state.Changes)
 
-	err = syscall.Exec(path, args, os.Environ())
+	if beforeUpdate != nil {
+		log.Println("running beforeUpdate func")
+		if err := beforeUpdate(ctx, rolledBack); err != nil {
+			CurrentStatus.RecordError("validation", state.Commit, err)
+			return fmt.Errorf("failed to run beforeUpdate func: %w", err)
+		}
+	}
+	if err := restartApplication(command, gitRepo.SyncVars("rollback"), "rollback"); err != nil {
+		CurrentStatus.RecordError("restart", state.Commit, err)
+		StatusBranch.Record(state.Info, "failed", err)
+		return err
+	}
+	if err := Supervised.Restart(state.Changes, "rollback"); err != nil {
+		log.Printf("%v\n", err)
+		CurrentStatus.RecordError("restart", state.Commit, err)
+	}
+	StatusBranch.Record(state.Info, "rolled back", nil)
+	Nomad.Submit(ctx, Options.LocalFolder, state.Changes)
+	if err := Hooks.Run(ctx, HookPostUpdate, rolledBack); err != nil {
+		log.Printf("failed to run post-update hooks: %v\n", err)
+		CurrentStatus.RecordError("hook", state.Commit, err)
+	}
+	return nil
+}
+
+// restartApplication restarts the command, recording it in the status and publishing an event. vars
+// resolve the placeholders of the restart command
+func restartApplication(command *Command, vars SyncVars, source string) error {
+	if len(command.Args) == 0 && command.RestartCommand == nil && command.Compose == nil {
+		// only the processes of --processes-file are supervised
+		return nil
+	}
+	err := command.Restart(vars)
+	event := Event{Type: EventChildRestarted, Source: source, Fields: map[string]string{"pid": strconv.Itoa(command.Pid)}}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	Events.Publish(event)
 	if err != nil {
-		log.Fatalf("Failed to exec command: %v", err)
+		return err
+	}
+	CurrentStatus.RecordChild(command.Pid, true)
+	return nil
+}
+
+// recordApplied records a commit applied successfully on the status branch and the deploy tag
+func recordApplied(info CommitInfo) {
+	StatusBranch.Record(info, "applied", nil)
+	DeployTag.Push(info.Hash)
+}
+
+// appliedFields summarizes the applied commit and its changes as event fields
+func appliedFields(gitRepo *GitRepo) map[string]string {
+	state := gitRepo.State()
+	info := state.Info
+	linesAdded, linesRemoved := state.Diff.Lines()
+	return map[string]string{
+		"added":         strconv.Itoa(len(state.Changes.Added)),
+		"modified":      strconv.Itoa(len(state.Changes.Modified)),
+		"removed":       strconv.Itoa(len(state.Changes.Removed)),
+		"preserved":     strconv.Itoa(len(state.Changes.Preserved)),
+		"renamed":       strconv.Itoa(state.Diff.Renamed()),
+		"lines_added":   strconv.Itoa(linesAdded),
+		"lines_removed": strconv.Itoa(linesRemoved),
+		"author":        info.Author,
+		"email":         info.Email,
+		"subject":       info.Subject,
+		"commit_time":   info.Time.Format(time.RFC3339),
+		"author_time":   info.AuthorTime.Format(time.RFC3339),
+		"committer":     info.Committer,
+		"parent":        info.Parent(),
+	}
+}
+
+// logDiff logs how the files changed in the last sync, with the unified diff if --log-diff is set
+func logDiff(gitRepo *GitRepo) {
+	state := gitRepo.State()
+	log.Printf("changes of commit %s: %s\n", shortCommit(state.Commit), state.Diff)
+	if Options.LogDiff {
+		if patch := state.Diff.Patch(int(Options.LogDiffLimit)); patch != "" {
+			log.Printf("diff of commit %s:\n%s", shortCommit(state.Commit), patch)
+		}
+	}
+}
+
+func CheckErr(err error) {
+	if err != nil {
+		panic(err)
 	}
 }
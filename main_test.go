@@ -0,0 +1,66 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	// the syncs record their timings, which need the histograms described
+	registerMetrics()
+	os.Exit(m.Run())
+}
+
+// writeTree writes the files of a test tree, by their slash path. Paths ending with / are directories
+func writeTree(t testing.TB, root string, files map[string]string) {
+	t.Helper()
+	for slashPath, content := range files {
+		path := filepath.Join(root, filepath.FromSlash(slashPath))
+		if strings.HasSuffix(slashPath, "/") {
+			if err := os.MkdirAll(path, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// readTree reads a tree like writeTree writes it, the directories ending with /. Only regular files and
+// directories are read, following symlinks
+func readTree(t testing.TB, root string) map[string]string {
+	t.Helper()
+	files := make(map[string]string)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		slashPath := filepath.ToSlash(rel)
+		switch {
+		case info.IsDir():
+			files[slashPath+"/"] = ""
+		case info.Mode().IsRegular():
+			content, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			files[slashPath] = string(content)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
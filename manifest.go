@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Manifest maps the synced files, relative to the folder and with forward slashes, to their SHA-256
+type Manifest map[string]string
+
+// sourceManifest hashes the files SyncDirs writes from src, as they should be in the destination.
+// Templated and converted files are hashed as written. Protected files and the .git folder are left
+// out, since they may rightly differ
+func sourceManifest(src string, config *RepoConfig) (Manifest, error) {
+	manifest := make(Manifest)
+	err := walkSynced(src, config, func(path, slashPath string) error {
+		if config.Protected(slashPath, false) {
+			return nil
+		}
+		transformed, err := transformFile(config, path, slashPath)
+		if err != nil {
+			return err
+		}
+		if transformed != nil {
+			sum := sha256.Sum256(transformed)
+			manifest[slashPath] = hex.EncodeToString(sum[:])
+			return nil
+		}
+		manifest[slashPath], err = hashFile(path)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash the files in %s: %w", src, err)
+	}
+	return manifest, nil
+}
+
+// syncedFiles lists the files SyncDirs writes from src, the protected ones included
+func syncedFiles(src string, config *RepoConfig) (map[string]bool, error) {
+	files := make(map[string]bool)
+	err := walkSynced(src, config, func(path, slashPath string) error {
+		files[slashPath] = true
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the files in %s: %w", src, err)
+	}
+	return files, nil
+}
+
+// walkSynced calls fn with the path and the slash-separated relative path of every file SyncDirs
+// writes from src, following the symlinks like it does and leaving out the .git folder
+func walkSynced(src string, config *RepoConfig, fn func(path, slashPath string) error) error {
+	return walkSyncedDir(src, "", config, fn)
+}
+
+func walkSyncedDir(dir, slashDir string, config *RepoConfig, fn func(path, slashPath string) error) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		path := filepath.Join(dir, entry.Name())
+		slashPath := entry.Name()
+		if slashDir != "" {
+			slashPath = slashDir + "/" + entry.Name()
+		}
+		isDir := entry.IsDir()
+		if entry.Type()&os.ModeSymlink != 0 {
+			info, err := os.Stat(path)
+			if err != nil {
+				return err
+			}
+			isDir = info.IsDir()
+		}
+		if isGitMetadata(slashPath) || !config.Synced(slashPath, isDir) {
+			continue
+		}
+		if isDir {
+			err = walkSyncedDir(path, slashPath, config, fn)
+		} else {
+			err = fn(path, slashPath)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Hash hashes the files of the manifest in folder, leaving out the missing ones
+func (m Manifest) Hash(folder string) (Manifest, error) {
+	hashed := make(Manifest, len(m))
+	for slashPath := range m {
+		sum, err := hashFile(filepath.Join(folder, filepath.FromSlash(slashPath)))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		hashed[slashPath] = sum
+	}
+	return hashed, nil
+}
+
+// Mismatched lists the files of the manifest that other has with a different hash or not at all, sorted
+func (m Manifest) Mismatched(other Manifest) []string {
+	var mismatched []string
+	for _, slashPath := range sortedKeys(m) {
+		if other[slashPath] != m[slashPath] {
+			mismatched = append(mismatched, slashPath)
+		}
+	}
+	return mismatched
+}
+
+// Write writes the manifest in the format of sha256sum, so it can be checked with sha256sum -c from
+// the folder
+func (m Manifest) Write(path string) error {
+	var b strings.Builder
+	for _, slashPath := range sortedKeys(m) {
+		fmt.Fprintf(&b, "%s  %s\n", m[slashPath], slashPath)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), DirMode); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), ".manifest-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+	if _, err := file.WriteString(b.String()); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// verifyApply checks the files SyncDirs just wrote from src against the ones in dst. A mismatch, e.g.
+// from a partial copy or something else writing to dst, is applied again once before failing. The
+// manifest of dst is then written to ManifestFile, if set
+func (gitRepo *GitRepo) verifyApply(src, dst string, config *RepoConfig) error {
+	if !gitRepo.VerifyApply && gitRepo.ManifestFile == "" {
+		return nil
+	}
+	expected, err := sourceManifest(src, config)
+	if err != nil {
+		return err
+	}
+	actual, err := expected.Hash(dst)
+	if err != nil {
+		return fmt.Errorf("failed to hash the files in %s: %w", dst, err)
+	}
+
+	if gitRepo.VerifyApply {
+		if mismatched := expected.Mismatched(actual); len(mismatched) > 0 {
+			log.Printf("%d files in %s don't match the repo after the apply, like %s, applying again\n", len(mismatched), dst, mismatched[0])
+			if _, err := SyncDirs(src, dst, config, gitRepo.Preserve...); err != nil {
+				return fmt.Errorf("failed to apply again: %w", err)
+			}
+			if actual, err = expected.Hash(dst); err != nil {
+				return fmt.Errorf("failed to hash the files in %s: %w", dst, err)
+			}
+			if mismatched := expected.Mismatched(actual); len(mismatched) > 0 {
+				return fmt.Errorf("%d files in %s don't match the repo even after applying again: %s", len(mismatched), dst, strings.Join(mismatched, ", "))
+			}
+		}
+	}
+
+	if gitRepo.ManifestFile != "" {
+		if err := actual.Write(gitRepo.ManifestFile); err != nil {
+			return fmt.Errorf("failed to write the manifest %s: %w", gitRepo.ManifestFile, err)
+		}
+	}
+	return nil
+}
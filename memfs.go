@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-billy/v5"
+	"github.com/go-git/go-billy/v5/memfs"
+)
+
+// Tree holds the synced files with --in-memory, instead of the local folder. It's nil otherwise
+var Tree *MemoryTree
+
+// MemoryTree is the in-memory copy of the repo folder at the last synced commit
+type MemoryTree struct {
+	mu   sync.RWMutex
+	fsys fs.FS
+}
+
+func NewMemoryTree() *MemoryTree {
+	return &MemoryTree{fsys: billyFS{memfs.New()}}
+}
+
+// FS returns the current files. Syncs replace the whole tree, so it stays consistent while being read
+func (t *MemoryTree) FS() fs.FS {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return t.fsys
+}
+
+// Replace swaps in the files of a new commit, returning what changed like SyncDirs does. How they
+// changed is added to diffs, if set
+func (t *MemoryTree) Replace(fsys fs.FS, diffs *DiffSummary) (SyncChanges, error) {
+	changes, err := diffTrees(t.FS(), fsys, diffs)
+	if err != nil {
+		return changes, err
+	}
+	t.mu.Lock()
+	t.fsys = fsys
+	t.mu.Unlock()
+	return changes, nil
+}
+
+// Applied lists the files of the last synced commit in the local folder, without --in-memory. It's nil otherwise
+var Applied *AppliedTree
+
+// AppliedTree serves the files of the applied commit from the folder they were written to, leaving out
+// the untracked and preserved ones
+type AppliedTree struct {
+	dir   string
+	mu    sync.RWMutex
+	files map[string]bool
+}
+
+func NewAppliedTree(dir string) *AppliedTree {
+	return &AppliedTree{dir: dir}
+}
+
+// Set replaces the files of the applied commit
+func (t *AppliedTree) Set(files map[string]bool) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files = files
+}
+
+// FS returns the applied files, none until the first sync
+func (t *AppliedTree) FS() fs.FS {
+	if t == nil {
+		return appliedFS{}
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return appliedFS{root: newRootFS(t.dir), files: t.files}
+}
+
+// appliedFS opens only the applied files and the directories they're in, which can't be listed
+type appliedFS struct {
+	root  fs.FS
+	files map[string]bool
+}
+
+func (a appliedFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	if a.root == nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if a.files[name] {
+		return a.root.Open(name)
+	}
+	if !a.isDir(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	f, err := a.root.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return unlistedDir{f}, nil
+}
+
+// isDir is true if name is a directory with applied files in it
+func (a appliedFS) isDir(name string) bool {
+	if name == "." {
+		return true
+	}
+	for file := range a.files {
+		if strings.HasPrefix(file, name+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// unlistedDir hides ReadDir, which would list the files left out
+type unlistedDir struct {
+	fs.File
+}
+
+// servedFS returns the synced files: the in-memory tree, or the applied files of the local folder
+func servedFS() fs.FS {
+	if Tree != nil {
+		return Tree.FS()
+	}
+	return Applied.FS()
+}
+
+// diffTrees lists the files added, modified and removed from old to new. Like SyncDirs, a removed
+// directory is reported once, with a trailing slash
+func diffTrees(old, new fs.FS, diffs *DiffSummary) (SyncChanges, error) {
+	var changes SyncChanges
+	err := fs.WalkDir(new, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		newContent, err := fs.ReadFile(new, name)
+		if err != nil {
+			return err
+		}
+		oldContent, err := fs.ReadFile(old, name)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			changes.recordAdded(name)
+			diffs.record(name, nil, newContent)
+		case err != nil:
+			// a directory replaced by a file
+			changes.recordModified(name)
+			diffs.record(name, nil, newContent)
+		case !bytes.Equal(oldContent, newContent):
+			changes.recordModified(name)
+			diffs.record(name, oldContent, newContent)
+		}
+		return nil
+	})
+	if err != nil {
+		return changes, err
+	}
+
+	err = fs.WalkDir(old, ".", func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || name == "." {
+			return err
+		}
+		info, err := fs.Stat(new, name)
+		if err == nil && info.IsDir() == entry.IsDir() {
+			return nil
+		}
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if entry.IsDir() {
+			changes.recordRemoved(name, true)
+			if diffs != nil {
+				if err := recordRemovedTree(diffs, old, name); err != nil {
+					return err
+				}
+			}
+			return fs.SkipDir
+		}
+		if err != nil {
+			changes.recordRemoved(name, false)
+			if diffs != nil {
+				content, err := fs.ReadFile(old, name)
+				if err != nil {
+					return err
+				}
+				diffs.record(name, content, nil)
+			}
+		}
+		return nil
+	})
+	diffs.finish()
+	return changes, err
+}
+
+// recordRemovedTree adds the files of a directory removed from the in-memory tree to the diff summary
+func recordRemovedTree(diffs *DiffSummary, fsys fs.FS, dir string) error {
+	return fs.WalkDir(fsys, dir, func(name string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		content, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return err
+		}
+		diffs.record(name, content, nil)
+		return nil
+	})
+}
+
+// billyFS exposes a go-billy filesystem, like the in-memory worktrees go-git checks out, as an fs.FS
+type billyFS struct {
+	fs billy.Filesystem
+}
+
+func (b billyFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	info, err := b.fs.Stat(name)
+	if name == "." && errors.Is(err, os.ErrNotExist) {
+		// memfs has no entry for its root
+		info, err = rootInfo{}, nil
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	if info.IsDir() {
+		entries, err := b.fs.ReadDir(name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+		}
+		return &billyDir{info: info, entries: entries}, nil
+	}
+	f, err := b.fs.Open(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	return &billyFile{File: f, info: info}, nil
+}
+
+type billyFile struct {
+	billy.File
+	info fs.FileInfo
+}
+
+func (f *billyFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+type billyDir struct {
+	info    fs.FileInfo
+	entries []os.FileInfo
+	offset  int
+}
+
+func (d *billyDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *billyDir) Read([]byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.info.Name(), Err: errors.New("is a directory")}
+}
+
+func (d *billyDir) Close() error {
+	return nil
+}
+
+func (d *billyDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	remaining := d.entries[d.offset:]
+	if n > 0 && len(remaining) == 0 {
+		return nil, io.EOF
+	}
+	if n > 0 && n < len(remaining) {
+		remaining = remaining[:n]
+	}
+	d.offset += len(remaining)
+
+	entries := make([]fs.DirEntry, len(remaining))
+	for i, info := range remaining {
+		entries[i] = fs.FileInfoToDirEntry(info)
+	}
+	return entries, nil
+}
+
+type rootInfo struct{}
+
+func (rootInfo) Name() string       { return "." }
+func (rootInfo) Size() int64        { return 0 }
+func (rootInfo) Mode() fs.FileMode  { return fs.ModeDir | 0o755 }
+func (rootInfo) ModTime() time.Time { return time.Time{} }
+func (rootInfo) IsDir() bool        { return true }
+func (rootInfo) Sys() any           { return nil }
+
+// chrootFS returns the repo folder inside a checked out worktree
+func chrootFS(worktree billy.Filesystem, repoFolder string) (fs.FS, error) {
+	if repoFolder == "" || path.Clean(repoFolder) == "." {
+		return billyFS{worktree}, nil
+	}
+	chrooted, err := worktree.Chroot(repoFolder)
+	if err != nil {
+		return nil, err
+	}
+	return billyFS{chrooted}, nil
+}
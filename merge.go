@@ -0,0 +1,188 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// mergeExtensions are tried for every layer, later ones overriding the earlier ones
+var mergeExtensions = []string{".properties", ".yaml", ".yml", ".json"}
+
+// MergeLayers lists the layer base names from lowest to highest precedence, like Spring Cloud Config:
+// application, {app}, then application-{profile} and {app}-{profile} for each profile in order
+func MergeLayers(app string, profiles []string) []string {
+	layers := []string{"application"}
+	if app != "" && app != "application" {
+		layers = append(layers, app)
+	}
+	for _, profile := range profiles {
+		if profile == "" {
+			continue
+		}
+		layers = append(layers, "application-"+profile)
+		if app != "" && app != "application" {
+			layers = append(layers, app+"-"+profile)
+		}
+	}
+	return layers
+}
+
+// MergeConfig merges the layers found in the files, returning the merged tree and the files used. Maps
+// are merged key by key, while lists and scalars in a higher layer replace the lower ones entirely
+func MergeConfig(files fs.FS, app string, profiles []string) (map[string]any, []string, error) {
+	merged := make(map[string]any)
+	var sources []string
+	for _, layer := range MergeLayers(app, profiles) {
+		for _, ext := range mergeExtensions {
+			name := layer + ext
+			content, err := fs.ReadFile(files, name)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			if ValueCipher != nil {
+				if content, err = ValueCipher.DecryptAll(content); err != nil {
+					return nil, nil, fmt.Errorf("failed to decrypt %s: %w", name, err)
+				}
+			}
+			format, err := configFormat(name)
+			if err != nil {
+				return nil, nil, err
+			}
+			tree, err := ParseConfig(format, content)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to parse %s: %w", name, err)
+			}
+			deepMerge(merged, tree)
+			sources = append(sources, name)
+		}
+	}
+	return merged, sources, nil
+}
+
+// deepMerge merges src into dst, src winning
+func deepMerge(dst, src map[string]any) {
+	for key, value := range src {
+		srcMap, srcIsMap := value.(map[string]any)
+		dstMap, dstIsMap := dst[key].(map[string]any)
+		if srcIsMap && dstIsMap {
+			deepMerge(dstMap, srcMap)
+			continue
+		}
+		if srcIsMap {
+			// copy, so later merges don't modify the parsed layer
+			copied := make(map[string]any, len(srcMap))
+			deepMerge(copied, srcMap)
+			value = copied
+		}
+		dst[key] = value
+	}
+}
+
+// WriteMergeOutput writes the merged config for the app and profiles into the file, in the format
+// given by its extension
+func WriteMergeOutput(localFolder, output, app string, profiles []string) error {
+	format, err := configFormat(output)
+	if err != nil {
+		return err
+	}
+	merged, sources, err := MergeConfig(os.DirFS(localFolder), app, profiles)
+	if err != nil {
+		return err
+	}
+	if len(sources) == 0 {
+		return fmt.Errorf("no config files to merge for %s in %s", app, localFolder)
+	}
+	content, err := RenderConfig(format, merged)
+	if err != nil {
+		return err
+	}
+
+	path := filepath.Join(localFolder, filepath.FromSlash(output))
+	if err := os.MkdirAll(filepath.Dir(path), DirMode); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("failed to write merged config: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write merged config: %w", err)
+	}
+	return nil
+}
+
+// registerMergeHandlers serves the merged config on /config/{app}/{profiles}[/{label}], profiles being
+// comma-separated. A label other than the synced branch is checked out like ?ref=
+func registerMergeHandlers(mux *http.ServeMux, authorized func(r *http.Request, scope Scope) bool) {
+	mux.HandleFunc("/config/", apiHandler(http.MethodGet, ScopeRead, authorized, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/config/"), "/"), "/")
+		if len(parts) < 1 || len(parts) > 3 || parts[0] == "" {
+			http.Error(w, "expected /config/{app}/{profiles}[/{label}]", http.StatusBadRequest)
+			return
+		}
+		app := parts[0]
+		var profiles []string
+		if len(parts) >= 2 {
+			profiles = strings.Split(parts[1], ",")
+		}
+		// the label is a ref like ?ref=, the synced branch being served from the local folder
+		ref := r.URL.Query().Get("ref")
+		if len(parts) == 3 && parts[2] != Options.RepoBranch {
+			ref = parts[2]
+		}
+		if strings.ContainsAny(app, `\.`) {
+			http.Error(w, fmt.Sprintf("invalid app %q", app), http.StatusBadRequest)
+			return
+		}
+		for _, profile := range profiles {
+			if strings.ContainsAny(profile, `\./`) {
+				http.Error(w, fmt.Sprintf("invalid profile %q", profile), http.StatusBadRequest)
+				return
+			}
+		}
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = FormatJSON
+		}
+		if !validFormat(format) {
+			http.Error(w, fmt.Sprintf("unknown format %q, expected json, yaml, properties or env", format), http.StatusBadRequest)
+			return
+		}
+
+		files, commit, ok := requestRoot(w, r, ref)
+		if !ok {
+			return
+		}
+		merged, sources, err := MergeConfig(files, app, profiles)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if len(sources) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		content, err := RenderConfig(format, merged)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", formatContentType(format))
+		w.Header().Set("X-Config-Commit", commit)
+		w.Header().Set("X-Config-Sources", strings.Join(sources, ","))
+		if err := signResponse(w, content); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Write(content)
+	}))
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestMergeLayers(t *testing.T) {
+	tests := []struct {
+		app      string
+		profiles []string
+		want     []string
+	}{
+		{"app", nil, []string{"application", "app"}},
+		{"app", []string{"prod"}, []string{"application", "app", "application-prod", "app-prod"}},
+		{"app", []string{"prod", "", "eu"}, []string{"application", "app", "application-prod", "app-prod", "application-eu", "app-eu"}},
+		{"application", []string{"prod"}, []string{"application", "application-prod"}},
+	}
+	for _, test := range tests {
+		if got := MergeLayers(test.app, test.profiles); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("MergeLayers(%q, %q) = %q, want %q", test.app, test.profiles, got, test.want)
+		}
+	}
+}
+
+func TestMergeConfig(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"application.yaml":       "db:\n  host: shared\n  port: 5432\n  pool: 10\nhosts: [a, b]\nlevel: info\n",
+		"application.properties": "db.port=1111\nlevel=warn\n",
+		"app.yaml":               "db:\n  host: app\nhosts: [c]\n",
+		"application-prod.json":  `{"level": "error"}`,
+		"app-prod.yml":           "db:\n  pool: 50\n",
+		"other.yaml":             "db:\n  host: other\n",
+		"app-dev.yaml":           "level: debug\n",
+	})
+
+	merged, sources, err := MergeConfig(os.DirFS(dir), "app", []string{"prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// .properties comes before .yaml within a layer, so the yaml of the same layer wins
+	wantSources := []string{"application.properties", "application.yaml", "app.yaml", "application-prod.json", "app-prod.yml"}
+	if !reflect.DeepEqual(sources, wantSources) {
+		t.Errorf("merged %q, want %q", sources, wantSources)
+	}
+	want := map[string]any{
+		"db":    map[string]any{"host": "app", "port": 5432, "pool": 50},
+		"hosts": []any{"c"},
+		"level": "error",
+	}
+	if !reflect.DeepEqual(merged, want) {
+		t.Errorf("merged %v, want %v", merged, want)
+	}
+
+	if _, sources, err := MergeConfig(os.DirFS(dir), "missing", []string{"test"}); err != nil || !reflect.DeepEqual(sources, []string{"application.properties", "application.yaml"}) {
+		t.Errorf("merged %q for an app without files: %v", sources, err)
+	}
+}
+
+func TestDeepMergeDoesNotModifyLayers(t *testing.T) {
+	layer := map[string]any{"db": map[string]any{"host": "a"}}
+	merged := make(map[string]any)
+	deepMerge(merged, layer)
+	deepMerge(merged, map[string]any{"db": map[string]any{"host": "b"}})
+	if host := layer["db"].(map[string]any)["host"]; host != "a" {
+		t.Errorf("the first layer was modified to %v", host)
+	}
+}
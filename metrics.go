@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MetricsRegistry holds counters, gauges and histograms, exposed on /metrics in the Prometheus text format
+type MetricsRegistry struct {
+	mu         sync.Mutex
+	families   map[string]*metricFamily
+	order      []string
+	collectors []func(r *MetricsRegistry)
+}
+
+type metricFamily struct {
+	kind    string
+	help    string
+	samples map[string]float64
+	labels  map[string][]string
+	// buckets are the upper bounds of a histogram, whose samples are in histograms instead
+	buckets    []float64
+	histograms map[string]*histogramSample
+}
+
+// histogramSample counts the observations in each bucket, cumulatively like Prometheus does
+type histogramSample struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+var Metrics = NewMetricsRegistry()
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{families: make(map[string]*metricFamily)}
+}
+
+// Describe declares a metric. kind is either "counter" or "gauge"
+func (r *MetricsRegistry) Describe(name, kind, help string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.families[name]; ok {
+		return
+	}
+	r.families[name] = &metricFamily{kind: kind, help: help, samples: make(map[string]float64), labels: make(map[string][]string)}
+	r.order = append(r.order, name)
+}
+
+// DescribeHistogram declares a histogram with the given bucket upper bounds, in increasing order
+func (r *MetricsRegistry) DescribeHistogram(name, help string, buckets []float64) {
+	r.Describe(name, "histogram", help)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.families[name].buckets = buckets
+	r.families[name].histograms = make(map[string]*histogramSample)
+}
+
+// OnCollect registers a function to update gauges right before they're written
+func (r *MetricsRegistry) OnCollect(collect func(r *MetricsRegistry)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collect)
+}
+
+// Add increments a sample. labels are alternating names and values
+func (r *MetricsRegistry) Add(name string, delta float64, labels ...string) {
+	r.update(name, labels, func(v float64) float64 { return v + delta })
+}
+
+// Set sets a sample. labels are alternating names and values
+func (r *MetricsRegistry) Set(name string, value float64, labels ...string) {
+	r.update(name, labels, func(float64) float64 { return value })
+}
+
+func (r *MetricsRegistry) update(name string, labels []string, f func(v float64) float64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	family, ok := r.families[name]
+	if !ok {
+		panic(fmt.Sprintf("metric %s is not described", name))
+	}
+	key := formatLabels(labels)
+	family.samples[key] = f(family.samples[key])
+	family.labels[key] = labels
+}
+
+// Observe adds a value to a histogram. labels are alternating names and values
+func (r *MetricsRegistry) Observe(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	family, ok := r.families[name]
+	if !ok || family.histograms == nil {
+		panic(fmt.Sprintf("histogram %s is not described", name))
+	}
+	key := formatLabels(labels)
+	sample, ok := family.histograms[key]
+	if !ok {
+		sample = &histogramSample{counts: make([]uint64, len(family.buckets))}
+		family.histograms[key] = sample
+		family.labels[key] = labels
+	}
+	for i, bound := range family.buckets {
+		if value <= bound {
+			sample.counts[i]++
+		}
+	}
+	sample.count++
+	sample.sum += value
+}
+
+// collect runs the collectors, updating the gauges
+func (r *MetricsRegistry) collect() {
+	r.mu.Lock()
+	collectors := append([]func(r *MetricsRegistry){}, r.collectors...)
+	r.mu.Unlock()
+	for _, collect := range collectors {
+		collect(r)
+	}
+}
+
+// Visit calls f with every sample, in a stable order. Histograms are visited as their _sum and _count
+// counters
+func (r *MetricsRegistry) Visit(f func(name, kind string, labels []string, value float64)) {
+	r.collect()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, name := range r.order {
+		family := r.families[name]
+		if family.histograms != nil {
+			for _, key := range sortedSampleKeys(family.histograms) {
+				sample := family.histograms[key]
+				f(name+"_sum", "counter", family.labels[key], sample.sum)
+				f(name+"_count", "counter", family.labels[key], float64(sample.count))
+			}
+			continue
+		}
+		for _, key := range sortedSampleKeys(family.samples) {
+			f(name, family.kind, family.labels[key], family.samples[key])
+		}
+	}
+}
+
+// Write outputs all metrics in the Prometheus text exposition format
+func (r *MetricsRegistry) Write(w io.Writer) error {
+	r.collect()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var b strings.Builder
+	for _, name := range r.order {
+		family := r.families[name]
+		fmt.Fprintf(&b, "# HELP %s %s\n", name, family.help)
+		fmt.Fprintf(&b, "# TYPE %s %s\n", name, family.kind)
+
+		if family.histograms != nil {
+			for _, key := range sortedSampleKeys(family.histograms) {
+				writeHistogram(&b, name, family.labels[key], family.buckets, family.histograms[key])
+			}
+			continue
+		}
+		for _, key := range sortedSampleKeys(family.samples) {
+			fmt.Fprintf(&b, "%s%s %s\n", name, key, strconv.FormatFloat(family.samples[key], 'f', -1, 64))
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func writeHistogram(b *strings.Builder, name string, labels []string, buckets []float64, sample *histogramSample) {
+	for i, bound := range buckets {
+		le := append(append([]string{}, labels...), "le", strconv.FormatFloat(bound, 'f', -1, 64))
+		fmt.Fprintf(b, "%s_bucket%s %d\n", name, formatLabels(le), sample.counts[i])
+	}
+	le := append(append([]string{}, labels...), "le", "+Inf")
+	fmt.Fprintf(b, "%s_bucket%s %d\n", name, formatLabels(le), sample.count)
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, formatLabels(labels), strconv.FormatFloat(sample.sum, 'f', -1, 64))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, formatLabels(labels), sample.count)
+}
+
+func sortedSampleKeys[V any](samples map[string]V) []string {
+	keys := make([]string, 0, len(samples))
+	for key := range samples {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// formatLabels renders label pairs as {a="1",b="2"}
+func formatLabels(labels []string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		value := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(labels[i+1])
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[i], value))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// deployLagBuckets go from a minute to a week, the usual range of change lead times
+var deployLagBuckets = []float64{60, 300, 900, 1800, 3600, 3 * 3600, 6 * 3600, 12 * 3600, 24 * 3600, 3 * 24 * 3600, 7 * 24 * 3600}
+
+// syncDirsBuckets go from 10ms, a small tree, to a minute, a tree of hundreds of thousands of files
+var syncDirsBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// registerMetrics declares the metrics about syncs and the application
+func registerMetrics() {
+	Metrics.Describe("git_config_server_syncs_total", "counter", "Sync attempts by result (applied, unchanged or failed)")
+	Metrics.Describe("git_config_server_consecutive_failures", "gauge", "Sync attempts that failed in a row")
+	Metrics.Describe("git_config_server_last_success_timestamp_seconds", "gauge", "Unix time of the last successful sync")
+	Metrics.Describe("git_config_server_staleness_seconds", "gauge", "Seconds since the last successful sync, or since startup if there was none")
+	Metrics.Describe("git_config_server_stale", "gauge", "1 if the config is older than --max-staleness")
+	Metrics.Describe("git_config_server_child_restarts_total", "counter", "Restarts of the application")
+	Metrics.Describe("git_config_server_process_restarts_total", "counter", "Restarts of the processes of --processes-file, after a sync, a failed health check or an exit")
+	Metrics.Describe("git_config_server_process_up", "gauge", "1 if the process of --processes-file is running")
+	Metrics.Describe("git_config_server_events_total", "counter", "Published events by type")
+	Metrics.Describe("git_config_server_deployments_total", "counter", "Commits applied after startup by result (succeeded, or failed on validation, pre-update or restart), for the change failure rate")
+	Metrics.Describe("git_config_server_remote_checks_total", "counter", "Polls of the remote branch")
+	Metrics.Describe("git_config_server_remote_changes_total", "counter", "Polls of the remote branch that found it moved since the previous poll")
+	Metrics.Describe("git_config_server_remote_change_ratio", "gauge", "Share of the polls of the remote branch that found it moved, to tune --update-period")
+	Metrics.Describe("git_config_server_rollbacks_total", "counter", "Rollbacks to the previously applied commit")
+	Metrics.Describe("git_config_server_ref_cache_bytes", "gauge", "Size of the refs checked out for ?ref=, history included, limited by --cache-max-size")
+	Metrics.Describe("git_config_server_gc_removed_total", "counter", "Refs removed from the ref cache and backups removed from --backup-dir by kind (ref or backup)")
+	Metrics.DescribeHistogram("git_config_server_sync_dirs_seconds", "Seconds each phase of writing a tree to a folder took: scan to compare it with the folder, apply to write the differences and prune to remove the directories left empty", syncDirsBuckets)
+	Metrics.Describe("git_config_server_sync_dirs_files", "gauge", "Files compared or written by the last write of a tree to a folder")
+	Metrics.Describe("git_config_server_preserved_paths", "gauge", "Paths of the local folder the last sync left alone since they're gitignored or protected by the .gitsync.yaml, listed on /status")
+	Metrics.Describe("git_config_server_errors_total", "counter", "Errors by category (git, validation, hook, restart, ack, deadline or writes), the recent ones being listed on /status")
+	Metrics.Describe("git_config_server_external_writes_total", "counter", "Paths of the local folder written by other processes between the applies, with --watch-writes")
+	Metrics.Describe("git_config_server_rate_limited_total", "counter", "Requests to the webhook server refused by --rate-limit")
+	Metrics.DescribeHistogram("git_config_server_deploy_lag_seconds", "Seconds from the author time of a commit to its successful deployment, i.e. the change lead time", deployLagBuckets)
+	Metrics.Describe("git_config_server_last_deploy_lag_seconds", "gauge", "Seconds from the author time of the last deployed commit to its deployment")
+	Metrics.Describe("git_config_server_child_cpu_seconds_total", "counter", "User and system CPU time of the application's process, reset when it restarts (Linux only)")
+	Metrics.Describe("git_config_server_child_resident_memory_bytes", "gauge", "Resident memory of the application's process (Linux only)")
+	Metrics.Describe("git_config_server_child_open_fds", "gauge", "Open file descriptors of the application's process (Linux only)")
+	Metrics.Describe("git_config_server_child_uptime_seconds", "gauge", "Seconds since the application's process started (Linux only)")
+
+	Metrics.OnCollect(func(r *MetricsRegistry) {
+		snapshot := CurrentStatus.Snapshot()
+		staleness := CurrentStatus.Staleness()
+
+		r.Set("git_config_server_consecutive_failures", float64(snapshot.Failures))
+		if snapshot.LastSuccessAt != nil {
+			r.Set("git_config_server_last_success_timestamp_seconds", float64(snapshot.LastSuccessAt.Unix()))
+		}
+		r.Set("git_config_server_staleness_seconds", staleness.Seconds())
+		stale := 0.0
+		if Options.MaxStaleness > 0 && staleness > Options.MaxStaleness {
+			stale = 1
+		}
+		r.Set("git_config_server_stale", stale)
+		r.Set("git_config_server_child_restarts_total", float64(snapshot.ChildRestarts))
+		for _, process := range snapshot.Processes {
+			up := 0.0
+			if process.Running {
+				up = 1
+			}
+			r.Set("git_config_server_process_up", up, "process", process.Name)
+		}
+
+		if !snapshot.ChildRunning {
+			r.Set("git_config_server_child_resident_memory_bytes", 0)
+			r.Set("git_config_server_child_open_fds", 0)
+			r.Set("git_config_server_child_uptime_seconds", 0)
+		} else if snapshot.ChildPid > 0 {
+			stats, err := readProcessStats(snapshot.ChildPid)
+			if err != nil {
+				return
+			}
+			r.Set("git_config_server_child_cpu_seconds_total", stats.CPUSeconds)
+			r.Set("git_config_server_child_resident_memory_bytes", float64(stats.ResidentMem))
+			if stats.OpenFDs >= 0 {
+				r.Set("git_config_server_child_open_fds", float64(stats.OpenFDs))
+			}
+			if !stats.StartTime.IsZero() {
+				r.Set("git_config_server_child_uptime_seconds", time.Since(stats.StartTime).Seconds())
+			}
+		}
+	})
+}
+
+// ProcessStats is a sample of the resources used by a process
+type ProcessStats struct {
+	CPUSeconds  float64
+	ResidentMem int64
+	// OpenFDs is -1 when they can't be listed, e.g. for a process of another user
+	OpenFDs   int
+	StartTime time.Time
+}
+
+// recordDeployment records a new commit going live, or failing to. The commit applied on startup isn't
+// counted, since it may have been deployed by a previous run
+func recordDeployment(info CommitInfo, err error) {
+	if err != nil {
+		Metrics.Add("git_config_server_deployments_total", 1, "result", "failed")
+		return
+	}
+	Metrics.Add("git_config_server_deployments_total", 1, "result", "succeeded")
+	if info.AuthorTime.IsZero() {
+		return
+	}
+	lag := time.Since(info.AuthorTime).Seconds()
+	Metrics.Observe("git_config_server_deploy_lag_seconds", lag)
+	Metrics.Set("git_config_server_last_deploy_lag_seconds", lag)
+}
@@ -0,0 +1,8 @@
+package main
+
+import "os"
+
+// deviceID isn't known on Windows, where SyncDirs doesn't look for mount points
+func deviceID(info os.FileInfo) (uint64, bool) {
+	return 0, false
+}
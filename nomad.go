@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+const (
+	nomadTimeout = 30 * time.Second
+	// maxNomadResponse limits what's read of the Nomad API responses
+	maxNomadResponse = 4 * 1024 * 1024
+)
+
+// NomadSubmitter plans and runs the job specs changed by a sync on a Nomad cluster. HCL specs are
+// parsed by the cluster itself, JSON ones are sent as they are
+type NomadSubmitter struct {
+	Address string
+	Token   string
+	jobs    gitignore.Matcher
+	client  *http.Client
+}
+
+// Nomad submits the changed job specs, if --nomad-addr is set
+var Nomad *NomadSubmitter
+
+// NewNomadSubmitter returns nil without an address. Jobs are gitignore-style patterns of the specs in
+// the local folder
+func NewNomadSubmitter(address, token string, jobs []string) (*NomadSubmitter, error) {
+	if address == "" {
+		return nil, nil
+	}
+	if _, err := url.Parse(address); err != nil {
+		return nil, fmt.Errorf("invalid --nomad-addr: %w", err)
+	}
+	return &NomadSubmitter{
+		Address: strings.TrimRight(address, "/"),
+		Token:   token,
+		jobs:    newPathMatcher(jobs),
+		client:  &http.Client{Timeout: nomadTimeout},
+	}, nil
+}
+
+// nomadPlan is the part of the plan response that's looked at
+type nomadPlan struct {
+	JobModifyIndex uint64
+	FailedTGAllocs map[string]json.RawMessage
+	Warnings       string
+	Diff           *struct {
+		Type string
+	}
+}
+
+// Submit plans and runs the jobs among the added and modified files, publishing the outcome of each.
+// Removed specs are left running. A failed job doesn't stop the others, and its event is passed to
+// the deploy-failed hooks
+func (n *NomadSubmitter) Submit(ctx context.Context, folder string, changes SyncChanges) {
+	if n == nil {
+		return
+	}
+	for _, slashPath := range append(append([]string(nil), changes.Added...), changes.Modified...) {
+		if !matchPath(n.jobs, slashPath, false) {
+			continue
+		}
+		fields := map[string]string{"file": slashPath}
+		result, err := n.submit(ctx, filepath.Join(folder, filepath.FromSlash(slashPath)), fields)
+		if err != nil {
+			log.Printf("failed to submit Nomad job %s: %v\n", slashPath, err)
+			failed := Events.Publish(Event{Type: EventNomadJobFailed, Fields: fields, Error: err.Error()})
+			if err := Hooks.Run(ctx, HookDeployFailed, failed); err != nil {
+				log.Printf("failed to run deploy-failed hooks: %v\n", err)
+			}
+			continue
+		}
+		fields["result"] = result
+		Events.Publish(Event{Type: EventNomadJobSubmitted, Fields: fields})
+	}
+}
+
+// submit plans the job and runs it if the plan changes anything and places every allocation, adding
+// what's known about it to fields. It returns whether the job was run or unchanged
+func (n *NomadSubmitter) submit(ctx context.Context, path string, fields map[string]string) (string, error) {
+	job, err := n.loadJob(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	id, _ := job["ID"].(string)
+	if id == "" {
+		id, _ = job["Name"].(string)
+	}
+	if id == "" {
+		return "", fmt.Errorf("the job has no ID")
+	}
+	fields["job"] = id
+
+	var plan nomadPlan
+	err = n.call(ctx, "/v1/job/"+url.PathEscape(id)+"/plan", map[string]any{"Job": job, "Diff": true}, &plan)
+	if err != nil {
+		return "", fmt.Errorf("failed to plan: %w", err)
+	}
+	if plan.Warnings != "" {
+		log.Printf("planning Nomad job %s: %s\n", id, strings.TrimSpace(plan.Warnings))
+	}
+	if len(plan.FailedTGAllocs) > 0 {
+		var groups []string
+		for group := range plan.FailedTGAllocs {
+			groups = append(groups, group)
+		}
+		sort.Strings(groups)
+		return "", fmt.Errorf("the plan can't place the allocations of %s", strings.Join(groups, ", "))
+	}
+	if plan.Diff != nil && plan.Diff.Type == "None" {
+		return "unchanged", nil
+	}
+
+	var registered struct {
+		EvalID string
+	}
+	err = n.call(ctx, "/v1/jobs", map[string]any{"Job": job, "EnforceIndex": true, "JobModifyIndex": plan.JobModifyIndex}, &registered)
+	if err != nil {
+		return "", fmt.Errorf("failed to run: %w", err)
+	}
+	fields["eval_id"] = registered.EvalID
+	fields["job_modify_index"] = strconv.FormatUint(plan.JobModifyIndex, 10)
+	return "submitted", nil
+}
+
+// loadJob reads a JSON spec, either the job itself or wrapped in a Job key, or asks the cluster to
+// parse an HCL one
+func (n *NomadSubmitter) loadJob(ctx context.Context, path string) (map[string]any, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var job map[string]any
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := json.Unmarshal(content, &job); err != nil {
+			return nil, fmt.Errorf("invalid job spec: %w", err)
+		}
+		if wrapped, ok := job["Job"].(map[string]any); ok {
+			job = wrapped
+		}
+		return job, nil
+	}
+	if err := n.call(ctx, "/v1/jobs/parse", map[string]any{"JobHCL": string(content), "Canonicalize": true}, &job); err != nil {
+		return nil, fmt.Errorf("failed to parse: %w", err)
+	}
+	return job, nil
+}
+
+// call POSTs the body as JSON to the API path, decoding the response into result
+func (n *NomadSubmitter) call(ctx context.Context, path string, body, result any) error {
+	content, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.Address+path, bytes.NewReader(content))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.Token != "" {
+		req.Header.Set("X-Nomad-Token", n.Token)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	response, err := io.ReadAll(io.LimitReader(resp.Body, maxNomadResponse))
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s returned %s: %s", path, resp.Status, strings.TrimSpace(string(response)))
+	}
+	return json.Unmarshal(response, result)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// webhookFieldPrefix marks the event fields about the webhook delivery that triggered a sync. Hooks
+// get them in the environment too, e.g. webhook_pusher as WEBHOOK_PUSHER
+const webhookFieldPrefix = "webhook_"
+
+// pushPayload has the fields of the push webhooks of GitHub, GitLab and Gitea that hooks may want
+type pushPayload struct {
+	Ref        string `json:"ref"`
+	Before     string `json:"before"`
+	After      string `json:"after"`
+	Compare    string `json:"compare"`
+	CompareURL string `json:"compare_url"`
+	Pusher     struct {
+		Name     string `json:"name"`
+		Login    string `json:"login"`
+		Username string `json:"username"`
+	} `json:"pusher"`
+	UserUsername string `json:"user_username"`
+	UserName     string `json:"user_name"`
+	Project      struct {
+		WebURL string `json:"web_url"`
+	} `json:"project"`
+}
+
+// parseWebhookPayload picks the pusher, compare URL, ref and pushed commit from a push payload, sent as
+// JSON or as the payload form field. Unknown payloads give no fields
+func parseWebhookPayload(body []byte) map[string]string {
+	if values, err := url.ParseQuery(string(body)); err == nil && values.Get("payload") != "" {
+		body = []byte(values.Get("payload"))
+	}
+	var payload pushPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		return nil
+	}
+
+	fields := make(map[string]string)
+	set := func(key string, values ...string) {
+		for _, value := range values {
+			if value != "" {
+				fields[key] = value
+				return
+			}
+		}
+	}
+	set("pusher", payload.Pusher.Name, payload.Pusher.Login, payload.Pusher.Username, payload.UserUsername, payload.UserName)
+	set("ref", payload.Ref)
+	set("after", payload.After)
+	set("compare_url", payload.Compare, payload.CompareURL)
+	// GitLab doesn't send one, but it's easy to build
+	if _, ok := fields["compare_url"]; !ok && payload.Project.WebURL != "" && payload.Before != "" && payload.After != "" {
+		fields["compare_url"] = payload.Project.WebURL + "/-/compare/" + payload.Before + "..." + payload.After
+	}
+	return fields
+}
+
+// SavePayload writes the raw payload of a webhook delivery next to the pending triggers, or in the
+// temporary directory without one, returning its path. It's removed once its trigger is done
+func (s *TriggerStore) SavePayload(body []byte) (string, error) {
+	dir := filepath.Join(os.TempDir(), "git-config-server-payloads")
+	if s.dir != "" {
+		dir = filepath.Join(s.dir, "payloads")
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", fmt.Errorf("failed to save webhook payload: %w", err)
+	}
+	file, err := os.CreateTemp(dir, "payload-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to save webhook payload: %w", err)
+	}
+	defer file.Close()
+	if _, err := file.Write(body); err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("failed to save webhook payload: %w", err)
+	}
+	return file.Name(), nil
+}
+
+// webhookFields returns the metadata of the latest webhook trigger as event fields
+func webhookFields(triggers []Trigger) map[string]string {
+	for i := len(triggers) - 1; i >= 0; i-- {
+		if triggers[i].Source != "webhook" || len(triggers[i].Metadata) == 0 {
+			continue
+		}
+		fields := make(map[string]string, len(triggers[i].Metadata))
+		for key, value := range triggers[i].Metadata {
+			fields[webhookFieldPrefix+key] = value
+		}
+		return fields
+	}
+	return nil
+}
+
+// webhookEnv turns the webhook fields of the event into environment variables
+func webhookEnv(event Event) []string {
+	var env []string
+	for _, key := range sortedKeys(event.Fields) {
+		if strings.HasPrefix(key, webhookFieldPrefix) {
+			env = append(env, strings.ToUpper(key)+"="+event.Fields[key])
+		}
+	}
+	return env
+}
@@ -0,0 +1,256 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: configserver.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	ConfigServer_GetStatus_FullMethodName    = "/gitconfigserver.v1.ConfigServer/GetStatus"
+	ConfigServer_TriggerSync_FullMethodName  = "/gitconfigserver.v1.ConfigServer/TriggerSync"
+	ConfigServer_WatchChanges_FullMethodName = "/gitconfigserver.v1.ConfigServer/WatchChanges"
+	ConfigServer_GetFile_FullMethodName      = "/gitconfigserver.v1.ConfigServer/GetFile"
+)
+
+// ConfigServerClient is the client API for ConfigServer service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type ConfigServerClient interface {
+	// GetStatus returns the current sync and application status
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	// TriggerSync queues a sync, like the webhook does
+	TriggerSync(ctx context.Context, in *TriggerSyncRequest, opts ...grpc.CallOption) (*TriggerSyncResponse, error)
+	// WatchChanges streams every applied change until the client goes away
+	WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (ConfigServer_WatchChangesClient, error)
+	// GetFile returns a file from the local folder
+	GetFile(ctx context.Context, in *GetFileRequest, opts ...grpc.CallOption) (*File, error)
+}
+
+type configServerClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewConfigServerClient(cc grpc.ClientConnInterface) ConfigServerClient {
+	return &configServerClient{cc}
+}
+
+func (c *configServerClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, ConfigServer_GetStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configServerClient) TriggerSync(ctx context.Context, in *TriggerSyncRequest, opts ...grpc.CallOption) (*TriggerSyncResponse, error) {
+	out := new(TriggerSyncResponse)
+	err := c.cc.Invoke(ctx, ConfigServer_TriggerSync_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *configServerClient) WatchChanges(ctx context.Context, in *WatchChangesRequest, opts ...grpc.CallOption) (ConfigServer_WatchChangesClient, error) {
+	stream, err := c.cc.NewStream(ctx, &ConfigServer_ServiceDesc.Streams[0], ConfigServer_WatchChanges_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &configServerWatchChangesClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type ConfigServer_WatchChangesClient interface {
+	Recv() (*ChangeEvent, error)
+	grpc.ClientStream
+}
+
+type configServerWatchChangesClient struct {
+	grpc.ClientStream
+}
+
+func (x *configServerWatchChangesClient) Recv() (*ChangeEvent, error) {
+	m := new(ChangeEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *configServerClient) GetFile(ctx context.Context, in *GetFileRequest, opts ...grpc.CallOption) (*File, error) {
+	out := new(File)
+	err := c.cc.Invoke(ctx, ConfigServer_GetFile_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// ConfigServerServer is the server API for ConfigServer service.
+// All implementations must embed UnimplementedConfigServerServer
+// for forward compatibility
+type ConfigServerServer interface {
+	// GetStatus returns the current sync and application status
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	// TriggerSync queues a sync, like the webhook does
+	TriggerSync(context.Context, *TriggerSyncRequest) (*TriggerSyncResponse, error)
+	// WatchChanges streams every applied change until the client goes away
+	WatchChanges(*WatchChangesRequest, ConfigServer_WatchChangesServer) error
+	// GetFile returns a file from the local folder
+	GetFile(context.Context, *GetFileRequest) (*File, error)
+	mustEmbedUnimplementedConfigServerServer()
+}
+
+// UnimplementedConfigServerServer must be embedded to have forward compatible implementations.
+type UnimplementedConfigServerServer struct {
+}
+
+func (UnimplementedConfigServerServer) GetStatus(context.Context, *GetStatusRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedConfigServerServer) TriggerSync(context.Context, *TriggerSyncRequest) (*TriggerSyncResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method TriggerSync not implemented")
+}
+func (UnimplementedConfigServerServer) WatchChanges(*WatchChangesRequest, ConfigServer_WatchChangesServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchChanges not implemented")
+}
+func (UnimplementedConfigServerServer) GetFile(context.Context, *GetFileRequest) (*File, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFile not implemented")
+}
+func (UnimplementedConfigServerServer) mustEmbedUnimplementedConfigServerServer() {}
+
+// UnsafeConfigServerServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to ConfigServerServer will
+// result in compilation errors.
+type UnsafeConfigServerServer interface {
+	mustEmbedUnimplementedConfigServerServer()
+}
+
+func RegisterConfigServerServer(s grpc.ServiceRegistrar, srv ConfigServerServer) {
+	s.RegisterService(&ConfigServer_ServiceDesc, srv)
+}
+
+func _ConfigServer_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServerServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ConfigServer_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServerServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigServer_TriggerSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(TriggerSyncRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServerServer).TriggerSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ConfigServer_TriggerSync_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServerServer).TriggerSync(ctx, req.(*TriggerSyncRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _ConfigServer_WatchChanges_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchChangesRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(ConfigServerServer).WatchChanges(m, &configServerWatchChangesServer{stream})
+}
+
+type ConfigServer_WatchChangesServer interface {
+	Send(*ChangeEvent) error
+	grpc.ServerStream
+}
+
+type configServerWatchChangesServer struct {
+	grpc.ServerStream
+}
+
+func (x *configServerWatchChangesServer) Send(m *ChangeEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _ConfigServer_GetFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(ConfigServerServer).GetFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: ConfigServer_GetFile_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(ConfigServerServer).GetFile(ctx, req.(*GetFileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// ConfigServer_ServiceDesc is the grpc.ServiceDesc for ConfigServer service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var ConfigServer_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "gitconfigserver.v1.ConfigServer",
+	HandlerType: (*ConfigServerServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler:    _ConfigServer_GetStatus_Handler,
+		},
+		{
+			MethodName: "TriggerSync",
+			Handler:    _ConfigServer_TriggerSync_Handler,
+		},
+		{
+			MethodName: "GetFile",
+			Handler:    _ConfigServer_GetFile_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchChanges",
+			Handler:       _ConfigServer_WatchChanges_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "configserver.proto",
+}
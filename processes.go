@@ -0,0 +1,541 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// processMinBackoff and processMaxBackoff bound the delay before starting again a process that exited
+	processMinBackoff = time.Second
+	processMaxBackoff = time.Minute
+	// processStableAfter resets the delay of a process that ran at least this long
+	processStableAfter = time.Minute
+	// processReadyTimeout is how long a process waits for its dependencies to be ready
+	processReadyTimeout = 2 * time.Minute
+	processReadyPoll    = 200 * time.Millisecond
+)
+
+// Supervised are the processes of --processes-file, run along with the application. It's nil without
+// one
+var Supervised *Supervisor
+
+// ProcessesConfig is the content of --processes-file
+type ProcessesConfig struct {
+	Processes []ProcessSpec `yaml:"processes"`
+}
+
+// ProcessSpec is a process supervised along with the application, sharing its local folder
+type ProcessSpec struct {
+	Name string `yaml:"name"`
+	// Command is the program and its arguments, run without a shell
+	Command []string `yaml:"command"`
+	// Dir is the working directory, relative to the local folder, which is the default
+	Dir string            `yaml:"dir"`
+	Env map[string]string `yaml:"env"`
+	// Restart decides which synced changes restart the process, like the restart rules of .gitsync.yaml
+	Restart RestartRules `yaml:"restart"`
+	// OnExit is what to do when the process exits by itself: start it again always, only on-failure,
+	// which is the default, or never
+	OnExit string       `yaml:"on_exit"`
+	Health *HealthCheck `yaml:"health"`
+	// DependsOn are the processes that must be ready, running and healthy, before this one starts. It's
+	// restarted after them when they're restarted by a sync
+	DependsOn []string `yaml:"depends_on"`
+}
+
+// HealthCheck restarts a running process once it fails Retries checks in a row
+type HealthCheck struct {
+	// Command passes if it exits with 0. It's run in the working directory of the process
+	Command []string `yaml:"command"`
+	// HTTP is a URL that passes if a GET answers with a 2xx or 3xx status
+	HTTP     string        `yaml:"http"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+	// StartPeriod is how long after a start the failures don't count
+	StartPeriod time.Duration `yaml:"start_period"`
+	Retries     int           `yaml:"retries"`
+}
+
+// ProcessStatus is the state of a supervised process, as served on /status
+type ProcessStatus struct {
+	Name     string `json:"name"`
+	Pid      int    `json:"pid,omitempty"`
+	Running  bool   `json:"running"`
+	Healthy  *bool  `json:"healthy,omitempty"`
+	Restarts int    `json:"restarts"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+}
+
+// Supervisor runs the processes, starting each once its dependencies are ready and stopping them in
+// the reverse order
+type Supervisor struct {
+	processes []*Process
+	byName    map[string]*Process
+	deps      map[string][]string
+	// order has the processes after their dependencies
+	order []string
+	stop  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Process is a supervised process and its restart and health state
+type Process struct {
+	spec    ProcessSpec
+	command *Command
+
+	mu        sync.Mutex
+	stopped   bool
+	startedAt time.Time
+	backoff   time.Duration
+	retry     *time.Timer
+	restarts  int
+	exitCode  *int
+	healthy   *bool
+	failures  int
+}
+
+// LoadProcesses reads the processes of the file, run in localFolder through the sandbox if set
+func LoadProcesses(path, localFolder string, sandbox *Sandbox) (*Supervisor, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read --processes-file: %w", err)
+	}
+	var config ProcessesConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid --processes-file %s: %w", path, err)
+	}
+
+	supervisor := &Supervisor{
+		byName: make(map[string]*Process),
+		deps:   make(map[string][]string),
+		stop:   make(chan struct{}),
+	}
+	var names []string
+	for _, spec := range config.Processes {
+		if err := spec.validate(); err != nil {
+			return nil, fmt.Errorf("invalid --processes-file %s: %w", path, err)
+		}
+		if supervisor.byName[spec.Name] != nil {
+			return nil, fmt.Errorf("invalid --processes-file %s: process %s is defined twice", path, spec.Name)
+		}
+		names = append(names, spec.Name)
+		supervisor.deps[spec.Name] = spec.DependsOn
+		spec.Restart.compile()
+
+		command := NewCommand(context.Background(), spec.Command, nil, Options.StopGracePeriod)
+		command.Sandbox = sandbox
+		command.Dir = spec.Dir
+		if !filepath.IsAbs(command.Dir) {
+			command.Dir = filepath.Join(localFolder, spec.Dir)
+		}
+		for _, key := range sortedKeys(spec.Env) {
+			command.Env = append(command.Env, key+"="+spec.Env[key])
+		}
+		process := &Process{spec: spec, command: command}
+		command.OnExit = func(exitCode int, requested bool) {
+			if !requested {
+				// the restart can't wait here, the command is only done once this returns
+				go process.exited(exitCode)
+			}
+		}
+		supervisor.processes = append(supervisor.processes, process)
+		supervisor.byName[spec.Name] = process
+	}
+	if len(supervisor.processes) == 0 {
+		return nil, fmt.Errorf("invalid --processes-file %s: no processes", path)
+	}
+	if err := checkDAG(names, supervisor.deps, nil); err != nil {
+		return nil, fmt.Errorf("invalid --processes-file %s: %w", path, err)
+	}
+	supervisor.order = topoSort(names, supervisor.deps)
+	return supervisor, nil
+}
+
+// validate checks the spec, filling in the defaults
+func (spec *ProcessSpec) validate() error {
+	if spec.Name == "" {
+		return errors.New("a process has no name")
+	}
+	if len(spec.Command) == 0 {
+		return fmt.Errorf("process %s has no command", spec.Name)
+	}
+	switch spec.OnExit {
+	case "":
+		spec.OnExit = "on-failure"
+	case "always", "on-failure", "never":
+	default:
+		return fmt.Errorf("on_exit of process %s must be always, on-failure or never, not %q", spec.Name, spec.OnExit)
+	}
+	health := spec.Health
+	if health == nil {
+		return nil
+	}
+	if (len(health.Command) == 0) == (health.HTTP == "") {
+		return fmt.Errorf("the health check of process %s needs either a command or an http URL", spec.Name)
+	}
+	if health.Interval <= 0 {
+		health.Interval = 10 * time.Second
+	}
+	if health.Timeout <= 0 {
+		health.Timeout = 5 * time.Second
+	}
+	if health.Retries <= 0 {
+		health.Retries = 3
+	}
+	return nil
+}
+
+// Start starts every process once its dependencies are ready, the independent ones at the same time,
+// and watches their health
+func (s *Supervisor) Start() error {
+	if s == nil {
+		return nil
+	}
+	return runDAG(context.Background(), s.order, s.deps, func(ctx context.Context, name string) error {
+		p := s.byName[name]
+		if err := s.waitDependencies(ctx, p); err != nil {
+			return fmt.Errorf("process %s can't start: %w", name, err)
+		}
+		if err := p.start(); err != nil {
+			return fmt.Errorf("process %s failed to start: %w", name, err)
+		}
+		if p.spec.Health != nil {
+			s.wg.Add(1)
+			go func() {
+				defer s.wg.Done()
+				p.watchHealth(s.stop)
+			}()
+		}
+		return nil
+	})
+}
+
+// Restart restarts the processes whose restart rules match the changes, along with the ones depending
+// on them, each once its dependencies are ready again. Empty changes restart them all
+func (s *Supervisor) Restart(changes SyncChanges, source string) error {
+	if s == nil {
+		return nil
+	}
+	restart := make(map[string]bool)
+	for _, name := range s.order {
+		if s.byName[name].spec.Restart.Matches(changes) {
+			restart[name] = true
+			continue
+		}
+		// the order puts the dependencies first
+		for _, dep := range s.deps[name] {
+			if restart[dep] {
+				log.Printf("restarting process %s along with %s, which it depends on\n", name, dep)
+				restart[name] = true
+				break
+			}
+		}
+		if !restart[name] {
+			log.Printf("not restarting process %s, since its restart rules don't match the changes\n", name)
+		}
+	}
+	var names []string
+	for _, name := range s.order {
+		if restart[name] {
+			names = append(names, name)
+		}
+	}
+	return runDAG(context.Background(), names, s.deps, func(ctx context.Context, name string) error {
+		p := s.byName[name]
+		if err := s.waitDependencies(ctx, p); err != nil {
+			return fmt.Errorf("failed to restart process %s: %w", name, err)
+		}
+		if err := p.restart(source); err != nil {
+			return fmt.Errorf("failed to restart process %s: %w", name, err)
+		}
+		return nil
+	})
+}
+
+// WaitReady waits until the process is running and healthy, up to processReadyTimeout
+func (s *Supervisor) WaitReady(ctx context.Context, name string) error {
+	p := s.byName[name]
+	if p == nil {
+		return fmt.Errorf("unknown process %s", name)
+	}
+	ctx, cancel := context.WithTimeout(ctx, processReadyTimeout)
+	defer cancel()
+	ticker := time.NewTicker(processReadyPoll)
+	defer ticker.Stop()
+	for !p.ready() {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("process %s isn't ready: %w", name, ctx.Err())
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Has is true if name is one of the processes
+func (s *Supervisor) Has(name string) bool {
+	return s != nil && s.byName[name] != nil
+}
+
+// waitDependencies waits for the processes p depends on to be ready
+func (s *Supervisor) waitDependencies(ctx context.Context, p *Process) error {
+	for _, dep := range p.spec.DependsOn {
+		if err := s.WaitReady(ctx, dep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Stop stops the health checks, then the processes, each before the ones it depends on
+func (s *Supervisor) Stop() {
+	if s == nil {
+		return
+	}
+	close(s.stop)
+	s.wg.Wait()
+	for i := len(s.order) - 1; i >= 0; i-- {
+		p := s.byName[s.order[i]]
+		p.mu.Lock()
+		p.stopped = true
+		if p.retry != nil {
+			p.retry.Stop()
+		}
+		if err := p.command.Stop(); err != nil {
+			log.Printf("failed to stop process %s: %v\n", p.spec.Name, err)
+		}
+		p.mu.Unlock()
+	}
+}
+
+// Status returns the state of the processes, in order
+func (s *Supervisor) Status() []ProcessStatus {
+	if s == nil {
+		return nil
+	}
+	statuses := make([]ProcessStatus, 0, len(s.processes))
+	for _, p := range s.processes {
+		p.mu.Lock()
+		status := ProcessStatus{
+			Name:     p.spec.Name,
+			Running:  p.command.IsRunning(),
+			Healthy:  p.healthy,
+			Restarts: p.restarts,
+			ExitCode: p.exitCode,
+		}
+		if status.Running {
+			status.Pid = p.command.Pid
+		}
+		p.mu.Unlock()
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// startLocked starts the process, resetting its health. Must be called with the lock held
+func (p *Process) startLocked() error {
+	if err := p.command.Start(); err != nil {
+		return err
+	}
+	p.startedAt = time.Now()
+	p.exitCode = nil
+	p.healthy = nil
+	p.failures = 0
+	return nil
+}
+
+// ready is true if the process is running and, with a health check, passed the last one
+func (p *Process) ready() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.command.IsRunning() && (p.spec.Health == nil || (p.healthy != nil && *p.healthy))
+}
+
+func (p *Process) start() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.startLocked()
+}
+
+// restart stops and starts the process, unless the supervisor is stopping
+func (p *Process) restart(source string) error {
+	p.mu.Lock()
+	if p.stopped {
+		p.mu.Unlock()
+		return nil
+	}
+	if p.retry != nil {
+		p.retry.Stop()
+		p.retry = nil
+	}
+	log.Printf("restarting process %s\n", p.spec.Name)
+	err := p.command.Stop()
+	if err == nil {
+		err = p.startLocked()
+	}
+	if err == nil {
+		p.restarts++
+	}
+	pid := p.command.Pid
+	p.mu.Unlock()
+
+	// events are published without the lock, as sinks may read the status
+	event := Event{Type: EventChildRestarted, Source: source, Fields: map[string]string{"process": p.spec.Name, "pid": strconv.Itoa(pid)}}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	Events.Publish(event)
+	Metrics.Add("git_config_server_process_restarts_total", 1, "process", p.spec.Name)
+	return err
+}
+
+// exited starts the process again after a delay if its on_exit policy asks for it. The delay doubles
+// while it keeps exiting soon after starting
+func (p *Process) exited(exitCode int) {
+	p.mu.Lock()
+	p.exitCode = &exitCode
+	again := !p.stopped && (p.spec.OnExit == "always" || (p.spec.OnExit == "on-failure" && exitCode != 0))
+	if again {
+		if p.backoff == 0 || time.Since(p.startedAt) >= processStableAfter {
+			p.backoff = processMinBackoff
+		} else {
+			p.backoff = min(p.backoff*2, processMaxBackoff)
+		}
+		p.retry = time.AfterFunc(p.backoff, p.startAgain)
+	}
+	delay := p.backoff
+	p.mu.Unlock()
+
+	eventType := EventChildCrashed
+	if exitCode == 0 {
+		eventType = EventChildExited
+	}
+	Events.Publish(Event{Type: eventType, Fields: map[string]string{"process": p.spec.Name, "exit_code": strconv.Itoa(exitCode)}})
+	if again {
+		log.Printf("process %s exited with code %d, starting it again in %v\n", p.spec.Name, exitCode, delay)
+	}
+}
+
+// startAgain starts the process that exited, retrying after a delay if it can't
+func (p *Process) startAgain() {
+	p.mu.Lock()
+	if p.stopped || p.command.IsRunning() {
+		p.mu.Unlock()
+		return
+	}
+	err := p.startLocked()
+	if err == nil {
+		p.restarts++
+	} else {
+		p.backoff = min(p.backoff*2, processMaxBackoff)
+		p.retry = time.AfterFunc(p.backoff, p.startAgain)
+	}
+	pid := p.command.Pid
+	p.mu.Unlock()
+
+	event := Event{Type: EventChildRestarted, Source: "on-exit", Fields: map[string]string{"process": p.spec.Name, "pid": strconv.Itoa(pid)}}
+	if err != nil {
+		log.Printf("process %s failed to start: %v\n", p.spec.Name, err)
+		event.Error = err.Error()
+	}
+	Events.Publish(event)
+	Metrics.Add("git_config_server_process_restarts_total", 1, "process", p.spec.Name)
+}
+
+// watchHealth checks the process every interval until stop is closed, restarting it once it fails
+// too many checks in a row
+func (p *Process) watchHealth(stop <-chan struct{}) {
+	health := p.spec.Health
+	ticker := time.NewTicker(health.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		p.mu.Lock()
+		skip := !p.command.IsRunning() || time.Since(p.startedAt) < health.StartPeriod
+		p.mu.Unlock()
+		if skip {
+			continue
+		}
+
+		err := p.check()
+		p.mu.Lock()
+		healthy := err == nil
+		p.healthy = &healthy
+		if healthy {
+			p.failures = 0
+		} else {
+			p.failures++
+		}
+		failures := p.failures
+		p.mu.Unlock()
+
+		if healthy {
+			continue
+		}
+		log.Printf("health check of process %s failed (%d/%d): %v\n", p.spec.Name, failures, health.Retries, err)
+		if failures < health.Retries {
+			continue
+		}
+		Events.Publish(Event{Type: EventProcessUnhealthy, Error: err.Error(), Fields: map[string]string{"process": p.spec.Name, "failures": strconv.Itoa(failures)}})
+		if err := p.restart("health"); err != nil {
+			log.Printf("failed to restart process %s: %v\n", p.spec.Name, err)
+		}
+	}
+}
+
+// check runs the health check once
+func (p *Process) check() error {
+	return p.spec.Health.Run(p.command.Dir, p.command.Env)
+}
+
+// Run checks once, running the command in dir with env added to the environment of the application
+func (health *HealthCheck) Run(dir string, env []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), health.Timeout)
+	defer cancel()
+	if health.HTTP == "" {
+		cmd := exec.CommandContext(ctx, health.Command[0], health.Command[1:]...)
+		cmd.Dir = dir
+		cmd.Env = append(ChildEnv.Environ(), env...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			if len(output) > 0 {
+				return fmt.Errorf("%w: %s", err, bytes.TrimSpace(output))
+			}
+			return err
+		}
+		return nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, health.HTTP, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
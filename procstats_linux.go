@@ -0,0 +1,74 @@
+//go:build linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// clockTicks is USER_HZ, the unit of the times in /proc/<pid>/stat, which is 100 on every Linux platform
+const clockTicks = 100
+
+// readProcessStats samples the process from /proc
+func readProcessStats(pid int) (ProcessStats, error) {
+	dir := fmt.Sprintf("/proc/%d", pid)
+	stat, err := os.ReadFile(dir + "/stat")
+	if err != nil {
+		return ProcessStats{}, err
+	}
+	// the command name is in parentheses and may contain spaces, so the fields start after the last one
+	end := strings.LastIndexByte(string(stat), ')')
+	if end < 0 {
+		return ProcessStats{}, fmt.Errorf("unexpected format of %s/stat", dir)
+	}
+	// fields[0] is the state, the third field of the file
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 22 {
+		return ProcessStats{}, fmt.Errorf("unexpected format of %s/stat", dir)
+	}
+	utime, _ := strconv.ParseUint(fields[11], 10, 64)
+	stime, _ := strconv.ParseUint(fields[12], 10, 64)
+	startTicks, _ := strconv.ParseUint(fields[19], 10, 64)
+	rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+
+	stats := ProcessStats{
+		CPUSeconds:  float64(utime+stime) / clockTicks,
+		ResidentMem: rssPages * int64(os.Getpagesize()),
+		OpenFDs:     -1,
+	}
+	if fds, err := os.ReadDir(dir + "/fd"); err == nil {
+		stats.OpenFDs = len(fds)
+	}
+	if bootTime, err := readBootTime(); err == nil {
+		stats.StartTime = bootTime.Add(time.Duration(startTicks) * time.Second / clockTicks)
+	}
+	return stats, nil
+}
+
+// readBootTime reads the btime line of /proc/stat
+func readBootTime() (time.Time, error) {
+	file, err := os.Open("/proc/stat")
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), "btime "); ok {
+			seconds, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return time.Time{}, err
+			}
+			return time.Unix(seconds, 0), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Time{}, fmt.Errorf("no btime in /proc/stat")
+}
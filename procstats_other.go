@@ -0,0 +1,12 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func readProcessStats(pid int) (ProcessStats, error) {
+	return ProcessStats{}, fmt.Errorf("process stats are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// SyncProgress is how far the running sync is, as served on /status, to tell a slow sync from a hung one
+type SyncProgress struct {
+	// Phase is clone, checkout, backup, copy, verify or load
+	Phase          string    `json:"phase"`
+	StartedAt      time.Time `json:"started_at"`
+	PhaseStartedAt time.Time `json:"phase_started_at"`
+	// UpdatedAt is the last time anything moved
+	UpdatedAt time.Time `json:"updated_at"`
+	// Message is the last progress line of the remote, like "Receiving objects:  45% (450/1000)"
+	Message string `json:"message,omitempty"`
+	// Files and Bytes are how many files were copied or compared so far, and their size
+	Files int64 `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+// StartProgress starts tracking a sync, logging its progress every interval until EndProgress
+func (s *ServerStatus) StartProgress(interval time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	s.progress = &SyncProgress{StartedAt: now, PhaseStartedAt: now, UpdatedAt: now}
+	s.progressDone = make(chan struct{})
+	if interval > 0 {
+		go s.logProgress(interval, s.progressDone)
+	}
+}
+
+// EndProgress stops tracking the sync
+func (s *ServerStatus) EndProgress() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.progress == nil {
+		return
+	}
+	close(s.progressDone)
+	s.progress = nil
+}
+
+// SetPhase records that the sync moved on to another phase
+func (s *ServerStatus) SetPhase(phase string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.progress == nil {
+		return
+	}
+	now := time.Now()
+	s.progress.Phase = phase
+	s.progress.PhaseStartedAt = now
+	s.progress.UpdatedAt = now
+	s.progress.Message = ""
+}
+
+// AdvanceProgress adds files and bytes to the ones done by the running sync
+func (s *ServerStatus) AdvanceProgress(files, bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.progress == nil {
+		return
+	}
+	s.progress.Files += files
+	s.progress.Bytes += bytes
+	s.progress.UpdatedAt = time.Now()
+}
+
+func (s *ServerStatus) setProgressMessage(message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.progress == nil {
+		return
+	}
+	s.progress.Message = message
+	s.progress.UpdatedAt = time.Now()
+}
+
+func (s *ServerStatus) logProgress(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		s.mu.Lock()
+		var p SyncProgress
+		if s.progress != nil {
+			p = *s.progress
+		}
+		s.mu.Unlock()
+		if p.StartedAt.IsZero() {
+			return
+		}
+
+		line := fmt.Sprintf("sync in progress: %s for %v", p.Phase, time.Since(p.PhaseStartedAt).Round(time.Second))
+		if p.Files > 0 {
+			line += fmt.Sprintf(", %d files, %s", p.Files, formatBytes(p.Bytes))
+		}
+		if p.Message != "" {
+			line += ", " + p.Message
+		}
+		log.Printf("%s, last progress %v ago\n", line, time.Since(p.UpdatedAt).Round(time.Second))
+	}
+}
+
+// progressWriter receives the sideband progress of the remote, keeping its latest line
+type progressWriter struct {
+	status *ServerStatus
+}
+
+func (w progressWriter) Write(p []byte) (int, error) {
+	// the remote rewrites its line with \r as it goes
+	lines := bytes.FieldsFunc(p, func(r rune) bool { return r == '\r' || r == '\n' })
+	for i := len(lines) - 1; i >= 0; i-- {
+		if line := strings.TrimSpace(string(lines[i])); line != "" {
+			w.status.setProgressMessage(line)
+			break
+		}
+	}
+	return len(p), nil
+}
+
+// formatBytes formats a size with a binary prefix, like 1.5 GiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// TrustedProxies are the peers whose X-Forwarded-For and X-Real-IP headers are believed, like the
+// ingress or the load balancer in front of the server
+type TrustedProxies []netip.Prefix
+
+// Proxies are set by --trusted-proxy. With none, the client is always the direct peer
+var Proxies TrustedProxies
+
+// ParseTrustedProxies parses CIDRs like 10.0.0.0/8, or single addresses
+func ParseTrustedProxies(specs []string) (TrustedProxies, error) {
+	var proxies TrustedProxies
+	for _, spec := range specs {
+		spec = strings.TrimSpace(spec)
+		if !strings.Contains(spec, "/") {
+			addr, err := netip.ParseAddr(spec)
+			if err != nil {
+				return nil, fmt.Errorf("invalid trusted proxy %q, expected a CIDR or an address", spec)
+			}
+			proxies = append(proxies, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy %q, expected a CIDR or an address", spec)
+		}
+		proxies = append(proxies, prefix.Masked())
+	}
+	return proxies, nil
+}
+
+// trusted is true if the address is in one of the ranges
+func (proxies TrustedProxies) trusted(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range proxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientAddr returns the address of the client of the request. The forwarding headers are only
+// looked at when the peer is a trusted proxy: X-Forwarded-For is walked from the right, skipping the
+// trusted proxies, then X-Real-IP is tried. Requests on the control socket have no peer address
+func (proxies TrustedProxies) ClientAddr(r *http.Request) string {
+	peer, ok := peerAddr(r)
+	if !ok || !proxies.trusted(peer) {
+		return r.RemoteAddr
+	}
+
+	var forwarded []string
+	for _, header := range r.Header.Values("X-Forwarded-For") {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr, err := netip.ParseAddr(strings.TrimSpace(forwarded[i]))
+		if err != nil {
+			break
+		}
+		if !proxies.trusted(addr) || i == 0 {
+			return addr.Unmap().String()
+		}
+	}
+	if addr, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return addr.Unmap().String()
+	}
+	return r.RemoteAddr
+}
+
+// peerAddr is the address of the direct peer of the request
+func peerAddr(r *http.Request) (netip.Addr, bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, err := netip.ParseAddr(host)
+	return addr, err == nil
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// statsdPacketSize keeps the StatsD datagrams below the usual Ethernet MTU
+const statsdPacketSize = 1432
+
+// MetricsEmitter sends the current metrics somewhere, for runs that end before they can be scraped
+type MetricsEmitter interface {
+	Name() string
+	Emit(r *MetricsRegistry) error
+}
+
+// MetricsPusher emits the metrics periodically, after every sync and a last time on Stop
+type MetricsPusher struct {
+	emitters []MetricsEmitter
+	interval time.Duration
+
+	mu     sync.Mutex
+	stop   chan struct{}
+	done   chan struct{}
+	cancel func()
+}
+
+// NewMetricsPusher returns the pusher from the options, nil if there's nowhere to push to
+func NewMetricsPusher() (*MetricsPusher, error) {
+	var emitters []MetricsEmitter
+	if Options.PushgatewayURL != "" {
+		emitters = append(emitters, NewPushgatewayEmitter(Options.PushgatewayURL, Options.PushJob))
+	}
+	if Options.StatsDAddress != "" {
+		emitter, err := NewStatsDEmitter(Options.StatsDAddress, Options.StatsDTags)
+		if err != nil {
+			return nil, err
+		}
+		emitters = append(emitters, emitter)
+	}
+	if len(emitters) == 0 {
+		return nil, nil
+	}
+	return &MetricsPusher{emitters: emitters, interval: Options.PushInterval}, nil
+}
+
+// Start emits every interval, if positive, and after every sync attempt
+func (p *MetricsPusher) Start() {
+	syncs, cancel := Events.Subscribe(EventSyncApplied, EventSyncUnchanged, EventSyncFailed)
+	p.stop = make(chan struct{})
+	p.done = make(chan struct{})
+	p.cancel = cancel
+
+	go func() {
+		defer close(p.done)
+		var tick <-chan time.Time
+		if p.interval > 0 {
+			ticker := time.NewTicker(p.interval)
+			defer ticker.Stop()
+			tick = ticker.C
+		}
+		for {
+			select {
+			case <-p.stop:
+				return
+			case <-syncs:
+			case <-tick:
+			}
+			p.emit()
+		}
+	}()
+}
+
+// Stop emits a last time, so the final state of the run is recorded
+func (p *MetricsPusher) Stop() {
+	if p.stop != nil {
+		p.cancel()
+		close(p.stop)
+		<-p.done
+	}
+	p.emit()
+}
+
+func (p *MetricsPusher) emit() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, emitter := range p.emitters {
+		if err := emitter.Emit(Metrics); err != nil {
+			log.Printf("failed to push metrics to %s: %v\n", emitter.Name(), err)
+		}
+	}
+}
+
+// PushgatewayEmitter replaces the metrics of the job and instance on a Prometheus Pushgateway
+type PushgatewayEmitter struct {
+	url string
+}
+
+// NewPushgatewayEmitter pushes to the grouping key of job and this host, so instances don't overwrite
+// each other
+func NewPushgatewayEmitter(gatewayURL, job string) *PushgatewayEmitter {
+	instance, _ := os.Hostname()
+	return &PushgatewayEmitter{
+		url: strings.TrimRight(gatewayURL, "/") + "/metrics/job/" + url.PathEscape(job) + "/instance/" + url.PathEscape(instance),
+	}
+}
+
+func (e *PushgatewayEmitter) Name() string {
+	return "Pushgateway"
+}
+
+func (e *PushgatewayEmitter) Emit(r *MetricsRegistry) error {
+	var body bytes.Buffer
+	if err := r.Write(&body); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, e.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// StatsDEmitter sends the gauges as they are and the counters as the increments since the last emit.
+// The label values are appended to the name, like name.value, unless tags are enabled, in which case
+// they're sent as DogStatsD tags
+type StatsDEmitter struct {
+	conn net.Conn
+	tags bool
+	last map[string]float64
+}
+
+func NewStatsDEmitter(address string, tags bool) (*StatsDEmitter, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up StatsD at %s: %w", address, err)
+	}
+	return &StatsDEmitter{conn: conn, tags: tags, last: make(map[string]float64)}, nil
+}
+
+func (e *StatsDEmitter) Name() string {
+	return "StatsD"
+}
+
+func (e *StatsDEmitter) Emit(r *MetricsRegistry) error {
+	var lines []string
+	r.Visit(func(name, kind string, labels []string, value float64) {
+		name, tags := e.format(name, labels)
+		switch kind {
+		case "counter":
+			delta := value - e.last[name+tags]
+			e.last[name+tags] = value
+			if delta != 0 {
+				lines = append(lines, name+":"+formatStatsDValue(delta)+"|c"+tags)
+			}
+		default:
+			lines = append(lines, name+":"+formatStatsDValue(value)+"|g"+tags)
+		}
+	})
+
+	var packet bytes.Buffer
+	for _, line := range lines {
+		if packet.Len() > 0 && packet.Len()+1+len(line) > statsdPacketSize {
+			if _, err := e.conn.Write(packet.Bytes()); err != nil {
+				return err
+			}
+			packet.Reset()
+		}
+		if packet.Len() > 0 {
+			packet.WriteByte('\n')
+		}
+		packet.WriteString(line)
+	}
+	if packet.Len() > 0 {
+		if _, err := e.conn.Write(packet.Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// format returns the name of the sample and its DogStatsD tags, if any
+func (e *StatsDEmitter) format(name string, labels []string) (string, string) {
+	var tags []string
+	for i := 0; i+1 < len(labels); i += 2 {
+		if e.tags {
+			tags = append(tags, sanitizeStatsD(labels[i])+":"+sanitizeStatsD(labels[i+1]))
+		} else {
+			name += "." + sanitizeStatsD(labels[i+1])
+		}
+	}
+	if len(tags) == 0 {
+		return name, ""
+	}
+	return name, "|#" + strings.Join(tags, ",")
+}
+
+// sanitizeStatsD replaces the characters with a meaning in the StatsD protocol
+func sanitizeStatsD(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ':', '|', '@', '#', ',', '.', '\n', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+func formatStatsDValue(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
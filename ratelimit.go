@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitExempt are the paths never limited, so the probes of the orchestrator keep working
+var rateLimitExempt = map[string]bool{"/healthz": true, "/health": true, "/ready": true}
+
+// ClientLimiter limits the requests of each client to the webhook server with a token bucket, the
+// client being the address ClientAddr finds behind the trusted proxies
+type ClientLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	swept   time.Time
+}
+
+// tokenBucket holds the requests a client can still make, refilled at the rate of the limiter
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimit is set by --rate-limit. A nil limiter lets every request through
+var RateLimit *ClientLimiter
+
+// NewClientLimiter allows each client rate requests per second, and bursts of burst requests
+func NewClientLimiter(rate float64, burst int) (*ClientLimiter, error) {
+	if rate < 0 || burst < 1 {
+		return nil, fmt.Errorf("--rate-limit can't be negative, and --rate-limit-burst must be at least 1")
+	}
+	if rate == 0 {
+		return nil, nil
+	}
+	return &ClientLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*tokenBucket)}, nil
+}
+
+// Allow takes a token from the bucket of the client, returning how long to wait for one otherwise
+func (l *ClientLimiter) Allow(client string) (bool, time.Duration) {
+	if l == nil {
+		return true, 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	bucket, ok := l.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[client] = bucket
+	}
+	bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// sweep forgets the clients whose buckets are full again, at most once a minute
+func (l *ClientLimiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < time.Minute {
+		return
+	}
+	l.swept = now
+	for client, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// Handler answers 429 Too Many Requests to the clients over their rate. The requests of the control
+// socket and the health probes aren't limited
+func (l *ClientLimiter) Handler(next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Context().Value(controlSocketKey{}) != nil || rateLimitExempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		client := clientHost(Proxies.ClientAddr(r))
+		if ok, wait := l.Allow(client); !ok {
+			Metrics.Add("git_config_server_rate_limited_total", 1)
+			debugf("rate limiting %s on %s\n", client, r.URL.Path)
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			http.Error(w, "Too many requests", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// clientHost drops the port of a client address, which changes with every connection
+func clientHost(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
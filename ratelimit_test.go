@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestClientLimiterAllow(t *testing.T) {
+	limiter, err := NewClientLimiter(1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+			t.Fatalf("request %d of the burst refused", i)
+		}
+	}
+	ok, wait := limiter.Allow("10.0.0.1")
+	if ok || wait <= 0 || wait > time.Second {
+		t.Errorf("request over the burst: allowed %v, wait %v", ok, wait)
+	}
+	if ok, _ := limiter.Allow("10.0.0.2"); !ok {
+		t.Errorf("another client was limited")
+	}
+	// a second later, the bucket has a token again
+	limiter.buckets["10.0.0.1"].last = limiter.buckets["10.0.0.1"].last.Add(-time.Second)
+	if ok, _ := limiter.Allow("10.0.0.1"); !ok {
+		t.Errorf("the bucket wasn't refilled")
+	}
+
+	if limiter, err := NewClientLimiter(0, 20); err != nil || limiter != nil {
+		t.Errorf("a rate of 0 gave %v, %v", limiter, err)
+	}
+	if _, err := NewClientLimiter(1, 0); err == nil {
+		t.Errorf("accepted a burst of 0")
+	}
+}
+
+func TestClientLimiterHandler(t *testing.T) {
+	defer func(proxies TrustedProxies) { Proxies = proxies }(Proxies)
+	Proxies = TrustedProxies{netip.MustParsePrefix("10.0.0.0/8")}
+	limiter, err := NewClientLimiter(0.001, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := limiter.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	request := func(path, peer, forwarded string) int {
+		r := httptest.NewRequest("GET", path, nil)
+		r.RemoteAddr = peer
+		if forwarded != "" {
+			r.Header.Set("X-Forwarded-For", forwarded)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	tests := []struct {
+		name      string
+		path      string
+		peer      string
+		forwarded string
+		want      int
+	}{
+		{"first request", "/status", "192.0.2.1:1000", "", http.StatusOK},
+		{"same client on another port", "/status", "192.0.2.1:2000", "", http.StatusTooManyRequests},
+		{"health probe", "/healthz", "192.0.2.1:3000", "", http.StatusOK},
+		{"client behind the proxy", "/status", "10.0.0.1:1000", "198.51.100.1", http.StatusOK},
+		{"same client through another proxy", "/status", "10.0.0.2:1000", "198.51.100.1", http.StatusTooManyRequests},
+		{"another client behind the proxy", "/status", "10.0.0.1:1000", "198.51.100.2", http.StatusOK},
+		{"forged header of an untrusted peer", "/status", "192.0.2.1:4000", "198.51.100.3", http.StatusTooManyRequests},
+	}
+	for _, test := range tests {
+		if got := request(test.path, test.peer, test.forwarded); got != test.want {
+			t.Errorf("%s: got %d, want %d", test.name, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// refResolveTTL is how long a branch or tag resolution is reused before asking the remote again
+const refResolveTTL = 10 * time.Second
+
+// Refs materializes the refs requested with ?ref=. It's nil if --ref-cache-size is 0
+var Refs *RefCache
+
+// RefCache keeps the most recently used refs checked out in a temporary directory, or in memory with
+// --in-memory, keyed by commit
+type RefCache struct {
+	gitRepo  *GitRepo
+	dir      string
+	size     int
+	maxBytes int64
+
+	mu       sync.Mutex
+	bytes    int64
+	lru      *list.List
+	entries  map[string]*list.Element
+	resolved map[string]resolvedRef
+}
+
+type refEntry struct {
+	key    string
+	dir    string
+	files  fs.FS
+	commit string
+	err    error
+	ready  chan struct{}
+	// bytes are the size of the files, counted once checked out
+	bytes int64
+}
+
+type resolvedRef struct {
+	key     string
+	refName plumbing.ReferenceName
+	at      time.Time
+}
+
+// NewRefCache creates the cache directory, keeping up to size refs and, unless maxBytes is 0, up to
+// maxBytes of files. Refs are checked out in memory if the repo keeps its files in memory
+func NewRefCache(gitRepo *GitRepo, size int, maxBytes int64) (*RefCache, error) {
+	var dir string
+	if gitRepo.Memory == nil {
+		var err error
+		dir, err = os.MkdirTemp("", "git-config-refs")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create ref cache directory: %w", err)
+		}
+	}
+	return &RefCache{
+		gitRepo:  gitRepo,
+		dir:      dir,
+		size:     size,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		resolved: make(map[string]resolvedRef),
+	}, nil
+}
+
+// Get returns the repo folder's files at the ref, and the commit they're from. Concurrent requests
+// for the same ref wait for a single checkout
+func (c *RefCache) Get(ctx context.Context, ref string) (fs.FS, string, error) {
+	key, refName, err := c.resolve(ctx, ref)
+	if err != nil {
+		return nil, "", err
+	}
+
+	c.mu.Lock()
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+		entry := element.Value.(*refEntry)
+		c.mu.Unlock()
+		select {
+		case <-entry.ready:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		if entry.err != nil {
+			return nil, "", entry.err
+		}
+		return entry.files, entry.commit, nil
+	}
+
+	entry := &refEntry{key: key, ready: make(chan struct{})}
+	if c.dir != "" {
+		entry.dir = filepath.Join(c.dir, key)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.evict()
+	c.mu.Unlock()
+
+	log.Printf("checking out ref %s of %s\n", ref, c.gitRepo.URL)
+	// the checkout is shared with other requests, so it mustn't be cancelled along with this one
+	entry.files, entry.commit, entry.err = c.gitRepo.Checkout(context.Background(), key, refName, entry.dir)
+	if entry.err != nil {
+		entry.err = fmt.Errorf("failed to check out %s: %w", ref, entry.err)
+		entry.remove()
+		c.mu.Lock()
+		if element, ok := c.entries[key]; ok && element.Value == entry {
+			c.lru.Remove(element)
+			delete(c.entries, key)
+		}
+		c.mu.Unlock()
+	} else {
+		bytes := entry.size()
+		c.mu.Lock()
+		if element, ok := c.entries[key]; ok && element.Value == entry {
+			entry.bytes = bytes
+			c.bytes += bytes
+			c.evict()
+		}
+		c.mu.Unlock()
+	}
+	close(entry.ready)
+
+	if entry.err != nil {
+		return nil, "", entry.err
+	}
+	return entry.files, entry.commit, nil
+}
+
+// resolve maps branches and tags to their current hash, so a moved branch gets a fresh checkout
+func (c *RefCache) resolve(ctx context.Context, ref string) (string, plumbing.ReferenceName, error) {
+	if len(ref) == 40 && isHex(ref) {
+		return ref, "", nil
+	}
+
+	c.mu.Lock()
+	cached, ok := c.resolved[ref]
+	c.mu.Unlock()
+	if ok && time.Since(cached.at) < refResolveTTL {
+		return cached.key, cached.refName, nil
+	}
+
+	key, refName, err := c.gitRepo.ResolveRef(ctx, ref)
+	if err != nil {
+		return "", "", err
+	}
+	c.mu.Lock()
+	c.resolved[ref] = resolvedRef{key: key, refName: refName, at: time.Now()}
+	c.mu.Unlock()
+	return key, refName, nil
+}
+
+// evict removes the least recently used refs over the size, or over maxBytes as long as more than the
+// most recent ref is left. Must be called with the lock held
+func (c *RefCache) evict() {
+	for c.lru.Len() > c.size || (c.maxBytes > 0 && c.bytes > c.maxBytes && c.lru.Len() > 1) {
+		element := c.lru.Back()
+		entry := element.Value.(*refEntry)
+		c.lru.Remove(element)
+		delete(c.entries, entry.key)
+		c.bytes -= entry.bytes
+		Metrics.Add("git_config_server_gc_removed_total", 1, "kind", "ref")
+		go func() {
+			// wait for the checkout, requests being served from it may still be reading though
+			<-entry.ready
+			entry.remove()
+		}()
+	}
+	Metrics.Set("git_config_server_ref_cache_bytes", float64(c.bytes))
+}
+
+// size is the size of the checkout on disk, history included, or of its files in memory
+func (e *refEntry) size() int64 {
+	if e.dir != "" {
+		return folderSize(os.DirFS(e.dir))
+	}
+	return folderSize(e.files)
+}
+
+// folderSize adds up the size of the regular files, skipping the ones it can't read
+func folderSize(files fs.FS) int64 {
+	var size int64
+	fs.WalkDir(files, ".", func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.Type().IsRegular() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size
+}
+
+// remove deletes the checkout from disk. In memory, it's simply dropped
+func (e *refEntry) remove() {
+	if e.dir != "" {
+		os.RemoveAll(e.dir)
+	}
+}
+
+// requestRoot returns the files to serve the request from, the synced ones unless it has ?ref=,
+// along with the commit. On errors, it writes the response itself
+func requestRoot(w http.ResponseWriter, r *http.Request, ref string) (fs.FS, string, bool) {
+	if ref == "" {
+		return servedFS(), CurrentStatus.Snapshot().Commit, true
+	}
+	if Refs == nil {
+		http.Error(w, "Serving other refs is disabled", http.StatusBadRequest)
+		return nil, "", false
+	}
+	files, commit, err := Refs.Get(r.Context(), ref)
+	if errors.Is(err, errUnknownRef) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return nil, "", false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, "", false
+	}
+	return files, commit, true
+}
+
+// Close removes the checked out refs
+func (c *RefCache) Close() error {
+	if c.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(c.dir)
+}
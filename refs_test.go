@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// initRemote creates a repo with a commit for each tree on master, returning it with the commit
+// hashes. Cloning it goes through the git binary, so the test is skipped without one
+func initRemote(t *testing.T, trees ...map[string]string) (*git.Repository, string, []string) {
+	t.Helper()
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var hashes []string
+	for i, tree := range trees {
+		writeTree(t, dir, tree)
+		if err := worktree.AddGlob("."); err != nil {
+			t.Fatal(err)
+		}
+		hash, err := worktree.Commit("commit", &git.CommitOptions{
+			Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(int64(i), 0)},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes = append(hashes, hash.String())
+	}
+	return repo, dir, hashes
+}
+
+func TestRefCache(t *testing.T) {
+	repo, remote, hashes := initRemote(t,
+		map[string]string{"config/app.conf": "v1"},
+		map[string]string{"config/app.conf": "v2"},
+	)
+	if _, err := repo.CreateTag("v1.0", plumbing.NewHash(hashes[0]), nil); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewRefCache(NewGitRepo(remote, "master", "config", "", ""), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	tests := []struct {
+		ref     string
+		commit  string
+		content string
+	}{
+		{"master", hashes[1], "v2"},
+		{"refs/heads/master", hashes[1], "v2"},
+		{"v1.0", hashes[0], "v1"},
+		{hashes[0], hashes[0], "v1"},
+		{hashes[1][:7], hashes[1], "v2"},
+	}
+	for _, test := range tests {
+		t.Run(test.ref, func(t *testing.T) {
+			dir, commit, err := cache.Get(context.Background(), test.ref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if commit != test.commit {
+				t.Errorf("checked out %s, want %s", commit, test.commit)
+			}
+			content, err := fs.ReadFile(dir, "app.conf")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(content) != test.content {
+				t.Errorf("got %q, want %q", content, test.content)
+			}
+		})
+	}
+
+	if _, _, err := cache.Get(context.Background(), "missing-branch"); !errors.Is(err, errUnknownRef) {
+		t.Errorf("got error %v for an unknown ref", err)
+	}
+	if _, _, err := cache.Get(context.Background(), "0123456789abcdef0123456789abcdef01234567"); err == nil {
+		t.Errorf("checked out a missing commit")
+	}
+	cache.mu.Lock()
+	defer cache.mu.Unlock()
+	if cache.lru.Len() > 1 {
+		t.Errorf("kept %d checkouts over the size of 1", cache.lru.Len())
+	}
+}
+
+func TestRefCacheSymlinks(t *testing.T) {
+	repo, remote, _ := initRemote(t, map[string]string{"config/app.conf": "v1"})
+	for link, target := range map[string]string{"alias.conf": "app.conf", "etc": "/etc", "passwd": "../../../../../../etc/passwd"} {
+		if err := os.Symlink(target, filepath.Join(remote, "config", link)); err != nil {
+			t.Skipf("can't create symlinks: %v", err)
+		}
+	}
+	worktree, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := worktree.AddGlob("."); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := worktree.Commit("links", &git.CommitOptions{
+		Author: &object.Signature{Name: "test", Email: "test@example.com", When: time.Unix(1, 0)},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	cache, err := NewRefCache(NewGitRepo(remote, "master", "config", "", ""), 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	files, _, err := cache.Get(context.Background(), "master")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, err := fs.ReadFile(files, "alias.conf"); err != nil || string(content) != "v1" {
+		t.Errorf("got %q, %v for a symlink inside the checkout", content, err)
+	}
+	for _, name := range []string{"etc/passwd", "passwd"} {
+		if _, err := fs.ReadFile(files, name); !errors.Is(err, fs.ErrPermission) {
+			t.Errorf("got error %v for %s, outside the checkout", err, name)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+
+	shellquote "github.com/kballard/go-shellquote"
+)
+
+// Renderer generates the synced files from the repo folder with kustomize or helm, for repos of
+// overlays or charts rather than of the config files themselves
+type Renderer struct {
+	Tool string
+	Args []string
+}
+
+// NewRenderer returns nil without a tool. The extra args are split like a shell would, e.g. for the
+// values files of helm
+func NewRenderer(tool, args string) (*Renderer, error) {
+	switch tool {
+	case "":
+		return nil, nil
+	case "kustomize", "helm":
+	default:
+		return nil, fmt.Errorf("invalid --render %q, expected kustomize or helm", tool)
+	}
+	split, err := shellquote.Split(args)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --render-args: %w", err)
+	}
+	if _, err := exec.LookPath(tool); err != nil {
+		return nil, fmt.Errorf("--render %s needs %s in the PATH: %w", tool, tool, err)
+	}
+	return &Renderer{Tool: tool, Args: split}, nil
+}
+
+// Render writes the output of kustomize build or helm template of src to dst, one file per resource
+// or template
+func (r *Renderer) Render(ctx context.Context, src, dst string) error {
+	if err := os.MkdirAll(dst, 0o775); err != nil {
+		return err
+	}
+	var args []string
+	switch r.Tool {
+	case "kustomize":
+		args = []string{"build", src, "--output", dst}
+	case "helm":
+		args = []string{"template", src, "--output-dir", dst}
+	}
+	args = append(args, r.Args...)
+	log.Printf("rendering the repo folder with %s\n", r.Tool)
+	err := runProcess(ctx, "render", r.Tool, func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, r.Tool, args...)
+		cmd.Dir = src
+		return cmd
+	})
+	if err != nil {
+		return fmt.Errorf("failed to render with %s: %w", r.Tool, err)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxWebhookBody is the largest webhook payload read for signature checks, like GitHub's limit
+const maxWebhookBody = 25 << 20
+
+// deliveryHeaders carry the unique ID of each webhook delivery, in order of preference
+var deliveryHeaders = []string{"X-GitHub-Delivery", "X-Gitea-Delivery", "X-Gitlab-Event-UUID", "X-Webhook-Id"}
+
+var (
+	errBadSignature = errors.New("invalid webhook signature")
+	errReplayed     = errors.New("webhook delivery already processed")
+)
+
+// maxRememberedDeliveries is how many signatures of untimestamped deliveries are remembered to refuse
+// their replays, which no window bounds
+const maxRememberedDeliveries = 100000
+
+// WebhookVerifier checks the HMAC signature of webhook deliveries and refuses replays. Signatures are
+// remembered since they cover the body, and the timestamp when there's one: those of timestamped
+// deliveries until the timestamp is out of the window, the others for the last maxRememberedDeliveries
+type WebhookVerifier struct {
+	secret []byte
+	window time.Duration
+
+	mu sync.Mutex
+	// seen is when each signature or delivery ID can be forgotten, never for a zero time
+	seen map[string]time.Time
+	// untimestamped are the keys of seen that never expire, oldest first
+	untimestamped []string
+}
+
+func NewWebhookVerifier(secret string, window time.Duration) *WebhookVerifier {
+	return &WebhookVerifier{
+		secret: []byte(secret),
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Verify accepts either a GitHub-style X-Hub-Signature-256 of the body, or an X-Webhook-Signature of
+// "<X-Webhook-Timestamp>.<body>", both as sha256=<hex HMAC>
+func (v *WebhookVerifier) Verify(r *http.Request, body []byte) error {
+	var signature string
+	var expires time.Time
+	if timestamp := r.Header.Get("X-Webhook-Timestamp"); timestamp != "" {
+		seconds, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid timestamp %q", errBadSignature, timestamp)
+		}
+		if skew := time.Since(time.Unix(seconds, 0)); skew > v.window || skew < -v.window {
+			return fmt.Errorf("%w: timestamp is %v off", errBadSignature, skew.Round(time.Second))
+		}
+		signature = r.Header.Get("X-Webhook-Signature")
+		if !v.valid(signature, []byte(timestamp+"."), body) {
+			return errBadSignature
+		}
+		expires = time.Unix(seconds, 0).Add(v.window)
+	} else {
+		signature = r.Header.Get("X-Hub-Signature-256")
+		if !v.valid(signature, body) {
+			return errBadSignature
+		}
+	}
+
+	return v.rememberDelivery(r, signature, expires)
+}
+
+// rememberDelivery refuses the replays of a delivery by its signature. The delivery ID isn't signed, so
+// it only refuses the redeliveries of a provider on top of the signature
+func (v *WebhookVerifier) rememberDelivery(r *http.Request, signature string, expires time.Time) error {
+	keys := []string{"signature:" + strings.ToLower(strings.TrimPrefix(signature, "sha256="))}
+	if id := deliveryID(r); id != "" {
+		keys = append(keys, id)
+	}
+	return v.remember(keys, expires)
+}
+
+// deliveryID is the unique ID of the delivery from its headers, if any
+func deliveryID(r *http.Request) string {
+	for _, header := range deliveryHeaders {
+		if value := r.Header.Get(header); value != "" {
+			return header + ":" + value
+		}
+	}
+	return ""
+}
+
+func (v *WebhookVerifier) valid(signature string, parts ...[]byte) bool {
+	hexSum, ok := strings.CutPrefix(signature, "sha256=")
+	if !ok {
+		return false
+	}
+	sum, err := hex.DecodeString(hexSum)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	for _, part := range parts {
+		mac.Write(part)
+	}
+	return hmac.Equal(sum, mac.Sum(nil))
+}
+
+// remember records the keys of the delivery until expires, or for good if it's zero, failing if any
+// of them was already seen
+func (v *WebhookVerifier) remember(keys []string, expires time.Time) error {
+	now := time.Now()
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	for key, at := range v.seen {
+		if !at.IsZero() && now.After(at) {
+			delete(v.seen, key)
+		}
+	}
+	for _, key := range keys {
+		if _, ok := v.seen[key]; ok {
+			return errReplayed
+		}
+	}
+	for _, key := range keys {
+		v.seen[key] = expires
+		if expires.IsZero() {
+			v.untimestamped = append(v.untimestamped, key)
+		}
+	}
+	for len(v.untimestamped) > maxRememberedDeliveries {
+		delete(v.seen, v.untimestamped[0])
+		v.untimestamped = v.untimestamped[1:]
+	}
+	return nil
+}
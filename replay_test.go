@@ -0,0 +1,160 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// sign is the sha256=<hex HMAC> of the parts with the secret
+func sign(secret string, parts ...string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	for _, part := range parts {
+		mac.Write([]byte(part))
+	}
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestWebhookVerifier(t *testing.T) {
+	const secret, body = "s3cret", `{"ref":"refs/heads/main"}`
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	// each test sends its deliveries in order to a new verifier, the last one getting want
+	type delivery map[string]string
+	tests := []struct {
+		name       string
+		deliveries []delivery
+		body       string
+		want       error
+	}{
+		{
+			name:       "signed body",
+			deliveries: []delivery{{"X-Hub-Signature-256": sign(secret, body)}},
+		},
+		{
+			name:       "wrong secret",
+			deliveries: []delivery{{"X-Hub-Signature-256": sign("other", body)}},
+			want:       errBadSignature,
+		},
+		{
+			name:       "tampered body",
+			deliveries: []delivery{{"X-Hub-Signature-256": sign(secret, body)}},
+			body:       `{"ref":"refs/heads/evil"}`,
+			want:       errBadSignature,
+		},
+		{
+			name:       "missing signature",
+			deliveries: []delivery{{}},
+			want:       errBadSignature,
+		},
+		{
+			name: "replayed",
+			deliveries: []delivery{
+				{"X-Hub-Signature-256": sign(secret, body), "X-GitHub-Delivery": "1"},
+				{"X-Hub-Signature-256": sign(secret, body), "X-GitHub-Delivery": "1"},
+			},
+			want: errReplayed,
+		},
+		{
+			name: "replayed with another delivery ID",
+			deliveries: []delivery{
+				{"X-Hub-Signature-256": sign(secret, body), "X-GitHub-Delivery": "1"},
+				{"X-Hub-Signature-256": sign(secret, body), "X-GitHub-Delivery": "2"},
+			},
+			want: errReplayed,
+		},
+		{
+			name: "replayed with a delivery ID added",
+			deliveries: []delivery{
+				{"X-Hub-Signature-256": sign(secret, body)},
+				{"X-Hub-Signature-256": sign(secret, body), "X-Webhook-Id": "new"},
+			},
+			want: errReplayed,
+		},
+		{
+			name: "replayed with the signature in upper case",
+			deliveries: []delivery{
+				{"X-Hub-Signature-256": sign(secret, body)},
+				{"X-Hub-Signature-256": "sha256=" + strings.ToUpper(strings.TrimPrefix(sign(secret, body), "sha256="))},
+			},
+			want: errReplayed,
+		},
+		{
+			name:       "timestamped",
+			deliveries: []delivery{{"X-Webhook-Timestamp": now, "X-Webhook-Signature": sign(secret, now+".", body)}},
+		},
+		{
+			name:       "timestamp out of the window",
+			deliveries: []delivery{{"X-Webhook-Timestamp": old, "X-Webhook-Signature": sign(secret, old+".", body)}},
+			want:       errBadSignature,
+		},
+		{
+			name:       "timestamp changed",
+			deliveries: []delivery{{"X-Webhook-Timestamp": now, "X-Webhook-Signature": sign(secret, old+".", body)}},
+			want:       errBadSignature,
+		},
+		{
+			name: "timestamped replayed with another delivery ID",
+			deliveries: []delivery{
+				{"X-Webhook-Timestamp": now, "X-Webhook-Signature": sign(secret, now+".", body), "X-Webhook-Id": "1"},
+				{"X-Webhook-Timestamp": now, "X-Webhook-Signature": sign(secret, now+".", body), "X-Webhook-Id": "2"},
+			},
+			want: errReplayed,
+		},
+		{
+			name: "delivery ID reused by another delivery",
+			deliveries: []delivery{
+				{"X-Hub-Signature-256": sign(secret, body), "X-Gitea-Delivery": "1"},
+				{"X-Webhook-Timestamp": now, "X-Webhook-Signature": sign(secret, now+".", body), "X-Gitea-Delivery": "1"},
+			},
+			want: errReplayed,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			verifier := NewWebhookVerifier(secret, 5*time.Minute)
+			var err error
+			for i, headers := range test.deliveries {
+				sent := body
+				if test.body != "" {
+					sent = test.body
+				}
+				r := httptest.NewRequest("POST", "/webhook", strings.NewReader(sent))
+				for name, value := range headers {
+					r.Header.Set(name, value)
+				}
+				err = verifier.Verify(r, []byte(sent))
+				if i < len(test.deliveries)-1 && err != nil {
+					t.Fatalf("delivery %d refused: %v", i, err)
+				}
+			}
+			if !errors.Is(err, test.want) {
+				t.Errorf("got %v, want %v", err, test.want)
+			}
+		})
+	}
+}
+
+func TestWebhookVerifierForgets(t *testing.T) {
+	verifier := NewWebhookVerifier("s3cret", time.Minute)
+	expired := time.Now().Add(-time.Second)
+	if err := verifier.remember([]string{"timestamped"}, expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.remember([]string{"untimestamped"}, time.Time{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := verifier.remember([]string{"timestamped"}, time.Now().Add(time.Minute)); err != nil {
+		t.Errorf("the expired delivery wasn't forgotten: %v", err)
+	}
+	if err := verifier.remember([]string{"untimestamped"}, time.Time{}); !errors.Is(err, errReplayed) {
+		t.Errorf("the untimestamped delivery was forgotten: %v", err)
+	}
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+	"gopkg.in/yaml.v3"
+)
+
+// repoConfigFile, at the root of the repo folder, lets the config repo change how it's synced without
+// redeploying the server
+const repoConfigFile = ".gitsync.yaml"
+
+// RepoConfig is the content of .gitsync.yaml. Paths are gitignore-style patterns, relative to the repo
+// folder
+type RepoConfig struct {
+	// Include, if set, only syncs the matching files
+	Include []string `yaml:"include"`
+	// Exclude never syncs the matching files, even if included. They're removed from the local folder
+	Exclude []string `yaml:"exclude"`
+	// Protect lists the paths in the local folder that are written if missing, but never overwritten or
+	// removed, so local edits survive
+	Protect []string `yaml:"protect"`
+	// Validate are shell commands run in the local folder once the files are written, before restarting.
+	// A failure aborts the update like a validate hook
+	Validate []string     `yaml:"validate"`
+	Restart  RestartRules `yaml:"restart"`
+	// Policies control how the files of each directory are written, by their path relative to the repo
+	// folder. The policy of the deepest directory applies
+	Policies map[string]*DirPolicy `yaml:"policies"`
+	// Evaluate generates plain config files from Jsonnet or CUE entrypoints before syncing
+	Evaluate []Evaluation `yaml:"evaluate"`
+	// Stamp lists the files whose __COMMIT__, __SHORT_COMMIT__, __COMMIT_TIME__ and __DEPLOY_TIME__ are
+	// replaced when they're written, so they can tell where they come from without being templates
+	Stamp []string `yaml:"stamp"`
+
+	include gitignore.Matcher
+	exclude gitignore.Matcher
+	protect gitignore.Matcher
+	stamp   gitignore.Matcher
+	// commit is the one being synced, for the templates
+	commit string
+	// eol, if set, converts the line endings of the text files
+	eol *eolConverter
+	// decrypt, if set, decrypts the {cipher} values of the files written
+	decrypt *Cipher
+	// mtime sets the modification time of the files written to the commitTime with "commit", or to the
+	// one of the source file with "source"
+	mtime      string
+	commitTime time.Time
+	// deployTime is when the sync started, the same for all the stamped files
+	deployTime time.Time
+	// xattrs keeps the extended attributes of the files in the local folder when they're replaced
+	xattrs bool
+	// chown sets the owner, group and mode of the matching paths after they're written
+	chown ChownRules
+	// pruneEmpty removes the directories left empty, unless they have one of the keepMarkers, which are
+	// never removed
+	pruneEmpty  bool
+	keepMarkers []string
+	// gitDir leaves the .git of the local folder alone, written after the sync with --include-git-dir
+	gitDir bool
+	// diff, if set, collects how the files changed
+	diff *DiffSummary
+}
+
+// DirPolicy controls how the files in a directory are written to the local folder
+type DirPolicy struct {
+	// Prune removes the files in the local folder that aren't in the repo, which is the default
+	Prune *bool `yaml:"prune"`
+	// Mode is the octal permissions of the files written, like "0600"
+	Mode string `yaml:"mode"`
+	// Template renders the files as Go templates, with .Env and .Commit
+	Template bool `yaml:"template"`
+
+	mode os.FileMode
+}
+
+// templateData is what the templated files can refer to
+type templateData struct {
+	Env    map[string]string
+	Commit string
+}
+
+// RestartRules decide whether a change restarts the application
+type RestartRules struct {
+	// Paths, if set, only restart the application when a matching path changed
+	Paths []string `yaml:"paths"`
+	// Ignore lists the paths whose changes never restart the application
+	Ignore []string `yaml:"ignore"`
+
+	paths  gitignore.Matcher
+	ignore gitignore.Matcher
+}
+
+// LoadRepoConfig reads .gitsync.yaml from the root of files. Without one, everything is synced as before
+func LoadRepoConfig(files fs.FS) (*RepoConfig, error) {
+	config := &RepoConfig{}
+	content, err := fs.ReadFile(files, repoConfigFile)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", repoConfigFile, err)
+	}
+	if len(content) > 0 {
+		decoder := yaml.NewDecoder(bytes.NewReader(content))
+		// typos shouldn't silently sync everything
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("invalid %s: %w", repoConfigFile, err)
+		}
+	}
+
+	config.include = newPathMatcher(config.Include)
+	config.exclude = newPathMatcher(config.Exclude)
+	config.protect = newPathMatcher(config.Protect)
+	config.stamp = newPathMatcher(config.Stamp)
+	config.Restart.compile()
+	for _, evaluation := range config.Evaluate {
+		if err := evaluation.validate(); err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", repoConfigFile, err)
+		}
+	}
+	for dir, policy := range config.Policies {
+		if policy == nil || policy.Mode == "" {
+			continue
+		}
+		mode, err := strconv.ParseUint(policy.Mode, 8, 32)
+		if err != nil || mode > 0o777 {
+			return nil, fmt.Errorf("invalid %s: mode %q of %s isn't octal permissions like 0640", repoConfigFile, policy.Mode, dir)
+		}
+		policy.mode = os.FileMode(mode)
+	}
+	return config, nil
+}
+
+// policy returns the policy of the deepest directory containing the path, nil if there's none
+func (c *RepoConfig) policy(slashPath string) *DirPolicy {
+	if c == nil {
+		return nil
+	}
+	var policy *DirPolicy
+	longest := -1
+	for dir, candidate := range c.Policies {
+		dir = strings.Trim(dir, "/")
+		if dir == "." {
+			dir = ""
+		}
+		if dir != "" && slashPath != dir && !strings.HasPrefix(slashPath, dir+"/") {
+			continue
+		}
+		if len(dir) > longest {
+			policy, longest = candidate, len(dir)
+		}
+	}
+	return policy
+}
+
+// prunes is true if the files not in the repo are removed
+func (p *DirPolicy) prunes() bool {
+	return p == nil || p.Prune == nil || *p.Prune
+}
+
+// executable is true if the written file should be executable, by the mode of its --chown-rule, of its
+// policy, or else like the source file
+func (c *RepoConfig) executable(slashPath string, src os.FileInfo) bool {
+	if c == nil {
+		return IsExecAny(src)
+	}
+	if rule := c.chown.match(slashPath, false); rule != nil && rule.mode != 0 {
+		return rule.mode&0o111 != 0
+	}
+	if p := c.policy(slashPath); p != nil && p.mode != 0 {
+		return p.mode&0o111 != 0
+	}
+	return IsExecAny(src)
+}
+
+// isKeepMarker is true for the files that keep their directory when pruning empty ones
+func (c *RepoConfig) isKeepMarker(name string) bool {
+	if c == nil || !c.pruneEmpty {
+		return false
+	}
+	for _, marker := range c.keepMarkers {
+		if name == marker {
+			return true
+		}
+	}
+	return false
+}
+
+// hasKeepMarker is true if a keep marker is somewhere inside the directory
+func (c *RepoConfig) hasKeepMarker(dir string) bool {
+	if c == nil || !c.pruneEmpty {
+		return false
+	}
+	found := false
+	filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() && c.isKeepMarker(entry.Name()) {
+			found = true
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return found
+}
+
+// applyOwnership applies the --chown-rule matching the path, if any
+func (c *RepoConfig) applyOwnership(path, slashPath string, isDir bool) error {
+	if c == nil {
+		return nil
+	}
+	return c.chown.Apply(path, slashPath, isDir)
+}
+
+// keepsXattrs is true if the extended attributes of the replaced files are kept
+func (c *RepoConfig) keepsXattrs() bool {
+	return c != nil && c.xattrs
+}
+
+// setMtime sets the modification time of a written file, according to --mtime
+func (c *RepoConfig) setMtime(dst string, src os.FileInfo) error {
+	if c == nil {
+		return nil
+	}
+	var mtime time.Time
+	switch c.mtime {
+	case "commit":
+		mtime = c.commitTime
+	case "source":
+		mtime = src.ModTime()
+	}
+	if mtime.IsZero() {
+		return nil
+	}
+	if err := os.Chtimes(dst, mtime, mtime); err != nil {
+		return fmt.Errorf("failed to set the modification time of %s: %w", dst, err)
+	}
+	return nil
+}
+
+// render renders a templated file
+func (c *RepoConfig) render(name string, content []byte) ([]byte, error) {
+	tmpl, err := template.New(name).Option("missingkey=zero").Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("invalid template %s: %w", name, err)
+	}
+	env := make(map[string]string)
+	for _, entry := range os.Environ() {
+		if key, value, ok := strings.Cut(entry, "="); ok {
+			env[key] = value
+		}
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, templateData{Env: env, Commit: c.commit}); err != nil {
+		return nil, fmt.Errorf("failed to render template %s: %w", name, err)
+	}
+	return b.Bytes(), nil
+}
+
+// stamps is true if the file gets its tokens replaced
+func (c *RepoConfig) stamps(slashPath string) bool {
+	return c != nil && matchPath(c.stamp, slashPath, false)
+}
+
+// stampTokens replaces the provenance tokens of a stamped file
+func (c *RepoConfig) stampTokens(content []byte) []byte {
+	return []byte(strings.NewReplacer(
+		"__COMMIT__", c.commit,
+		"__SHORT_COMMIT__", shortCommit(c.commit),
+		"__COMMIT_TIME__", c.commitTime.UTC().Format(time.RFC3339),
+		"__DEPLOY_TIME__", c.deployTime.UTC().Format(time.RFC3339),
+	).Replace(string(content)))
+}
+
+func newPathMatcher(patterns []string) gitignore.Matcher {
+	var parsed []gitignore.Pattern
+	for _, pattern := range patterns {
+		parsed = append(parsed, gitignore.ParsePattern(pattern, nil))
+	}
+	return gitignore.NewMatcher(parsed)
+}
+
+func matchPath(matcher gitignore.Matcher, slashPath string, isDir bool) bool {
+	return matcher != nil && matcher.Match(strings.Split(slashPath, "/"), isDir)
+}
+
+// Synced is true if the path is synced. Directories are synced unless excluded, since included files
+// may be inside. A nil config syncs everything
+func (c *RepoConfig) Synced(slashPath string, isDir bool) bool {
+	if c == nil {
+		return true
+	}
+	if matchPath(c.exclude, slashPath, isDir) {
+		return false
+	}
+	return isDir || len(c.Include) == 0 || matchPath(c.include, slashPath, isDir)
+}
+
+// Protected is true if the path in the local folder is never overwritten or removed
+func (c *RepoConfig) Protected(slashPath string, isDir bool) bool {
+	return c != nil && matchPath(c.protect, slashPath, isDir)
+}
+
+// validateCommands returns the validation commands, none for a nil config
+func (c *RepoConfig) validateCommands() []string {
+	if c == nil {
+		return nil
+	}
+	return c.Validate
+}
+
+// Restarts is true if the changes call for restarting the application
+func (c *RepoConfig) Restarts(changes SyncChanges) bool {
+	return c == nil || c.Restart.Matches(changes)
+}
+
+// compile builds the matchers of the patterns
+func (r *RestartRules) compile() {
+	r.paths = newPathMatcher(r.Paths)
+	r.ignore = newPathMatcher(r.Ignore)
+}
+
+// Matches is true if the changes restart the application: always without rules or changes, else if a
+// changed path matches Paths, or any path without Paths, and isn't ignored
+func (r *RestartRules) Matches(changes SyncChanges) bool {
+	if changes.Empty() || (len(r.Paths) == 0 && len(r.Ignore) == 0) {
+		return true
+	}
+	for _, paths := range [][]string{changes.Added, changes.Modified, changes.Removed} {
+		for _, changed := range paths {
+			slashPath := strings.TrimSuffix(changed, "/")
+			isDir := slashPath != changed
+			if matchPath(r.ignore, slashPath, isDir) {
+				continue
+			}
+			if len(r.Paths) == 0 || matchPath(r.paths, slashPath, isDir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filteredFS hides the files the repo config doesn't sync, for the in-memory tree
+type filteredFS struct {
+	fsys   fs.FS
+	config *RepoConfig
+}
+
+// hidden is true if the config doesn't sync the path
+func (f filteredFS) hidden(name string) bool {
+	if name == "." {
+		return false
+	}
+	info, err := fs.Stat(f.fsys, name)
+	return err == nil && !f.config.Synced(name, info.IsDir())
+}
+
+func (f filteredFS) Open(name string) (fs.File, error) {
+	if f.hidden(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return f.fsys.Open(name)
+}
+
+func (f filteredFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if f.hidden(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	}
+	entries, err := fs.ReadDir(f.fsys, name)
+	if err != nil {
+		return nil, err
+	}
+	synced := entries[:0]
+	for _, entry := range entries {
+		if f.config.Synced(path.Join(name, entry.Name()), entry.IsDir()) {
+			synced = append(synced, entry)
+		}
+	}
+	return synced, nil
+}
+
+// diffs returns the summary collecting how the files changed, nil if none is
+// keepsGitDir is true if the .git of the local folder isn't synced like the other paths
+func (c *RepoConfig) keepsGitDir() bool {
+	return c != nil && c.gitDir
+}
+
+func (c *RepoConfig) diffs() *DiffSummary {
+	if c == nil {
+		return nil
+	}
+	return c.diff
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RestartPolicy is how the application is restarted and checked afterwards
+type RestartPolicy struct {
+	// Runner is the shell running the restart command, in Dir
+	Runner string
+	Dir    string
+	// Exec runs the restart command directly, split into arguments, rather than with the runner
+	Exec bool
+	// Retries is how many more times a failed restart command is run, RetryDelay apart
+	Retries    int
+	RetryDelay time.Duration
+	// Check, if set, must pass within CheckTimeout after a restart for it to succeed
+	Check        *HealthCheck
+	CheckTimeout time.Duration
+	// Fallback stops and starts the application when the restart command still fails
+	Fallback bool
+}
+
+// NewRestartCheck makes the check of --restart-check: a GET of an http:// or https:// URL, or a shell
+// command run with the runner otherwise. Nil if check is empty
+func NewRestartCheck(check, runner string) *HealthCheck {
+	if check == "" {
+		return nil
+	}
+	health := &HealthCheck{Interval: time.Second, Timeout: 5 * time.Second}
+	if strings.HasPrefix(check, "http://") || strings.HasPrefix(check, "https://") {
+		health.HTTP = check
+	} else {
+		health.Command = append([]string{runner}, shellArgs(runner, check)...)
+	}
+	return health
+}
+
+// runRestartCommand runs the restart command until it succeeds and the check passes, at most 1 +
+// Retries times. The application's pid is in APP_PID
+func (c *Command) runRestartCommand(vars SyncVars) error {
+	policy := c.RestartPolicy
+	var env []string
+	if c.Pid >= 0 {
+		env = append(env, "APP_PID="+strconv.Itoa(c.Pid))
+	}
+	for attempt := 1; ; attempt++ {
+		err := c.execRestartCommand(vars, env)
+		if err == nil {
+			err = policy.verify()
+		}
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("restart command failed: %w", err)
+		if attempt > policy.Retries {
+			return err
+		}
+		log.Printf("%v, trying again in %v (%d/%d)\n", err, policy.RetryDelay, attempt, policy.Retries)
+		time.Sleep(policy.RetryDelay)
+	}
+}
+
+// execRestartCommand runs the restart command once
+func (c *Command) execRestartCommand(vars SyncVars, env []string) error {
+	policy := c.RestartPolicy
+	if !policy.Exec {
+		shellCommand, err := c.RestartCommand.Render(vars)
+		if err != nil {
+			return err
+		}
+		log.Printf("executing restart command\n")
+		return runShellCommand(c.ctx, "restart-command", shellCommand, policy.Runner, policy.Dir, env...)
+	}
+	args, err := c.RestartCommand.Args(vars)
+	if err != nil {
+		return err
+	}
+	log.Printf("executing restart command: %v\n", args)
+	return runProcess(c.ctx, "restart-command", "restart-command", func(ctx context.Context) *exec.Cmd {
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Env = append(os.Environ(), env...)
+		cmd.Dir = policy.Dir
+		return cmd
+	})
+}
+
+// verify waits for the check, if any, to pass, failing after CheckTimeout
+func (policy RestartPolicy) verify() error {
+	if policy.Check == nil {
+		return nil
+	}
+	deadline := time.Now().Add(policy.CheckTimeout)
+	for {
+		err := policy.Check.Run(policy.Dir, nil)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("the application isn't healthy %v after the restart: %w", policy.CheckTimeout, err)
+		}
+		time.Sleep(policy.Check.Interval)
+	}
+}
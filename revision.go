@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing"
+)
+
+// revisionExpr is a parsed --ref: a base looked up in the refs advertised by the remote, and the rest
+// of the expression, like ~2 or ^2, which needs the history to be resolved
+type revisionExpr struct {
+	base   string
+	suffix string
+}
+
+// parseRevision splits a revision expression like main~2 or v1.2.0^{} into its base and suffix. Peeling
+// to the commit is dropped from the suffix, since tags are always peeled
+func parseRevision(expr string) (revisionExpr, error) {
+	expr = strings.TrimSpace(expr)
+	i := strings.IndexAny(expr, "~^@:")
+	if i < 0 {
+		return revisionExpr{base: expr}, nil
+	}
+	rev := revisionExpr{base: expr[:i], suffix: expr[i:]}
+	if rev.base == "" {
+		return rev, fmt.Errorf("invalid --ref %q, it must start with HEAD, a branch, a tag or a commit", expr)
+	}
+	for _, peel := range []string{"^{}", "^{commit}"} {
+		rev.suffix = strings.TrimSuffix(rev.suffix, peel)
+	}
+	if strings.ContainsAny(rev.suffix, "@:") {
+		return rev, fmt.Errorf("invalid --ref %q, only ~, ^ and ^{} are supported after %s", expr, rev.base)
+	}
+	return rev, nil
+}
+
+// lookupRevision finds the base of the expression in the refs advertised by the remote, returning the
+// commit it points to and the ref to clone to get it. The base is tried as HEAD, as a full ref name,
+// as a branch and as a tag, in this order. A full commit hash comes with an empty ref name, since it
+// can be anywhere in the history
+func lookupRevision(refs []*plumbing.Reference, base string) (string, plumbing.ReferenceName, error) {
+	byName := make(map[plumbing.ReferenceName]*plumbing.Reference, len(refs))
+	for _, ref := range refs {
+		byName[ref.Name()] = ref
+	}
+	// annotated tags point to the tag object, the commit is in the peeled ref
+	find := func(name plumbing.ReferenceName) (string, bool) {
+		if peeled, ok := byName[name+"^{}"]; ok {
+			return peeled.Hash().String(), true
+		}
+		if ref, ok := byName[name]; ok && ref.Type() == plumbing.HashReference {
+			return ref.Hash().String(), true
+		}
+		return "", false
+	}
+
+	if base == "HEAD" {
+		head, ok := byName[plumbing.HEAD]
+		if !ok {
+			return "", "", fmt.Errorf("the remote doesn't advertise HEAD")
+		}
+		if head.Type() == plumbing.SymbolicReference {
+			if commit, ok := find(head.Target()); ok {
+				return commit, head.Target(), nil
+			}
+			return "", "", fmt.Errorf("HEAD points to %s, which isn't in the remote", head.Target())
+		}
+		return head.Hash().String(), "", nil
+	}
+	for _, name := range []plumbing.ReferenceName{
+		plumbing.ReferenceName(base),
+		plumbing.NewBranchReferenceName(base),
+		plumbing.NewTagReferenceName(base),
+	} {
+		if commit, ok := find(name); ok {
+			return commit, name, nil
+		}
+	}
+	if len(base) == 40 && isHex(base) {
+		return strings.ToLower(base), "", nil
+	}
+	return "", "", fmt.Errorf("%w %q", errUnknownRef, base)
+}
+
+// resolveRevision resolves --ref to the commit to apply, setting the ref Fetch clones. Expressions
+// walking the history are resolved in a full clone, which is only done again when their base moves
+func (gitRepo *GitRepo) resolveRevision(ctx context.Context) (string, error) {
+	log.Printf("Resolving %s in %s\n", gitRepo.Ref, gitRepo.URL)
+	rev, err := parseRevision(gitRepo.Ref)
+	if err != nil {
+		return "", err
+	}
+	refs, err := gitRepo.listRefs(ctx, 0)
+	if err != nil {
+		return "", err
+	}
+	base, refName, err := lookupRevision(refs, rev.base)
+	if err != nil {
+		return "", err
+	}
+	gitRepo.fetchRef = refName
+	if rev.suffix == "" {
+		log.Printf("%s is commit %s\n", gitRepo.Ref, base)
+		return base, nil
+	}
+	if base == gitRepo.revisionBase && gitRepo.revisionCommit != "" {
+		return gitRepo.revisionCommit, nil
+	}
+
+	repo, err := gitRepo.clone(ctx, "", 0, refName, nil)
+	if err != nil {
+		return "", err
+	}
+	hash, err := repo.ResolveRevision(plumbing.Revision(base + rev.suffix))
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve %s: %w", gitRepo.Ref, err)
+	}
+	gitRepo.revisionBase, gitRepo.revisionCommit = base, hash.String()
+	log.Printf("%s is commit %s\n", gitRepo.Ref, gitRepo.revisionCommit)
+	return gitRepo.revisionCommit, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"syscall"
+)
+
+// sandboxCommand is the hidden first argument that makes this binary set up the sandbox and then
+// exec the application, so the restrictions apply to it and not to the server
+const sandboxCommand = "__sandbox"
+
+// sandboxFailedCode is the exit code of the helper when the sandbox can't be set up
+const sandboxFailedCode = 126
+
+// Sandbox lists the restrictions for the application
+type Sandbox struct {
+	NoNewPrivs bool     `json:"no_new_privs,omitempty"`
+	DropCaps   []string `json:"drop_caps,omitempty"`
+	Seccomp    string   `json:"seccomp,omitempty"`
+	PrivateTmp bool     `json:"private_tmp,omitempty"`
+}
+
+// NewSandbox returns the sandbox from the options, nil if none is enabled
+func NewSandbox() (*Sandbox, error) {
+	s := &Sandbox{
+		NoNewPrivs: Options.SandboxNoNewPrivs || Options.SandboxSeccomp != "",
+		DropCaps:   Options.SandboxDropCaps,
+		Seccomp:    Options.SandboxSeccomp,
+		PrivateTmp: Options.SandboxPrivateTmp,
+	}
+	if !s.NoNewPrivs && len(s.DropCaps) == 0 && !s.PrivateTmp {
+		return nil, nil
+	}
+	if s.Seccomp != "" {
+		// the helper reads it from the working directory of the application
+		seccomp, err := filepath.Abs(s.Seccomp)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve --sandbox-seccomp: %w", err)
+		}
+		s.Seccomp = seccomp
+	}
+	if err := s.validate(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Wrap returns the arguments that run the command inside the sandbox
+func (s *Sandbox) Wrap(args []string) ([]string, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, fmt.Errorf("failed to find this executable: %w", err)
+	}
+	spec, err := json.Marshal(s)
+	if err != nil {
+		return nil, err
+	}
+	return append([]string{self, sandboxCommand, string(spec)}, args...), nil
+}
+
+// runSandboxed is the helper's entrypoint: it applies the sandbox in args[0] and execs the rest
+func runSandboxed(args []string) {
+	if len(args) < 2 {
+		log.Printf("usage: %s <sandbox> <command> [args...]\n", sandboxCommand)
+		os.Exit(sandboxFailedCode)
+	}
+	var s Sandbox
+	if err := json.Unmarshal([]byte(args[0]), &s); err != nil {
+		log.Printf("invalid sandbox: %v\n", err)
+		os.Exit(sandboxFailedCode)
+	}
+	path, err := exec.LookPath(args[1])
+	if err != nil {
+		log.Printf("failed to find command: %v\n", err)
+		os.Exit(sandboxFailedCode)
+	}
+
+	// the restrictions are set on this thread, which is the one that execs
+	runtime.LockOSThread()
+	if err := s.apply(); err != nil {
+		log.Printf("failed to set up the sandbox: %v\n", err)
+		os.Exit(sandboxFailedCode)
+	}
+	err = syscall.Exec(path, args[1:], os.Environ())
+	log.Printf("failed to exec %s: %v\n", path, err)
+	os.Exit(sandboxFailedCode)
+}
@@ -0,0 +1,191 @@
+//go:build linux
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var capabilities = map[string]uintptr{
+	"CAP_CHOWN":              unix.CAP_CHOWN,
+	"CAP_DAC_OVERRIDE":       unix.CAP_DAC_OVERRIDE,
+	"CAP_DAC_READ_SEARCH":    unix.CAP_DAC_READ_SEARCH,
+	"CAP_FOWNER":             unix.CAP_FOWNER,
+	"CAP_FSETID":             unix.CAP_FSETID,
+	"CAP_KILL":               unix.CAP_KILL,
+	"CAP_SETGID":             unix.CAP_SETGID,
+	"CAP_SETUID":             unix.CAP_SETUID,
+	"CAP_SETPCAP":            unix.CAP_SETPCAP,
+	"CAP_LINUX_IMMUTABLE":    unix.CAP_LINUX_IMMUTABLE,
+	"CAP_NET_BIND_SERVICE":   unix.CAP_NET_BIND_SERVICE,
+	"CAP_NET_BROADCAST":      unix.CAP_NET_BROADCAST,
+	"CAP_NET_ADMIN":          unix.CAP_NET_ADMIN,
+	"CAP_NET_RAW":            unix.CAP_NET_RAW,
+	"CAP_IPC_LOCK":           unix.CAP_IPC_LOCK,
+	"CAP_IPC_OWNER":          unix.CAP_IPC_OWNER,
+	"CAP_SYS_MODULE":         unix.CAP_SYS_MODULE,
+	"CAP_SYS_RAWIO":          unix.CAP_SYS_RAWIO,
+	"CAP_SYS_CHROOT":         unix.CAP_SYS_CHROOT,
+	"CAP_SYS_PTRACE":         unix.CAP_SYS_PTRACE,
+	"CAP_SYS_PACCT":          unix.CAP_SYS_PACCT,
+	"CAP_SYS_ADMIN":          unix.CAP_SYS_ADMIN,
+	"CAP_SYS_BOOT":           unix.CAP_SYS_BOOT,
+	"CAP_SYS_NICE":           unix.CAP_SYS_NICE,
+	"CAP_SYS_RESOURCE":       unix.CAP_SYS_RESOURCE,
+	"CAP_SYS_TIME":           unix.CAP_SYS_TIME,
+	"CAP_SYS_TTY_CONFIG":     unix.CAP_SYS_TTY_CONFIG,
+	"CAP_MKNOD":              unix.CAP_MKNOD,
+	"CAP_LEASE":              unix.CAP_LEASE,
+	"CAP_AUDIT_WRITE":        unix.CAP_AUDIT_WRITE,
+	"CAP_AUDIT_CONTROL":      unix.CAP_AUDIT_CONTROL,
+	"CAP_SETFCAP":            unix.CAP_SETFCAP,
+	"CAP_MAC_OVERRIDE":       unix.CAP_MAC_OVERRIDE,
+	"CAP_MAC_ADMIN":          unix.CAP_MAC_ADMIN,
+	"CAP_SYSLOG":             unix.CAP_SYSLOG,
+	"CAP_WAKE_ALARM":         unix.CAP_WAKE_ALARM,
+	"CAP_BLOCK_SUSPEND":      unix.CAP_BLOCK_SUSPEND,
+	"CAP_AUDIT_READ":         unix.CAP_AUDIT_READ,
+	"CAP_PERFMON":            unix.CAP_PERFMON,
+	"CAP_BPF":                unix.CAP_BPF,
+	"CAP_CHECKPOINT_RESTORE": unix.CAP_CHECKPOINT_RESTORE,
+}
+
+// parseCaps maps the names, with or without the CAP_ prefix, to the capability numbers. ALL is
+// every capability
+func parseCaps(names []string) ([]uintptr, error) {
+	var caps []uintptr
+	for _, name := range names {
+		name = strings.ToUpper(strings.TrimSpace(name))
+		if name == "ALL" {
+			for c := uintptr(0); c <= unix.CAP_LAST_CAP; c++ {
+				caps = append(caps, c)
+			}
+			continue
+		}
+		if !strings.HasPrefix(name, "CAP_") {
+			name = "CAP_" + name
+		}
+		c, ok := capabilities[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown capability %s", name)
+		}
+		caps = append(caps, c)
+	}
+	return caps, nil
+}
+
+// readSeccompFilter reads a compiled classic BPF program, an array of 8-byte sock_filter instructions
+func readSeccompFilter(path string) ([]unix.SockFilter, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 || len(data)%8 != 0 {
+		return nil, fmt.Errorf("%s isn't a compiled BPF filter: its size isn't a multiple of 8", path)
+	}
+	filter := make([]unix.SockFilter, len(data)/8)
+	for i := range filter {
+		instruction := data[i*8 : i*8+8]
+		filter[i] = unix.SockFilter{
+			Code: binary.NativeEndian.Uint16(instruction[0:2]),
+			Jt:   instruction[2],
+			Jf:   instruction[3],
+			K:    binary.NativeEndian.Uint32(instruction[4:8]),
+		}
+	}
+	return filter, nil
+}
+
+func (s *Sandbox) validate() error {
+	if _, err := parseCaps(s.DropCaps); err != nil {
+		return err
+	}
+	if s.Seccomp != "" {
+		if _, err := readSeccompFilter(s.Seccomp); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apply sets up the sandbox on the calling thread. The order matters: mounting and dropping from the
+// bounding set need capabilities that may be dropped, and the seccomp filter could block the setup
+func (s *Sandbox) apply() error {
+	if s.PrivateTmp {
+		if err := unix.Unshare(unix.CLONE_NEWNS); err != nil {
+			return fmt.Errorf("failed to create a mount namespace: %w", err)
+		}
+		if err := unix.Mount("", "/", "", unix.MS_REC|unix.MS_PRIVATE, ""); err != nil {
+			return fmt.Errorf("failed to make the mounts private: %w", err)
+		}
+		if err := unix.Mount("tmpfs", "/tmp", "tmpfs", unix.MS_NOSUID|unix.MS_NODEV, "mode=1777"); err != nil {
+			return fmt.Errorf("failed to mount a private /tmp: %w", err)
+		}
+	}
+
+	if len(s.DropCaps) > 0 {
+		if err := dropCaps(s.DropCaps); err != nil {
+			return err
+		}
+	}
+
+	if s.NoNewPrivs {
+		if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+			return fmt.Errorf("failed to set no_new_privs: %w", err)
+		}
+	}
+
+	if s.Seccomp != "" {
+		filter, err := readSeccompFilter(s.Seccomp)
+		if err != nil {
+			return err
+		}
+		program := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+		err = unix.Prctl(unix.PR_SET_SECCOMP, unix.SECCOMP_MODE_FILTER, uintptr(unsafe.Pointer(&program)), 0, 0)
+		if err != nil {
+			return fmt.Errorf("failed to load the seccomp filter: %w", err)
+		}
+	}
+	return nil
+}
+
+// dropCaps removes the capabilities from the bounding and ambient sets, so the application can't
+// regain them on exec, and from the effective, permitted and inheritable sets
+func dropCaps(names []string) error {
+	caps, err := parseCaps(names)
+	if err != nil {
+		return err
+	}
+	header := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to read the capabilities: %w", err)
+	}
+
+	for _, c := range caps {
+		err := unix.Prctl(unix.PR_CAPBSET_DROP, c, 0, 0, 0)
+		// EINVAL: the kernel doesn't know the capability, so there's nothing to drop
+		if err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d from the bounding set: %w", c, err)
+		}
+		err = unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_LOWER, c, 0, 0)
+		if err != nil && err != unix.EINVAL {
+			return fmt.Errorf("failed to drop capability %d from the ambient set: %w", c, err)
+		}
+		mask := ^uint32(1 << (c % 32))
+		data[c/32].Effective &= mask
+		data[c/32].Permitted &= mask
+		data[c/32].Inheritable &= mask
+	}
+
+	if err := unix.Capset(&header, &data[0]); err != nil {
+		return fmt.Errorf("failed to set the capabilities: %w", err)
+	}
+	return nil
+}
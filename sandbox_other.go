@@ -0,0 +1,16 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func (s *Sandbox) validate() error {
+	return fmt.Errorf("sandboxing the application is not supported on %s", runtime.GOOS)
+}
+
+func (s *Sandbox) apply() error {
+	return s.validate()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// InstallServiceCommand registers this binary as a host service running with the given arguments
+type InstallServiceCommand struct {
+	Name        string `long:"name" default:"git-config-server" description:"Service name"`
+	Description string `long:"description" default:"Git config server" description:"Service description"`
+	NoStart     bool   `long:"no-start" description:"Only register the service, without enabling or starting it"`
+	UnitDir     string `long:"unit-dir" default:"/etc/systemd/system" description:"Directory to write the systemd unit to (Linux only)"`
+}
+
+// UninstallServiceCommand stops and removes a service previously registered with install-service
+type UninstallServiceCommand struct {
+	Name    string `long:"name" default:"git-config-server" description:"Service name"`
+	UnitDir string `long:"unit-dir" default:"/etc/systemd/system" description:"Directory the systemd unit was written to (Linux only)"`
+}
+
+// ServiceSpec describes what the installed service should run
+type ServiceSpec struct {
+	Name        string
+	Description string
+	Executable  string
+	Args        []string
+	WorkingDir  string
+	EnvFile     string
+}
+
+func addServiceCommands(parser *flags.Parser) {
+	_, err := parser.AddCommand(
+		"install-service",
+		"Install as a host service",
+		"Registers the tool as a Windows service or installs a systemd unit, running it with the arguments after --",
+		&InstallServiceCommand{},
+	)
+	CheckErr(err)
+
+	_, err = parser.AddCommand(
+		"uninstall-service",
+		"Uninstall the host service",
+		"Stops and removes a service previously registered with install-service",
+		&UninstallServiceCommand{},
+	)
+	CheckErr(err)
+}
+
+func (c *InstallServiceCommand) Execute(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("no arguments for the service, pass them after --")
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find the path to this executable: %w", err)
+	}
+	workingDir, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get cwd: %w", err)
+	}
+
+	envFile := os.Getenv("ENV_FILE")
+	if envFile == "" {
+		envFile = ".env"
+	}
+	envFile, err = filepath.Abs(envFile)
+	if err != nil {
+		return fmt.Errorf("failed to resolve env file path: %w", err)
+	}
+
+	return installService(ServiceSpec{
+		Name:        c.Name,
+		Description: c.Description,
+		Executable:  executable,
+		Args:        args,
+		WorkingDir:  workingDir,
+		EnvFile:     envFile,
+	}, c)
+}
+
+func (c *UninstallServiceCommand) Execute(args []string) error {
+	return uninstallService(c)
+}
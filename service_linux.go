@@ -0,0 +1,95 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// installService writes a systemd unit for the service and enables it
+func installService(spec ServiceSpec, c *InstallServiceCommand) error {
+	unitPath := filepath.Join(c.UnitDir, spec.Name+".service")
+
+	log.Printf("writing systemd unit to %s\n", unitPath)
+	if err := os.WriteFile(unitPath, []byte(systemdUnit(spec)), 0o644); err != nil {
+		return fmt.Errorf("failed to write systemd unit %s: %w", unitPath, err)
+	}
+
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	if c.NoStart {
+		return nil
+	}
+	return systemctl("enable", "--now", spec.Name+".service")
+}
+
+// uninstallService disables the systemd unit and removes it
+func uninstallService(c *UninstallServiceCommand) error {
+	unitPath := filepath.Join(c.UnitDir, c.Name+".service")
+
+	if err := systemctl("disable", "--now", c.Name+".service"); err != nil {
+		log.Printf("failed to disable service %s: %v\n", c.Name, err)
+	}
+
+	log.Printf("removing systemd unit %s\n", unitPath)
+	if err := os.Remove(unitPath); err != nil {
+		return fmt.Errorf("failed to remove systemd unit %s: %w", unitPath, err)
+	}
+
+	return systemctl("daemon-reload")
+}
+
+// systemdUnit renders the unit file contents. The service notifies readiness via sd_notify
+func systemdUnit(spec ServiceSpec) string {
+	execStart := make([]string, 0, len(spec.Args)+1)
+	for _, arg := range append([]string{spec.Executable}, spec.Args...) {
+		execStart = append(execStart, systemdQuote(arg))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "[Unit]\n")
+	fmt.Fprintf(&b, "Description=%s\n", spec.Description)
+	fmt.Fprintf(&b, "Wants=network-online.target\n")
+	fmt.Fprintf(&b, "After=network-online.target\n")
+	fmt.Fprintf(&b, "\n[Service]\n")
+	fmt.Fprintf(&b, "Type=notify\n")
+	fmt.Fprintf(&b, "NotifyAccess=main\n")
+	fmt.Fprintf(&b, "ExecStart=%s\n", strings.Join(execStart, " "))
+	fmt.Fprintf(&b, "WorkingDirectory=%s\n", strings.ReplaceAll(spec.WorkingDir, "%", "%%"))
+	fmt.Fprintf(&b, "Environment=%s\n", systemdQuote("ENV_FILE="+spec.EnvFile))
+	fmt.Fprintf(&b, "Restart=on-failure\n")
+	fmt.Fprintf(&b, "\n[Install]\n")
+	fmt.Fprintf(&b, "WantedBy=multi-user.target\n")
+	return b.String()
+}
+
+// systemdQuote quotes a value for unit files, escaping specifiers and variable expansions too
+func systemdQuote(s string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "%", "%%", "$", "$$")
+	return `"` + replacer.Replace(s) + `"`
+}
+
+func systemctl(args ...string) error {
+	log.Printf("running systemctl %s\n", strings.Join(args, " "))
+	cmd := exec.Command("systemctl", args...)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to run systemctl %s: %w", strings.Join(args, " "), err)
+	}
+	return nil
+}
+
+// startService is a no-op on Linux: systemd just runs the process
+func startService(cancel func()) func() {
+	return func() {}
+}
+
+// enterServiceDir is a no-op on Linux, where the unit sets the working directory
+func enterServiceDir() {}
@@ -0,0 +1,22 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func installService(spec ServiceSpec, c *InstallServiceCommand) error {
+	return fmt.Errorf("installing a service is not supported on %s", runtime.GOOS)
+}
+
+func uninstallService(c *UninstallServiceCommand) error {
+	return fmt.Errorf("uninstalling a service is not supported on %s", runtime.GOOS)
+}
+
+func startService(cancel func()) func() {
+	return func() {}
+}
+
+func enterServiceDir() {}
@@ -0,0 +1,161 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/sys/windows/registry"
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// serviceDirEnv is the folder install-service ran from, which the service runs in
+const serviceDirEnv = "SERVICE_WORKING_DIR"
+
+// installService registers the service with the Service Control Manager
+func installService(spec ServiceSpec, c *InstallServiceCommand) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	log.Printf("registering Windows service %s\n", spec.Name)
+	s, err := m.CreateService(spec.Name, spec.Executable, mgr.Config{
+		DisplayName: spec.Name,
+		Description: spec.Description,
+		StartType:   mgr.StartAutomatic,
+	}, spec.Args...)
+	if err != nil {
+		return fmt.Errorf("failed to create service %s: %w", spec.Name, err)
+	}
+	defer s.Close()
+
+	// services start in the system folder, so point them to the env file and their folder explicitly
+	key, err := registry.OpenKey(registry.LOCAL_MACHINE, `SYSTEM\CurrentControlSet\Services\`+spec.Name, registry.SET_VALUE)
+	if err != nil {
+		return fmt.Errorf("failed to open the registry key of service %s: %w", spec.Name, err)
+	}
+	defer key.Close()
+	if err := key.SetStringsValue("Environment", []string{"ENV_FILE=" + spec.EnvFile, serviceDirEnv + "=" + spec.WorkingDir}); err != nil {
+		return fmt.Errorf("failed to set the environment of service %s: %w", spec.Name, err)
+	}
+
+	if c.NoStart {
+		return nil
+	}
+	log.Printf("starting Windows service %s\n", spec.Name)
+	if err := s.Start(); err != nil {
+		return fmt.Errorf("failed to start service %s: %w", spec.Name, err)
+	}
+	return nil
+}
+
+// uninstallService stops the service and removes it from the Service Control Manager
+func uninstallService(c *UninstallServiceCommand) error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("failed to connect to the service manager: %w", err)
+	}
+	defer m.Disconnect()
+
+	s, err := m.OpenService(c.Name)
+	if err != nil {
+		return fmt.Errorf("failed to open service %s: %w", c.Name, err)
+	}
+	defer s.Close()
+
+	if _, err := s.Control(svc.Stop); err != nil {
+		log.Printf("failed to stop service %s: %v\n", c.Name, err)
+	}
+
+	log.Printf("removing Windows service %s\n", c.Name)
+	if err := s.Delete(); err != nil {
+		return fmt.Errorf("failed to delete service %s: %w", c.Name, err)
+	}
+	return nil
+}
+
+// enterServiceDir moves to the folder install-service ran from when running as a service, instead of
+// the system folder, so the relative paths of the arguments resolve like they did there. Services
+// installed without it run in the folder of the executable
+func enterServiceDir() {
+	isService, err := svc.IsWindowsService()
+	if err != nil || !isService {
+		return
+	}
+	dir := os.Getenv(serviceDirEnv)
+	if dir == "" {
+		executable, err := os.Executable()
+		if err != nil {
+			log.Fatalf("failed to find the path to this executable: %v\n", err)
+		}
+		dir = filepath.Dir(executable)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatalf("failed to enter the service folder %s: %v\n", dir, err)
+	}
+}
+
+// serviceHandler reports the service status to the SCM and cancels the main context when asked to stop
+type serviceHandler struct {
+	cancel   func()
+	finished chan struct{}
+}
+
+func (h *serviceHandler) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for {
+		select {
+		case <-h.finished:
+			return false, 0
+		case req := <-requests:
+			switch req.Cmd {
+			case svc.Interrogate:
+				status <- req.CurrentStatus
+			case svc.Stop, svc.Shutdown:
+				status <- svc.Status{State: svc.StopPending}
+				h.cancel()
+				<-h.finished
+				return false, 0
+			}
+		}
+	}
+}
+
+// startService connects to the SCM when running as a Windows service. The returned function
+// must be called once the application is done
+func startService(cancel func()) func() {
+	isService, err := svc.IsWindowsService()
+	if err != nil {
+		log.Printf("failed to detect whether running as a Windows service: %v\n", err)
+		return func() {}
+	}
+	if !isService {
+		return func() {}
+	}
+
+	handler := &serviceHandler{cancel: cancel, finished: make(chan struct{})}
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		if err := svc.Run("", handler); err != nil {
+			log.Printf("Windows service failed: %v\n", err)
+		}
+	}()
+
+	return func() {
+		close(handler.finished)
+		select {
+		case <-runDone:
+		case <-time.After(5 * time.Second):
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+var (
+	// syncSignal enqueues a sync, same as a webhook call
+	syncSignal os.Signal = syscall.SIGUSR1
+	// restartSignal restarts the application without syncing
+	restartSignal os.Signal = syscall.SIGUSR2
+)
+
+// notifySignals are the signals --ack-notify can send, by name
+var notifySignals = map[string]os.Signal{
+	"HUP":   syscall.SIGHUP,
+	"INT":   syscall.SIGINT,
+	"QUIT":  syscall.SIGQUIT,
+	"TERM":  syscall.SIGTERM,
+	"USR1":  syscall.SIGUSR1,
+	"USR2":  syscall.SIGUSR2,
+	"WINCH": syscall.SIGWINCH,
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// Windows has no user-defined signals, so there's no signal-driven sync or restart
+var (
+	syncSignal    os.Signal
+	restartSignal os.Signal
+)
+
+// notifySignals is empty, since Windows can't signal the application
+var notifySignals = map[string]os.Signal{}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+)
+
+// signatureHeader holds the detached JWS of the response body
+const signatureHeader = "X-Config-Signature"
+
+// Signer signs the served config. It's nil unless --signing-key is set
+var Signer *ResponseSigner
+
+// ResponseSigner produces detached JWS signatures (RFC 7515, appendix F) over response bodies:
+// the payload part is left empty and the verifier puts the body back in
+type ResponseSigner struct {
+	key       crypto.Signer
+	alg       string
+	hash      crypto.Hash
+	kid       string
+	publicPEM []byte
+}
+
+// LoadSigner reads a PEM private key: Ed25519, ECDSA P-256 or P-384, or RSA
+func LoadSigner(path string) (*ResponseSigner, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block in %s", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key %s: %w", path, err)
+	}
+	return NewResponseSigner(key)
+}
+
+func NewResponseSigner(key any) (*ResponseSigner, error) {
+	s := &ResponseSigner{}
+	switch k := key.(type) {
+	case ed25519.PrivateKey:
+		s.key, s.alg = k, "EdDSA"
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P256():
+			s.key, s.alg, s.hash = k, "ES256", crypto.SHA256
+		case elliptic.P384():
+			s.key, s.alg, s.hash = k, "ES384", crypto.SHA384
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", k.Curve.Params().Name)
+		}
+	case *rsa.PrivateKey:
+		s.key, s.alg, s.hash = k, "RS256", crypto.SHA256
+	default:
+		return nil, fmt.Errorf("unsupported signing key type %T", key)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(s.key.Public())
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(der)
+	s.kid = base64.RawURLEncoding.EncodeToString(fingerprint[:12])
+	s.publicPEM = pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})
+	return s, nil
+}
+
+// Sign returns the detached JWS of the payload, as <header>..<signature>
+func (s *ResponseSigner) Sign(payload []byte) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": s.alg, "kid": s.kid})
+	if err != nil {
+		return "", err
+	}
+	encodedHeader := base64.RawURLEncoding.EncodeToString(header)
+	signingInput := encodedHeader + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := s.key.(type) {
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signingInput))
+	case *ecdsa.PrivateKey:
+		digest := hashOf(s.hash, []byte(signingInput))
+		r, sig, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return "", err
+		}
+		// JWS wants the raw r||s, each padded to the curve size
+		size := (key.Curve.Params().BitSize + 7) / 8
+		signature = append(padded(r, size), padded(sig, size)...)
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, key, s.hash, hashOf(s.hash, []byte(signingInput)))
+		if err != nil {
+			return "", err
+		}
+	}
+	return encodedHeader + ".." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+func hashOf(hash crypto.Hash, data []byte) []byte {
+	if hash == crypto.SHA384 {
+		sum := sha512.Sum384(data)
+		return sum[:]
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+func padded(n *big.Int, size int) []byte {
+	return n.FillBytes(make([]byte, size))
+}
+
+// signResponse sets the signature header for the body about to be written, if signing is enabled.
+// The signature covers the body before any Content-Encoding
+func signResponse(w http.ResponseWriter, body []byte) error {
+	if Signer == nil {
+		return nil
+	}
+	signature, err := Signer.Sign(body)
+	if err != nil {
+		return fmt.Errorf("failed to sign response: %w", err)
+	}
+	w.Header().Set(signatureHeader, signature)
+	return nil
+}
+
+// registerSigningKey publishes the public key on /signing-key, so clients can verify the responses
+func registerSigningKey(mux *http.ServeMux) {
+	mux.HandleFunc("/signing-key", func(w http.ResponseWriter, r *http.Request) {
+		if Signer == nil {
+			http.Error(w, "Response signing is disabled", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("X-Config-Signature-Kid", Signer.kid)
+		w.Write(Signer.publicPEM)
+	})
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a size flag, in bytes or with a unit like 512K, 10MB or 1GiB (all powers of 1024)
+type ByteSize int64
+
+func (s *ByteSize) UnmarshalFlag(value string) error {
+	value = strings.TrimSpace(value)
+	number := strings.TrimRightFunc(value, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	unit := strings.ToUpper(strings.TrimSpace(value[len(number):]))
+	unit = strings.TrimSuffix(strings.TrimSuffix(unit, "B"), "I")
+	multiplier := map[string]float64{"": 1, "K": 1 << 10, "M": 1 << 20, "G": 1 << 30, "T": 1 << 40}[unit]
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || multiplier == 0 || n < 0 {
+		return fmt.Errorf("invalid size %q, expected bytes or a number with a unit like 512K, 10MB or 1GiB", value)
+	}
+	*s = ByteSize(n * multiplier)
+	return nil
+}
+
+func (s ByteSize) String() string {
+	return formatBytes(int64(s))
+}
+
+// sizeLimitError is returned when the synced tree exceeds --max-file-size or --max-total-size. It won't
+// go away by retrying, so the on-failure command runs right away
+type sizeLimitError struct {
+	reason string
+}
+
+func (e *sizeLimitError) Error() string {
+	return e.reason
+}
+
+// checkTreeSize refuses a tree whose synced files are bigger than maxFile, or add up to more than
+// maxTotal. Limits of 0 are disabled
+func checkTreeSize(files fs.FS, config *RepoConfig, maxFile, maxTotal ByteSize) error {
+	if maxFile <= 0 && maxTotal <= 0 {
+		return nil
+	}
+	var total int64
+	err := fs.WalkDir(files, ".", func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == "." {
+			return nil
+		}
+		if isGitMetadata(path) || !config.Synced(path, entry.IsDir()) {
+			if entry.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if maxFile > 0 && info.Size() > int64(maxFile) {
+			return &sizeLimitError{fmt.Sprintf("%s is %s, over the --max-file-size of %s", path, formatBytes(info.Size()), maxFile)}
+		}
+		total += info.Size()
+		if maxTotal > 0 && total > int64(maxTotal) {
+			return &sizeLimitError{fmt.Sprintf("the synced files add up to more than the --max-total-size of %s", maxTotal)}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("refusing to sync: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// SnapshotDirs keeps every applied tree in its own directory, named after its commit, the local folder
+// being a symlink to the active one. An apply writes a new directory and flips the symlink at once, so
+// the application never sees a half-written tree, like the atomic writer of the kubelet
+type SnapshotDirs struct {
+	dir  string
+	link string
+	// keep is how many snapshots are kept, the active one included
+	keep int
+}
+
+// NewSnapshotDirs keeps the snapshots in dir, the local folder becoming a symlink. It must be missing,
+// empty or already a symlink
+func NewSnapshotDirs(dir, localFolder string, keep int) (*SnapshotDirs, error) {
+	if keep < 2 {
+		return nil, fmt.Errorf("--snapshot-count must be at least 2, the active snapshot and the previous one")
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	// the symlink is read and replaced from wherever the working directory is
+	if localFolder, err = filepath.Abs(localFolder); err != nil {
+		return nil, err
+	}
+	if isInside(dir, localFolder) {
+		return nil, fmt.Errorf("--snapshot-dir must be outside the local folder")
+	}
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		return nil, fmt.Errorf("failed to create --snapshot-dir %s: %w", dir, err)
+	}
+	info, err := os.Lstat(localFolder)
+	switch {
+	case os.IsNotExist(err), err == nil && info.Mode()&os.ModeSymlink != 0:
+	case err != nil:
+		return nil, err
+	case info.IsDir():
+		if err := os.Remove(localFolder); err != nil {
+			return nil, fmt.Errorf("the local folder %s must be a symlink to the active snapshot of --snapshot-dir: move its files away", localFolder)
+		}
+	default:
+		return nil, fmt.Errorf("the local folder %s isn't a directory", localFolder)
+	}
+	return &SnapshotDirs{dir: dir, link: localFolder, keep: keep}, nil
+}
+
+// Active is the directory of the active snapshot, empty before the first apply
+func (s *SnapshotDirs) Active() string {
+	target, err := os.Readlink(s.link)
+	if err != nil {
+		return ""
+	}
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(s.link), target)
+	}
+	return target
+}
+
+// Existing is the directory of the snapshot of the commit if it's still there and isn't the active one,
+// so a rollback can flip back to it instead of writing it again
+func (s *SnapshotDirs) Existing(commit string) (string, bool) {
+	snapshot := filepath.Join(s.dir, commit)
+	if snapshot == s.Active() {
+		return "", false
+	}
+	info, err := os.Lstat(snapshot)
+	return snapshot, err == nil && info.IsDir()
+}
+
+// CarryOver copies the paths kept by the last sync from the active snapshot to another one, before
+// flipping back to it, so the files written by others aren't lost. Directories end with /
+func (s *SnapshotDirs) CarryOver(snapshot string, preserved []string) error {
+	active := s.Active()
+	if active == "" {
+		return nil
+	}
+	for _, slashPath := range preserved {
+		src := filepath.Join(active, filepath.FromSlash(slashPath))
+		dst := filepath.Join(snapshot, filepath.FromSlash(slashPath))
+		info, err := os.Lstat(src)
+		switch {
+		case os.IsNotExist(err):
+			continue
+		case err != nil:
+			return err
+		case info.IsDir():
+			_, err = SyncDirs(src, dst, nil)
+		case info.Mode().IsRegular():
+			if err = os.MkdirAll(filepath.Dir(dst), DirMode); err == nil {
+				if err = copyFile(src, dst, false); err == nil {
+					err = os.Chmod(dst, info.Mode().Perm())
+				}
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("failed to carry %s over to the snapshot %s: %w", slashPath, snapshot, err)
+		}
+	}
+	return nil
+}
+
+// Prepare makes the directory of the next snapshot of the commit, a copy of the active one so the sync
+// finds the changes as if it was written in place
+func (s *SnapshotDirs) Prepare(commit string) (string, error) {
+	active := s.Active()
+	// the commit applied again, e.g. when a --source changed
+	name := commit
+	for i := 2; filepath.Join(s.dir, name) == active; i++ {
+		name = fmt.Sprintf("%s-%d", commit, i)
+	}
+	next := filepath.Join(s.dir, name)
+	if err := os.RemoveAll(next); err != nil {
+		return "", fmt.Errorf("failed to remove the old snapshot %s: %w", next, err)
+	}
+	if err := os.MkdirAll(next, DirMode); err != nil {
+		return "", fmt.Errorf("failed to create the snapshot %s: %w", next, err)
+	}
+	if active == "" {
+		return next, nil
+	}
+	if _, err := SyncDirs(active, next, nil); err != nil {
+		s.Discard(next)
+		return "", fmt.Errorf("failed to copy the active snapshot %s: %w", active, err)
+	}
+	return next, nil
+}
+
+// Discard removes a snapshot that won't be applied
+func (s *SnapshotDirs) Discard(next string) {
+	if err := os.RemoveAll(next); err != nil {
+		log.Printf("failed to remove the snapshot %s: %v\n", next, err)
+	}
+}
+
+// Flip points the local folder at the snapshot at once, replacing the symlink, then removes the oldest
+// snapshots
+func (s *SnapshotDirs) Flip(next string) error {
+	now := time.Now()
+	if err := os.Chtimes(next, now, now); err != nil {
+		return err
+	}
+	tmp := s.link + ".next"
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := os.Symlink(next, tmp); err != nil {
+		return fmt.Errorf("failed to link the snapshot %s: %w", next, err)
+	}
+	if err := os.Rename(tmp, s.link); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to point %s at the snapshot %s: %w", s.link, next, err)
+	}
+	log.Printf("%s now points to %s\n", s.link, next)
+	s.prune()
+	return nil
+}
+
+// prune removes the snapshots beyond the newest ones to keep, never the active one
+func (s *SnapshotDirs) prune() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("failed to list the snapshots in %s: %v\n", s.dir, err)
+		return
+	}
+	type snapshot struct {
+		path    string
+		modTime time.Time
+	}
+	var snapshots []snapshot
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.IsDir() {
+			continue
+		}
+		snapshots = append(snapshots, snapshot{filepath.Join(s.dir, entry.Name()), info.ModTime()})
+	}
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].modTime.After(snapshots[j].modTime)
+	})
+	active := s.Active()
+	kept := 0
+	for _, snapshot := range snapshots {
+		if snapshot.path == active || kept < s.keep {
+			kept++
+			continue
+		}
+		if err := os.RemoveAll(snapshot.path); err != nil {
+			log.Printf("failed to remove the snapshot %s: %v\n", snapshot.path, err)
+			continue
+		}
+		debugf("removed the snapshot %s\n", snapshot.path)
+	}
+}
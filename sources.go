@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Source is another repository whose files are composed into a subdirectory of the synced ones, like
+// the org-wide config shared by several services
+type Source struct {
+	// Dir is where its files go, relative to the repo folder, with forward slashes
+	Dir  string
+	Repo *GitRepo
+	// commit is the last one seen on the remote, and applied the one composed by the last sync
+	commit  string
+	applied string
+}
+
+// ParseSource parses a --source as dir=url, optionally followed by //folder for a folder of the repo and
+// #branch for another branch than master, like shared=https://github.com/org/config.git//prod#main
+func ParseSource(source, username, password string) (*Source, error) {
+	dir, url, ok := strings.Cut(source, "=")
+	if !ok || dir == "" || url == "" {
+		return nil, fmt.Errorf("invalid --source %q, expected dir=url[//folder][#branch]", source)
+	}
+	dir = path.Clean(filepath.ToSlash(dir))
+	if !filepath.IsLocal(filepath.FromSlash(dir)) || isGitMetadata(dir) {
+		return nil, fmt.Errorf("invalid --source %q: %s must be a subdirectory", source, dir)
+	}
+	url, branch, ok := strings.Cut(url, "#")
+	if !ok {
+		branch = "master"
+	}
+	// the // of the scheme isn't the one of the folder
+	scheme, rest, hasScheme := strings.Cut(url, "://")
+	if !hasScheme {
+		scheme, rest = "", url
+	}
+	folder := "."
+	if i := strings.Index(rest, "//"); i >= 0 {
+		rest, folder = rest[:i], rest[i+2:]
+	}
+	if hasScheme {
+		url = scheme + "://" + rest
+	} else {
+		url = rest
+	}
+	return &Source{Dir: dir, Repo: NewGitRepo(url, branch, folder, username, password)}, nil
+}
+
+// checkSourceDirs refuses sources composed into the same directory, or into one another
+func checkSourceDirs(sources []*Source) error {
+	for i, a := range sources {
+		for _, b := range sources[i+1:] {
+			if a.Dir == b.Dir || strings.HasPrefix(b.Dir, a.Dir+"/") || strings.HasPrefix(a.Dir, b.Dir+"/") {
+				return fmt.Errorf("--source %s and --source %s overlap", a.Dir, b.Dir)
+			}
+		}
+	}
+	return nil
+}
+
+// checkSources finds the last commit of every source, returning true if one isn't the applied one
+func (gitRepo *GitRepo) checkSources(ctx context.Context) (bool, error) {
+	changed := false
+	for _, source := range gitRepo.Sources {
+		commit, err := source.Repo.GetLastCommit(ctx)
+		if err != nil {
+			return false, fmt.Errorf("failed to check --source %s: %w", source.Dir, err)
+		}
+		source.commit = commit
+		if commit != source.applied {
+			log.Printf("--source %s moved to %s\n", source.Dir, shortCommit(commit))
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// pinSources composes the applied commits of the sources on rollbacks, which only roll back the repo
+func (gitRepo *GitRepo) pinSources(ctx context.Context) error {
+	for _, source := range gitRepo.Sources {
+		if source.applied != "" {
+			source.commit = source.applied
+			continue
+		}
+		commit, err := source.Repo.GetLastCommit(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to check --source %s: %w", source.Dir, err)
+		}
+		source.commit = commit
+	}
+	return nil
+}
+
+// composeSources checks out every source at its last seen commit into tmpDir and moves its files to
+// their directory of the repo folder, which mustn't have anything there
+func (gitRepo *GitRepo) composeSources(ctx context.Context, repoSourceFolder, tmpDir string, progress io.Writer) error {
+	for i, source := range gitRepo.Sources {
+		target := filepath.Join(repoSourceFolder, filepath.FromSlash(source.Dir))
+		if _, err := os.Lstat(target); err == nil {
+			return fmt.Errorf("the repo already has %s, where --source %s goes", source.Dir, source.Dir)
+		}
+		log.Printf("Composing commit %s of %s into %s\n", shortCommit(source.commit), source.Repo.URL, source.Dir)
+		dir := filepath.Join(tmpDir, fmt.Sprintf("source%d", i))
+		cloneDir := func(name string) string {
+			return filepath.Join(dir, name)
+		}
+		_, _, worktree, err := source.Repo.checkout(ctx, cloneDir, source.commit, progress)
+		if err != nil {
+			return fmt.Errorf("failed to check out --source %s: %w", source.Dir, err)
+		}
+		root := worktree.Filesystem.Root()
+		if err := os.RemoveAll(filepath.Join(root, ".git")); err != nil {
+			return err
+		}
+		folder := filepath.Join(root, filepath.FromSlash(source.Repo.RepoFolder))
+		if info, err := os.Stat(folder); err != nil || !info.IsDir() {
+			return fmt.Errorf("--source %s has no folder %s", source.Dir, source.Repo.RepoFolder)
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0o775); err != nil {
+			return err
+		}
+		if err := os.Rename(folder, target); err != nil {
+			return fmt.Errorf("failed to compose --source %s: %w", source.Dir, err)
+		}
+	}
+	return nil
+}
+
+// sourcesApplied records the composed commits of the sources as applied
+func (gitRepo *GitRepo) sourcesApplied() {
+	for _, source := range gitRepo.Sources {
+		source.applied = source.commit
+	}
+}
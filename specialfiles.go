@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// specialFileKind names what a file that's neither a regular file, a directory nor a symlink is, like a
+// socket an application listens on in the local folder. It's empty for the others. SyncDirs leaves
+// them alone: they can't be copied, and reading a named pipe would block
+func specialFileKind(info os.FileInfo) string {
+	mode := info.Mode()
+	switch {
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeNamedPipe != 0:
+		return "named pipe"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "device"
+	case mode&os.ModeIrregular != 0:
+		return "irregular file"
+	}
+	return ""
+}
+
+// filesystems tells the mount points of another filesystem apart from the paths of the one of a root
+// directory, so SyncDirs never removes anything across them
+type filesystems struct {
+	root  uint64
+	known bool
+}
+
+// newFilesystems finds the filesystem of root, unknown if it's missing or on Windows
+func newFilesystems(root string) filesystems {
+	info, err := os.Stat(root)
+	if err != nil {
+		return filesystems{}
+	}
+	dev, ok := deviceID(info)
+	return filesystems{root: dev, known: ok}
+}
+
+// isMountPoint is true if the path is on another filesystem than the root
+func (f filesystems) isMountPoint(info os.FileInfo) bool {
+	if !f.known {
+		return false
+	}
+	dev, ok := deviceID(info)
+	return ok && dev != f.root
+}
+
+// errFound stops a walk once it found what it was looking for
+var errFound = errors.New("found")
+
+// unremovable finds a special file or a mount point inside the directory, which removing it would
+// delete too, returning its path, or an empty string if there's none
+func (f filesystems) unremovable(dir string) string {
+	var found string
+	filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if specialFileKind(info) != "" || f.isMountPoint(info) {
+			found = path
+			return errFound
+		}
+		return nil
+	})
+	return found
+}
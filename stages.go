@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Stages of the commands run outside of --hooks-dir, along with the hook stages
+const (
+	StageRestart   = "restart"
+	StageOnFailure = "on-failure"
+	StageOnStale   = "on-stale"
+)
+
+// stageNames are the stages --hook-runner and --hook-workdir configure
+var stageNames = []string{HookPreApply, HookValidate, HookPreUpdate, HookPostUpdate, HookDeployFailed, StageRestart, StageOnFailure, StageOnStale}
+
+// Stages are the runner and the working directory of each stage. The defaults run everything in the
+// local folder
+var Stages = &StageSettings{}
+
+// StageSettings give each stage its own runner and working directory, falling back to the defaults
+type StageSettings struct {
+	// Runner is the shell running the commands of the stages without their own
+	Runner string
+	// Dir is the working directory of the stages without their own
+	Dir     string
+	runners map[string]string
+	dirs    map[string]string
+}
+
+// NewStageSettings parses the stage=runner and stage=dir settings. Relative directories are in the local
+// folder
+func NewStageSettings(runner, localFolder string, runners, dirs []string) (*StageSettings, error) {
+	s := &StageSettings{Runner: runner, Dir: localFolder}
+	var err error
+	if s.runners, err = parseStageSettings("--hook-runner", runners); err != nil {
+		return nil, err
+	}
+	if s.dirs, err = parseStageSettings("--hook-workdir", dirs); err != nil {
+		return nil, err
+	}
+	for stage, dir := range s.dirs {
+		if !filepath.IsAbs(dir) {
+			s.dirs[stage] = filepath.Join(localFolder, dir)
+		}
+	}
+	return s, nil
+}
+
+// parseStageSettings maps the stages to the values of the option, given as stage=value
+func parseStageSettings(option string, settings []string) (map[string]string, error) {
+	values := make(map[string]string, len(settings))
+	for _, setting := range settings {
+		stage, value, ok := strings.Cut(setting, "=")
+		stage, value = strings.TrimSpace(stage), strings.TrimSpace(value)
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid %s %q: expected stage=value", option, setting)
+		}
+		if !isStage(stage) {
+			return nil, fmt.Errorf("invalid %s %q: the stage must be one of %s", option, setting, strings.Join(stageNames, ", "))
+		}
+		values[stage] = value
+	}
+	return values, nil
+}
+
+func isStage(name string) bool {
+	for _, stage := range stageNames {
+		if stage == name {
+			return true
+		}
+	}
+	return false
+}
+
+// CommandRunner is the shell running the commands of the stage
+func (s *StageSettings) CommandRunner(stage string) string {
+	if runner := s.runners[stage]; runner != "" {
+		return runner
+	}
+	return s.Runner
+}
+
+// ScriptRunner is the program running the executables of the stage in --hooks-dir, empty to run them
+// directly
+func (s *StageSettings) ScriptRunner(stage string) string {
+	return s.runners[stage]
+}
+
+// WorkingDir is the directory the commands and hooks of the stage run in
+func (s *StageSettings) WorkingDir(stage string) string {
+	return s.workingDir(stage, s.Dir)
+}
+
+// workingDir is the directory of the stage, or fallback if it hasn't one of its own
+func (s *StageSettings) workingDir(stage, fallback string) string {
+	if dir := s.dirs[stage]; dir != "" {
+		return dir
+	}
+	return fallback
+}
+
+// scriptArgs returns the arguments to make the runner execute a script file
+func scriptArgs(runner, script string) []string {
+	name := strings.ToLower(strings.TrimSuffix(filepath.Base(runner), filepath.Ext(runner)))
+	switch name {
+	case "cmd":
+		return []string{"/C", script}
+	case "powershell", "pwsh":
+		return []string{"-NoProfile", "-File", script}
+	default:
+		return []string{script}
+	}
+}
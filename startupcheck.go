@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+)
+
+// startupCheckTimeout bounds the check of the remote on startup
+const startupCheckTimeout = 15 * time.Second
+
+// startupCheck is a check of the options, run on startup and by doctor
+type startupCheck struct {
+	name string
+	run  func(ctx context.Context) error
+}
+
+// startupChecks checks the URL, the remote, the sources, the local folder, the hooks directory, the runners and the command
+func startupChecks(gitRepo *GitRepo, args []string) []startupCheck {
+	checks := []startupCheck{
+		{"url", func(ctx context.Context) error {
+			if _, err := transport.NewEndpoint(gitRepo.URL); err != nil {
+				return fmt.Errorf("invalid --url %s: %v", redactURL(gitRepo.URL), err)
+			}
+			return nil
+		}},
+		{"remote", func(ctx context.Context) error {
+			if _, err := transport.NewEndpoint(gitRepo.URL); err != nil {
+				// already reported by the url check
+				return nil
+			}
+			return checkRemote(ctx, gitRepo)
+		}},
+	}
+	for _, source := range gitRepo.Sources {
+		source := source
+		checks = append(checks, startupCheck{"source " + source.Dir, func(ctx context.Context) error {
+			if err := checkRemote(ctx, source.Repo); err != nil {
+				return fmt.Errorf("--source %s: %w", source.Dir, err)
+			}
+			return nil
+		}})
+	}
+	switch {
+	case Options.SnapshotDir != "":
+		// the local folder is a symlink, made on the first apply
+		checks = append(checks, startupCheck{"snapshot dir", func(ctx context.Context) error {
+			if err := checkWritable(Options.SnapshotDir); err != nil {
+				return fmt.Errorf("--snapshot-dir %s isn't writable: %v", Options.SnapshotDir, err)
+			}
+			return nil
+		}})
+	case !Options.InMemory:
+		checks = append(checks, startupCheck{"local folder", func(ctx context.Context) error {
+			if err := checkWritable(Options.LocalFolder); err != nil {
+				return fmt.Errorf("the local folder %s isn't writable: %v", Options.LocalFolder, err)
+			}
+			return nil
+		}})
+	}
+	if Options.HooksDir != "" {
+		checks = append(checks, startupCheck{"hooks dir", func(ctx context.Context) error {
+			if info, err := os.Stat(Options.HooksDir); err != nil || !info.IsDir() {
+				return fmt.Errorf("--hooks-dir %s isn't a directory", Options.HooksDir)
+			}
+			return nil
+		}})
+	}
+
+	runners := []string{Stages.Runner}
+	for _, runner := range Stages.runners {
+		runners = append(runners, runner)
+	}
+	sort.Strings(runners)
+	for i, runner := range runners {
+		if i > 0 && runners[i-1] == runner {
+			continue
+		}
+		runner := runner
+		checks = append(checks, startupCheck{"runner " + runner, func(ctx context.Context) error {
+			if _, err := exec.LookPath(runner); err != nil {
+				return fmt.Errorf("the runner %s isn't installed or in the PATH: install it, or pick another with --pre-update-runner or --hook-runner", runner)
+			}
+			return nil
+		}})
+	}
+	if len(args) > 0 {
+		checks = append(checks, startupCheck{"command", func(ctx context.Context) error {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				return fmt.Errorf("the command %s isn't installed or in the PATH", args[0])
+			}
+			return nil
+		}})
+	}
+	return checks
+}
+
+// checkStartup runs the startup checks before the first sync, so every problem is reported at once
+// rather than one sync after another. A remote that can't be reached or has no commits yet is only
+// logged, like any problem of the remote with --wait-for-config, since the first sync is tried again
+// until it goes through
+func checkStartup(ctx context.Context, gitRepo *GitRepo, args []string) error {
+	var problems []string
+	for _, check := range startupChecks(gitRepo, args) {
+		err := check.run(ctx)
+		var transient *transientRemoteError
+		switch {
+		case err == nil:
+		case errors.As(err, &transient) || (Options.WaitForConfig && (check.name == "remote" || strings.HasPrefix(check.name, "source "))):
+			log.Printf("%v, trying the first sync anyway\n", err)
+		default:
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("invalid options:\n  - %s", strings.Join(problems, "\n  - "))
+}
+
+// transientRemoteError is a problem of the remote that may go away, like a network failure
+type transientRemoteError struct {
+	err error
+}
+
+func (e *transientRemoteError) Error() string {
+	return e.err.Error()
+}
+
+// checkRemote lists the refs of the remote, checking the credentials, and that the branch or the ref
+// is there
+func checkRemote(ctx context.Context, gitRepo *GitRepo) error {
+	ctx, cancel := context.WithTimeout(ctx, startupCheckTimeout)
+	defer cancel()
+	refs, err := gitRepo.listRefs(ctx, 0)
+	switch {
+	case errors.Is(err, transport.ErrAuthenticationRequired), errors.Is(err, transport.ErrAuthorizationFailed):
+		return fmt.Errorf("%s refused the credentials: check --username and --password", redactURL(gitRepo.URL))
+	case errors.Is(err, transport.ErrRepositoryNotFound):
+		return fmt.Errorf("%s isn't a repository, or the credentials can't see it: check --url", redactURL(gitRepo.URL))
+	case errors.Is(err, transport.ErrEmptyRemoteRepository):
+		return &transientRemoteError{fmt.Errorf("%s has no commits yet", redactURL(gitRepo.URL))}
+	case err != nil:
+		return &transientRemoteError{fmt.Errorf("couldn't reach the remote to check it: %w", err)}
+	}
+
+	ref := gitRepo.Ref
+	if ref == "" {
+		for _, r := range refs {
+			if r.Name().Short() == gitRepo.Branch && r.Name().IsBranch() {
+				return nil
+			}
+		}
+		return fmt.Errorf("branch %s not found in %s: check --branch", gitRepo.Branch, redactURL(gitRepo.URL))
+	}
+	// expressions walk the history, only resolved by the sync
+	if ref == "HEAD" || strings.ContainsAny(ref, "~^") {
+		return nil
+	}
+	if _, _, err := gitRepo.ResolveRef(ctx, ref); err != nil {
+		return fmt.Errorf("%v: check --ref", err)
+	}
+	return nil
+}
+
+// checkWritable creates the folder if needed, and a file in it
+func checkWritable(dir string) error {
+	if err := os.MkdirAll(dir, DirMode); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(dir, ".git-config-server-check-*")
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// historySize is how many sync attempts are kept for /history
+const historySize = 100
+
+// recentErrorsSize is how many errors are kept for /status
+const recentErrorsSize = 20
+
+// ServerStatus tracks what the server has been doing, to be reported on /status
+type ServerStatus struct {
+	mu            sync.Mutex
+	startedAt     time.Time
+	paused        bool
+	history       []SyncRecord
+	recentErrors  []ErrorRecord
+	commit        string
+	lastSyncAt    time.Time
+	lastSyncError string
+	lastSuccessAt time.Time
+	failures      int
+	lastTrigger   string
+	lastTriggerAt time.Time
+	childPid      int
+	childRunning  bool
+	childExitCode int
+	childRestarts int
+	lastRestartAt time.Time
+	previous      string
+	lastChanges   SyncChanges
+	lastCommit    *CommitInfo
+	lastChangeAt  time.Time
+	progress      *SyncProgress
+	progressDone  chan struct{}
+}
+
+// StatusSnapshot is a point-in-time copy of the status, as served on /status
+type StatusSnapshot struct {
+	StartedAt     time.Time    `json:"started_at"`
+	Commit        string       `json:"commit,omitempty"`
+	LastSyncAt    *time.Time   `json:"last_sync_at,omitempty"`
+	LastSyncError string       `json:"last_sync_error,omitempty"`
+	LastSuccessAt *time.Time   `json:"last_success_at,omitempty"`
+	Failures      int          `json:"consecutive_failures"`
+	LastTrigger   string       `json:"last_trigger,omitempty"`
+	LastTriggerAt *time.Time   `json:"last_trigger_at,omitempty"`
+	ChildPid      int          `json:"child_pid,omitempty"`
+	ChildRunning  bool         `json:"child_running"`
+	ChildExitCode *int         `json:"child_exit_code,omitempty"`
+	ChildRestarts int          `json:"child_restarts"`
+	LastRestartAt *time.Time   `json:"last_restart_at,omitempty"`
+	Paused        bool         `json:"paused"`
+	Previous      string       `json:"previous_commit,omitempty"`
+	LastChanges   *SyncChanges `json:"last_changes,omitempty"`
+	// LastCommit is the commit the last change applied
+	LastCommit   *CommitInfo `json:"last_commit,omitempty"`
+	LastChangeAt *time.Time  `json:"last_change_at,omitempty"`
+	// Progress is set while a sync is running
+	Progress *SyncProgress `json:"progress,omitempty"`
+	// RecentErrors are the last errors, oldest first, kept after the syncs succeed again
+	RecentErrors []ErrorRecord `json:"recent_errors,omitempty"`
+	// Processes are the ones of --processes-file
+	Processes []ProcessStatus `json:"processes,omitempty"`
+}
+
+// SyncRecord is an entry in the sync history
+type SyncRecord struct {
+	Time    time.Time `json:"time"`
+	Trigger string    `json:"trigger,omitempty"`
+	Commit  string    `json:"commit,omitempty"`
+	Changed bool      `json:"changed"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// ErrorRecord is an error of a sync, a hook or a restart
+type ErrorRecord struct {
+	Time time.Time `json:"time"`
+	// Category is git, validation, hook, restart, ack or deadline
+	Category string `json:"category"`
+	Commit   string `json:"commit,omitempty"`
+	Error    string `json:"error"`
+}
+
+var CurrentStatus = NewServerStatus()
+
+func NewServerStatus() *ServerStatus {
+	return &ServerStatus{startedAt: time.Now()}
+}
+
+// RecordTrigger records what asked for the next sync or restart (timer, webhook, signal)
+func (s *ServerStatus) RecordTrigger(source string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastTrigger = source
+	s.lastTriggerAt = time.Now()
+}
+
+// LoadHistory starts the history with the sync attempts of the previous runs
+func (s *ServerStatus) LoadHistory(history []SyncRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.history = append(history, s.history...)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+}
+
+// RecordSync records the outcome of a sync attempt, saving it in the store
+func (s *ServerStatus) RecordSync(commit string, changed bool, err error) {
+	Store.RecordSync(s.recordSync(commit, changed, err))
+}
+
+func (s *ServerStatus) recordSync(commit string, changed bool, err error) SyncRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastSyncAt = time.Now()
+
+	record := SyncRecord{
+		Time:    s.lastSyncAt,
+		Trigger: s.lastTrigger,
+		Commit:  commit,
+		Changed: changed,
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	s.history = append(s.history, record)
+	if len(s.history) > historySize {
+		s.history = s.history[len(s.history)-historySize:]
+	}
+
+	switch {
+	case err != nil:
+		Metrics.Add("git_config_server_syncs_total", 1, "result", "failed")
+	case changed:
+		Metrics.Add("git_config_server_syncs_total", 1, "result", "applied")
+	default:
+		Metrics.Add("git_config_server_syncs_total", 1, "result", "unchanged")
+	}
+
+	if err != nil {
+		s.lastSyncError = err.Error()
+		s.failures++
+		return record
+	}
+	s.lastSyncError = ""
+	s.lastSuccessAt = s.lastSyncAt
+	s.failures = 0
+	s.commit = commit
+	return record
+}
+
+// RecordError keeps the error among the recent ones, counting it by category. Errors caused by the
+// deadline of the sync are recorded as deadline ones, whatever category they're reported in
+func (s *ServerStatus) RecordError(category, commit string, err error) {
+	if err == nil {
+		return
+	}
+	if errors.Is(err, errSyncDeadline) {
+		category = "deadline"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recentErrors = append(s.recentErrors, ErrorRecord{
+		Time:     time.Now(),
+		Category: category,
+		Commit:   commit,
+		Error:    err.Error(),
+	})
+	if len(s.recentErrors) > recentErrorsSize {
+		s.recentErrors = s.recentErrors[len(s.recentErrors)-recentErrorsSize:]
+	}
+	Metrics.Add("git_config_server_errors_total", 1, "category", category)
+}
+
+// Staleness returns how long it's been since the last successful sync, or since startup if there was none
+func (s *ServerStatus) Staleness() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastSuccessAt.IsZero() {
+		return time.Since(s.startedAt)
+	}
+	return time.Since(s.lastSuccessAt)
+}
+
+// Ready is true once a sync succeeded, and none of the limits are exceeded. If not, reason explains why
+func (s *ServerStatus) Ready(maxStaleness time.Duration) (ready bool, reason string) {
+	s.mu.Lock()
+	lastSuccessAt := s.lastSuccessAt
+	s.mu.Unlock()
+
+	if lastSuccessAt.IsZero() {
+		return false, "no successful sync yet"
+	}
+	if maxStaleness > 0 && time.Since(lastSuccessAt) > maxStaleness {
+		return false, fmt.Sprintf("config is stale: last successful sync at %s", lastSuccessAt.Format(time.RFC3339))
+	}
+	return true, ""
+}
+
+// ConsecutiveFailures returns how many sync attempts failed in a row
+func (s *ServerStatus) ConsecutiveFailures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failures
+}
+
+// SetPaused pauses or resumes syncing
+func (s *ServerStatus) SetPaused(paused bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.paused = paused
+}
+
+func (s *ServerStatus) Paused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.paused
+}
+
+// History returns the recent sync attempts, oldest first
+func (s *ServerStatus) History() []SyncRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]SyncRecord(nil), s.history...)
+}
+
+// RecordChanges records the commit applied last and the files it changed, and the commit that was live
+// before it
+func (s *ServerStatus) RecordChanges(previous string, info CommitInfo, changes SyncChanges) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.previous = previous
+	s.lastCommit = &info
+	s.lastChanges = changes
+	s.lastChangeAt = time.Now()
+}
+
+// RecordChild records the current pid of the application
+func (s *ServerStatus) RecordChild(pid int, restarted bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.childPid = pid
+	s.childRunning = true
+	if restarted {
+		s.childRestarts++
+		s.lastRestartAt = time.Now()
+	}
+}
+
+// RecordChildExit records that the application exited
+func (s *ServerStatus) RecordChildExit(exitCode int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.childRunning = false
+	s.childExitCode = exitCode
+}
+
+func (s *ServerStatus) Snapshot() StatusSnapshot {
+	snapshot := s.snapshot()
+	// read without the lock, since a process may take its stop grace period to restart
+	snapshot.Processes = Supervised.Status()
+	return snapshot
+}
+
+func (s *ServerStatus) snapshot() StatusSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var exitCode *int
+	if !s.childRunning && s.childPid != 0 {
+		code := s.childExitCode
+		exitCode = &code
+	}
+	var changes *SyncChanges
+	if !s.lastChangeAt.IsZero() {
+		c := s.lastChanges
+		changes = &c
+	}
+	var progress *SyncProgress
+	if s.progress != nil {
+		p := *s.progress
+		progress = &p
+	}
+
+	return StatusSnapshot{
+		StartedAt:     s.startedAt,
+		Commit:        s.commit,
+		LastSyncAt:    optionalTime(s.lastSyncAt),
+		LastSyncError: s.lastSyncError,
+		LastSuccessAt: optionalTime(s.lastSuccessAt),
+		Failures:      s.failures,
+		LastTrigger:   s.lastTrigger,
+		LastTriggerAt: optionalTime(s.lastTriggerAt),
+		ChildPid:      s.childPid,
+		ChildRunning:  s.childRunning,
+		ChildExitCode: exitCode,
+		ChildRestarts: s.childRestarts,
+		LastRestartAt: optionalTime(s.lastRestartAt),
+		Paused:        s.paused,
+		Previous:      s.previous,
+		LastChanges:   changes,
+		LastCommit:    s.lastCommit,
+		LastChangeAt:  optionalTime(s.lastChangeAt),
+		Progress:      progress,
+		RecentErrors:  append([]ErrorRecord(nil), s.recentErrors...),
+	}
+}
+
+func (s *ServerStatus) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.Snapshot())
+}
+
+// optionalTime turns zero times into nil, so they're omitted from the JSON output
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/go-git/go-billy/v5/memfs"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/storage/memory"
+)
+
+const (
+	// statusPushAttempts is how often a status push is retried when other hosts push to the branch at
+	// the same time
+	statusPushAttempts = 5
+	statusPushTimeout  = time.Minute
+)
+
+// DeploymentStatus is what a host writes to the status branch after every apply
+type DeploymentStatus struct {
+	Host string `json:"host"`
+	// Commit is the one in the local folder, which is the previous one if the apply was rolled back
+	Commit string `json:"commit"`
+	// Attempted is the commit that failed to apply, if any
+	Attempted string    `json:"attempted_commit,omitempty"`
+	Subject   string    `json:"subject,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+	Time      time.Time `json:"time"`
+	Version   string    `json:"version"`
+}
+
+// StatusBranchWriter commits the status of every apply to a file of this host in a branch, of the config
+// repo or a separate one, so which host runs which commit can be looked up with git alone. Pushes run
+// in the background, only the latest status is pushed if they fall behind
+type StatusBranchWriter struct {
+	URL    string
+	Branch string
+	File   string
+	Host   string
+
+	username string
+	password string
+	pending  chan DeploymentStatus
+	done     chan struct{}
+}
+
+// StatusBranch writes the result of the applies to --status-branch, if set
+var StatusBranch *StatusBranchWriter
+
+// NewStatusBranchWriter returns nil without a branch. The file defaults to <host>.json
+func NewStatusBranchWriter(url, branch, file, username, password string) *StatusBranchWriter {
+	if branch == "" {
+		return nil
+	}
+	host, _ := os.Hostname()
+	if file == "" {
+		file = host + ".json"
+	}
+	return &StatusBranchWriter{
+		URL:      url,
+		Branch:   branch,
+		File:     file,
+		Host:     host,
+		username: username,
+		password: password,
+		pending:  make(chan DeploymentStatus, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// Start pushes the recorded statuses until Stop
+func (w *StatusBranchWriter) Start() {
+	go func() {
+		defer close(w.done)
+		for status := range w.pending {
+			if err := w.push(status); err != nil {
+				log.Printf("failed to push the status to branch %s of %s: %v\n", w.Branch, w.URL, err)
+			}
+		}
+	}()
+}
+
+// Stop waits for the status being pushed, if any
+func (w *StatusBranchWriter) Stop() {
+	close(w.pending)
+	<-w.done
+}
+
+// Record queues the status of an apply of the commit, replacing any status not pushed yet. A nil
+// writer records nothing
+func (w *StatusBranchWriter) Record(info CommitInfo, result string, err error) {
+	if w == nil {
+		return
+	}
+	status := DeploymentStatus{
+		Host:    w.Host,
+		Commit:  CurrentStatus.Snapshot().Commit,
+		Subject: info.Subject,
+		Result:  result,
+		Time:    time.Now().UTC(),
+		Version: version,
+	}
+	if err != nil {
+		status.Error = err.Error()
+	}
+	if info.Hash != status.Commit {
+		status.Attempted = info.Hash
+	}
+	for {
+		select {
+		case w.pending <- status:
+			return
+		default:
+		}
+		select {
+		case <-w.pending:
+		default:
+		}
+	}
+}
+
+func (w *StatusBranchWriter) push(status DeploymentStatus) error {
+	content, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+
+	ctx, cancel := context.WithTimeout(context.Background(), statusPushTimeout)
+	defer cancel()
+	for attempt := 1; ; attempt++ {
+		err = w.commitAndPush(ctx, content, status)
+		if !errors.Is(err, git.ErrNonFastForwardUpdate) || attempt == statusPushAttempts {
+			return err
+		}
+		log.Printf("branch %s moved while pushing the status, trying again\n", w.Branch)
+	}
+}
+
+// commitAndPush commits the status file on top of the branch, creating it if needed
+func (w *StatusBranchWriter) commitAndPush(ctx context.Context, content []byte, status DeploymentStatus) error {
+	auth := &http.BasicAuth{Username: w.username, Password: w.password}
+	refName := plumbing.NewBranchReferenceName(w.Branch)
+	repo, err := git.CloneContext(ctx, memory.NewStorage(), memfs.New(), &git.CloneOptions{
+		URL:           w.URL,
+		Depth:         1,
+		SingleBranch:  true,
+		ReferenceName: refName,
+		Auth:          auth,
+	})
+	var noBranch git.NoMatchingRefSpecError
+	if errors.As(err, &noBranch) || errors.Is(err, transport.ErrEmptyRemoteRepository) {
+		log.Printf("creating branch %s in %s for the status\n", w.Branch, w.URL)
+		repo, err = w.initBranch(refName)
+	}
+	if err != nil {
+		return err
+	}
+
+	worktree, err := repo.Worktree()
+	if err != nil {
+		return err
+	}
+	file, err := worktree.Filesystem.Create(w.File)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if _, err := worktree.Add(w.File); err != nil {
+		return err
+	}
+	changes, err := worktree.Status()
+	if err != nil {
+		return err
+	}
+	if changes.IsClean() {
+		return nil
+	}
+
+	message := fmt.Sprintf("%s: %s %s", w.Host, status.Result, shortCommit(status.Commit))
+	_, err = worktree.Commit(message, &git.CommitOptions{
+		Author: &object.Signature{Name: "git-config-server", Email: "git-config-server@" + w.Host, When: status.Time},
+	})
+	if err != nil {
+		return err
+	}
+	return repo.PushContext(ctx, &git.PushOptions{
+		RemoteName: git.DefaultRemoteName,
+		RefSpecs:   []config.RefSpec{config.RefSpec(refName + ":" + refName)},
+		Auth:       auth,
+	})
+}
+
+// initBranch starts an empty repo whose first commit becomes the branch
+func (w *StatusBranchWriter) initBranch(refName plumbing.ReferenceName) (*git.Repository, error) {
+	repo, err := git.Init(memory.NewStorage(), memfs.New())
+	if err != nil {
+		return nil, err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewSymbolicReference(plumbing.HEAD, refName)); err != nil {
+		return nil, err
+	}
+	_, err = repo.CreateRemote(&config.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{w.URL}})
+	return repo, err
+}
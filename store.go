@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// storeRetention is how many entries are kept in each of the history buckets
+const storeRetention = 1000
+
+var (
+	syncsBucket   = []byte("syncs")
+	hooksBucket   = []byte("hooks")
+	appliedBucket = []byte("applied")
+	stateBucket   = []byte("state")
+	stateKey      = []byte("current")
+)
+
+// Store keeps the state under --data-dir. Without it, nothing outlives the process
+var Store *StateStore
+
+// StateStore records the applied commits, the sync attempts, the hook results and the rollbacks in a
+// bbolt database, so /history, rolling back and the recovery after a crash work across restarts
+type StateStore struct {
+	db *bbolt.DB
+}
+
+// AppliedState is what was live when the state was last saved
+type AppliedState struct {
+	Commit   string    `json:"commit,omitempty"`
+	Previous string    `json:"previous,omitempty"`
+	At       time.Time `json:"at"`
+	// Applying is the commit whose files were being written, left behind by a crash
+	Applying string `json:"applying,omitempty"`
+}
+
+// HookRecord is the result of a hook or command run on an update
+type HookRecord struct {
+	Time     time.Time `json:"time"`
+	Stage    string    `json:"stage"`
+	Hook     string    `json:"hook"`
+	ExitCode int       `json:"exit_code"`
+	Duration string    `json:"duration,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// AppliedRecord is a commit going live, through a sync or a rollback
+type AppliedRecord struct {
+	Time   time.Time `json:"time"`
+	Type   EventType `json:"type"`
+	Source string    `json:"source,omitempty"`
+	Commit string    `json:"commit"`
+	// From is the commit rolled back from
+	From string `json:"from,omitempty"`
+}
+
+// OpenStateStore opens or creates the database. Only one process can have it open
+func OpenStateStore(path string) (*StateStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	db, err := bbolt.Open(path, 0o600, &bbolt.Options{Timeout: time.Second})
+	if errors.Is(err, bbolt.ErrTimeout) {
+		return nil, fmt.Errorf("state store %s is locked, is another instance using the same --data-dir?", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state store %s: %w", path, err)
+	}
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, bucket := range [][]byte{syncsBucket, hooksBucket, appliedBucket, stateBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to set up state store %s: %w", path, err)
+	}
+	return &StateStore{db: db}, nil
+}
+
+// Close releases the database for the next run
+func (s *StateStore) Close() error {
+	if s == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// append adds the value at the end of the bucket, dropping the oldest entries past storeRetention
+func (s *StateStore) append(bucket []byte, value any) {
+	if s == nil {
+		return
+	}
+	content, err := json.Marshal(value)
+	if err != nil {
+		log.Printf("failed to encode %s entry: %v\n", bucket, err)
+		return
+	}
+	err = s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(bucket)
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(sequenceKey(seq), content); err != nil {
+			return err
+		}
+		if seq <= storeRetention {
+			return nil
+		}
+		// keys are big endian, so the cursor goes from the oldest
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && binary.BigEndian.Uint64(k) <= seq-storeRetention; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to record %s entry: %v\n", bucket, err)
+	}
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// RecordSync adds the sync attempt to the history
+func (s *StateStore) RecordSync(record SyncRecord) {
+	s.append(syncsBucket, record)
+}
+
+// History returns the last sync attempts, oldest first
+func (s *StateStore) History(limit int) []SyncRecord {
+	var history []SyncRecord
+	for _, content := range s.Entries(syncsBucket, limit) {
+		var record SyncRecord
+		if err := json.Unmarshal(content, &record); err != nil {
+			log.Printf("failed to read the sync history: %v\n", err)
+			return nil
+		}
+		history = append(history, record)
+	}
+	return history
+}
+
+// Entries returns the last entries of the bucket as they're saved, oldest first
+func (s *StateStore) Entries(bucket []byte, limit int) []json.RawMessage {
+	if s == nil {
+		return nil
+	}
+	var entries []json.RawMessage
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		c := tx.Bucket(bucket).Cursor()
+		for k, v := c.Last(); k != nil && len(entries) < limit; k, v = c.Prev() {
+			// the values are only valid during the transaction
+			entries = append(entries, append(json.RawMessage(nil), v...))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("failed to read the %s entries: %v\n", bucket, err)
+		return nil
+	}
+	slices.Reverse(entries)
+	return entries
+}
+
+// Handle records the hook results and the commits going live
+func (s *StateStore) Handle(event Event) {
+	switch event.Type {
+	case EventHookFinished:
+		exitCode, _ := strconv.Atoi(event.Fields["exit_code"])
+		s.append(hooksBucket, HookRecord{
+			Time:     event.Time,
+			Stage:    event.Fields["stage"],
+			Hook:     event.Fields["hook"],
+			ExitCode: exitCode,
+			Duration: event.Fields["duration"],
+			Error:    event.Error,
+		})
+	case EventSyncApplied, EventRolledBack:
+		s.append(appliedBucket, AppliedRecord{
+			Time:   event.Time,
+			Type:   event.Type,
+			Source: event.Source,
+			Commit: event.Commit,
+			From:   event.Fields["from"],
+		})
+	}
+}
+
+// LoadState returns the state saved by the previous run, empty on the first one
+func (s *StateStore) LoadState() (AppliedState, error) {
+	var state AppliedState
+	if s == nil {
+		return state, nil
+	}
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		content := tx.Bucket(stateBucket).Get(stateKey)
+		if content == nil {
+			return nil
+		}
+		return json.Unmarshal(content, &state)
+	})
+	if err != nil {
+		return state, fmt.Errorf("failed to read the saved state: %w", err)
+	}
+	return state, nil
+}
+
+// update changes the saved state
+func (s *StateStore) update(change func(state *AppliedState)) {
+	if s == nil {
+		return
+	}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(stateBucket)
+		var state AppliedState
+		if content := b.Get(stateKey); content != nil {
+			if err := json.Unmarshal(content, &state); err != nil {
+				return err
+			}
+		}
+		change(&state)
+		content, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return b.Put(stateKey, content)
+	})
+	if err != nil {
+		log.Printf("failed to save the state: %v\n", err)
+	}
+}
+
+// SaveApplied saves the commit live now, and the one a rollback would go back to
+func (s *StateStore) SaveApplied(commit, previous string) {
+	s.update(func(state *AppliedState) {
+		state.Commit, state.Previous, state.At = commit, previous, time.Now()
+	})
+}
+
+// BeginApply marks the commit as being written, until EndApply
+func (s *StateStore) BeginApply(commit string) {
+	s.update(func(state *AppliedState) {
+		state.Applying = commit
+	})
+}
+
+// EndApply clears the mark of BeginApply, whether the files were written or not
+func (s *StateStore) EndApply() {
+	s.update(func(state *AppliedState) {
+		state.Applying = ""
+	})
+}
+
+// recordInterruptedApply records a write of the files interrupted by a crash as a failed sync. The
+// first sync writes them all again anyway
+func recordInterruptedApply(saved AppliedState) {
+	if saved.Applying == "" {
+		return
+	}
+	log.Printf("the previous run stopped while writing the files of commit %s\n", shortCommit(saved.Applying))
+	CurrentStatus.RecordSync(saved.Applying, false, fmt.Errorf("interrupted while writing the files of commit %s", shortCommit(saved.Applying)))
+	Store.EndApply()
+}
+
+// recoverState restores what the previous run saved, after the first sync of this one. A rollback goes
+// back to the commit live before the restart, or to the one before it if the same commit is still live
+func (gitRepo *GitRepo) recoverState(saved AppliedState) {
+	state := gitRepo.State()
+	if saved.Commit == "" || state.Commit == "" || state.Previous != "" {
+		return
+	}
+	previous := saved.Commit
+	if saved.Commit == state.Commit {
+		previous = saved.Previous
+	}
+	if previous == "" {
+		return
+	}
+	gitRepo.stateMu.Lock()
+	gitRepo.previousCommit = previous
+	gitRepo.stateMu.Unlock()
+	Store.SaveApplied(state.Commit, previous)
+	CurrentStatus.RecordChanges(previous, state.Info, state.Changes)
+	log.Printf("rolling back would go to commit %s, live before the restart\n", shortCommit(previous))
+}
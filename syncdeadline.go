@@ -0,0 +1,53 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+)
+
+// errSyncDeadline marks the syncs cancelled by --sync-deadline
+var errSyncDeadline = errors.New("sync deadline exceeded")
+
+// withSyncDeadline bounds a sync, from the check of the remote to the restart, by --sync-deadline
+func withSyncDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if Options.SyncDeadline <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, Options.SyncDeadline)
+}
+
+// deadlineError tells the errors caused by the deadline of the sync apart, so they're recorded as
+// timeouts rather than as whatever the cancelled operation returned
+func deadlineError(ctx context.Context, err error) error {
+	if err == nil || !errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return err
+	}
+	return fmt.Errorf("%w after %v: %v", errSyncDeadline, Options.SyncDeadline, err)
+}
+
+// restoreAfterDeadline puts back the files of the commit that was live when the deadline passed after
+// the new ones were written, so the application doesn't run with files it never validated. The commit
+// is tried again by the next sync
+func restoreAfterDeadline(ctx context.Context, gitRepo *GitRepo, err error) {
+	CurrentStatus.RecordSync("", false, err)
+	timedOut := gitRepo.State()
+	if timedOut.Previous == "" {
+		return
+	}
+	// the sync's own context is done, the restore gets a deadline of its own
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), Options.SyncDeadline)
+	defer cancel()
+	if err := gitRepo.Rollback(ctx, Options.LocalFolder); err != nil {
+		log.Printf("failed to restore commit %s after the sync deadline: %v\n", shortCommit(timedOut.Previous), err)
+		return
+	}
+	gitRepo.ForgetPrevious()
+	restored := gitRepo.State()
+	fields := appliedFields(gitRepo)
+	fields["from"] = timedOut.Commit
+	Events.Publish(Event{Type: EventRolledBack, Source: "deadline", Commit: restored.Commit, Error: err.Error(), Fields: fields})
+	Metrics.Add("git_config_server_rollbacks_total", 1)
+	CurrentStatus.RecordChanges(restored.Previous, restored.Info, restored.Changes)
+}
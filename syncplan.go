@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// maxCompareWorkers bounds the files of src compared with the ones of dst at once
+const maxCompareWorkers = 8
+
+// syncTimings is how long each phase of SyncDirs took, and how many files of src it compared or wrote
+type syncTimings struct {
+	// Scan walks src and dst together and compares their files, writing nothing
+	Scan time.Duration
+	// Apply removes and writes what the scan found, and Prune removes the directories left empty
+	Apply time.Duration
+	Prune time.Duration
+	Files int
+}
+
+// Total is the time SyncDirs took
+func (t syncTimings) Total() time.Duration {
+	return t.Scan + t.Apply + t.Prune
+}
+
+// syncPlan is what SyncDirs changes in dst, found by a single walk of both directories before anything
+// is written, so a refused sync leaves dst alone
+type syncPlan struct {
+	src, dst  string
+	config    *RepoConfig
+	gitignore gitignore.Matcher
+	preserved map[string]bool
+	// srcRoot is src with its symlinks resolved, which the symlinks of src must point inside
+	srcRoot     string
+	filesystems filesystems
+	changes     SyncChanges
+	// the removals are applied first, then the writes, both in the order of the walk
+	removals []syncRemoval
+	writes   []*syncWrite
+	// compares are the writes whose dst may already have the same contents
+	compares []*syncWrite
+	files    int
+	// realDirs are the directories of dst known not to be symlinks, whose files are written without
+	// looking for symlinks on their way again
+	realDirs map[string]bool
+	// linkedDirs are the directories of src walked through a symlink, and what it resolved to
+	linkedDirs map[string]string
+}
+
+// syncRemoval is a path of dst removed by the sync
+type syncRemoval struct {
+	slashPath string
+	info      os.FileInfo
+	// replaced is true if src has another kind of file there, written afterwards
+	replaced bool
+}
+
+// syncWrite is a directory or file of src written to dst, or only given its mode and owner if dst
+// already has it
+type syncWrite struct {
+	slashPath string
+	info      os.FileInfo
+	// exists is true if dst has it once the removals are applied, and replaced if it was removed
+	exists      bool
+	replaced    bool
+	transformed []byte
+	same        bool
+	// dstLink is true if dst has a symlink there, replaced by the file since it would be written through
+	dstLink bool
+	// followLinks compares the files a symlink of src or dst points to, whose sizes aren't known yet
+	followLinks bool
+	err         error
+}
+
+// syncDirs is SyncDirs, also returning how long it took
+func syncDirs(src, dst string, config *RepoConfig, preserve ...string) (SyncChanges, syncTimings, error) {
+	var timings syncTimings
+	start := time.Now()
+	srcRoot, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return SyncChanges{}, timings, fmt.Errorf("failed to resolve the source dir %s: %w", src, err)
+	}
+	plan := &syncPlan{
+		src:         src,
+		dst:         dst,
+		config:      config,
+		gitignore:   loadGitignorePatterns(src),
+		preserved:   make(map[string]bool, len(preserve)),
+		srcRoot:     srcRoot,
+		filesystems: newFilesystems(dst),
+		realDirs:    map[string]bool{".": true},
+		linkedDirs:  make(map[string]string),
+	}
+	for _, p := range preserve {
+		plan.preserved[p] = true
+	}
+	err = plan.scan()
+	timings.Scan = time.Since(start)
+	timings.Files = plan.files
+	if err != nil {
+		return plan.changes, timings, err
+	}
+
+	start = time.Now()
+	err = plan.apply()
+	timings.Apply = time.Since(start)
+	if err != nil || config == nil || !config.pruneEmpty {
+		return plan.changes, timings, err
+	}
+	start = time.Now()
+	err = pruneEmptyDirs(dst, config, plan.gitignore, plan.preserved, &plan.changes)
+	timings.Prune = time.Since(start)
+	return plan.changes, timings, err
+}
+
+// recordSyncTimings exports the timings of a SyncDirs as metrics
+func recordSyncTimings(timings syncTimings) {
+	Metrics.Observe("git_config_server_sync_dirs_seconds", timings.Scan.Seconds(), "phase", "scan")
+	Metrics.Observe("git_config_server_sync_dirs_seconds", timings.Apply.Seconds(), "phase", "apply")
+	if timings.Prune > 0 {
+		Metrics.Observe("git_config_server_sync_dirs_seconds", timings.Prune.Seconds(), "phase", "prune")
+	}
+	Metrics.Set("git_config_server_sync_dirs_files", float64(timings.Files))
+	debugf("synced %d files in %s: scanned in %s, applied in %s\n", timings.Files, timings.Total().Round(time.Millisecond),
+		timings.Scan.Round(time.Millisecond), timings.Apply.Round(time.Millisecond))
+}
+
+// scan walks src and dst, then compares the files found in both concurrently
+func (p *syncPlan) scan() error {
+	_, err := os.Stat(p.dst)
+	dstExists := err == nil
+	lazyDirs := p.config != nil && (len(p.config.Include) > 0 || p.config.pruneEmpty)
+	if !lazyDirs {
+		p.writes = append(p.writes, &syncWrite{slashPath: ".", exists: dstExists})
+	}
+	if err := p.scanDir(".", true, dstExists, true); err != nil {
+		return err
+	}
+	if err := p.compare(); err != nil {
+		return err
+	}
+	for _, w := range p.writes {
+		if w.info == nil || w.info.IsDir() {
+			continue
+		}
+		CurrentStatus.AdvanceProgress(1, w.info.Size())
+		if w.same {
+			continue
+		}
+		if w.exists || w.replaced {
+			p.changes.recordModified(w.slashPath)
+		} else {
+			p.changes.recordAdded(w.slashPath)
+		}
+	}
+	return nil
+}
+
+// scanDir merges the sorted entries of the directory in src and in dst. The ones of dst are only
+// removed if prune is set, which it isn't inside the gitignored and protected directories
+func (p *syncPlan) scanDir(slashDir string, srcOK, dstOK, prune bool) error {
+	var srcEntries, dstEntries []os.DirEntry
+	var err error
+	if srcOK {
+		if srcEntries, err = os.ReadDir(p.srcPath(slashDir)); err != nil {
+			return err
+		}
+	}
+	if dstOK {
+		if dstEntries, err = os.ReadDir(p.dstPath(slashDir)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove non-matching dst dir: %w", err)
+		}
+	}
+	for len(srcEntries) > 0 || len(dstEntries) > 0 {
+		var srcEntry, dstEntry os.DirEntry
+		switch {
+		case len(dstEntries) == 0 || (len(srcEntries) > 0 && srcEntries[0].Name() < dstEntries[0].Name()):
+			srcEntry, srcEntries = srcEntries[0], srcEntries[1:]
+		case len(srcEntries) == 0 || dstEntries[0].Name() < srcEntries[0].Name():
+			dstEntry, dstEntries = dstEntries[0], dstEntries[1:]
+		default:
+			srcEntry, dstEntry = srcEntries[0], dstEntries[0]
+			srcEntries, dstEntries = srcEntries[1:], dstEntries[1:]
+		}
+		if err := p.scanEntry(slashDir, srcEntry, dstEntry, prune); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanEntry plans the sync of a path found in src, dst or both, then walks it if it's a directory
+func (p *syncPlan) scanEntry(slashDir string, srcEntry, dstEntry os.DirEntry, prune bool) error {
+	var name string
+	if srcEntry != nil {
+		name = srcEntry.Name()
+	} else {
+		name = dstEntry.Name()
+	}
+	slashPath := path.Join(slashDir, name)
+	config := p.config
+
+	// what's in src, following its symlinks like the files they point to are copied
+	var srcInfo os.FileInfo
+	if srcEntry != nil {
+		info, err := srcEntry.Info()
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			if info, err = p.followSourceLink(slashPath); err != nil {
+				return err
+			}
+		}
+		srcInfo = info
+	}
+	srcSynced := srcInfo != nil && !isGitMetadata(slashPath) && config.Synced(slashPath, srcInfo.IsDir())
+
+	// the removals from dst
+	var dstInfo os.FileInfo
+	// removable is false for the paths of dst the sync leaves alone, and walkInside for the directories
+	// whose extra paths aren't removed either
+	removed, removable, walkInside := false, prune, prune
+	if dstEntry != nil {
+		info, err := dstEntry.Info()
+		if os.IsNotExist(err) {
+			dstEntry = nil
+		} else if err != nil {
+			return fmt.Errorf("failed to remove non-matching dst dir: %w", err)
+		}
+		dstInfo = info
+	}
+	if dstInfo != nil {
+		isDir := dstInfo.IsDir()
+		switch {
+		case !prune:
+		case isGitMetadata(slashPath) && config.keepsGitDir():
+			return nil
+		case p.preserved[slashPath] || (isDir && hasPreservedChild(p.preserved, slashPath)):
+			// the walk goes on inside the preserved directories
+			removable = false
+		case p.gitignore.Match(strings.Split(slashPath, "/"), isDir) || config.Protected(slashPath, isDir) || (!isDir && config.isKeepMarker(name)):
+			// This file/directory is gitignored or protected, so preserve it in destination
+			if !config.isKeepMarker(name) || isDir {
+				p.changes.recordPreserved(slashPath, isDir)
+			}
+			removable, walkInside = false, false
+		}
+		if kind := specialFileKind(dstInfo); kind != "" {
+			if removable {
+				log.Printf("skipping the %s %s, which can't be synced\n", kind, p.dstPath(slashPath))
+			}
+			return nil
+		}
+		if p.filesystems.isMountPoint(dstInfo) {
+			if removable {
+				log.Printf("skipping %s, the mount point of another filesystem\n", p.dstPath(slashPath))
+			}
+			return nil
+		}
+		if removable && !srcSynced && !config.policy(slashPath).prunes() {
+			removable, walkInside = false, false
+		}
+		if removable {
+			var err error
+			if removed, err = p.scanRemoval(slashPath, dstInfo, srcInfo, srcSynced); err != nil {
+				return err
+			}
+		}
+	}
+	dstExists := dstInfo != nil && !removed
+	if dstExists && dstInfo.IsDir() {
+		p.realDirs[slashPath] = true
+	}
+
+	if srcSynced {
+		if kind := specialFileKind(srcInfo); kind != "" {
+			log.Printf("skipping the %s %s, which can't be synced\n", kind, p.srcPath(slashPath))
+			srcSynced = false
+		}
+	}
+	if !srcSynced {
+		if dstExists && dstInfo.IsDir() && walkInside {
+			return p.scanDir(slashPath, false, true, true)
+		}
+		return nil
+	}
+	if srcInfo.IsDir() {
+		lazyDirs := config != nil && (len(config.Include) > 0 || config.pruneEmpty)
+		if !lazyDirs || dstExists {
+			p.writes = append(p.writes, &syncWrite{slashPath: slashPath, info: srcInfo, exists: dstExists})
+		}
+		return p.scanDir(slashPath, true, dstExists && dstInfo.IsDir(), walkInside)
+	}
+	if dstExists && config.Protected(slashPath, false) {
+		return nil
+	}
+	p.files++
+	w := &syncWrite{slashPath: slashPath, info: srcInfo, exists: dstExists, replaced: removed}
+	w.dstLink = dstExists && dstInfo.Mode()&os.ModeSymlink != 0
+	p.writes = append(p.writes, w)
+	transformed, err := transformFile(config, p.srcPath(slashPath), slashPath)
+	if err != nil {
+		return err
+	}
+	w.transformed = transformed
+	switch {
+	case !dstExists:
+	case transformed != nil:
+		current, err := os.ReadFile(p.dstPath(slashPath))
+		w.same = err == nil && bytes.Equal(current, transformed)
+	case dstInfo.Mode()&os.ModeSymlink != 0 || srcEntry.Type()&os.ModeSymlink != 0:
+		// the sizes are the ones of the files the symlinks point to
+		w.followLinks = true
+		p.compares = append(p.compares, w)
+	case dstInfo.Mode().IsRegular() && dstInfo.Size() == srcInfo.Size():
+		p.compares = append(p.compares, w)
+	}
+	return nil
+}
+
+// scanRemoval plans removing the path of dst if src doesn't have it, or has another kind of file there.
+// It's true if the path is removed, and the directories that can't be are walked instead
+func (p *syncPlan) scanRemoval(slashPath string, dstInfo, srcInfo os.FileInfo, srcSynced bool) (bool, error) {
+	config := p.config
+	isDir := dstInfo.IsDir()
+	dstPath := p.dstPath(slashPath)
+	if !srcSynced && isDir && config.hasKeepMarker(dstPath) {
+		// only what's around the markers is removed
+		return false, nil
+	}
+	if srcSynced && srcInfo.IsDir() == isDir && (isDir || config.executable(slashPath, srcInfo) == IsExecAny(dstInfo)) {
+		return false, nil
+	}
+	if isDir {
+		if inner := p.filesystems.unremovable(dstPath); inner != "" {
+			if srcSynced {
+				return false, fmt.Errorf("failed to replace the dst dir %s with a file: %s can't be removed", dstPath, inner)
+			}
+			// the walk goes on inside, removing everything else
+			return false, nil
+		}
+	}
+	p.removals = append(p.removals, syncRemoval{slashPath: slashPath, info: dstInfo, replaced: srcSynced})
+	return true, nil
+}
+
+// followSourceLink refuses the symlinks of src pointing outside of it, since their targets, like
+// /etc/shadow, would be copied into the destination, returning what it points to. The symlinks to a
+// directory the walk is in are refused too, since following them would never end
+func (p *syncPlan) followSourceLink(slashPath string) (os.FileInfo, error) {
+	link := p.srcPath(slashPath)
+	target, err := filepath.EvalSymlinks(link)
+	if err != nil {
+		return nil, fmt.Errorf("refusing to sync the broken symlink %s: %w", link, err)
+	}
+	if !isInside(target, p.srcRoot) {
+		return nil, fmt.Errorf("refusing to sync the symlink %s, which points outside of the repo", link)
+	}
+	info, err := os.Stat(link)
+	if err != nil || !info.IsDir() {
+		return info, err
+	}
+	for dir := path.Dir(slashPath); ; dir = path.Dir(dir) {
+		if isInside(p.realSrcDir(dir), target) {
+			return nil, fmt.Errorf("refusing to sync the symlink %s, which points to a directory it's in", link)
+		}
+		if dir == "." {
+			break
+		}
+	}
+	p.linkedDirs[slashPath] = target
+	return info, nil
+}
+
+// realSrcDir is where a directory of src is with its symlinks resolved
+func (p *syncPlan) realSrcDir(slashDir string) string {
+	for dir := slashDir; dir != "."; dir = path.Dir(dir) {
+		if target, ok := p.linkedDirs[dir]; ok {
+			rest := strings.TrimPrefix(strings.TrimPrefix(slashDir, dir), "/")
+			return filepath.Join(target, filepath.FromSlash(rest))
+		}
+	}
+	return filepath.Join(p.srcRoot, filepath.FromSlash(slashDir))
+}
+
+// compare reads the files of src that dst has with the same size, to find the ones already written
+func (p *syncPlan) compare() error {
+	workers := min(runtime.GOMAXPROCS(0), maxCompareWorkers, len(p.compares))
+	next := make(chan *syncWrite)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for w := range next {
+				srcPath, dstPath := p.srcPath(w.slashPath), p.dstPath(w.slashPath)
+				if w.followLinks {
+					w.same, w.err = sameContents(srcPath, dstPath)
+				} else {
+					w.same, w.err = sameBytes(srcPath, dstPath, w.info.Size())
+				}
+				if w.err != nil {
+					w.err = fmt.Errorf("failed to compare %s with %s: %w", srcPath, dstPath, w.err)
+				}
+			}
+		}()
+	}
+	for _, w := range p.compares {
+		next <- w
+	}
+	close(next)
+	wg.Wait()
+	for _, w := range p.compares {
+		if w.err != nil {
+			return w.err
+		}
+	}
+	return nil
+}
+
+// apply removes the paths of dst that don't match src, then writes the ones that differ
+func (p *syncPlan) apply() error {
+	config := p.config
+	diffs := config.diffs()
+	defer diffs.finish()
+	// contents of the replaced files, for the diff summary
+	replacedContents := make(map[string][]byte)
+	// extended attributes of the replaced files, restored once they're written again
+	savedXattrs := make(map[string]map[string][]byte)
+
+	for _, r := range p.removals {
+		path := p.dstPath(r.slashPath)
+		if r.replaced && r.info.Mode().IsRegular() && config.keepsXattrs() {
+			attrs, err := readXattrs(path)
+			if err != nil {
+				return fmt.Errorf("failed to read the extended attributes of %s: %w", path, err)
+			}
+			savedXattrs[r.slashPath] = attrs
+		}
+		if diffs != nil {
+			if err := recordRemoval(diffs, replacedContents, path, r.slashPath, r.info, !r.replaced); err != nil {
+				return fmt.Errorf("failed to remove non-matching dst dir: %w", err)
+			}
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove non-matching dst dir: failed to remove dst file or dir %s: %w", path, err)
+		}
+		if !r.replaced {
+			p.changes.recordRemoved(r.slashPath, r.info.IsDir())
+		}
+	}
+
+	for _, w := range p.writes {
+		srcPath, dstPath := p.srcPath(w.slashPath), p.dstPath(w.slashPath)
+		if w.info == nil || w.info.IsDir() {
+			if err := p.writeDir(w, dstPath); err != nil {
+				return err
+			}
+			continue
+		}
+		policy := config.policy(w.slashPath)
+		if w.same {
+			if err := applyPolicyMode(policy, dstPath); err != nil {
+				return err
+			}
+			if err := config.applyOwnership(dstPath, w.slashPath, false); err != nil {
+				return err
+			}
+			continue
+		}
+		if diffs != nil {
+			if err := recordWrite(diffs, replacedContents, srcPath, dstPath, w.slashPath, w.transformed); err != nil {
+				return err
+			}
+		}
+		if err := p.writeFile(w, srcPath, dstPath); err != nil {
+			return err
+		}
+		if attrs := savedXattrs[w.slashPath]; len(attrs) > 0 {
+			if err := writeXattrs(dstPath, attrs); err != nil {
+				return fmt.Errorf("failed to restore the extended attributes of %s: %w", dstPath, err)
+			}
+		}
+		if err := applyPolicyMode(policy, dstPath); err != nil {
+			return err
+		}
+		if err := config.applyOwnership(dstPath, w.slashPath, false); err != nil {
+			return err
+		}
+		if err := config.setMtime(dstPath, w.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeDir creates a directory of src in dst, or only applies its --chown-rule if dst has it and
+// the directories are created along with their files
+func (p *syncPlan) writeDir(w *syncWrite, dstPath string) error {
+	config := p.config
+	lazyDirs := config != nil && (len(config.Include) > 0 || config.pruneEmpty)
+	if lazyDirs {
+		return config.applyOwnership(dstPath, w.slashPath, true)
+	}
+	if err := safeDestination(p.dst, dstPath); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dstPath, DirMode); err != nil {
+		return fmt.Errorf("failed to create dst dir %s: %w", dstPath, err)
+	}
+	p.realDirs[w.slashPath] = true
+	if w.slashPath == "." {
+		return nil
+	}
+	return config.applyOwnership(dstPath, w.slashPath, true)
+}
+
+// writeFile writes a file of src to dst, converted if it's transformed, keeping the executable bit of
+// the owner
+func (p *syncPlan) writeFile(w *syncWrite, srcPath, dstPath string) error {
+	if parent := path.Dir(w.slashPath); !p.realDirs[parent] {
+		if err := safeDestination(p.dst, dstPath); err != nil {
+			return err
+		}
+		if err := makeParents(p.dst, w.slashPath, p.config); err != nil {
+			return err
+		}
+		for dir := parent; dir != "."; dir = path.Dir(dir) {
+			p.realDirs[dir] = true
+		}
+	}
+	if w.dstLink {
+		if err := os.Remove(dstPath); err != nil {
+			return fmt.Errorf("failed to replace the symlink %s: %w", dstPath, err)
+		}
+	}
+	userExecutableBit := w.info.Mode().Perm() & 0100
+	if w.transformed != nil {
+		if err := os.WriteFile(dstPath, w.transformed, 0666); err != nil {
+			return fmt.Errorf("failed to write converted %s to %s: %w", srcPath, dstPath, err)
+		}
+		if userExecutableBit != 0 {
+			return addUserExecutableBit(dstPath)
+		}
+		return nil
+	}
+	if err := copyFile(srcPath, dstPath, userExecutableBit != 0); err != nil {
+		return fmt.Errorf("failed to copy source dir %s to %s: %w", srcPath, dstPath, err)
+	}
+	return nil
+}
+
+func (p *syncPlan) srcPath(slashPath string) string {
+	return filepath.Join(p.src, filepath.FromSlash(slashPath))
+}
+
+func (p *syncPlan) dstPath(slashPath string) string {
+	return filepath.Join(p.dst, filepath.FromSlash(slashPath))
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFollowSourceLink(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	writeTree(t, src, map[string]string{"a/a.conf": "a", "b.conf": "b"})
+	writeTree(t, dir, map[string]string{"outside.conf": "secret", "src2/c.conf": "c"})
+	links := map[string]string{
+		"file":           "b.conf",
+		"a/up":           filepath.Join("..", "b.conf"),
+		"dir":            "a",
+		"escape":         filepath.Join("..", "outside.conf"),
+		"a/escape":       filepath.Join("..", "..", "outside.conf"),
+		"prefix":         filepath.Join("..", "src2", "c.conf"),
+		"absolute":       filepath.Join(dir, "outside.conf"),
+		"absolute-in":    filepath.Join(src, "b.conf"),
+		"root":           ".",
+		"a/parent":       "..",
+		"a/self":         ".",
+		"broken":         "missing.conf",
+		"a/to-a-by-root": src,
+	}
+	for link, target := range links {
+		if err := os.Symlink(target, filepath.Join(src, filepath.FromSlash(link))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srcRoot, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		link string
+		dir  bool
+		err  string
+	}{
+		{link: "file"},
+		{link: "a/up"},
+		{link: "absolute-in"},
+		{link: "dir", dir: true},
+		{link: "escape", err: "outside of the repo"},
+		{link: "a/escape", err: "outside of the repo"},
+		{link: "prefix", err: "outside of the repo"},
+		{link: "absolute", err: "outside of the repo"},
+		{link: "broken", err: "broken symlink"},
+		{link: "root", err: "a directory it's in"},
+		{link: "a/parent", err: "a directory it's in"},
+		{link: "a/self", err: "a directory it's in"},
+		{link: "a/to-a-by-root", err: "a directory it's in"},
+	}
+	for _, test := range tests {
+		t.Run(test.link, func(t *testing.T) {
+			plan := &syncPlan{src: src, srcRoot: srcRoot, linkedDirs: make(map[string]string)}
+			info, err := plan.followSourceLink(test.link)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("got error %v, want one with %q", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.IsDir() != test.dir {
+				t.Errorf("followed to a directory: %v, want %v", info.IsDir(), test.dir)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Tenant is an application allowed to read only the files under its path prefix, authenticated by its
+// token. Client certificates are left to a TLS-terminating proxy, the server only speaks plain HTTP
+type Tenant struct {
+	Name   string
+	Prefix string
+	token  string
+}
+
+// Tenants are checked in order, the first one whose token and prefix match wins
+type Tenants []Tenant
+
+// ParseTenant parses a name:prefix:token spec. The token is everything after the second colon
+func ParseTenant(spec string) (Tenant, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return Tenant{}, fmt.Errorf("invalid tenant %q, expected name:prefix:token", spec)
+	}
+	prefix := strings.Trim(path.Clean("/"+parts[1]), "/")
+	return Tenant{Name: parts[0], Prefix: prefix, token: parts[2]}, nil
+}
+
+// ParseTenants parses all the specs
+func ParseTenants(specs []string) (Tenants, error) {
+	var tenants Tenants
+	for _, spec := range specs {
+		tenant, err := ParseTenant(spec)
+		if err != nil {
+			return nil, err
+		}
+		tenants = append(tenants, tenant)
+	}
+	return tenants, nil
+}
+
+// Contains is true if the slash-separated path is the prefix itself or inside it
+func (t Tenant) Contains(slashPath string) bool {
+	slashPath = strings.Trim(path.Clean("/"+slashPath), "/")
+	if t.Prefix == "" {
+		return true
+	}
+	return slashPath == t.Prefix || strings.HasPrefix(slashPath, t.Prefix+"/")
+}
+
+// Authorize returns the tenant owning the token, if it may read the path
+func (tenants Tenants) Authorize(token, slashPath string) (Tenant, bool) {
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return Tenant{}, false
+	}
+	for _, tenant := range tenants {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tenant.token)) == 1 && tenant.Contains(slashPath) {
+			return tenant, true
+		}
+	}
+	return Tenant{}, false
+}
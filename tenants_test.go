@@ -0,0 +1,77 @@
+package main
+
+import "testing"
+
+func TestParseTenant(t *testing.T) {
+	tests := []struct {
+		spec   string
+		prefix string
+		token  string
+		err    bool
+	}{
+		{spec: "app:app:t0ken", prefix: "app", token: "t0ken"},
+		{spec: "app:/app/:t0ken", prefix: "app", token: "t0ken"},
+		{spec: "app:app/../other:t0ken", prefix: "other", token: "t0ken"},
+		{spec: "app:../../etc:t0ken", prefix: "etc", token: "t0ken"},
+		{spec: "all::t0ken", prefix: "", token: "t0ken"},
+		{spec: "app:app:with:colons", prefix: "app", token: "with:colons"},
+		{spec: "app:app:", err: true},
+		{spec: ":app:t0ken", err: true},
+		{spec: "app:app", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.spec, func(t *testing.T) {
+			tenant, err := ParseTenant(test.spec)
+			if test.err {
+				if err == nil {
+					t.Errorf("accepted %q", test.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tenant.Prefix != test.prefix || tenant.token != test.token {
+				t.Errorf("got prefix %q and token %q, want %q and %q", tenant.Prefix, tenant.token, test.prefix, test.token)
+			}
+		})
+	}
+}
+
+func TestTenantsAuthorize(t *testing.T) {
+	tenants, err := ParseTenants([]string{"app:app:app-token", "nested:teams/web:web-token", "admin::admin-token"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		token  string
+		path   string
+		tenant string
+	}{
+		{"app-token", "app", "app"},
+		{"app-token", "app/config.yaml", "app"},
+		{"app-token", "/app/config.yaml", "app"},
+		{"app-token", "app2/config.yaml", ""},
+		{"app-token", "app.yaml", ""},
+		{"app-token", "application/config.yaml", ""},
+		{"app-token", "app/../app2/config.yaml", ""},
+		{"app-token", "app/../../app/config.yaml", "app"},
+		{"app-token", "", ""},
+		{" app-token\n", "app/config.yaml", "app"},
+		{"web-token", "teams/web/nginx.conf", "nested"},
+		{"web-token", "teams/webapp/nginx.conf", ""},
+		{"web-token", "teams", ""},
+		{"admin-token", "app2/config.yaml", "admin"},
+		{"wrong", "app/config.yaml", ""},
+		{"", "app/config.yaml", ""},
+		{"app-token-longer", "app/config.yaml", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.token+" "+test.path, func(t *testing.T) {
+			tenant, ok := tenants.Authorize(test.token, test.path)
+			if ok != (test.tenant != "") || tenant.Name != test.tenant {
+				t.Errorf("authorized %q (%v), want %q", tenant.Name, ok, test.tenant)
+			}
+		})
+	}
+}
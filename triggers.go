@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// eventHeaders carry the kind of webhook delivery, like push or tag_push
+var eventHeaders = []string{"X-GitHub-Event", "X-Gitlab-Event", "X-Gitea-Event"}
+
+// pollSource is the trigger of the periodic syncs, which gives way to any other
+const pollSource = "timer"
+
+// Triggers queues the requested syncs until one of them is done
+var Triggers = NewTriggerStore("")
+
+// Trigger is a request for a sync, with what's known about where it came from
+type Trigger struct {
+	ID       string            `json:"id"`
+	Source   string            `json:"source"`
+	At       time.Time         `json:"at"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// TriggerStore is the queue of pending triggers. All the pending ones are handled by the next sync,
+// and they're only removed once a sync after them goes through, so each is processed at least once.
+// With a directory, each one is also written there until it's done, so the triggers accepted before a
+// crash or restart are processed on startup
+type TriggerStore struct {
+	dir   string
+	ready chan struct{}
+
+	mu      sync.Mutex
+	pending []Trigger
+	taken   map[string]bool
+	seq     int
+}
+
+// NewTriggerStore loads the triggers left in dir. Without a dir, they're only kept in memory
+func NewTriggerStore(dir string) *TriggerStore {
+	s := &TriggerStore{dir: dir, ready: make(chan struct{}, 1), taken: make(map[string]bool)}
+	if dir == "" {
+		return s
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("failed to read pending triggers: %v\n", err)
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			log.Printf("failed to read pending trigger %s: %v\n", entry.Name(), err)
+			continue
+		}
+		var trigger Trigger
+		if err := json.Unmarshal(content, &trigger); err != nil {
+			log.Printf("ignoring invalid pending trigger %s: %v\n", entry.Name(), err)
+			os.Remove(filepath.Join(dir, entry.Name()))
+			continue
+		}
+		s.pending = append(s.pending, trigger)
+	}
+	sort.Slice(s.pending, func(i, j int) bool {
+		return s.pending[i].At.Before(s.pending[j].At)
+	})
+	return s
+}
+
+// Ready receives when there are new triggers. Several triggers may be behind a single receive
+func (s *TriggerStore) Ready() <-chan struct{} {
+	return s.ready
+}
+
+// Add queues a trigger, persisting it if there's a directory. A trigger from the same source and
+// delivery as a pending one is coalesced into it, unless its sync already started
+func (s *TriggerStore) Add(source string, metadata map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.notify()
+	for _, pending := range s.pending {
+		if !s.taken[pending.ID] && pending.Source == source && pending.Metadata["delivery"] == metadata["delivery"] {
+			log.Printf("a sync from %s is already pending, coalescing\n", source)
+			removePayload(metadata)
+			return nil
+		}
+	}
+	trigger := s.newTrigger(source, metadata)
+	s.pending = append(s.pending, trigger)
+
+	if s.dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(s.dir, 0o700); err != nil {
+		return fmt.Errorf("failed to persist trigger: %w", err)
+	}
+	content, err := json.Marshal(trigger)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, trigger.ID+".json")
+	if err := os.WriteFile(path+".tmp", content, 0o600); err != nil {
+		return fmt.Errorf("failed to persist trigger: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to persist trigger: %w", err)
+	}
+	return nil
+}
+
+// Poll queues a periodic sync, unless other triggers are already pending. It isn't persisted, since
+// there's a sync on startup anyway
+func (s *TriggerStore) Poll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		s.pending = append(s.pending, s.newTrigger(pollSource, nil))
+	}
+}
+
+// newTrigger must be called with the lock held
+func (s *TriggerStore) newTrigger(source string, metadata map[string]string) Trigger {
+	s.seq++
+	now := time.Now()
+	return Trigger{
+		ID:       fmt.Sprintf("%d-%d", now.UnixNano(), s.seq),
+		Source:   source,
+		At:       now,
+		Metadata: metadata,
+	}
+}
+
+func (s *TriggerStore) notify() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take returns the triggers not done yet, oldest first, for a sync that's about to start. They stay
+// pending until Done
+func (s *TriggerStore) Take() []Trigger {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, trigger := range s.pending {
+		s.taken[trigger.ID] = true
+	}
+	return append([]Trigger(nil), s.pending...)
+}
+
+// Done removes the triggers, once a sync after them went through
+func (s *TriggerStore) Done(triggers []Trigger) {
+	if len(triggers) == 0 {
+		return
+	}
+	done := make(map[string]bool, len(triggers))
+	for _, trigger := range triggers {
+		done[trigger.ID] = true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var pending []Trigger
+	for _, trigger := range s.pending {
+		if !done[trigger.ID] {
+			pending = append(pending, trigger)
+			continue
+		}
+		delete(s.taken, trigger.ID)
+		removePayload(trigger.Metadata)
+		if s.dir != "" {
+			err := os.Remove(filepath.Join(s.dir, trigger.ID+".json"))
+			if err != nil && !os.IsNotExist(err) {
+				log.Printf("failed to remove done trigger %s: %v\n", trigger.ID, err)
+			}
+		}
+	}
+	s.pending = pending
+}
+
+// removePayload removes the webhook payload saved for a trigger, if any
+func removePayload(metadata map[string]string) {
+	if path := metadata["payload"]; path != "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			log.Printf("failed to remove webhook payload %s: %v\n", path, err)
+		}
+	}
+}
+
+// primarySource is what the sync of the triggers is attributed to: the first one that isn't the timer
+func primarySource(triggers []Trigger) string {
+	for _, trigger := range triggers {
+		if trigger.Source != pollSource {
+			return trigger.Source
+		}
+	}
+	return pollSource
+}
+
+// webhookMetadata picks the delivery ID and event kind of a webhook request
+func webhookMetadata(r *http.Request) map[string]string {
+	metadata := make(map[string]string)
+	for _, header := range deliveryHeaders {
+		if value := r.Header.Get(header); value != "" {
+			metadata["delivery"] = value
+			break
+		}
+	}
+	for _, header := range eventHeaders {
+		if value := r.Header.Get(header); value != "" {
+			metadata["event"] = value
+			break
+		}
+	}
+	return metadata
+}
+
+// triggerSources describes the triggers for the logs, like "webhook (delivery=abc), api"
+func triggerSources(triggers []Trigger) string {
+	sources := make([]string, len(triggers))
+	for i, trigger := range triggers {
+		sources[i] = trigger.Source
+		if len(trigger.Metadata) > 0 {
+			var fields []string
+			for _, key := range sortedKeys(trigger.Metadata) {
+				fields = append(fields, key+"="+trigger.Metadata[key])
+			}
+			sources[i] += " (" + strings.Join(fields, " ") + ")"
+		}
+	}
+	return strings.Join(sources, ", ")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTriggerStorePersists(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "triggers")
+	store := NewTriggerStore(dir)
+	if err := store.Add("webhook", map[string]string{"delivery": "abc", "event": "push"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Add("api", nil); err != nil {
+		t.Fatal(err)
+	}
+	writeTree(t, dir, map[string]string{"broken.json": "{", "notes.txt": "not a trigger"})
+
+	// a restart finds them in order, skipping and removing the invalid ones
+	reloaded := NewTriggerStore(dir)
+	pending := reloaded.Take()
+	if got := triggerSources(pending); got != "webhook (delivery=abc event=push), api" {
+		t.Errorf("reloaded %s", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "broken.json")); !os.IsNotExist(err) {
+		t.Errorf("the invalid trigger wasn't removed: %v", err)
+	}
+
+	reloaded.Done(pending[:1])
+	if got := reloaded.Take(); len(got) != 1 || got[0].Source != "api" {
+		t.Errorf("pending after done: %+v", got)
+	}
+	if _, err := os.Stat(filepath.Join(dir, pending[0].ID+".json")); !os.IsNotExist(err) {
+		t.Errorf("the done trigger is still persisted: %v", err)
+	}
+	if got := NewTriggerStore(dir).Take(); len(got) != 1 || got[0].Source != "api" {
+		t.Errorf("reloaded after done: %+v", got)
+	}
+}
+
+func TestTriggerStoreCoalesces(t *testing.T) {
+	store := NewTriggerStore("")
+	add := func(source, delivery string) {
+		t.Helper()
+		var metadata map[string]string
+		if delivery != "" {
+			metadata = map[string]string{"delivery": delivery}
+		}
+		if err := store.Add(source, metadata); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	add("api", "")
+	add("api", "")
+	add("webhook", "1")
+	add("webhook", "1")
+	add("webhook", "2")
+	taken := store.Take()
+	if got := triggerSources(taken); got != "api, webhook (delivery=1), webhook (delivery=2)" {
+		t.Errorf("queued %s", got)
+	}
+	select {
+	case <-store.Ready():
+	default:
+		t.Errorf("not ready after the triggers")
+	}
+	select {
+	case <-store.Ready():
+		t.Errorf("ready once per trigger rather than once for all of them")
+	default:
+	}
+
+	// the sync of the taken triggers already started, so a new one has to wait for the next
+	add("api", "")
+	store.Done(taken)
+	if got := triggerSources(store.Take()); got != "api" {
+		t.Errorf("pending after done: %s", got)
+	}
+}
+
+func TestTriggerStorePoll(t *testing.T) {
+	store := NewTriggerStore("")
+	store.Poll()
+	store.Poll()
+	taken := store.Take()
+	if got := triggerSources(taken); got != pollSource {
+		t.Errorf("polled %s", got)
+	}
+	if got := primarySource(taken); got != pollSource {
+		t.Errorf("attributed the poll to %s", got)
+	}
+
+	// the timer gives way to the other triggers
+	if err := store.Add("webhook", nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Poll()
+	taken = store.Take()
+	if got := triggerSources(taken); got != "timer, webhook" {
+		t.Errorf("queued %s", got)
+	}
+	if got := primarySource(taken); got != "webhook" {
+		t.Errorf("attributed the sync to %s, want webhook", got)
+	}
+	store.Done(taken)
+	if got := store.Take(); len(got) != 0 {
+		t.Errorf("pending after done: %+v", got)
+	}
+}
@@ -0,0 +1,179 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ttySession is the pseudo-terminal of the application with --tty
+type ttySession struct {
+	pty *os.File
+	// tty is the application's side, only open here until it started
+	tty *os.File
+}
+
+// terminal relays this process's terminal to the pseudo-terminal of the running application
+var terminal struct {
+	mu       sync.Mutex
+	current  *ttySession
+	started  bool
+	restore  *unix.Termios
+	resizeCh chan os.Signal
+}
+
+// attachTTY gives the command a new pseudo-terminal as its stdin, stdout, stderr and controlling
+// terminal, in a new session whose process group is still the one of the application
+func attachTTY(cmd *exec.Cmd) (*ttySession, error) {
+	pty, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a pseudo-terminal: %w", err)
+	}
+	var number int
+	err = fdControl(pty, func(fd int) error {
+		if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+			return err
+		}
+		number, err = unix.IoctlGetInt(fd, unix.TIOCGPTN)
+		return err
+	})
+	if err != nil {
+		pty.Close()
+		return nil, fmt.Errorf("failed to unlock the pseudo-terminal: %w", err)
+	}
+	tty, err := os.OpenFile("/dev/pts/"+strconv.Itoa(number), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		pty.Close()
+		return nil, fmt.Errorf("failed to open the pseudo-terminal: %w", err)
+	}
+
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = tty, tty, tty
+	// setsid makes the application the leader of its process group too, which can't be done twice
+	cmd.SysProcAttr.Setpgid = false
+	cmd.SysProcAttr.Setsid = true
+	cmd.SysProcAttr.Setctty = true
+	cmd.SysProcAttr.Ctty = 0
+	session := &ttySession{pty: pty, tty: tty}
+	session.resize()
+	return session, nil
+}
+
+// started relays the terminal to the application once it's running
+func (s *ttySession) started() {
+	s.tty.Close()
+	go io.Copy(os.Stdout, s.pty)
+
+	terminal.mu.Lock()
+	defer terminal.mu.Unlock()
+	terminal.current = s
+	if terminal.started {
+		return
+	}
+	terminal.started = true
+	makeInputRaw()
+	go relayStdin()
+	terminal.resizeCh = make(chan os.Signal, 1)
+	signal.Notify(terminal.resizeCh, syscall.SIGWINCH)
+	go func() {
+		for range terminal.resizeCh {
+			terminal.mu.Lock()
+			if terminal.current != nil {
+				terminal.current.resize()
+			}
+			terminal.mu.Unlock()
+		}
+	}()
+}
+
+// close releases the pseudo-terminal once the application exited
+func (s *ttySession) close() {
+	terminal.mu.Lock()
+	if terminal.current == s {
+		terminal.current = nil
+	}
+	terminal.mu.Unlock()
+	s.tty.Close()
+	s.pty.Close()
+}
+
+// resize gives the pseudo-terminal the size of this process's terminal, if it has one
+func (s *ttySession) resize() {
+	size, err := unix.IoctlGetWinsize(int(os.Stdin.Fd()), unix.TIOCGWINSZ)
+	if err != nil {
+		return
+	}
+	fdControl(s.pty, func(fd int) error {
+		return unix.IoctlSetWinsize(fd, unix.TIOCSWINSZ, size)
+	})
+}
+
+// relayStdin copies this process's stdin to the application running at the time
+func relayStdin() {
+	buf := make([]byte, 4096)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if n > 0 {
+			terminal.mu.Lock()
+			if terminal.current != nil {
+				terminal.current.pty.Write(buf[:n])
+			}
+			terminal.mu.Unlock()
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// makeInputRaw passes the keys typed in this process's terminal, if it has one, to the application
+// as they're typed, Ctrl-C included. The output is still processed, so the logs stay readable
+func makeInputRaw() {
+	fd := int(os.Stdin.Fd())
+	termios, err := unix.IoctlGetTermios(fd, unix.TCGETS)
+	if err != nil {
+		return
+	}
+	saved := *termios
+	termios.Iflag &^= unix.IGNBRK | unix.BRKINT | unix.PARMRK | unix.ISTRIP | unix.INLCR | unix.IGNCR | unix.ICRNL | unix.IXON
+	termios.Lflag &^= unix.ECHO | unix.ECHONL | unix.ICANON | unix.ISIG | unix.IEXTEN
+	termios.Cc[unix.VMIN] = 1
+	termios.Cc[unix.VTIME] = 0
+	if err := unix.IoctlSetTermios(fd, unix.TCSETS, termios); err != nil {
+		log.Printf("failed to put the terminal in raw mode: %v\n", err)
+		return
+	}
+	terminal.restore = &saved
+}
+
+// restoreTerminal puts this process's terminal back the way it was before --tty changed it
+func restoreTerminal() {
+	terminal.mu.Lock()
+	defer terminal.mu.Unlock()
+	if terminal.restore != nil {
+		unix.IoctlSetTermios(int(os.Stdin.Fd()), unix.TCSETS, terminal.restore)
+		terminal.restore = nil
+	}
+}
+
+// fdControl runs f on the descriptor of the file without making it blocking, as Fd would
+func fdControl(file *os.File, f func(fd int) error) error {
+	conn, err := file.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := conn.Control(func(fd uintptr) { ferr = f(int(fd)) }); err != nil {
+		return err
+	}
+	return ferr
+}
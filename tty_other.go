@@ -0,0 +1,21 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+// ttySession is the pseudo-terminal of the application with --tty, only on Linux
+type ttySession struct{}
+
+func attachTTY(cmd *exec.Cmd) (*ttySession, error) {
+	return nil, errors.New("--tty is only supported on Linux")
+}
+
+func (s *ttySession) started() {}
+
+func (s *ttySession) close() {}
+
+func restoreTerminal() {}
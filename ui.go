@@ -0,0 +1,31 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"log"
+	"net/http"
+)
+
+//go:embed ui/index.html
+var dashboardHTML string
+
+var dashboardTemplate = template.Must(template.New("dashboard").Parse(dashboardHTML))
+
+// registerDashboard serves the web dashboard on /ui/. The page itself holds no data: it calls the
+// authenticated API endpoints with the token entered by the user
+func registerDashboard(mux *http.ServeMux, tokenHeader string) {
+	mux.Handle("/ui", http.RedirectHandler("/ui/", http.StatusMovedPermanently))
+	mux.HandleFunc("/ui/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := dashboardTemplate.Execute(w, struct{ TokenHeader string }{tokenHeader})
+		if err != nil {
+			log.Printf("failed to render dashboard: %v\n", err)
+		}
+	})
+}
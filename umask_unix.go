@@ -0,0 +1,12 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+const umaskSupported = true
+
+// setUmask sets the umask of the process, returning the previous one
+func setUmask(mask int) int {
+	return syscall.Umask(mask)
+}
@@ -0,0 +1,8 @@
+package main
+
+// Windows has no umask, the permissions of new files come from the ACLs
+const umaskSupported = false
+
+func setUmask(mask int) int {
+	return 0
+}
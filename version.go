@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Build information, set with -ldflags "-X main.version=... -X main.buildCommit=... -X main.buildDate=..."
+var (
+	version     = "dev"
+	buildCommit = ""
+	buildDate   = ""
+)
+
+const releasesURL = "https://api.github.com/repos/diogenes1oliveira/git-config-server/releases/latest"
+
+// BuildInfo describes this binary
+type BuildInfo struct {
+	Version      string `json:"version"`
+	Commit       string `json:"commit,omitempty"`
+	Date         string `json:"date,omitempty"`
+	GoVersion    string `json:"go_version"`
+	GoGitVersion string `json:"go_git_version,omitempty"`
+}
+
+// GetBuildInfo returns the stamped build information, falling back to what the Go toolchain embedded
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   version,
+		Commit:    buildCommit,
+		Date:      buildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	buildInfo, ok := debug.ReadBuildInfo()
+	if !ok {
+		return info
+	}
+	for _, setting := range buildInfo.Settings {
+		switch {
+		case setting.Key == "vcs.revision" && info.Commit == "":
+			info.Commit = setting.Value
+		case setting.Key == "vcs.time" && info.Date == "":
+			info.Date = setting.Value
+		}
+	}
+	for _, dep := range buildInfo.Deps {
+		if dep.Path == "github.com/go-git/go-git/v5" {
+			info.GoGitVersion = dep.Version
+		}
+	}
+	return info
+}
+
+func (info BuildInfo) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "git-config-server %s\n", info.Version)
+	fmt.Fprintf(&b, "commit:  %s\n", info.Commit)
+	fmt.Fprintf(&b, "built:   %s\n", info.Date)
+	fmt.Fprintf(&b, "go:      %s\n", info.GoVersion)
+	fmt.Fprintf(&b, "go-git:  %s\n", info.GoGitVersion)
+	return b.String()
+}
+
+// CheckForUpdate looks up the latest GitHub release, returning its tag and whether it's newer than this binary
+func CheckForUpdate(ctx context.Context) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, releasesURL, nil)
+	if err != nil {
+		return "", false, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", false, fmt.Errorf("failed to fetch the latest release: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", false, fmt.Errorf("failed to fetch the latest release: status %d", resp.StatusCode)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&release); err != nil {
+		return "", false, fmt.Errorf("failed to parse the latest release: %w", err)
+	}
+
+	return release.TagName, versionLess(version, release.TagName), nil
+}
+
+// logUpdateCheck checks for updates in the background, only logging the outcome
+func logUpdateCheck(ctx context.Context) {
+	go func() {
+		latest, newer, err := CheckForUpdate(ctx)
+		if err != nil {
+			log.Printf("update check failed: %v\n", err)
+			return
+		}
+		if newer {
+			log.Printf("a newer version is available: %s (running %s)\n", latest, version)
+		}
+	}()
+}
+
+// versionLess compares dotted versions like v1.2.3 numerically. Unparseable versions (like dev builds)
+// are never considered outdated
+func versionLess(current, latest string) bool {
+	currentParts, ok := parseVersion(current)
+	if !ok {
+		return false
+	}
+	latestParts, ok := parseVersion(latest)
+	if !ok {
+		return false
+	}
+	for i := 0; i < len(currentParts) && i < len(latestParts); i++ {
+		if currentParts[i] != latestParts[i] {
+			return currentParts[i] < latestParts[i]
+		}
+	}
+	return len(currentParts) < len(latestParts)
+}
+
+func parseVersion(v string) ([]int, bool) {
+	v = strings.TrimPrefix(v, "v")
+	if i := strings.IndexAny(v, "-+"); i >= 0 {
+		v = v[:i]
+	}
+	var parts []int
+	for _, field := range strings.Split(v, ".") {
+		n, err := strconv.Atoi(field)
+		if err != nil {
+			return nil, false
+		}
+		parts = append(parts, n)
+	}
+	return parts, true
+}
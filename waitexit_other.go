@@ -0,0 +1,11 @@
+//go:build !linux && !windows
+
+package main
+
+import "errors"
+
+// waitExited can't wait for the child without reaping it here, so the leftovers of its process group
+// aren't killed
+func waitExited(pid int) error {
+	return errors.ErrUnsupported
+}
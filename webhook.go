@@ -2,123 +2,291 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"strings"
 	"time"
 )
 
+// WebhookServer is a handle to a running webhook server
+type WebhookServer struct {
+	server *http.Server
+	errs   chan error
+}
+
+// ListenerError is a listener of the webhook server failing after the startup. The others keep serving
+type ListenerError struct {
+	Network string
+	Address string
+	Err     error
+}
+
+func (e *ListenerError) Error() string {
+	return fmt.Sprintf("webhook server stopped serving on %s: %v", e.Address, e.Err)
+}
+
+func (e *ListenerError) Unwrap() error {
+	return e.Err
+}
+
+// controlSocketKey marks requests that came through the control socket
+type controlSocketKey struct{}
+
 // StartWebhookServer starts a simple http server to listen to POST requests.
 //
-// ctx is a context that can be used to stop the server.
+// port is the port to bind the webhook to. If 0, no TCP port is bound.
+//
+// socketPath is a Unix socket to also serve the API on, for local control. Requests through it
+// are protected by the file permissions instead of the token. If empty, no socket is created.
+//
+// verifier, if set, requires the webhook deliveries on webhookPath to be signed, refusing replays. The
+// token isn't enough then, since a captured request could be sent again.
+//
+// webhookPath is where the webhook deliveries trigger syncs, / for any path the API doesn't take.
 //
-// port is the port to bind the webhook to.
+// routes are extra paths for the deliveries of specific providers, checked with their own secret.
 //
-// onInvoked is a function to be called when a valid request is received.
-func StartWebhookServer(ctx context.Context, port int, tokenHeader, tokenValue string, onInvoked func() error) error {
+// actions are the functions to be called when a valid request is received.
+//
+// Binding fails right away, while the listeners failing later are reported on Err.
+func StartWebhookServer(port int, socketPath string, tokenHeader string, tokens APITokens, tenants Tenants, verifier *WebhookVerifier, webhookPath string, routes []*WebhookRoute, actions APIActions) (*WebhookServer, error) {
 	mux := http.NewServeMux()
+
+	authorized := func(r *http.Request, scope Scope) bool {
+		if r.Context().Value(controlSocketKey{}) != nil {
+			return true
+		}
+		// without tokens, the API only triggers syncs
+		if tokenHeader == "" {
+			return scope == ScopeTrigger
+		}
+		return tokens.Allows(r.Header.Get(tokenHeader), scope)
+	}
+
+	registerAPIHandlers(mux, authorized, actions)
+	registerDashboard(mux, tokenHeader)
+	registerWebSocket(mux, tokenHeader, authorized)
+	registerMergeHandlers(mux, authorized)
+	registerSigningKey(mux)
+	registerFileHandlers(mux, func(r *http.Request, scope Scope) bool {
+		if authorized(r, scope) {
+			return true
+		}
+		_, ok := tenants.Authorize(r.Header.Get(tokenHeader), strings.TrimPrefix(r.URL.Path, "/files/"))
+		return ok
+	})
+
+	// the main path takes the secret of --webhook-secret, or the token
+	verify := func(r *http.Request, body []byte) error {
+		if verifier != nil && r.Context().Value(controlSocketKey{}) == nil {
+			return verifier.Verify(r, body)
+		}
+		if !authorized(r, ScopeTrigger) {
+			return errNotAuthorized
+		}
+		return nil
+	}
+	trigger := webhookHandler(actions, "", verify)
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		status := http.StatusOK
-		defer func() {
-			printLog(r, status)
-		}()
-
-		if r.Method == "GET" && strings.Contains(r.RequestURI, "/health") {
-			w.WriteHeader(http.StatusOK)
-			w.Write([]byte("OK"))
+		if webhookPath != "/" {
+			http.NotFound(w, r)
 			return
 		}
+		trigger(w, r)
+	})
+	if webhookPath != "/" {
+		if err := registerWebhookRoute(mux, webhookPath, trigger); err != nil {
+			return nil, err
+		}
+	}
+	for _, route := range routes {
+		route := route
+		handler := webhookHandler(actions, route.Provider, func(r *http.Request, body []byte) error {
+			if r.Context().Value(controlSocketKey{}) != nil {
+				return nil
+			}
+			return route.Verify(r, body, func(r *http.Request) bool {
+				return authorized(r, ScopeTrigger)
+			})
+		})
+		if err := registerWebhookRoute(mux, route.Path, handler); err != nil {
+			return nil, err
+		}
+		log.Printf("%s webhooks accepted on %s\n", route.Provider, route.Path)
+	}
 
-		if r.Method != http.MethodPost {
-			status = http.StatusMethodNotAllowed
-			http.Error(w, "Invalid request method", status)
+	var listeners []net.Listener
+	if port != 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+		if err != nil {
+			return nil, fmt.Errorf("failed to listen on %d: %w", port, err)
+		}
+		log.Printf("starting webhook server on :%d", port)
+		listeners = append(listeners, listener)
+	}
+	if socketPath != "" {
+		listener, err := listenControlSocket(socketPath)
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, err
+		}
+		log.Printf("starting control socket on %s", socketPath)
+		listeners = append(listeners, listener)
+	}
+
+	// long-polling requests watch the base context, which is cancelled as soon as the shutdown starts
+	baseCtx, cancelBase := context.WithCancel(context.Background())
+	server := &http.Server{
+		Handler:           AccessLog.Handler(mux, RateLimit.Handler(mux)),
+		ReadHeaderTimeout: Options.ReadHeaderTimeout,
+		ReadTimeout:       Options.ReadTimeout,
+		WriteTimeout:      Options.WriteTimeout,
+		IdleTimeout:       Options.IdleTimeout,
+		MaxHeaderBytes:    int(Options.MaxHeaderBytes),
+		BaseContext:       func(net.Listener) context.Context { return baseCtx },
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			if _, ok := c.(*net.UnixConn); ok {
+				return context.WithValue(ctx, controlSocketKey{}, true)
+			}
+			return ctx
+		},
+	}
+
+	server.RegisterOnShutdown(cancelBase)
+
+	webhookServer := &WebhookServer{server: server, errs: make(chan error, len(listeners))}
+	for _, listener := range listeners {
+		go webhookServer.serve(listener)
+	}
+	return webhookServer, nil
+}
+
+// serve serves on the listener until the shutdown, reporting the failures on Err
+func (s *WebhookServer) serve(listener net.Listener) {
+	addr := listener.Addr()
+	if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		s.errs <- &ListenerError{Network: addr.Network(), Address: addr.String(), Err: err}
+	}
+}
+
+// Err receives the listeners failing after the startup. It never receives anything for a nil server
+func (s *WebhookServer) Err() <-chan error {
+	if s == nil {
+		return nil
+	}
+	return s.errs
+}
+
+// Relisten binds the address of the failed listener again, retrying with a growing delay until it
+// works or ctx is cancelled, then serves on it
+func (s *WebhookServer) Relisten(ctx context.Context, failed *ListenerError) {
+	delay := time.Second
+	for {
+		var listener net.Listener
+		var err error
+		if failed.Network == "unix" {
+			listener, err = listenControlSocket(failed.Address)
+		} else {
+			listener, err = net.Listen(failed.Network, failed.Address)
+		}
+		if err == nil {
+			log.Printf("serving on %s again\n", failed.Address)
+			go s.serve(listener)
 			return
 		}
+		log.Printf("failed to listen on %s again, retrying in %v: %v\n", failed.Address, delay, err)
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, 30*time.Second)
+	}
+}
 
-		if tokenHeader != "" {
-			headerValue := r.Header.Get(tokenHeader)
-			headerValue = strings.TrimSpace(headerValue)
+// webhookHandler triggers a sync for the deliveries verify accepts, recording the provider of the
+// route, if any, in the trigger
+func webhookHandler(actions APIActions, provider string, verify func(r *http.Request, body []byte) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
+			return
+		}
 
-			if headerValue != tokenValue {
-				status = http.StatusForbidden
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBody))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := verify(r, body); err != nil {
+			status := http.StatusForbidden
+			switch {
+			case errors.Is(err, errNotAuthorized):
 				http.Error(w, "Not authorized", status)
 				return
+			case errors.Is(err, errReplayed):
+				status = http.StatusConflict
+			}
+			log.Printf("refused webhook: %v\n", err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+
+		metadata := webhookMetadata(r)
+		metadata["client"] = Proxies.ClientAddr(r)
+		if provider != "" {
+			metadata["provider"] = provider
+		}
+		if len(body) > 0 {
+			for key, value := range parseWebhookPayload(body) {
+				metadata[key] = value
+			}
+			if path, err := Triggers.SavePayload(body); err != nil {
+				log.Printf("%v\n", err)
+			} else {
+				metadata["payload"] = path
 			}
 		}
 
 		log.Printf("invoking webhook handler\n")
-		err := onInvoked()
+		err = actions.Sync("webhook", metadata)
 		if err != nil {
 			log.Printf("webhook handler failed: %v\n", err)
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 		w.WriteHeader(http.StatusOK)
-	})
-
-	server := &http.Server{
-		Addr:    fmt.Sprintf(":%d", port),
-		Handler: mux,
-	}
-
-	go func() {
-		<-ctx.Done()
-		log.Printf("stopping webhook server")
-		if err := server.Shutdown(context.Background()); err != nil {
-			log.Printf("webhook server shutdown: %v", err)
-		}
-	}()
-
-	errCh := make(chan error)
-
-	go func() {
-		defer close(errCh)
-
-		log.Printf("starting webhook server on :%d", port)
-		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Printf("failed to listen on %d: %v", port, err)
-		}
-	}()
-
-	select {
-	case err := <-errCh:
-		return err
-	case <-time.After(1 * time.Second):
-		return nil
 	}
 }
 
-func printLog(r *http.Request, statusCode int) {
-	remoteAddr := r.RemoteAddr
-	if remoteAddr == "" {
-		remoteAddr = "-"
+// listenControlSocket binds the Unix socket, replacing a stale one left by a previous run
+func listenControlSocket(socketPath string) (net.Listener, error) {
+	if err := os.Remove(socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale control socket %s: %w", socketPath, err)
 	}
-
-	method := r.Method
-	if method == "" {
-		method = "-"
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on control socket %s: %w", socketPath, err)
 	}
-
-	uri := r.RequestURI
-	if uri == "" {
-		uri = "-"
+	if err := os.Chmod(socketPath, 0o600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to restrict control socket %s: %w", socketPath, err)
 	}
+	return listener, nil
+}
 
-	protocol := r.Proto
-	if protocol == "" {
-		protocol = "-"
+// Shutdown stops accepting new requests and waits for the in-flight ones to finish
+func (s *WebhookServer) Shutdown(ctx context.Context) error {
+	log.Printf("stopping webhook server")
+	if err := s.server.Shutdown(ctx); err != nil {
+		return fmt.Errorf("webhook server shutdown: %w", err)
 	}
-
-	logEntry := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d -",
-		remoteAddr,
-		time.Now().Format("02/Jan/2006:15:04:05 -0700"),
-		method,
-		uri,
-		protocol,
-		statusCode,
-	)
-
-	fmt.Fprintln(os.Stderr, logEntry)
+	return nil
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+)
+
+// errNotAuthorized is returned for the deliveries without the right token
+var errNotAuthorized = errors.New("not authorized")
+
+// webhookProviders are the providers a route can check the deliveries of
+var webhookProviders = []string{"github", "gitlab", "gitea", "generic"}
+
+// WebhookRoute is an extra path triggering syncs, whose deliveries are checked the way their provider
+// signs them: github with X-Hub-Signature-256, gitea with X-Gitea-Signature, gitlab with X-Gitlab-Token.
+// generic routes take the token of --webhook-token-header, like the main path
+type WebhookRoute struct {
+	Provider string
+	Path     string
+	verifier *WebhookVerifier
+	secret   string
+}
+
+// cleanWebhookPath checks --webhook-path is absolute, cleaning it
+func cleanWebhookPath(webhookPath string) (string, error) {
+	if !strings.HasPrefix(webhookPath, "/") {
+		return "", fmt.Errorf("invalid --webhook-path %q, it must start with /", webhookPath)
+	}
+	return path.Clean(webhookPath), nil
+}
+
+// ParseWebhookRoute parses a provider:path:secret spec. The secret is everything after the second
+// colon, and only generic routes go without one
+func ParseWebhookRoute(spec string, replayWindow time.Duration) (*WebhookRoute, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) < 2 || !strings.HasPrefix(parts[1], "/") {
+		return nil, fmt.Errorf("invalid webhook route %q, expected provider:/path:secret", spec)
+	}
+	route := &WebhookRoute{Provider: parts[0], Path: path.Clean(parts[1])}
+	if len(parts) == 3 {
+		route.secret = parts[2]
+	}
+	if !slices.Contains(webhookProviders, route.Provider) {
+		return nil, fmt.Errorf("invalid webhook route %q, the provider must be one of %s", spec, strings.Join(webhookProviders, ", "))
+	}
+	if route.secret == "" && route.Provider != "generic" {
+		return nil, fmt.Errorf("invalid webhook route %q, %s routes need a secret", spec, route.Provider)
+	}
+	route.verifier = NewWebhookVerifier(route.secret, replayWindow)
+	return route, nil
+}
+
+// Verify checks the delivery was sent by the provider, refusing replays. authorized checks the token
+// of generic routes
+func (route *WebhookRoute) Verify(r *http.Request, body []byte, authorized func(r *http.Request) bool) error {
+	switch route.Provider {
+	case "github":
+		return route.verifier.Verify(r, body)
+	case "gitea":
+		signature := r.Header.Get("X-Gitea-Signature")
+		if !route.verifier.valid("sha256="+signature, body) {
+			return errBadSignature
+		}
+		return route.verifier.rememberDelivery(r, signature, time.Time{})
+	case "gitlab":
+		token := r.Header.Get("X-Gitlab-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(route.secret)) != 1 {
+			return fmt.Errorf("%w: wrong X-Gitlab-Token", errBadSignature)
+		}
+		// the token doesn't cover the body, so only the delivery ID tells a replay
+		if id := deliveryID(r); id != "" {
+			return route.verifier.remember([]string{id}, time.Time{})
+		}
+		return nil
+	}
+	if !authorized(r) {
+		return errNotAuthorized
+	}
+	return nil
+}
+
+// registerWebhookRoute adds the handler of a path triggering syncs, refusing the paths already taken
+func registerWebhookRoute(mux *http.ServeMux, routePath string, handler http.HandlerFunc) error {
+	if routePath != "/" {
+		if _, pattern := mux.Handler(&http.Request{Method: http.MethodPost, URL: &url.URL{Path: routePath}}); pattern == routePath {
+			return fmt.Errorf("webhook path %s is already taken", routePath)
+		}
+	}
+	mux.HandleFunc(routePath, handler)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/net/websocket"
+)
+
+// appliedMessage is pushed to the /ws clients for every applied sync or rollback
+type appliedMessage struct {
+	Type     EventType    `json:"type"`
+	Time     time.Time    `json:"time"`
+	Source   string       `json:"source,omitempty"`
+	Commit   CommitInfo   `json:"commit"`
+	Previous string       `json:"previous_commit,omitempty"`
+	Changes  *SyncChanges `json:"changes,omitempty"`
+}
+
+// registerWebSocket serves /ws, pushing a JSON message per applied change. Browsers can't set headers
+// on the handshake, so the token is also accepted in the token query parameter
+func registerWebSocket(mux *http.ServeMux, tokenHeader string, authorized func(r *http.Request, scope Scope) bool) {
+	server := websocket.Server{
+		// the token check replaces the origin check, as non-browser clients don't send one. Without a
+		// token, browsers must come from a page of this server so other sites can't read the changes
+		Handshake: func(config *websocket.Config, r *http.Request) error {
+			if tokenHeader != "" {
+				return nil
+			}
+			return checkSameOrigin(r)
+		},
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+			// the connection outlives the request, so the timeouts of the server don't apply
+			ws.SetDeadline(time.Time{})
+			serveAppliedChanges(ws)
+		},
+	}
+
+	mux.Handle("/ws", apiHandler(http.MethodGet, ScopeRead, func(r *http.Request, scope Scope) bool {
+		if token := r.URL.Query().Get("token"); token != "" && tokenHeader != "" {
+			r.Header.Set(tokenHeader, token)
+		}
+		return authorized(r, scope)
+	}, server.ServeHTTP))
+}
+
+// checkSameOrigin refuses the handshakes whose Origin is another host than the one requested. Requests
+// without one don't come from a browser
+func checkSameOrigin(r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	u, err := url.Parse(origin)
+	if err != nil || !strings.EqualFold(u.Host, r.Host) {
+		return fmt.Errorf("cross-origin websocket handshake from %q refused", origin)
+	}
+	return nil
+}
+
+// serveAppliedChanges pushes the changes until the client disconnects or the server shuts down
+func serveAppliedChanges(ws *websocket.Conn) {
+	events, cancel := Events.Subscribe(EventSyncApplied, EventRolledBack)
+	defer cancel()
+
+	// clients aren't expected to send anything, reading only detects when they go away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		var discard []byte
+		for websocket.Message.Receive(ws, &discard) == nil {
+		}
+	}()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case <-ws.Request().Context().Done():
+			return
+		case event := <-events:
+			snapshot := CurrentStatus.Snapshot()
+			commitTime, _ := time.Parse(time.RFC3339, event.Fields["commit_time"])
+			authorTime, _ := time.Parse(time.RFC3339, event.Fields["author_time"])
+			message := appliedMessage{
+				Type:   event.Type,
+				Time:   event.Time,
+				Source: event.Source,
+				Commit: CommitInfo{
+					Hash:       event.Commit,
+					Author:     event.Fields["author"],
+					Email:      event.Fields["email"],
+					Subject:    event.Fields["subject"],
+					Time:       commitTime,
+					AuthorTime: authorTime,
+					Committer:  event.Fields["committer"],
+				},
+				Previous: snapshot.Previous,
+				Changes:  snapshot.LastChanges,
+			}
+			if err := websocket.JSON.Send(ws, message); err != nil {
+				log.Printf("failed to push change to %s: %v\n", Proxies.ClientAddr(ws.Request()), err)
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// LocalWrites watches the local folder for the writes of other processes. Nil unless --watch-writes is
+// set
+var LocalWrites *WriteWatcher
+
+// maxWrites bounds the paths written by other processes that are remembered until they're confirmed
+const maxWrites = 100
+
+// WriteWatcher notices the files of the local folder written by other processes between the applies,
+// like an application using it as scratch space. Its own writes are ignored while it's paused
+type WriteWatcher struct {
+	dir string
+	// block refuses the next apply until the writes are confirmed, instead of only warning
+	block bool
+	// ignored are paths written by the server itself, like --merge-output
+	ignored map[string]bool
+	// protected is true for the paths the .gitsync.yaml protects, which are meant to be written
+	protected func(slashPath string, isDir bool) bool
+
+	mu     sync.Mutex
+	paused int
+	// resumed is set once the writes of the server are over, until the events they queued are drained
+	resumed bool
+	// root is the watched directory, the one the local folder points to if it's a symlink
+	root      string
+	gitignore gitignore.Matcher
+	written   map[string]string
+}
+
+// NewWriteWatcher watches the local folder, ignoring the paths the server writes itself
+func NewWriteWatcher(mode, localFolder string, ignored []string, protected func(slashPath string, isDir bool) bool) *WriteWatcher {
+	if mode == "" || mode == "off" {
+		return nil
+	}
+	w := &WriteWatcher{
+		dir:       localFolder,
+		block:     mode == "block",
+		ignored:   make(map[string]bool),
+		protected: protected,
+		written:   make(map[string]string),
+	}
+	for _, path := range ignored {
+		w.ignored[path] = true
+	}
+	return w
+}
+
+// Pause ignores the writes until the returned function is called, for the applies and the hooks
+func (w *WriteWatcher) Pause() func() {
+	if w == nil {
+		return func() {}
+	}
+	w.mu.Lock()
+	w.paused++
+	w.mu.Unlock()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			w.mu.Lock()
+			defer w.mu.Unlock()
+			w.paused--
+			if w.paused == 0 {
+				w.resumed = true
+			}
+		})
+	}
+}
+
+// Check refuses the apply if other processes wrote to the local folder and it blocks
+func (w *WriteWatcher) Check() error {
+	if w == nil || !w.block {
+		return nil
+	}
+	if paths := w.Written(); len(paths) > 0 {
+		return &externalWriteError{paths: paths}
+	}
+	return nil
+}
+
+// Written lists the paths written by other processes since the writes were last confirmed
+func (w *WriteWatcher) Written() []string {
+	if w == nil {
+		return nil
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	paths := make([]string, 0, len(w.written))
+	for path := range w.written {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+// Confirm forgets the writes, letting the next apply overwrite them, returning their paths
+func (w *WriteWatcher) Confirm() []string {
+	paths := w.Written()
+	if w == nil {
+		return paths
+	}
+	w.mu.Lock()
+	w.written = make(map[string]string)
+	w.mu.Unlock()
+	if len(paths) > 0 {
+		log.Printf("confirmed the writes to %s of %s\n", w.dir, strings.Join(paths, ", "))
+	}
+	return paths
+}
+
+// ignoring is true while the server writes itself, or the events it queued aren't drained yet
+func (w *WriteWatcher) ignoring() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.paused > 0 || w.resumed
+}
+
+// takeResumed is true once after the server stopped writing, the events queued until then to be
+// drained and the directories watched again
+func (w *WriteWatcher) takeResumed() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.paused > 0 || !w.resumed {
+		return false
+	}
+	w.resumed = false
+	return true
+}
+
+// reset finds the watched directory again after an apply, which may have flipped the symlink or
+// changed the .gitignore
+func (w *WriteWatcher) reset() string {
+	root, err := filepath.EvalSymlinks(w.dir)
+	if err != nil {
+		root = w.dir
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.root = root
+	w.gitignore = loadGitignorePatterns(root)
+	return root
+}
+
+// record reports a write of another process to the path, once per path until they're confirmed
+func (w *WriteWatcher) record(path, op string, isDir bool) {
+	w.mu.Lock()
+	rel, err := filepath.Rel(w.root, path)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		w.mu.Unlock()
+		return
+	}
+	slashPath := filepath.ToSlash(rel)
+	_, seen := w.written[slashPath]
+	if seen || isGitMetadata(slashPath) || w.ignored[slashPath] || w.gitignore.Match(strings.Split(slashPath, "/"), isDir) ||
+		(w.protected != nil && w.protected(slashPath, isDir)) || len(w.written) >= maxWrites {
+		w.mu.Unlock()
+		return
+	}
+	w.written[slashPath] = op
+	w.mu.Unlock()
+
+	Metrics.Add("git_config_server_external_writes_total", 1)
+	if w.block {
+		log.Printf("another process %s %s in %s, the next apply waits for the writes to be confirmed\n", op, slashPath, w.dir)
+	} else {
+		log.Printf("another process %s %s in %s, which the next apply overwrites\n", op, slashPath, w.dir)
+	}
+	Events.Publish(Event{Type: EventExternalWrite, Fields: map[string]string{"path": slashPath, "op": op}})
+}
+
+// externalWriteError refuses an apply over the writes of other processes
+type externalWriteError struct {
+	paths []string
+}
+
+func (e *externalWriteError) Error() string {
+	return fmt.Sprintf("other processes wrote %s to the local folder since the last apply: confirm with POST /admin/writes/confirm to overwrite them", strings.Join(e.paths, ", "))
+}
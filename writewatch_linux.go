@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const writeWatchSupported = true
+
+// inotifyMask are the changes of the files and directories reported
+const inotifyMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_DELETE | unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_ATTRIB
+
+// Watch reports the writes of other processes to the local folder until the context is done
+func (w *WriteWatcher) Watch(ctx context.Context) error {
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	dirs := make(map[int]string)
+	watch := func(root string) {
+		filepath.WalkDir(root, func(path string, entry os.DirEntry, err error) error {
+			if err != nil || !entry.IsDir() {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			if isGitMetadata(filepath.ToSlash(rel)) {
+				return filepath.SkipDir
+			}
+			wd, err := unix.InotifyAddWatch(fd, path, inotifyMask)
+			if err != nil {
+				log.Printf("failed to watch %s: %v\n", path, err)
+				return nil
+			}
+			dirs[wd] = path
+			return nil
+		})
+	}
+	watch(w.reset())
+
+	buf := make([]byte, 64*1024)
+	for ctx.Err() == nil {
+		if w.takeResumed() {
+			// the events of the apply are still queued
+			for {
+				if _, err := unix.Read(fd, buf); err != nil {
+					break
+				}
+			}
+			watch(w.reset())
+		}
+		fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+		if n, err := unix.Poll(fds, 500); err != nil && !errors.Is(err, unix.EINTR) {
+			return err
+		} else if n == 0 {
+			continue
+		}
+		n, err := unix.Read(fd, buf)
+		if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		ignoring := w.ignoring()
+		for offset := 0; offset+unix.SizeofInotifyEvent <= n; {
+			event := (*unix.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+unix.SizeofInotifyEvent : offset+unix.SizeofInotifyEvent+int(event.Len)]
+			offset += unix.SizeofInotifyEvent + int(event.Len)
+			dir, ok := dirs[int(event.Wd)]
+			if event.Mask&unix.IN_IGNORED != 0 {
+				delete(dirs, int(event.Wd))
+				continue
+			}
+			if !ok || ignoring {
+				continue
+			}
+			path := filepath.Join(dir, unix.ByteSliceToString(nameBytes))
+			isDir := event.Mask&unix.IN_ISDIR != 0
+			if isDir && event.Mask&(unix.IN_CREATE|unix.IN_MOVED_TO) != 0 {
+				watch(path)
+			}
+			w.record(path, inotifyOp(event.Mask), isDir)
+		}
+	}
+	return nil
+}
+
+// inotifyOp describes the change of an event
+func inotifyOp(mask uint32) string {
+	switch {
+	case mask&unix.IN_CREATE != 0, mask&unix.IN_MOVED_TO != 0:
+		return "created"
+	case mask&unix.IN_DELETE != 0, mask&unix.IN_MOVED_FROM != 0:
+		return "removed"
+	case mask&unix.IN_ATTRIB != 0:
+		return "changed the attributes of"
+	}
+	return "wrote"
+}
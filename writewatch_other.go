@@ -0,0 +1,15 @@
+//go:build !linux
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+const writeWatchSupported = false
+
+func (w *WriteWatcher) Watch(ctx context.Context) error {
+	return fmt.Errorf("--watch-writes is only supported on Linux, not %s", runtime.GOOS)
+}
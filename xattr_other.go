@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+)
+
+const xattrsSupported = false
+
+func readXattrs(path string) (map[string][]byte, error) {
+	return nil, fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}
+
+func writeXattrs(path string, attrs map[string][]byte) error {
+	return fmt.Errorf("extended attributes are not supported on %s", runtime.GOOS)
+}